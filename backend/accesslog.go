@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/handlers"
+)
+
+// accessLogHandler writes an access log line for each request, except those
+// whose path is in skip, such as probes and metrics scrapes. Skipped requests
+// go straight to h without passing through the logger at all.
+func accessLogHandler(out io.Writer, skip []string, h http.Handler) http.Handler {
+	logged := handlers.LoggingHandler(out, h)
+
+	skipped := make(map[string]bool, len(skip))
+	for _, p := range skip {
+		skipped[p] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skipped[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		logged.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogSkip(t *testing.T) {
+	var out bytes.Buffer
+	served := 0
+	h := accessLogHandler(&out, []string{"/healthz", "/metrics"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		target  string
+		wantLog bool
+	}{
+		{target: "/healthz"},
+		{target: "/metrics"},
+		{target: "/albums", wantLog: true},
+		// Only exact paths are skipped.
+		{target: "/healthz/extra", wantLog: true},
+		{target: "/healthz?verbose=1"},
+	}
+
+	for _, tt := range tests {
+		out.Reset()
+		served = 0
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+		if served != 1 {
+			t.Errorf("GET %s: handler ran %d times, want once", tt.target, served)
+		}
+		logged := strings.Contains(out.String(), "GET "+tt.target+" ")
+		if logged != tt.wantLog {
+			t.Errorf("GET %s: logged = %v, want %v: %q", tt.target, logged, tt.wantLog, out.String())
+		}
+		if !tt.wantLog && out.Len() != 0 {
+			t.Errorf("GET %s: wrote %q to the access log", tt.target, out.String())
+		}
+	}
+}
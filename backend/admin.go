@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"google.golang.org/api/iterator"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	sppb "google.golang.org/genproto/googleapis/spanner/v1"
+)
+
+// registerAdminRoutes adds the /admin endpoints to the router. These are only
+// registered when the admin flag is set. mysqlDB is nil unless the MySQL store
+// is configured.
+func registerAdminRoutes(r *mux.Router, cfg Config, client *spanner.Client, adminClient *database.DatabaseAdminClient, dbPath string, audit *auditLog, cache *responseCache, reads *coalescer, flags *featureFlags, maintenance *maintenanceMode, mysqlDB *sql.DB) {
+	// Flags are left unnamed so they can't switch themselves off.
+	r.HandleFunc("/admin/flags", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, flags.snapshot())
+	}).Methods(http.MethodGet)
+
+	// Unnamed like the flags, so a flag can't stop maintenance mode being
+	// switched off.
+	r.HandleFunc("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Maintenance{Enabled: maintenance.enabled()})
+	}).Methods(http.MethodGet)
+
+	r.HandleFunc("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var req Maintenance
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+			return
+		}
+
+		if err := maintenance.set(req.Enabled); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, Maintenance{Enabled: maintenance.enabled()})
+	}).Methods(http.MethodPut)
+
+	registerOperationsRoutes(r, cfg, adminOperations{adminClient})
+
+	r.HandleFunc("/admin/backups", func(w http.ResponseWriter, r *http.Request) {
+		backups, err := listBackups(r.Context(), adminClient, cfg.GCloudProject, cfg.SpannerInstanceID)
+		if errors.Is(err, ErrUnsupported) {
+			writeJSONError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeList(w, r, cfg.JSONEnvelope, backups, len(backups), 0, "")
+	}).Methods(http.MethodGet).Name("admin.backups")
+
+	r.HandleFunc("/admin/version-retention", func(w http.ResponseWriter, r *http.Request) {
+		var req VersionRetention
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+			return
+		}
+		if err := validateRetentionPeriod(req.Period); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		period, err := updateVersionRetention(r.Context(), adminClient, dbPath, req.Period)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, VersionRetention{Period: period})
+	}).Methods(http.MethodPut).Name("admin.version-retention")
+
+	r.HandleFunc("/admin/archive", func(w http.ResponseWriter, r *http.Request) {
+		// Built in full first so a failed read is still a clean 500.
+		var buf bytes.Buffer
+		if err := exportArchive(r.Context(), client, &buf); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="archive.json.gz"`)
+		w.Write(buf.Bytes())
+	}).Methods(http.MethodGet).Name("admin.archive.export")
+
+	r.HandleFunc("/admin/archive", func(w http.ResponseWriter, r *http.Request) {
+		mode, err := parseRestoreMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		a, err := readArchive(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := restoreArchive(r.Context(), client, audit, a, mode); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		cache.invalidate("/albums")
+		reads.forget("/albums")
+
+		log.Printf("Restored archive of %d singers exported at %s (%s)", len(a.Singers), a.ExportedAt.Format(time.RFC3339), mode)
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost).Name("admin.archive.restore")
+
+	r.HandleFunc("/admin/audit/albums", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("progress") == "true" {
+			streamAlbumCheck(w, r, client)
+			return
+		}
+
+		res, err := checkAlbums(r.Context(), client, nil)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}).Methods(http.MethodGet).Name("admin.audit.albums")
+
+	// Reconciliation needs both stores.
+	if mysqlDB != nil {
+		r.HandleFunc("/admin/reconcile", func(w http.ResponseWriter, r *http.Request) {
+			res, err := reconcileAlbums(r.Context(), client, mysqlDB)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res)
+		}).Methods(http.MethodGet).Name("admin.reconcile")
+	}
+
+	// The ad hoc query endpoint is for local development against the emulator
+	// only.
+	if usingEmulator() {
+		r.HandleFunc("/admin/query", func(w http.ResponseWriter, r *http.Request) {
+			sql := strings.TrimSpace(r.URL.Query().Get("sql"))
+			if !isSelect(sql) {
+				writeJSONError(w, http.StatusBadRequest, "only SELECT statements are allowed")
+				return
+			}
+
+			res, err := runQuery(r.Context(), client, sql)
+			if err != nil {
+				if spanner.ErrCode(err) == codes.InvalidArgument {
+					writeJSONError(w, http.StatusBadRequest, spanner.ErrDesc(err))
+					return
+				}
+				writeInternalError(w, err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res)
+		}).Methods(http.MethodGet).Name("admin.query")
+	}
+}
+
+// streamAlbumCheck runs checkAlbums, streaming a ConsistencyLine of NDJSON
+// after each partition and one with the report at the end. A scan that fails
+// before the first line is a plain error response; after that the status is
+// already out, so the failure is the last line instead. The route's timeout
+// buffers the whole response, so for the lines to arrive as they're written
+// set the admin.audit.albums timeout to zero.
+func streamAlbumCheck(w http.ResponseWriter, r *http.Request, client *spanner.Client) {
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	started := false
+
+	line := func(l ConsistencyLine) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		enc.Encode(l)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	res, err := checkAlbums(r.Context(), client, func(p ScanProgress) {
+		line(ConsistencyLine{Progress: &p})
+	})
+	if err != nil {
+		if !started {
+			writeInternalError(w, err)
+			return
+		}
+		log.Printf("Error: %s", err.Error())
+		line(ConsistencyLine{Error: &ErrorDetail{Code: http.StatusInternalServerError, Message: internalErrorMessage}})
+		return
+	}
+
+	line(ConsistencyLine{Report: res})
+}
+
+// registerOperationsRoutes adds the endpoints for listing and cancelling
+// long-running admin operations.
+func registerOperationsRoutes(r *mux.Router, cfg Config, client operationsClient) {
+	r.HandleFunc("/admin/operations", func(w http.ResponseWriter, r *http.Request) {
+		ops, err := listOperations(r.Context(), client, cfg.GCloudProject, cfg.SpannerInstanceID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeList(w, r, cfg.JSONEnvelope, ops, len(ops), 0, "")
+	}).Methods(http.MethodGet).Name("admin.operations")
+
+	r.HandleFunc("/admin/operations/{name:.+}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		if err := cancelOperation(r.Context(), client, name); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeJSONError(w, http.StatusNotFound, fmt.Sprintf("operation %s not found", name))
+				return
+			}
+			writeInternalError(w, err)
+			return
+		}
+
+		log.Printf("Cancelled operation [%s]", name)
+
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods(http.MethodPost).Name("admin.operations.cancel")
+}
+
+// operationsClient is the part of the admin API the operations endpoints use,
+// so they can be tested without Spanner. adminOperations is the real one.
+type operationsClient interface {
+	ListDatabaseOperations(ctx context.Context, req *adminpb.ListDatabaseOperationsRequest) operationIterator
+	ListBackupOperations(ctx context.Context, req *adminpb.ListBackupOperationsRequest) operationIterator
+	CancelOperation(ctx context.Context, req *longrunningpb.CancelOperationRequest) error
+}
+
+type operationIterator interface {
+	Next() (*longrunningpb.Operation, error)
+}
+
+type adminOperations struct {
+	client *database.DatabaseAdminClient
+}
+
+func (o adminOperations) ListDatabaseOperations(ctx context.Context, req *adminpb.ListDatabaseOperationsRequest) operationIterator {
+	return o.client.ListDatabaseOperations(ctx, req)
+}
+
+func (o adminOperations) ListBackupOperations(ctx context.Context, req *adminpb.ListBackupOperationsRequest) operationIterator {
+	return o.client.ListBackupOperations(ctx, req)
+}
+
+func (o adminOperations) CancelOperation(ctx context.Context, req *longrunningpb.CancelOperationRequest) error {
+	return o.client.LROClient.CancelOperation(ctx, req)
+}
+
+// Operation is an in-progress long-running admin operation (DDL, backup etc).
+type Operation struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Done bool   `json:"done"`
+}
+
+func listOperations(ctx context.Context, client operationsClient, projectID, instanceID string) (ops []*Operation, err error) {
+	parent := fmt.Sprintf("projects/%s/instances/%s", projectID, instanceID)
+
+	iters := []operationIterator{
+		client.ListDatabaseOperations(ctx, &adminpb.ListDatabaseOperationsRequest{
+			Parent: parent,
+			Filter: "done:false",
+		}),
+	}
+	if err := checkSupported(FeatureBackups); err != nil {
+		log.Printf("Skipping backup operations: %s", err.Error())
+	} else {
+		iters = append(iters, client.ListBackupOperations(ctx, &adminpb.ListBackupOperationsRequest{
+			Parent: parent,
+			Filter: "done:false",
+		}))
+	}
+
+	ops = []*Operation{}
+
+	for _, iter := range iters {
+		for {
+			var op *longrunningpb.Operation
+			op, err = iter.Next()
+			if err == iterator.Done {
+				err = nil
+				break
+			}
+			if err != nil {
+				return
+			}
+
+			ops = append(ops, &Operation{
+				Name: op.GetName(),
+				Type: strings.TrimPrefix(op.GetMetadata().GetTypeUrl(), "type.googleapis.com/"),
+				Done: op.GetDone(),
+			})
+		}
+	}
+
+	return
+}
+
+type Backup struct {
+	Name       string    `json:"name"`
+	Database   string    `json:"database"`
+	State      string    `json:"state"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+func listBackups(ctx context.Context, adminClient *database.DatabaseAdminClient, projectID, instanceID string) (backups []*Backup, err error) {
+	if err = checkSupported(FeatureBackups); err != nil {
+		return
+	}
+
+	iter := adminClient.ListBackups(ctx, &adminpb.ListBackupsRequest{
+		Parent: fmt.Sprintf("projects/%s/instances/%s", projectID, instanceID),
+	})
+
+	backups = []*Backup{}
+
+	for {
+		var b *adminpb.Backup
+		b, err = iter.Next()
+		if err == iterator.Done {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		backups = append(backups, &Backup{
+			Name:       b.GetName(),
+			Database:   b.GetDatabase(),
+			State:      b.GetState().String(),
+			ExpireTime: b.GetExpireTime().AsTime(),
+		})
+	}
+}
+
+// cancelOperation asks Spanner to cancel a long-running operation. Cancellation
+// is best effort; the operation may still complete.
+func cancelOperation(ctx context.Context, client operationsClient, name string) error {
+	err := client.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{
+		Name: name,
+	})
+	return spannerError(err)
+}
+
+type VersionRetention struct {
+	Period string `json:"version_retention_period"`
+}
+
+// validateRetentionPeriod checks a version_retention_period value is in the
+// format Spanner expects (e.g. 90m, 12h, 7d) and within its 1h to 7d range.
+func validateRetentionPeriod(period string) error {
+	if len(period) < 2 {
+		return fmt.Errorf("invalid version retention period %q", period)
+	}
+
+	// Atoi takes a sign, which Spanner doesn't, so check for digits first.
+	digits := period[:len(period)-1]
+	if strings.TrimLeft(digits, "0123456789") != "" {
+		return fmt.Errorf("invalid version retention period %q", period)
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid version retention period %q", period)
+	}
+
+	var unit time.Duration
+	switch period[len(period)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	default:
+		return fmt.Errorf("invalid version retention period %q, expected a unit of s, m, h or d", period)
+	}
+
+	if d := time.Duration(n) * unit; d < time.Hour || d > 7*24*time.Hour {
+		return fmt.Errorf("version retention period %q must be between 1h and 7d", period)
+	}
+
+	return nil
+}
+
+// updateVersionRetention sets the database's version retention period and
+// returns the value Spanner reports back once the DDL has been applied.
+func updateVersionRetention(ctx context.Context, adminClient *database.DatabaseAdminClient, dbPath, period string) (string, error) {
+	databaseID := dbPath[strings.LastIndex(dbPath, "/")+1:]
+
+	op, err := adminClient.UpdateDatabaseDdl(ctx, &adminpb.UpdateDatabaseDdlRequest{
+		Database: dbPath,
+		Statements: []string{
+			fmt.Sprintf("ALTER DATABASE `%s` SET OPTIONS (version_retention_period = '%s')", databaseID, period),
+		},
+	})
+	if err != nil {
+		return "", spannerError(err)
+	}
+	if err := op.Wait(ctx); err != nil {
+		return "", spannerError(err)
+	}
+
+	db, err := adminClient.GetDatabase(ctx, &adminpb.GetDatabaseRequest{Name: dbPath})
+	if err != nil {
+		return "", spannerError(err)
+	}
+
+	log.Printf("Set version retention period of [%s] to %s", databaseID, db.VersionRetentionPeriod)
+
+	return db.VersionRetentionPeriod, nil
+}
+
+type QueryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type QueryResult struct {
+	Columns []QueryColumn   `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+func isSelect(sql string) bool {
+	fields := strings.Fields(sql)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "SELECT")
+}
+
+// runQuery runs a statement in a single-use read-only transaction, so even a
+// statement that slips past isSelect can't write anything, and returns the
+// rows along with the name and Spanner type of each column.
+func runQuery(ctx context.Context, client *spanner.Client, sql string) (res *QueryResult, err error) {
+	iter := client.Single().Query(ctx, spanner.Statement{SQL: sql})
+	defer iter.Stop()
+
+	res = &QueryResult{Columns: []QueryColumn{}, Rows: [][]interface{}{}}
+
+	for {
+		var row *spanner.Row
+		row, err = iter.Next()
+		if len(res.Columns) == 0 && iter.Metadata != nil {
+			for _, f := range iter.Metadata.GetRowType().GetFields() {
+				res.Columns = append(res.Columns, QueryColumn{Name: f.GetName(), Type: typeName(f.GetType())})
+			}
+		}
+		if err == iterator.Done {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		vals := make([]interface{}, row.Size())
+		for i := range vals {
+			var v spanner.GenericColumnValue
+			if err = row.Column(i, &v); err != nil {
+				return
+			}
+			vals[i] = v.Value.AsInterface()
+		}
+
+		res.Rows = append(res.Rows, vals)
+	}
+}
+
+// typeName renders a Spanner type the way it's written in DDL, e.g. INT64 or
+// ARRAY<STRING>.
+func typeName(t *sppb.Type) string {
+	switch t.GetCode() {
+	case sppb.TypeCode_ARRAY:
+		return "ARRAY<" + typeName(t.GetArrayElementType()) + ">"
+	case sppb.TypeCode_STRUCT:
+		var fields []string
+		for _, f := range t.GetStructType().GetFields() {
+			fields = append(fields, strings.TrimSpace(f.GetName()+" "+typeName(f.GetType())))
+		}
+		return "STRUCT<" + strings.Join(fields, ", ") + ">"
+	default:
+		return t.GetCode().String()
+	}
+}
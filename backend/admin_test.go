@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"github.com/gorilla/mux"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	sppb "google.golang.org/genproto/googleapis/spanner/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeOperations is an operationsClient with a fixed set of operations.
+type fakeOperations struct {
+	database, backup []*longrunningpb.Operation
+	listErr          error
+
+	// cancelled holds the names passed to CancelOperation; names in missing
+	// fail with NotFound.
+	cancelled []string
+	missing   map[string]bool
+}
+
+type fakeOperationIterator struct {
+	ops []*longrunningpb.Operation
+	err error
+}
+
+func (it *fakeOperationIterator) Next() (*longrunningpb.Operation, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.ops) == 0 {
+		return nil, iterator.Done
+	}
+	op := it.ops[0]
+	it.ops = it.ops[1:]
+	return op, nil
+}
+
+func (f *fakeOperations) ListDatabaseOperations(ctx context.Context, req *adminpb.ListDatabaseOperationsRequest) operationIterator {
+	return &fakeOperationIterator{ops: f.database, err: f.listErr}
+}
+
+func (f *fakeOperations) ListBackupOperations(ctx context.Context, req *adminpb.ListBackupOperationsRequest) operationIterator {
+	return &fakeOperationIterator{ops: f.backup, err: f.listErr}
+}
+
+func (f *fakeOperations) CancelOperation(ctx context.Context, req *longrunningpb.CancelOperationRequest) error {
+	if f.missing[req.Name] {
+		return status.Errorf(codes.NotFound, "Operation not found: %s", req.Name)
+	}
+	f.cancelled = append(f.cancelled, req.Name)
+	return nil
+}
+
+func serveOperations(ops operationsClient, method, target string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	registerOperationsRoutes(router, Config{GCloudProject: "p", SpannerInstanceID: "i"}, ops)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// fakeDatabaseAdmin is a database admin server that records the DDL it's sent
+// and finishes every operation straight away.
+type fakeDatabaseAdmin struct {
+	adminpb.UnimplementedDatabaseAdminServer
+
+	mu sync.Mutex
+	// requests holds the statements of each UpdateDatabaseDdl call.
+	requests [][]string
+	// failAt, if set, fails each UpdateDatabaseDdl at that statement,
+	// numbered from 1, after applying the ones before it.
+	failAt int
+	// getErr fails GetDatabase.
+	getErr    error
+	retention string
+}
+
+var retentionOption = regexp.MustCompile(`version_retention_period = '([^']*)'`)
+
+func (f *fakeDatabaseAdmin) UpdateDatabaseDdl(ctx context.Context, req *adminpb.UpdateDatabaseDdlRequest) (*longrunningpb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req.Statements)
+
+	applied := len(req.Statements)
+	if f.failAt > 0 && f.failAt <= applied {
+		applied = f.failAt - 1
+	}
+
+	md := &adminpb.UpdateDatabaseDdlMetadata{Database: req.Database, Statements: req.Statements}
+	for _, stmt := range req.Statements[:applied] {
+		if m := retentionOption.FindStringSubmatch(stmt); m != nil {
+			f.retention = m[1]
+		}
+		md.CommitTimestamps = append(md.CommitTimestamps, timestamppb.Now())
+	}
+	mdAny, err := anypb.New(md)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &longrunningpb.Operation{Name: req.Database + "/operations/ddl", Metadata: mdAny, Done: true}
+	if applied < len(req.Statements) {
+		op.Result = &longrunningpb.Operation_Error{Error: &rpcstatus.Status{
+			Code:    int32(codes.FailedPrecondition),
+			Message: "Duplicate name in schema",
+		}}
+		return op, nil
+	}
+
+	res, err := anypb.New(&emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	op.Result = &longrunningpb.Operation_Response{Response: res}
+	return op, nil
+}
+
+func (f *fakeDatabaseAdmin) GetDatabase(ctx context.Context, req *adminpb.GetDatabaseRequest) (*adminpb.Database, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	return &adminpb.Database{Name: req.Name, VersionRetentionPeriod: f.retention}, nil
+}
+
+// newFakeAdminClient returns an admin client talking to f over a local
+// connection, closed when the test ends.
+func newFakeAdminClient(t *testing.T, f *fakeDatabaseAdmin) *database.DatabaseAdminClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	adminpb.RegisterDatabaseAdminServer(s, f)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminClient, err := database.NewDatabaseAdminClient(context.Background(), option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { adminClient.Close() })
+
+	return adminClient
+}
+
+func TestListOperations(t *testing.T) {
+	ddl := &longrunningpb.Operation{
+		Name:     "projects/p/instances/i/databases/d/operations/ddl1",
+		Metadata: &anypb.Any{TypeUrl: "type.googleapis.com/google.spanner.admin.database.v1.UpdateDatabaseDdlMetadata"},
+	}
+	backup := &longrunningpb.Operation{
+		Name:     "projects/p/instances/i/backups/b/operations/bk1",
+		Metadata: &anypb.Any{TypeUrl: "type.googleapis.com/google.spanner.admin.database.v1.CreateBackupMetadata"},
+	}
+
+	w := serveOperations(&fakeOperations{database: []*longrunningpb.Operation{ddl}, backup: []*longrunningpb.Operation{backup}}, http.MethodGet, "/admin/operations")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var got []Operation
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Operation{{Name: ddl.Name, Type: "google.spanner.admin.database.v1.UpdateDatabaseDdlMetadata"}}
+	// Backup operations are left out where backups aren't supported.
+	if checkSupported(FeatureBackups) == nil {
+		want = append(want, Operation{Name: backup.Name, Type: "google.spanner.admin.database.v1.CreateBackupMetadata"})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("operation %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestListOperationsEmpty(t *testing.T) {
+	w := serveOperations(&fakeOperations{}, http.MethodGet, "/admin/operations")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var got []Operation
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("body = %s, want an empty array", w.Body)
+	}
+}
+
+func TestListOperationsError(t *testing.T) {
+	w := serveOperations(&fakeOperations{listErr: status.Error(codes.PermissionDenied, "projects/p: denied")}, http.MethodGet, "/admin/operations")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	const name = "projects/p/instances/i/databases/d/operations/ddl1"
+	const missing = "projects/p/instances/i/databases/d/operations/gone"
+
+	tests := []struct {
+		name     string
+		op       string
+		wantCode int
+	}{
+		{name: "cancelled", op: name, wantCode: http.StatusAccepted},
+		{name: "not found", op: missing, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := &fakeOperations{missing: map[string]bool{missing: true}}
+
+			w := serveOperations(ops, http.MethodPost, "/admin/operations/"+tt.op+"/cancel")
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode == http.StatusAccepted && (len(ops.cancelled) != 1 || ops.cancelled[0] != tt.op) {
+				t.Errorf("cancelled %v, want [%s]", ops.cancelled, tt.op)
+			}
+		})
+	}
+}
+
+// TestBackupsUnsupportedOnEmulator checks /admin/backups answers 501 with a
+// JSON error under the emulator, rather than failing however the emulator
+// happens to fail.
+func TestBackupsUnsupportedOnEmulator(t *testing.T) {
+	t.Setenv("SPANNER_EMULATOR_HOST", "localhost:9010")
+
+	router := mux.NewRouter()
+	registerAdminRoutes(router, Config{GCloudProject: "p", SpannerInstanceID: "i"}, nil, nil, "", nil, nil, nil, nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/backups", nil))
+
+	if w.Code != http.StatusNotImplemented {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusNotImplemented, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+
+	var got ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %s: %v", w.Body, err)
+	}
+	if got.Error.Code != http.StatusNotImplemented || !strings.Contains(got.Error.Message, "not supported by the Spanner emulator") {
+		t.Errorf("error = %+v", got.Error)
+	}
+}
+
+func TestValidateRetentionPeriod(t *testing.T) {
+	tests := []struct {
+		period  string
+		wantErr bool
+	}{
+		{period: "1h"},
+		{period: "90m"},
+		{period: "3600s"},
+		{period: "7d"},
+		{period: "59m", wantErr: true},
+		{period: "8d", wantErr: true},
+		{period: "0h", wantErr: true},
+		{period: "-1d", wantErr: true},
+		{period: "+1d", wantErr: true},
+		{period: "+90m", wantErr: true},
+		{period: " 2h", wantErr: true},
+		{period: "1w", wantErr: true},
+		{period: "1.5h", wantErr: true},
+		{period: "h", wantErr: true},
+		{period: "", wantErr: true},
+		// Quotes would end the option's string in the DDL.
+		{period: "1d') --", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateRetentionPeriod(tt.period); (err != nil) != tt.wantErr {
+			t.Errorf("validateRetentionPeriod(%q) = %v, want error %v", tt.period, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUpdateVersionRetention(t *testing.T) {
+	const dbPath = "projects/p/instances/i/databases/d"
+
+	tests := []struct {
+		name       string
+		body       string
+		wantCode   int
+		wantDDL    []string
+		wantPeriod string
+	}{
+		{
+			name:       "valid",
+			body:       `{"version_retention_period": "3d"}`,
+			wantCode:   http.StatusOK,
+			wantDDL:    []string{"ALTER DATABASE `d` SET OPTIONS (version_retention_period = '3d')"},
+			wantPeriod: "3d",
+		},
+		{name: "out of range", body: `{"version_retention_period": "30m"}`, wantCode: http.StatusBadRequest},
+		{name: "bad body", body: `3d`, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeDatabaseAdmin{retention: "1h"}
+			router := mux.NewRouter()
+			registerAdminRoutes(router, Config{}, nil, newFakeAdminClient(t, f), dbPath, nil, nil, nil, nil, nil, nil)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/version-retention", strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if len(tt.wantDDL) == 0 {
+				if len(f.requests) != 0 {
+					t.Errorf("DDL issued for a rejected request: %q", f.requests)
+				}
+				return
+			}
+
+			if len(f.requests) != 1 || strings.Join(f.requests[0], "\n") != strings.Join(tt.wantDDL, "\n") {
+				t.Errorf("DDL = %q, want %q", f.requests, tt.wantDDL)
+			}
+			var got VersionRetention
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Period != tt.wantPeriod {
+				t.Errorf("version_retention_period = %q, want %q", got.Period, tt.wantPeriod)
+			}
+		})
+	}
+}
+
+func TestIsSelect(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{sql: "SELECT 1", want: true},
+		{sql: "select * from Albums", want: true},
+		{sql: "SELECT\n  SingerId\nFROM Singers", want: true},
+		{sql: "", want: false},
+		{sql: "SELECTION", want: false},
+		{sql: "DELETE FROM Albums WHERE true", want: false},
+		{sql: "UPDATE Albums SET AlbumTitle = '' WHERE true", want: false},
+		{sql: "INSERT INTO Singers (SingerId) VALUES (1)", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isSelect(tt.sql); got != tt.want {
+			t.Errorf("isSelect(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	tests := []struct {
+		typ  *sppb.Type
+		want string
+	}{
+		{typ: &sppb.Type{Code: sppb.TypeCode_INT64}, want: "INT64"},
+		{typ: &sppb.Type{Code: sppb.TypeCode_ARRAY, ArrayElementType: &sppb.Type{Code: sppb.TypeCode_STRING}}, want: "ARRAY<STRING>"},
+		{
+			typ: &sppb.Type{Code: sppb.TypeCode_STRUCT, StructType: &sppb.StructType{Fields: []*sppb.StructType_Field{
+				{Name: "id", Type: &sppb.Type{Code: sppb.TypeCode_INT64}},
+				{Type: &sppb.Type{Code: sppb.TypeCode_TIMESTAMP}},
+			}}},
+			want: "STRUCT<id INT64, TIMESTAMP>",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := typeName(tt.typ); got != tt.want {
+			t.Errorf("typeName(%v) = %q, want %q", tt.typ, got, tt.want)
+		}
+	}
+}
+
+// TestAdminQuery runs the albums query through /admin/query and checks the
+// column types it reports.
+func TestAdminQuery(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 1, AlbumID: 2})
+
+	router := mux.NewRouter()
+	registerAdminRoutes(router, Config{}, client, nil, "", nil, nil, nil, nil, nil, nil)
+
+	query := func(sql string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/query?sql="+url.QueryEscape(sql), nil))
+		return w
+	}
+
+	w := query(sqlSelectAlbums)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var res QueryResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want := []QueryColumn{
+		{Name: "SingerId", Type: "INT64"},
+		{Name: "AlbumId", Type: "INT64"},
+		{Name: "AlbumTitle", Type: "STRING"},
+		{Name: "MarketingBudget", Type: "INT64"},
+		{Name: "LastUpdateTime", Type: "TIMESTAMP"},
+	}
+	if mustMarshal(t, res.Columns) != mustMarshal(t, want) {
+		t.Errorf("columns = %s, want %s", mustMarshal(t, res.Columns), mustMarshal(t, want))
+	}
+	if len(res.Rows) != 2 {
+		t.Errorf("%d rows, want 2", len(res.Rows))
+	}
+
+	for _, sql := range []string{"DELETE FROM Albums WHERE true", "SELECT * FROM NoSuchTable"} {
+		if w := query(sql); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d: %s", sql, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
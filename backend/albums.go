@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// ListOptions selects which albums to list. Handlers build these from query
+// parameters with parseListOptions.
+type ListOptions struct {
+	Limit     int
+	SingerIDs []int64
+	// UpdatedAfter and UpdatedBefore bound LastUpdateTime to the half-open
+	// window [UpdatedAfter, UpdatedBefore). Either can be left zero.
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	AsOf          time.Time
+	// MinReadTimestamp allows a read that may be stale, but not older than
+	// this; see parseListOptions.
+	MinReadTimestamp time.Time
+	Order            []orderKey
+	// After is where the previous page ended, from ?page_token.
+	After *albumCursor
+}
+
+const (
+	defaultAlbumLimit = 10
+	maxAlbumLimit     = 1000
+)
+
+// AlbumPage is a page of albums. Items holds either []*Album, or the raw JSON
+// rows from getAlbumsJSON when using the JSON projection.
+type AlbumPage struct {
+	Items interface{}
+	Count int
+	// LastModified is the newest LastUpdateTime in Items.
+	LastModified time.Time
+	// NextPageToken fetches the page after this one. It's empty on the last
+	// page.
+	NextPageToken string
+}
+
+// listAlbums returns the albums matching opts, serialized by Spanner itself
+// when projection is set.
+func listAlbums(ctx context.Context, client *spanner.Client, opts ListOptions, projection bool) (AlbumPage, error) {
+	if projection {
+		albums, lastModified, next, err := getAlbumsJSON(ctx, client, opts)
+		return AlbumPage{Items: albums, Count: len(albums), LastModified: lastModified, NextPageToken: pageToken(next)}, err
+	}
+
+	albums, next, err := getAlbums(ctx, client, opts)
+
+	var lastModified time.Time
+	for _, a := range albums {
+		if a.LastUpdateTime.Time.After(lastModified) {
+			lastModified = a.LastUpdateTime.Time
+		}
+	}
+
+	return AlbumPage{Items: albums, Count: len(albums), LastModified: lastModified, NextPageToken: pageToken(next)}, err
+}
+
+func pageToken(c *albumCursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.encode()
+}
+
+// parseListOptions translates the /albums query parameters into ListOptions.
+func parseListOptions(q url.Values, cfg Config) (opts ListOptions, err error) {
+	if opts.Limit, err = parseLimit(q.Get("limit")); err != nil {
+		return
+	}
+	if opts.AsOf, err = parseAsOf(q.Get("asOf"), cfg.VersionRetentionPeriod); err != nil {
+		return
+	}
+	if opts.SingerIDs, err = parseSingerIDs(q["singer_id"]); err != nil {
+		return
+	}
+	if opts.Order, err = parseOrder(q.Get("order")); err != nil {
+		return
+	}
+	if opts.UpdatedAfter, opts.UpdatedBefore, err = parseUpdatedWindow(q.Get("updatedAfter"), q.Get("updatedBefore")); err != nil {
+		return
+	}
+
+	// A client that has just written passes back the commit timestamp from
+	// the write's response here, to be sure of reading its own write without
+	// paying for a strong read.
+	if v := q.Get("min_read_timestamp"); v != "" {
+		if !opts.AsOf.IsZero() {
+			err = errors.New("asOf and min_read_timestamp can't be used together")
+			return
+		}
+		if opts.MinReadTimestamp, err = parseTimestampRoundUp(v); err != nil {
+			err = fmt.Errorf("min_read_timestamp: %w", err)
+			return
+		}
+	}
+
+	// Pages follow the default order, so a token can't be combined with
+	// another one.
+	if v := q.Get("page_token"); v != "" {
+		if len(opts.Order) > 0 {
+			err = errors.New("page_token can't be used with order")
+			return
+		}
+		if opts.After, err = decodeAlbumCursor(v); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// parseLimit parses ?limit for GET /albums. Unlike ?n on /albums/top, a limit
+// over maxAlbumLimit is rejected rather than clamped, so a client never gets
+// fewer albums than it asked for without being told.
+func parseLimit(v string) (int, error) {
+	if v == "" {
+		return defaultAlbumLimit, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxAlbumLimit {
+		return 0, fmt.Errorf("invalid limit %q, expected a number from 1 to %d", v, maxAlbumLimit)
+	}
+	return n, nil
+}
+
+// parseAsOf parses an RFC3339 ?asOf timestamp for a time-travel read. Spanner
+// can only read versions within the database's retention period, so anything
+// older than that (or in the future) is rejected up front.
+func parseAsOf(v string, retention time.Duration) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid asOf timestamp %q, expected RFC3339", v)
+	}
+
+	now := time.Now()
+	if t.After(now) {
+		return time.Time{}, fmt.Errorf("asOf timestamp %s is in the future", v)
+	}
+	if t.Before(now.Add(-retention)) {
+		return time.Time{}, fmt.Errorf("asOf timestamp %s is older than the version retention period (%s)", v, retention)
+	}
+
+	return t, nil
+}
+
+// parseUpdatedWindow parses ?updatedAfter and ?updatedBefore, in the
+// configured time format. The window includes updatedAfter and excludes
+// updatedBefore, so consecutive windows don't overlap.
+func parseUpdatedWindow(afterParam, beforeParam string) (after, before time.Time, err error) {
+	if afterParam != "" {
+		if after, err = parseTimestamp(afterParam); err != nil {
+			err = fmt.Errorf("updatedAfter: %w", err)
+			return
+		}
+	}
+	if beforeParam != "" {
+		if before, err = parseTimestamp(beforeParam); err != nil {
+			err = fmt.Errorf("updatedBefore: %w", err)
+			return
+		}
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		err = errors.New("updatedAfter must be before updatedBefore")
+	}
+	return
+}
+
+// maxSingerIDFilters caps how many ?singer_id values one request can filter on.
+const maxSingerIDFilters = 100
+
+// parseSingerIDs parses repeated ?singer_id parameters, dropping duplicates.
+func parseSingerIDs(vals []string) ([]int64, error) {
+	var ids []int64
+	seen := make(map[int64]bool)
+
+	for _, v := range vals {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid singer_id %q", v)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	if len(ids) > maxSingerIDFilters {
+		return nil, fmt.Errorf("too many singer_id values, at most %d are allowed", maxSingerIDFilters)
+	}
+
+	return ids, nil
+}
+
+// albumOrderColumns maps the keys ?order accepts to the columns they sort by.
+// Only these ever make it into the SQL.
+var albumOrderColumns = map[string]string{
+	"singer":  "SingerId",
+	"album":   "AlbumId",
+	"title":   "AlbumTitle",
+	"budget":  "MarketingBudget",
+	"updated": "LastUpdateTime",
+}
+
+// maxOrderKeys caps how many keys one ?order can list.
+const maxOrderKeys = 3
+
+type orderKey struct {
+	column string
+	desc   bool
+}
+
+// parseOrder parses ?order, a comma-separated list of keys from
+// albumOrderColumns, each sorting ascending or, prefixed with "-", descending,
+// e.g. "singer,-budget".
+func parseOrder(v string) ([]orderKey, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(v, ",")
+	if len(parts) > maxOrderKeys {
+		return nil, fmt.Errorf("too many order keys, at most %d are allowed", maxOrderKeys)
+	}
+
+	var keys []orderKey
+	seen := make(map[string]bool)
+
+	for _, p := range parts {
+		name := strings.TrimSpace(p)
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+
+		col, ok := albumOrderColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid order key %q, expected one of %s", p, orderKeyNames())
+		}
+		if seen[col] {
+			return nil, fmt.Errorf("order key %q given more than once", name)
+		}
+		seen[col] = true
+
+		keys = append(keys, orderKey{column: col, desc: desc})
+	}
+
+	return keys, nil
+}
+
+func orderKeyNames() string {
+	names := make([]string, 0, len(albumOrderColumns))
+	for name := range albumOrderColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// albumsOrderBy returns the ORDER BY clause for keys, or the default order if
+// there are none.
+func albumsOrderBy(keys []orderKey) string {
+	if len(keys) == 0 {
+		return sqlListAlbumsOrder
+	}
+
+	terms := make([]string, 0, len(keys)+2)
+	for _, k := range albumOrderTerms(keys) {
+		term := k.column
+		if k.desc {
+			term += " DESC"
+		}
+		terms = append(terms, term)
+	}
+
+	return "ORDER BY " + strings.Join(terms, ", ")
+}
+
+// albumOrderTerms is keys with the album's key added last to break ties, so
+// the order is stable.
+func albumOrderTerms(keys []orderKey) []orderKey {
+	terms := append([]orderKey(nil), keys...)
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		seen[k.column] = true
+	}
+	for _, col := range []string{"SingerId", "AlbumId"} {
+		if !seen[col] {
+			terms = append(terms, orderKey{column: col})
+		}
+	}
+	return terms
+}
+
+// readBound returns a strong read, a read at exactly opts.AsOf, or a read at
+// opts.MinReadTimestamp or later, depending on which is set. The last is only
+// valid in single-use transactions.
+func readBound(opts ListOptions) spanner.TimestampBound {
+	switch {
+	case !opts.AsOf.IsZero():
+		return spanner.ReadTimestamp(opts.AsOf)
+	case !opts.MinReadTimestamp.IsZero():
+		return spanner.MinReadTimestamp(opts.MinReadTimestamp)
+	}
+	return spanner.StrongRead()
+}
+
+type Album struct {
+	SingerID        int64              `json:"singer_id"`
+	AlbumID         int64              `json:"album_id"`
+	AlbumTitle      spanner.NullString `json:"album_title"`
+	MarketingBudget spanner.NullInt64  `json:"marketing_budget"`
+	LastUpdateTime  Timestamp          `json:"last_update_time"`
+}
+
+// getAlbums returns up to opts.Limit albums. If there are more, next is where
+// the next page starts; one row more than the limit is read to find out, so
+// a last page that happens to be full doesn't hand out a token for an empty
+// one. Cursors only follow the default order, so with opts.Order set there's
+// never a next page.
+func getAlbums(ctx context.Context, client *spanner.Client, opts ListOptions) (albums []*Album, next *albumCursor, err error) {
+	defer func() { err = spannerError(err) }()
+
+	stmt := listAlbumsStatement(opts)
+
+	err = retrySessionNotFound("albums", func() (err error) {
+		albums, err = queryAlbums(ctx, client, stmt, readBound(opts))
+		return
+	})
+
+	if len(albums) > opts.Limit {
+		albums = albums[:opts.Limit]
+		if len(opts.Order) == 0 {
+			next = newAlbumCursor(albums[len(albums)-1])
+		}
+	}
+	return
+}
+
+// listAlbumsStatement builds getAlbums' query from the shared statement text.
+// It reads one row more than opts.Limit.
+func listAlbumsStatement(opts ListOptions) spanner.Statement {
+	params := map[string]interface{}{
+		"max": opts.Limit + 1,
+	}
+	return spanner.Statement{
+		SQL:    sqlSelectAlbums + "\n" + albumsWhere(opts, params) + "\n" + albumsOrderBy(opts.Order) + "\n" + sqlListAlbumsLimit,
+		Params: params,
+	}
+}
+
+// retrySessionNotFound runs read, and runs it once more if it fails with
+// "Session not found". The client normally recovers from this itself, but it
+// can still surface from a read loop like ours, and a fresh iterator gets a
+// fresh session. what names what's being read, for the log.
+func retrySessionNotFound(what string, read func() error) error {
+	err := read()
+	if isSessionNotFound(err) {
+		log.Printf("Session not found reading %s, retrying: %s", what, err.Error())
+		err = read()
+	}
+	return err
+}
+
+func queryAlbums(ctx context.Context, client *spanner.Client, stmt spanner.Statement, bound spanner.TimestampBound) (albums []*Album, err error) {
+	err = queryRows(ctx, client.Single().WithTimestampBound(bound), "getAlbums", stmt, func(row *spanner.Row) error {
+		a, err := albumFromRow(row)
+		if err != nil {
+			return err
+		}
+		albums = append(albums, a)
+		return nil
+	})
+	if err != nil {
+		albums = nil
+	}
+	return
+}
+
+// albumsWhere returns the WHERE clause for the album list filters, adding any
+// parameters it refers to.
+func albumsWhere(opts ListOptions, params map[string]interface{}) string {
+	var conds []string
+
+	if len(opts.SingerIDs) > 0 {
+		params["singerIds"] = opts.SingerIDs
+		conds = append(conds, "SingerId IN UNNEST(@singerIds)")
+	}
+	if !opts.UpdatedAfter.IsZero() {
+		params["updatedAfter"] = opts.UpdatedAfter
+		conds = append(conds, "LastUpdateTime >= @updatedAfter")
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		params["updatedBefore"] = opts.UpdatedBefore
+		conds = append(conds, "LastUpdateTime < @updatedBefore")
+	}
+	if opts.After != nil {
+		conds = append(conds, albumsAfterCursor(opts.After, params))
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+func albumFromRow(row *spanner.Row) (*Album, error) {
+	a := new(Album)
+
+	if err := row.ColumnByName("SingerId", &a.SingerID); err != nil {
+		return nil, err
+	}
+	if err := row.ColumnByName("AlbumId", &a.AlbumID); err != nil {
+		return nil, err
+	}
+	if err := row.ColumnByName("AlbumTitle", &a.AlbumTitle); err != nil {
+		return nil, err
+	}
+	if err := row.ColumnByName("MarketingBudget", &a.MarketingBudget); err != nil {
+		return nil, err
+	}
+	if err := row.ColumnByName("LastUpdateTime", &a.LastUpdateTime.NullTime); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+type AlbumSync struct {
+	Albums    []*Album  `json:"albums"`
+	NextSince Timestamp `json:"next_since"`
+	// NextPageToken is where the next pull picks up, at full precision
+	// whatever the time format. It's left out until there's been an album to
+	// sync.
+	NextPageToken string `json:"next_page_token,omitempty"`
+	// HasMore is set when the pull stopped at the limit rather than running
+	// out of albums, so the next one can follow straight away.
+	HasMore bool `json:"has_more"`
+}
+
+// syncAlbums returns up to limit albums after from in the sync order, oldest
+// first, and the position to pull from next. Rows that share a commit
+// timestamp are ordered by key, so a pull can stop part way through a commit
+// and the next one carries on after the last album it returned.
+func syncAlbums(ctx context.Context, client *spanner.Client, from *albumCursor, limit int) (res *AlbumSync, err error) {
+	defer func() { err = spannerError(err) }()
+
+	params := map[string]interface{}{"max": limit + 1}
+	stmt := spanner.Statement{
+		SQL:    fmt.Sprintf(sqlSyncAlbums, albumsSinceCursor(from, params)),
+		Params: params,
+	}
+	res = &AlbumSync{Albums: []*Album{}, NextSince: newTimestamp(from.LastUpdateTime)}
+
+	err = queryRows(ctx, client.Single(), "syncAlbums", stmt, func(row *spanner.Row) error {
+		a, err := albumFromRow(row)
+		if err != nil {
+			return err
+		}
+		res.Albums = append(res.Albums, a)
+		return nil
+	})
+	if err != nil {
+		res = nil
+		return
+	}
+
+	if len(res.Albums) > limit {
+		res.Albums, res.HasMore = res.Albums[:limit], true
+	}
+	next := from
+	if n := len(res.Albums); n > 0 {
+		next = newAlbumCursor(res.Albums[n-1])
+		res.NextSince = res.Albums[n-1].LastUpdateTime
+	}
+	if !next.LastUpdateTime.IsZero() {
+		res.NextPageToken = next.encode()
+	}
+	return
+}
+
+// sinceCursor is the sync position for ?since: after every album updated at
+// or before since, whatever its key.
+func sinceCursor(since time.Time) *albumCursor {
+	return &albumCursor{LastUpdateTime: since, SingerID: math.MaxInt64, AlbumID: math.MaxInt64}
+}
+
+const (
+	defaultTopAlbums = 10
+	maxTopAlbums     = 100
+)
+
+// TopAlbum is an album in the marketing budget leaderboard, with its singer's
+// name.
+type TopAlbum struct {
+	SingerID        int64              `json:"singer_id"`
+	AlbumID         int64              `json:"album_id"`
+	AlbumTitle      spanner.NullString `json:"album_title"`
+	MarketingBudget int64              `json:"marketing_budget"`
+	FirstName       spanner.NullString `json:"first_name"`
+	LastName        spanner.NullString `json:"last_name"`
+}
+
+// parseTopN parses ?n for GET /albums/top, clamping it to maxTopAlbums.
+func parseTopN(v string) (int, error) {
+	if v == "" {
+		return defaultTopAlbums, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid n %q, expected a positive number", v)
+	}
+	if n > maxTopAlbums {
+		n = maxTopAlbums
+	}
+	return n, nil
+}
+
+// getTopAlbums returns the n albums with the largest marketing budgets,
+// largest first. Albums without a budget are left out rather than counted as
+// 0.
+func getTopAlbums(ctx context.Context, client *spanner.Client, n int) (albums []*TopAlbum, err error) {
+	defer func() { err = spannerError(err) }()
+
+	stmt := spanner.Statement{
+		SQL:    sqlTopAlbumsByBudget,
+		Params: map[string]interface{}{"n": n},
+	}
+
+	albums = []*TopAlbum{}
+
+	err = queryRows(ctx, client.Single(), "getTopAlbums", stmt, func(row *spanner.Row) error {
+		a := &TopAlbum{}
+		if err := row.Columns(&a.SingerID, &a.AlbumID, &a.AlbumTitle, &a.MarketingBudget, &a.FirstName, &a.LastName); err != nil {
+			return err
+		}
+		albums = append(albums, a)
+		return nil
+	})
+	if err != nil {
+		albums = nil
+	}
+	return
+}
+
+// getAlbum reads a single album, failing with ErrNotFound if it doesn't
+// exist.
+func getAlbum(ctx context.Context, client *spanner.Client, singerID, albumID int64) (a *Album, err error) {
+	defer func() { err = spannerError(err) }()
+
+	row, err := client.Single().ReadRow(ctx, "Albums", spanner.Key{singerID, albumID}, albumColumns)
+	if err != nil {
+		return nil, err
+	}
+	return albumFromRow(row)
+}
+
+// saveAlbum writes an album with the given write mode, setting its
+// LastUpdateTime to the commit timestamp. An insert of an album that exists
+// fails with ErrConflict, and an update of one that doesn't with ErrNotFound.
+func saveAlbum(ctx context.Context, client *spanner.Client, audit *auditLog, a *Album, mode string) (err error) {
+	defer func() { err = spannerError(err) }()
+
+	var op mutationOp
+	if op, err = parseWriteMode(mode); err != nil {
+		return
+	}
+
+	var ts time.Time
+	if ts, err = client.Apply(ctx, []*spanner.Mutation{albumMutation(op, a)}, applyOptions("saveAlbum")...); err != nil {
+		return
+	}
+	logCommit("saveAlbum", ts)
+	noteAlbumWrite(ts)
+	a.LastUpdateTime = newTimestamp(ts)
+
+	audit.record(ctx, albumAudit(auditActions[mode], a))
+	return
+}
+
+// insertAlbum inserts an album with the ids it's given. It fails with
+// ErrConflict if the album exists and ErrNotFound if its singer doesn't.
+func insertAlbum(ctx context.Context, client *spanner.Client, audit *auditLog, a *Album) error {
+	return saveAlbum(ctx, client, audit, a, WriteInsert)
+}
+
+// deleteAlbum deletes an album, returning the commit timestamp. If ifMatch is
+// set, the album is only deleted if its current ETag matches, checked inside
+// the transaction so a concurrent write can't slip in between; otherwise it
+// fails with ErrPrecondition. A missing album is ErrNotFound.
+func deleteAlbum(ctx context.Context, client *spanner.Client, audit *auditLog, singerID, albumID int64, ifMatch string) (ts time.Time, err error) {
+	defer func() { err = spannerError(err) }()
+
+	key := spanner.Key{singerID, albumID}
+
+	var before *Album
+
+	ts, err = readWriteTransaction(ctx, client, "deleteAlbum", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "Albums", key, albumColumns)
+		if err != nil {
+			return err
+		}
+		if before, err = albumFromRow(row); err != nil {
+			return err
+		}
+
+		if ifMatch != "" && !etagMatches(ifMatch, albumETag(before.LastUpdateTime.Time)) {
+			return fmt.Errorf("%w: album %d/%d has changed", ErrPrecondition, singerID, albumID)
+		}
+
+		return txn.BufferWrite([]*spanner.Mutation{spanner.Delete("Albums", key)})
+	})
+	if err != nil {
+		return
+	}
+
+	logCommit("deleteAlbum", ts)
+	noteAlbumWrite(ts)
+
+	rec := albumAudit(AuditDelete, before)
+	rec.Before, rec.After = rec.After, nil
+	audit.record(ctx, rec)
+	return
+}
+
+// createAlbum inserts an album for a.SingerID. If a.AlbumID is zero the next
+// free id for the singer is assigned, MAX(AlbumId)+1, read inside the same
+// read-write transaction as the insert so concurrent creates can't pick the
+// same one; one of them is aborted and retried instead. The album is returned
+// with its id and commit timestamp filled in.
+func createAlbum(ctx context.Context, client *spanner.Client, audit *auditLog, a Album) (res *Album, err error) {
+	defer func() { err = spannerError(err) }()
+
+	var ts time.Time
+
+	ts, err = readWriteTransaction(ctx, client, "createAlbum", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		album := a
+
+		if album.AlbumID == 0 {
+			stmt := spanner.Statement{
+				SQL:    sqlNextAlbumID,
+				Params: map[string]interface{}{"singerId": album.SingerID},
+			}
+			err := queryRows(ctx, txn, "nextAlbumID", stmt, func(row *spanner.Row) error {
+				return row.Column(0, &album.AlbumID)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		res = &album
+		return txn.BufferWrite([]*spanner.Mutation{insertAlbumMutation(&album)})
+	})
+	if err != nil {
+		res = nil
+		return
+	}
+
+	logCommit("createAlbum", ts)
+	noteAlbumWrite(ts)
+	res.LastUpdateTime = newTimestamp(ts)
+	audit.record(ctx, albumAudit(AuditInsert, res))
+	return
+}
+
+// jsonTimeColumn renders a timestamp column in the configured time format when
+// Spanner serializes it with TO_JSON_STRING.
+func jsonTimeColumn(col string) string {
+	if jsonTimeFormat == TimeFormatUnixMillis {
+		return "UNIX_MILLIS(" + col + ")"
+	}
+	return col
+}
+
+// getAlbumsJSON returns the same albums as getAlbums, but has Spanner serialize
+// each row to JSON with TO_JSON_STRING so we can pass them through as is.
+func getAlbumsJSON(ctx context.Context, client *spanner.Client, opts ListOptions) (albums []json.RawMessage, lastModified time.Time, next *albumCursor, err error) {
+	defer func() { err = spannerError(err) }()
+
+	params := map[string]interface{}{
+		"max": opts.Limit + 1,
+	}
+	stmt := spanner.Statement{
+		SQL:    fmt.Sprintf(sqlSelectAlbumsJSON, jsonBudgetColumn("MarketingBudget"), jsonTimeColumn("LastUpdateTime")) + "\n" + albumsWhere(opts, params) + "\n" + albumsOrderBy(opts.Order) + "\n" + sqlListAlbumsLimit,
+		Params: params,
+	}
+	var lastRow albumCursor
+
+	err = queryRows(ctx, client.Single().WithTimestampBound(readBound(opts)), "getAlbumsJSON", stmt, func(row *spanner.Row) error {
+		var (
+			s   string
+			ts  spanner.NullTime
+			pos albumCursor
+		)
+		if err := row.Columns(&s, &ts, &pos.SingerID, &pos.AlbumID); err != nil {
+			return err
+		}
+
+		// The extra row only tells us there's another page.
+		if len(albums) == opts.Limit {
+			if len(opts.Order) == 0 {
+				next = &lastRow
+			}
+			return nil
+		}
+		pos.LastUpdateTime = ts.Time
+		lastRow = pos
+
+		if ts.Time.After(lastModified) {
+			lastModified = ts.Time
+		}
+
+		albums = append(albums, json.RawMessage(s))
+		return nil
+	})
+	if err != nil {
+		albums, next = nil, nil
+	}
+	return
+}
@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSaveAlbumModes(t *testing.T) {
+	tests := []struct {
+		mode    string
+		exists  bool
+		wantErr error
+	}{
+		{mode: WriteInsert, exists: false},
+		{mode: WriteInsert, exists: true, wantErr: ErrConflict},
+		{mode: WriteUpdate, exists: false, wantErr: ErrNotFound},
+		{mode: WriteUpdate, exists: true},
+		{mode: WriteUpsert, exists: false},
+		{mode: WriteUpsert, exists: true},
+	}
+
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	for i, tt := range tests {
+		name := tt.mode + "/missing"
+		if tt.exists {
+			name = tt.mode + "/existing"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			// A singer per case, so the cases don't see each other's albums.
+			singerID := int64(i + 1)
+			seedAlbums(t, client, &Album{SingerID: singerID, AlbumID: 1, AlbumTitle: nullString("old")})
+			albumID := int64(2)
+			if tt.exists {
+				albumID = 1
+			}
+
+			err := saveAlbum(ctx, client, nil, &Album{SingerID: singerID, AlbumID: albumID, AlbumTitle: nullString("new")}, tt.mode)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want errors.Is %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("saveAlbum: %v", err)
+			}
+
+			title, found := albumTitle(t, client, singerID, albumID)
+			switch {
+			case tt.wantErr == nil && title != "new":
+				t.Errorf("title = %q, want the write to have landed", title)
+			case tt.wantErr != nil && tt.exists && title != "old":
+				t.Errorf("title = %q, want the album untouched", title)
+			case tt.wantErr != nil && !tt.exists && found:
+				t.Error("failed write created the album")
+			}
+		})
+	}
+}
+
+func TestSaveAlbumInvalidMode(t *testing.T) {
+	client := newTestDB(t)
+
+	if err := saveAlbum(context.Background(), client, nil, &Album{SingerID: 1, AlbumID: 1}, "replace"); err == nil {
+		t.Error("got nil error for an invalid mode")
+	}
+}
+
+// TestAlbumWritesAudited checks an insert and an update each leave an audit
+// record naming who made the write and what it wrote.
+func TestAlbumWritesAudited(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1, AlbumTitle: nullString("old")})
+
+	ctx := withPrincipal(context.Background(), &Principal{Name: "alice"})
+
+	tests := []struct {
+		name       string
+		write      func(audit *auditLog) error
+		wantAction string
+		wantKey    string
+		wantAfter  map[string]interface{}
+	}{
+		{
+			name: "insert",
+			write: func(audit *auditLog) error {
+				return insertAlbum(ctx, client, audit, &Album{SingerID: 1, AlbumID: 2, AlbumTitle: nullString("Green")})
+			},
+			wantAction: AuditInsert,
+			wantKey:    "[1,2]",
+			wantAfter:  map[string]interface{}{"AlbumTitle": "Green"},
+		},
+		{
+			name: "update",
+			write: func(audit *auditLog) error {
+				return saveAlbum(ctx, client, audit, &Album{SingerID: 1, AlbumID: 1, AlbumTitle: nullString("new"), MarketingBudget: spanner.NullInt64{Int64: 500, Valid: true}}, WriteUpdate)
+			},
+			wantAction: AuditUpdate,
+			wantKey:    "[1,1]",
+			wantAfter:  map[string]interface{}{"AlbumTitle": "new", "MarketingBudget": float64(500)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.write(&auditLog{sink: &jsonAuditSink{w: &buf}}); err != nil {
+				t.Fatal(err)
+			}
+
+			var rec struct {
+				Principal string                 `json:"principal"`
+				Action    string                 `json:"action"`
+				Table     string                 `json:"table"`
+				Key       json.RawMessage        `json:"key"`
+				After     map[string]interface{} `json:"after"`
+			}
+			dec := json.NewDecoder(&buf)
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatalf("decoding audit record: %v", err)
+			}
+			if dec.More() {
+				t.Error("more than one audit record")
+			}
+
+			if rec.Principal != "alice" || rec.Action != tt.wantAction || rec.Table != "Albums" || string(rec.Key) != tt.wantKey {
+				t.Errorf("got %s %s %s %s, want alice %s Albums %s", rec.Principal, rec.Action, rec.Table, rec.Key, tt.wantAction, tt.wantKey)
+			}
+			if !reflect.DeepEqual(rec.After, tt.wantAfter) {
+				t.Errorf("after = %v, want %v", rec.After, tt.wantAfter)
+			}
+		})
+	}
+}
+
+// auditSinkFunc is an auditSink that calls itself.
+type auditSinkFunc func(ctx context.Context, recs []AuditRecord) error
+
+func (f auditSinkFunc) write(ctx context.Context, recs []AuditRecord) error {
+	return f(ctx, recs)
+}
+
+// TestAuditRecordDetached checks a write's audit records are written even
+// after the request that made it has been canceled, still as its principal.
+func TestAuditRecordDetached(t *testing.T) {
+	ctx, cancel := context.WithCancel(withPrincipal(context.Background(), &Principal{Name: "alice"}))
+	cancel()
+
+	var wrote bool
+	audit := &auditLog{sink: auditSinkFunc(func(ctx context.Context, recs []AuditRecord) error {
+		wrote = true
+		if err := ctx.Err(); err != nil {
+			t.Errorf("sink context: %v", err)
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("sink context has no deadline")
+		}
+		if got := principalName(ctx); got != "alice" {
+			t.Errorf("sink context principal = %q, want alice", got)
+		}
+		return nil
+	})}
+
+	audit.record(ctx, albumAudit(AuditUpdate, &Album{SingerID: 1, AlbumID: 1}))
+	if !wrote {
+		t.Error("nothing written")
+	}
+}
+
+// albumTitle reads an album's title, reporting whether the album exists.
+func albumTitle(t *testing.T, client *spanner.Client, singerID, albumID int64) (string, bool) {
+	t.Helper()
+
+	row, err := client.Single().ReadRow(context.Background(), "Albums", spanner.Key{singerID, albumID}, []string{"AlbumTitle"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("reading album %d/%d: %v", singerID, albumID, err)
+	}
+	var title spanner.NullString
+	if err := row.Columns(&title); err != nil {
+		t.Fatal(err)
+	}
+	return title.StringVal, true
+}
+
+func TestDeleteAlbumIfMatch(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	ts := seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1},
+		&Album{SingerID: 1, AlbumID: 2},
+		&Album{SingerID: 1, AlbumID: 3},
+	)
+	current := albumETag(ts)
+	stale := albumETag(ts.Add(-time.Second))
+
+	tests := []struct {
+		name     string
+		albumID  int64
+		ifMatch  string
+		wantErr  error
+		wantGone bool
+	}{
+		{name: "matched", albumID: 1, ifMatch: current, wantGone: true},
+		{name: "no If-Match", albumID: 2, wantGone: true},
+		{name: "stale", albumID: 3, ifMatch: stale, wantErr: ErrPrecondition},
+		{name: "missing", albumID: 9, ifMatch: "*", wantErr: ErrNotFound, wantGone: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := deleteAlbum(ctx, client, nil, 1, tt.albumID, tt.ifMatch)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want errors.Is %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("deleteAlbum: %v", err)
+			}
+
+			if _, found := albumTitle(t, client, 1, tt.albumID); found == tt.wantGone {
+				t.Errorf("album exists = %v, want %v", found, !tt.wantGone)
+			}
+		})
+	}
+}
+
+func TestParseListOptions(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantLimit   int
+		wantSingers []int64
+		wantErr     bool
+	}{
+		{query: "", wantLimit: defaultAlbumLimit},
+		{query: "limit=1", wantLimit: 1},
+		{query: "limit=1000", wantLimit: 1000},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=1001", wantErr: true},
+		{query: "limit=ten", wantErr: true},
+		{query: "singer_id=2&singer_id=1&singer_id=2", wantLimit: defaultAlbumLimit, wantSingers: []int64{2, 1}},
+		{query: "singer_id=x", wantErr: true},
+		{query: "page_token=bm9wZQ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts, err := parseListOptions(q, Config{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseListOptions(%q): %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if opts.Limit != tt.wantLimit || fmt.Sprint(opts.SingerIDs) != fmt.Sprint(tt.wantSingers) {
+			t.Errorf("parseListOptions(%q) = limit %d, singers %v; want %d, %v", tt.query, opts.Limit, opts.SingerIDs, tt.wantLimit, tt.wantSingers)
+		}
+	}
+}
+
+func TestParseListOptionsMinReadTimestamp(t *testing.T) {
+	withTimeFormat(t, TimeFormatUnixMillis)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		// A millisecond value reads no earlier than the end of that
+		// millisecond, so it can't fall before the commit it came from.
+		{value: "1714564800123", want: time.Date(2024, 5, 1, 12, 0, 0, 123999999, time.UTC)},
+		{value: "2024-05-01T12:00:00.123456Z", want: time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		opts, err := parseListOptions(url.Values{"min_read_timestamp": {tt.value}}, Config{})
+		if err != nil {
+			t.Fatalf("min_read_timestamp=%s: %v", tt.value, err)
+		}
+		if !opts.MinReadTimestamp.Equal(tt.want) {
+			t.Errorf("min_read_timestamp=%s: MinReadTimestamp = %v, want %v", tt.value, opts.MinReadTimestamp, tt.want)
+		}
+	}
+}
+
+// TestParseListOptionsHostile feeds parseListOptions what a careless or
+// hostile client might send: oversized numbers, SQL in ?order and tokens that
+// aren't ours. Each must be rejected with an error rather than a panic, and
+// whatever is accepted must only put allowed columns into the ORDER BY.
+func TestParseListOptionsHostile(t *testing.T) {
+	token := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	manyIDs := make([]string, maxSingerIDFilters+1)
+	for i := range manyIDs {
+		manyIDs[i] = strconv.Itoa(i + 1)
+	}
+
+	tests := []struct {
+		name    string
+		query   url.Values
+		wantErr bool
+	}{
+		{name: "limit at the max", query: url.Values{"limit": {strconv.Itoa(maxAlbumLimit)}}},
+		{name: "limit over the max", query: url.Values{"limit": {strconv.Itoa(maxAlbumLimit + 1)}}, wantErr: true},
+		{name: "limit of max int64", query: url.Values{"limit": {"9223372036854775807"}}, wantErr: true},
+		{name: "limit overflowing int64", query: url.Values{"limit": {"99999999999999999999"}}, wantErr: true},
+		{name: "limit of a million digits", query: url.Values{"limit": {strings.Repeat("9", 1<<20)}}, wantErr: true},
+		{name: "negative limit", query: url.Values{"limit": {"-1"}}, wantErr: true},
+		{name: "limit in exponent form", query: url.Values{"limit": {"1e3"}}, wantErr: true},
+		{name: "hex limit", query: url.Values{"limit": {"0x10"}}, wantErr: true},
+		{name: "limit with spaces", query: url.Values{"limit": {" 10"}}, wantErr: true},
+
+		{name: "order with a statement", query: url.Values{"order": {"title; DROP TABLE Albums"}}, wantErr: true},
+		{name: "order with a comment", query: url.Values{"order": {"title--"}}, wantErr: true},
+		{name: "order with a subquery", query: url.Values{"order": {"(SELECT 1)"}}, wantErr: true},
+		{name: "order by column name", query: url.Values{"order": {"AlbumTitle"}}, wantErr: true},
+		{name: "order with a direction", query: url.Values{"order": {"title DESC"}}, wantErr: true},
+		{name: "order with a NUL", query: url.Values{"order": {"title\x00"}}, wantErr: true},
+		{name: "order with a newline", query: url.Values{"order": {"title\nLIMIT 1"}}, wantErr: true},
+		{name: "order of many keys", query: url.Values{"order": {strings.Repeat("title,", 1<<16)}}, wantErr: true},
+		{name: "order with spaces", query: url.Values{"order": {" -budget ,\ttitle"}}},
+
+		{name: "token that isn't base64", query: url.Values{"page_token": {"%%%"}}, wantErr: true},
+		{name: "padded token", query: url.Values{"page_token": {"e30="}}, wantErr: true},
+		{name: "empty object token", query: url.Values{"page_token": {token("{}")}}, wantErr: true},
+		{name: "token with SQL for a key", query: url.Values{"page_token": {token(`{"t":"2022-07-01T12:00:00Z","s":"1 OR 1=1","a":1}`)}}, wantErr: true},
+		{name: "token with a bad time", query: url.Values{"page_token": {token(`{"t":"yesterday","s":1,"a":1}`)}}, wantErr: true},
+		{name: "token of a JSON array", query: url.Values{"page_token": {token(`[1,2,3]`)}}, wantErr: true},
+		{name: "token of a huge number", query: url.Values{"page_token": {token(`{"t":"2022-07-01T12:00:00Z","s":1e400,"a":1}`)}}, wantErr: true},
+		{name: "token of a megabyte of garbage", query: url.Values{"page_token": {strings.Repeat("A", 1<<20)}}, wantErr: true},
+		{name: "well-formed token", query: url.Values{"page_token": {token(`{"t":"2022-07-01T12:00:00Z","s":1,"a":2}`)}}},
+
+		{name: "singer_id with SQL", query: url.Values{"singer_id": {"1 OR 1=1"}}, wantErr: true},
+		{name: "singer_id overflowing int64", query: url.Values{"singer_id": {"9223372036854775808"}}, wantErr: true},
+		{name: "too many singer_ids", query: url.Values{"singer_id": manyIDs}, wantErr: true},
+	}
+
+	orderBy := regexp.MustCompile(`^ORDER BY (SingerId|AlbumId|AlbumTitle|MarketingBudget|LastUpdateTime)( DESC)?(, (SingerId|AlbumId|AlbumTitle|MarketingBudget|LastUpdateTime)( DESC)?)*$`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseListOptions(tt.query, Config{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if opts.Limit < 1 || opts.Limit > maxAlbumLimit {
+				t.Errorf("Limit = %d, want 1 to %d", opts.Limit, maxAlbumLimit)
+			}
+			if got := albumsOrderBy(opts.Order); !orderBy.MatchString(got) {
+				t.Errorf("ORDER BY = %q, want only allowed columns", got)
+			}
+		})
+	}
+}
+
+// TestCreateAlbumConcurrentIDs creates albums for one singer concurrently
+// without ids: each gets its own, since they're assigned inside the insert's
+// transaction.
+func TestCreateAlbumConcurrentIDs(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1})
+
+	const n = 10
+	ids := make(chan int64, n)
+	errs := make(chan error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := createAlbum(context.Background(), client, nil, Album{SingerID: 1})
+			if err != nil {
+				errs <- err
+				return
+			}
+			ids <- a.AlbumID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("createAlbum: %v", err)
+	}
+
+	seen := make(map[int64]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("album id %d assigned twice", id)
+		}
+		if id < 2 || id > n+1 {
+			t.Errorf("album id %d, want one of 2 to %d", id, n+1)
+		}
+		seen[id] = true
+	}
+}
+
+// TestReadYourWrites writes an album, then lists albums at or after the
+// commit timestamp, rendered in each time format the way a client would get
+// it back, and expects to see the write.
+func TestReadYourWrites(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1})
+
+	for i, format := range []string{TimeFormatRFC3339, TimeFormatUnixMillis} {
+		t.Run(format, func(t *testing.T) {
+			withTimeFormat(t, format)
+
+			a, err := createAlbum(ctx, client, nil, Album{SingerID: 1, AlbumID: int64(i + 2)})
+			if err != nil {
+				t.Fatalf("createAlbum: %v", err)
+			}
+
+			for name, token := range map[string]string{
+				"header": commitTimestampOf(t, a.LastUpdateTime.Time),
+				"body":   strings.Trim(mustMarshal(t, a.LastUpdateTime), `"`),
+			} {
+				opts, err := parseListOptions(url.Values{"min_read_timestamp": {token}, "limit": {"100"}}, Config{})
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				page, err := listAlbums(ctx, client, opts, false)
+				if err != nil {
+					t.Fatalf("%s: listAlbums: %v", name, err)
+				}
+
+				want := fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID)
+				if !strings.Contains(" "+strings.Join(pageKeys(t, page), " ")+" ", " "+want+" ") {
+					t.Errorf("%s: min_read_timestamp=%s doesn't see album %s", name, token, want)
+				}
+			}
+		})
+	}
+}
+
+// commitTimestampOf returns the commit timestamp header a write committed at
+// ts responds with.
+func commitTimestampOf(t *testing.T, ts time.Time) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	setCommitTimestamp(w, ts)
+	return w.Header().Get(commitTimestampHeader)
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// TestListAlbums pages through listAlbums, with and without the JSON
+// projection, passing each page's token back the way a handler would.
+func TestListAlbums(t *testing.T) {
+	client := newTestDB(t)
+
+	var albums []*Album
+	for _, k := range [][2]int64{{1, 1}, {1, 2}, {2, 1}, {3, 1}, {3, 2}} {
+		albums = append(albums, &Album{SingerID: k[0], AlbumID: k[1]})
+	}
+	seedAlbums(t, client, albums...)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string // one entry per page
+	}{
+		{name: "one page", query: "limit=10", want: []string{"[1/1 1/2 2/1 3/1 3/2]"}},
+		{name: "exactly full", query: "limit=5", want: []string{"[1/1 1/2 2/1 3/1 3/2]"}},
+		{name: "pages", query: "limit=2", want: []string{"[1/1 1/2]", "[2/1 3/1]", "[3/2]"}},
+		{name: "filtered", query: "singer_id=1&singer_id=3", want: []string{"[1/1 1/2 3/1 3/2]"}},
+		{name: "filtered pages", query: "singer_id=3&singer_id=1&limit=3", want: []string{"[1/1 1/2 3/1]", "[3/2]"}},
+		{name: "no match", query: "singer_id=9", want: []string{"[]"}},
+	}
+
+	for _, projection := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/projection=%v", tt.name, projection), func(t *testing.T) {
+				q, err := url.ParseQuery(tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got []string
+				for {
+					if len(got) == len(tt.want) {
+						t.Fatalf("more pages than expected after %v", got)
+					}
+
+					opts, err := parseListOptions(q, Config{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					page, err := listAlbums(context.Background(), client, opts, projection)
+					if err != nil {
+						t.Fatalf("listAlbums: %v", err)
+					}
+
+					keys := pageKeys(t, page)
+					if page.Count != len(keys) {
+						t.Errorf("Count = %d, want %d", page.Count, len(keys))
+					}
+					got = append(got, fmt.Sprint(keys))
+
+					if page.NextPageToken == "" {
+						break
+					}
+					if len(keys) != opts.Limit {
+						t.Errorf("page of %d with a next page, want a full page of %d", len(keys), opts.Limit)
+					}
+					q.Set("page_token", page.NextPageToken)
+				}
+
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("pages = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// pageKeys returns the singer/album ids of a page's albums, whichever form
+// its items are in.
+func pageKeys(t *testing.T, page AlbumPage) []string {
+	t.Helper()
+
+	keys := []string{}
+	switch items := page.Items.(type) {
+	case []*Album:
+		for _, a := range items {
+			keys = append(keys, fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID))
+		}
+	case []json.RawMessage:
+		for _, raw := range items {
+			var a struct {
+				SingerID int64 `json:"singer_id"`
+				AlbumID  int64 `json:"album_id"`
+			}
+			if err := json.Unmarshal(raw, &a); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID))
+		}
+	default:
+		t.Fatalf("unexpected items %T", page.Items)
+	}
+	return keys
+}
+
+// TestListAlbumsProjectionMatches checks the JSON projection renders the same
+// albums as the struct path, in each time format and null budget mode.
+func TestListAlbumsProjectionMatches(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, AlbumTitle: spanner.NullString{StringVal: "Total Junk", Valid: true}, MarketingBudget: spanner.NullInt64{Int64: 300000, Valid: true}},
+		&Album{SingerID: 1, AlbumID: 2, AlbumTitle: spanner.NullString{StringVal: `Go, Go, "Go"`, Valid: true}},
+		&Album{SingerID: 2, AlbumID: 1},
+	)
+
+	for _, format := range []string{TimeFormatRFC3339, TimeFormatUnixMillis} {
+		for _, budget := range []string{NullBudgetNull, NullBudgetZero} {
+			t.Run(format+"/"+budget, func(t *testing.T) {
+				withTimeFormat(t, format)
+				prev := nullBudget
+				nullBudget = budget
+				t.Cleanup(func() { nullBudget = prev })
+
+				opts := ListOptions{Limit: 10}
+				structs, err := listAlbums(context.Background(), client, opts, false)
+				if err != nil {
+					t.Fatalf("struct path: %v", err)
+				}
+				projected, err := listAlbums(context.Background(), client, opts, true)
+				if err != nil {
+					t.Fatalf("projection: %v", err)
+				}
+
+				want := renderedAlbums(t, structs.Items)
+				got := renderedAlbums(t, projected.Items)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("projection rendered\n%v\nwant\n%v", got, want)
+				}
+				if !projected.LastModified.Equal(structs.LastModified) {
+					t.Errorf("projection LastModified = %v, want %v", projected.LastModified, structs.LastModified)
+				}
+			})
+		}
+	}
+}
+
+// renderedAlbums marshals a page's items and decodes them back, with
+// RFC3339 times parsed so the same instant compares equal however many
+// fractional digits it was written with.
+func renderedAlbums(t *testing.T, items interface{}) []map[string]interface{} {
+	t.Helper()
+
+	var albums []map[string]interface{}
+	if err := json.Unmarshal([]byte(mustMarshal(t, items)), &albums); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range albums {
+		if s, ok := a["last_update_time"].(string); ok {
+			ts, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				t.Fatalf("last_update_time %q: %v", s, err)
+			}
+			a["last_update_time"] = ts.UTC()
+		}
+	}
+	return albums
+}
+
+func TestParseAsOf(t *testing.T) {
+	const retention = time.Hour
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "unset", value: ""},
+		{name: "in the window", value: now.Add(-30 * time.Minute).Format(time.RFC3339)},
+		{name: "fractional seconds", value: now.Add(-time.Minute).Format(time.RFC3339Nano)},
+		{name: "not a timestamp", value: "yesterday", wantErr: "expected RFC3339"},
+		{name: "future", value: now.Add(time.Hour).Format(time.RFC3339), wantErr: "in the future"},
+		{name: "past retention", value: now.Add(-2 * time.Hour).Format(time.RFC3339), wantErr: "older than the version retention period (1h0m0s)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAsOf(tt.value, retention)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseAsOf(%q) = %v, %v; want an error containing %q", tt.value, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAsOf(%q): %v", tt.value, err)
+			}
+			if tt.value == "" && !got.IsZero() {
+				t.Errorf("parseAsOf(\"\") = %v, want zero", got)
+			}
+		})
+	}
+}
+
+// TestListAlbumsAsOf changes an album's title, then reads at the first
+// write's commit timestamp and expects the old title back.
+func TestListAlbumsAsOf(t *testing.T) {
+	client := newTestDB(t)
+
+	before := seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1, AlbumTitle: spanner.NullString{StringVal: "Old", Valid: true}})
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1, AlbumTitle: spanner.NullString{StringVal: "New", Valid: true}})
+
+	for _, tt := range []struct {
+		name string
+		asOf time.Time
+		want string
+	}{
+		{name: "now", want: "New"},
+		{name: "as of the first write", asOf: before, want: "Old"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := listAlbums(context.Background(), client, ListOptions{Limit: 10, AsOf: tt.asOf}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			albums := page.Items.([]*Album)
+			if len(albums) != 1 || albums[0].AlbumTitle.StringVal != tt.want {
+				t.Errorf("albums = %s, want one titled %q", mustMarshal(t, albums), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSingerIDs(t *testing.T) {
+	ids := func(n, dups int) []string {
+		var vals []string
+		for i := 1; i <= n; i++ {
+			vals = append(vals, fmt.Sprint(i))
+		}
+		for i := 0; i < dups; i++ {
+			vals = append(vals, "1")
+		}
+		return vals
+	}
+
+	tests := []struct {
+		name    string
+		vals    []string
+		wantLen int
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "union", vals: []string{"1", "2"}, wantLen: 2},
+		{name: "duplicates dropped", vals: []string{"7", "7", "7"}, wantLen: 1},
+		{name: "at the cap", vals: ids(maxSingerIDFilters, 0), wantLen: maxSingerIDFilters},
+		// Only distinct ids count towards the cap.
+		{name: "at the cap with duplicates", vals: ids(maxSingerIDFilters, 5), wantLen: maxSingerIDFilters},
+		{name: "over the cap", vals: ids(maxSingerIDFilters+1, 0), wantErr: "too many singer_id values"},
+		{name: "not a number", vals: []string{"1", "one"}, wantErr: `invalid singer_id "one"`},
+		{name: "empty", vals: []string{""}, wantErr: "invalid singer_id"},
+		{name: "overflow", vals: []string{"9223372036854775808"}, wantErr: "invalid singer_id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSingerIDs(tt.vals)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one containing %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("got %d ids, want %d", len(got), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestListAlbumsStatement(t *testing.T) {
+	after := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		opts       ListOptions
+		wantSQL    string
+		wantParams map[string]interface{}
+	}{
+		{
+			name:       "default",
+			opts:       ListOptions{Limit: 10},
+			wantSQL:    sqlSelectAlbums + "\n\nORDER BY LastUpdateTime DESC, SingerId, AlbumId\nLIMIT @max",
+			wantParams: map[string]interface{}{"max": 11},
+		},
+		{
+			name:       "filtered and ordered",
+			opts:       ListOptions{Limit: 5, SingerIDs: []int64{1, 2}, UpdatedAfter: after, Order: []orderKey{{column: "MarketingBudget", desc: true}}},
+			wantSQL:    sqlSelectAlbums + "\nWHERE SingerId IN UNNEST(@singerIds) AND LastUpdateTime >= @updatedAfter\nORDER BY MarketingBudget DESC, SingerId, AlbumId\nLIMIT @max",
+			wantParams: map[string]interface{}{"max": 6, "singerIds": []int64{1, 2}, "updatedAfter": after},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := listAlbumsStatement(tt.opts)
+			if stmt.SQL != tt.wantSQL {
+				t.Errorf("SQL =\n%s\nwant\n%s", stmt.SQL, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(stmt.Params, tt.wantParams) {
+				t.Errorf("params = %v, want %v", stmt.Params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []orderKey
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "title", want: []orderKey{{column: "AlbumTitle"}}},
+		{value: "singer,-album", want: []orderKey{{column: "SingerId"}, {column: "AlbumId", desc: true}}},
+		{value: "-budget, title ,updated", want: []orderKey{{column: "MarketingBudget", desc: true}, {column: "AlbumTitle"}, {column: "LastUpdateTime"}}},
+		{value: "singer,album,title,budget", wantErr: true},
+		{value: "singer,plays", wantErr: true},
+		{value: "SingerId", wantErr: true},
+		{value: "title,-title", wantErr: true},
+		{value: "singer,", wantErr: true},
+		{value: "-", wantErr: true},
+		{value: "--budget", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseOrder(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseOrder(%q): %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseOrder(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAlbumsOrderBy(t *testing.T) {
+	tests := []struct {
+		keys []orderKey
+		want string
+	}{
+		{want: sqlListAlbumsOrder},
+		{keys: []orderKey{{column: "AlbumTitle"}}, want: "ORDER BY AlbumTitle, SingerId, AlbumId"},
+		{keys: []orderKey{{column: "MarketingBudget", desc: true}, {column: "AlbumTitle"}}, want: "ORDER BY MarketingBudget DESC, AlbumTitle, SingerId, AlbumId"},
+		// The album's key isn't repeated if it's already there.
+		{keys: []orderKey{{column: "SingerId"}, {column: "AlbumId", desc: true}}, want: "ORDER BY SingerId, AlbumId DESC"},
+		{keys: []orderKey{{column: "AlbumId", desc: true}}, want: "ORDER BY AlbumId DESC, SingerId"},
+	}
+
+	for _, tt := range tests {
+		if got := albumsOrderBy(tt.keys); got != tt.want {
+			t.Errorf("albumsOrderBy(%v) = %q, want %q", tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestListAlbumsMultiKeyOrder(t *testing.T) {
+	client := newTestDB(t)
+
+	title := func(s string) spanner.NullString { return spanner.NullString{StringVal: s, Valid: true} }
+	budget := func(n int64) spanner.NullInt64 { return spanner.NullInt64{Int64: n, Valid: true} }
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, AlbumTitle: title("B"), MarketingBudget: budget(100)},
+		&Album{SingerID: 1, AlbumID: 2, AlbumTitle: title("A"), MarketingBudget: budget(100)},
+		&Album{SingerID: 2, AlbumID: 1, AlbumTitle: title("C"), MarketingBudget: budget(300)},
+		&Album{SingerID: 2, AlbumID: 2, AlbumTitle: title("A")},
+	)
+
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{order: "singer,-album", want: "[1/2 1/1 2/2 2/1]"},
+		{order: "title,-singer", want: "[2/2 1/2 1/1 2/1]"},
+		// NULLs sort first ascending, so last descending.
+		{order: "-budget,title", want: "[2/1 1/2 1/1 2/2]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			opts, err := parseListOptions(url.Values{"order": {tt.order}, "limit": {"10"}}, Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := listAlbums(context.Background(), client, opts, false)
+			if err != nil {
+				t.Fatalf("listAlbums: %v", err)
+			}
+			if got := fmt.Sprint(pageKeys(t, page)); got != tt.want {
+				t.Errorf("albums = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUpdatedWindow(t *testing.T) {
+	withTimeFormat(t, TimeFormatRFC3339)
+
+	t1 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Microsecond)
+
+	tests := []struct {
+		name       string
+		after      string
+		before     string
+		wantAfter  time.Time
+		wantBefore time.Time
+		wantErr    bool
+	}{
+		{name: "unset"},
+		{name: "after only", after: "2024-05-01T12:00:00Z", wantAfter: t1},
+		{name: "before only", before: "2024-05-01T12:00:00.000001Z", wantBefore: t2},
+		{name: "window", after: "2024-05-01T12:00:00Z", before: "2024-05-01T12:00:00.000001Z", wantAfter: t1, wantBefore: t2},
+		{name: "empty window", after: "2024-05-01T12:00:00Z", before: "2024-05-01T12:00:00Z", wantErr: true},
+		{name: "reversed", after: "2024-05-01T12:00:00.000001Z", before: "2024-05-01T12:00:00Z", wantErr: true},
+		{name: "invalid after", after: "yesterday", wantErr: true},
+		{name: "invalid before", before: "2024-05-01", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after, before, err := parseUpdatedWindow(tt.after, tt.before)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUpdatedWindow(%q, %q): %v, want error %v", tt.after, tt.before, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !after.Equal(tt.wantAfter) || !before.Equal(tt.wantBefore) {
+				t.Errorf("parseUpdatedWindow(%q, %q) = %v, %v; want %v, %v", tt.after, tt.before, after, before, tt.wantAfter, tt.wantBefore)
+			}
+		})
+	}
+}
+
+// TestListAlbumsUpdatedWindow checks the window includes albums updated at
+// updatedAfter, excludes those updated at updatedBefore, and combines with
+// the singer filter.
+func TestListAlbumsUpdatedWindow(t *testing.T) {
+	withTimeFormat(t, TimeFormatRFC3339)
+	client := newTestDB(t)
+
+	ts1 := seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1})
+	ts2 := seedAlbums(t, client, &Album{SingerID: 2, AlbumID: 1})
+	ts3 := seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 2})
+	format := func(ts time.Time) string { return ts.UTC().Format(time.RFC3339Nano) }
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  string
+	}{
+		{name: "after, inclusive", query: url.Values{"updatedAfter": {format(ts2)}}, want: "[1/2 2/1]"},
+		{name: "before, exclusive", query: url.Values{"updatedBefore": {format(ts2)}}, want: "[1/1]"},
+		{name: "window", query: url.Values{"updatedAfter": {format(ts1)}, "updatedBefore": {format(ts3)}}, want: "[2/1 1/1]"},
+		{name: "window and singer", query: url.Values{"updatedAfter": {format(ts1)}, "updatedBefore": {format(ts3)}, "singer_id": {"1"}}, want: "[1/1]"},
+		{name: "nothing in the window", query: url.Values{"updatedAfter": {format(ts3.Add(time.Microsecond))}}, want: "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseListOptions(tt.query, Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := listAlbums(context.Background(), client, opts, false)
+			if err != nil {
+				t.Fatalf("listAlbums: %v", err)
+			}
+			if got := fmt.Sprint(pageKeys(t, page)); got != tt.want {
+				t.Errorf("albums = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseListOptions(url.Values{"updatedAfter": {format(ts2)}, "updatedBefore": {format(ts1)}}, Config{}); err == nil {
+		t.Error("parseListOptions accepted a window ending before it starts")
+	}
+}
+
+func TestParseTopN(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: defaultTopAlbums},
+		{value: "1", want: 1},
+		{value: "100", want: maxTopAlbums},
+		{value: "101", want: maxTopAlbums},
+		{value: "999999999999", want: maxTopAlbums},
+		{value: "99999999999999999999", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-3", wantErr: true},
+		{value: "ten", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTopN(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTopN(%q): %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTopN(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestTopAlbums checks /albums/top ranks albums by budget, largest first,
+// with their singer's name, and leaves out albums without a budget.
+func TestTopAlbums(t *testing.T) {
+	client := newTestDB(t)
+
+	budget := func(n int64) spanner.NullInt64 { return spanner.NullInt64{Int64: n, Valid: true} }
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, MarketingBudget: budget(100)},
+		&Album{SingerID: 1, AlbumID: 2},
+		&Album{SingerID: 2, AlbumID: 1, MarketingBudget: budget(500)},
+		&Album{SingerID: 2, AlbumID: 2, MarketingBudget: budget(100)},
+		&Album{SingerID: 3, AlbumID: 1},
+		&Album{SingerID: 3, AlbumID: 2, MarketingBudget: budget(0)},
+	)
+	_, err := client.Apply(context.Background(), []*spanner.Mutation{
+		insertOrUpdateSingerMutation(&Singer{SingerID: 2, FirstName: spanner.NullString{StringVal: "Catalina", Valid: true}, LastName: spanner.NullString{StringVal: "Smith", Valid: true}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	tests := []struct {
+		query    string
+		wantCode int
+		want     string
+	}{
+		// Ties are broken by key.
+		{query: "", wantCode: http.StatusOK, want: "[2/1:500 1/1:100 2/2:100 3/2:0]"},
+		{query: "?n=2", wantCode: http.StatusOK, want: "[2/1:500 1/1:100]"},
+		{query: "?n=1000", wantCode: http.StatusOK, want: "[2/1:500 1/1:100 2/2:100 3/2:0]"},
+		{query: "?n=0", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums/top"+tt.query, nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var albums []TopAlbum
+			if err := json.Unmarshal(w.Body.Bytes(), &albums); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, a := range albums {
+				got = append(got, fmt.Sprintf("%d/%d:%d", a.SingerID, a.AlbumID, a.MarketingBudget))
+				if a.SingerID == 2 && (a.FirstName.StringVal != "Catalina" || a.LastName.StringVal != "Smith") {
+					t.Errorf("album %d/%d has singer %v %v, want Catalina Smith", a.SingerID, a.AlbumID, a.FirstName, a.LastName)
+				}
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("albums = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
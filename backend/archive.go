@@ -0,0 +1,213 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+const archiveVersion = 1
+
+// Ways of restoring an archive. replace clears Singers, and with them Albums,
+// before loading; upsert loads on top of what's there.
+const (
+	RestoreReplace = "replace"
+	RestoreUpsert  = "upsert"
+)
+
+// maxArchiveSize caps an uncompressed archive we'll restore. Everything is
+// written in one commit, which Spanner caps too, so a bigger one wouldn't go
+// through anyway.
+const maxArchiveSize = 64 << 20
+
+// Archive is every singer and their albums, for backing up databases that
+// can't be backed up with Spanner backups, like the emulator. Timestamps are
+// always RFC3339, whatever the configured time format, so an archive reads
+// the same way everywhere.
+type Archive struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Singers    []ArchiveSinger `json:"singers"`
+}
+
+type ArchiveSinger struct {
+	SingerID   int64              `json:"singer_id"`
+	FirstName  spanner.NullString `json:"first_name"`
+	LastName   spanner.NullString `json:"last_name"`
+	SingerInfo []byte             `json:"singer_info"`
+	Albums     []ArchiveAlbum     `json:"albums"`
+}
+
+// ArchiveAlbum's LastUpdateTime is when the album last changed before the
+// export. It isn't restored: see restoreArchive.
+type ArchiveAlbum struct {
+	AlbumID         int64              `json:"album_id"`
+	AlbumTitle      spanner.NullString `json:"album_title"`
+	MarketingBudget spanner.NullInt64  `json:"marketing_budget"`
+	LastUpdateTime  time.Time          `json:"last_update_time"`
+}
+
+// parseRestoreMode checks a restore mode, defaulting to upsert, which can't
+// lose data that isn't in the archive.
+func parseRestoreMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return RestoreUpsert, nil
+	case RestoreReplace, RestoreUpsert:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid mode %q, expected %s or %s", mode, RestoreReplace, RestoreUpsert)
+}
+
+func (a *Archive) validate() error {
+	if a.Version != archiveVersion {
+		return fmt.Errorf("unsupported archive version %d, expected %d", a.Version, archiveVersion)
+	}
+
+	singers := make(map[int64]bool, len(a.Singers))
+	for i, s := range a.Singers {
+		if singers[s.SingerID] {
+			return fmt.Errorf("singers[%d]: duplicate singer_id %d", i, s.SingerID)
+		}
+		singers[s.SingerID] = true
+
+		albums := make(map[int64]bool, len(s.Albums))
+		for j, al := range s.Albums {
+			if albums[al.AlbumID] {
+				return fmt.Errorf("singers[%d].albums[%d]: duplicate album_id %d", i, j, al.AlbumID)
+			}
+			albums[al.AlbumID] = true
+		}
+	}
+	return nil
+}
+
+// exportArchive reads every singer and album in one read-only transaction, so
+// the archive is a consistent snapshot, and writes it to w as gzipped JSON.
+func exportArchive(ctx context.Context, client *spanner.Client, w io.Writer) (err error) {
+	defer func() { err = spannerError(err) }()
+
+	txn := client.ReadOnlyTransaction()
+	defer txn.Close()
+
+	a := &Archive{Version: archiveVersion, Singers: []ArchiveSinger{}}
+	index := make(map[int64]int)
+
+	err = txn.Read(ctx, "Singers", spanner.AllKeys(), []string{"SingerId", "FirstName", "LastName", "SingerInfo"}).Do(func(row *spanner.Row) error {
+		s := ArchiveSinger{Albums: []ArchiveAlbum{}}
+		if err := row.Columns(&s.SingerID, &s.FirstName, &s.LastName, &s.SingerInfo); err != nil {
+			return err
+		}
+		index[s.SingerID] = len(a.Singers)
+		a.Singers = append(a.Singers, s)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = txn.Read(ctx, "Albums", spanner.AllKeys(), []string{"SingerId", "AlbumId", "AlbumTitle", "MarketingBudget", "LastUpdateTime"}).Do(func(row *spanner.Row) error {
+		var (
+			singerID int64
+			al       ArchiveAlbum
+		)
+		if err := row.Columns(&singerID, &al.AlbumID, &al.AlbumTitle, &al.MarketingBudget, &al.LastUpdateTime); err != nil {
+			return err
+		}
+		// Albums are interleaved in Singers, so their singer is always there.
+		s := &a.Singers[index[singerID]]
+		s.Albums = append(s.Albums, al)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if a.ExportedAt, err = txn.Timestamp(); err != nil {
+		return
+	}
+	logReadTimestamp("exportArchive", txn)
+
+	gz := gzip.NewWriter(w)
+	if err = json.NewEncoder(gz).Encode(a); err != nil {
+		return
+	}
+	return gz.Close()
+}
+
+// readArchive decodes and validates a gzipped archive.
+func readArchive(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("archive isn't gzipped: %w", err)
+	}
+	defer gz.Close()
+
+	lr := &io.LimitedReader{R: gz, N: maxArchiveSize + 1}
+
+	a := &Archive{}
+	if err := json.NewDecoder(lr).Decode(a); err != nil {
+		if lr.N <= 0 {
+			return nil, fmt.Errorf("archive is larger than %d bytes", maxArchiveSize)
+		}
+		return nil, fmt.Errorf("invalid archive: %w", err)
+	}
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// restoreArchive loads an archive in a single transaction, so a failed restore
+// leaves the database as it was. Restored albums get the restore's commit
+// timestamp as their LastUpdateTime, not the archived one: they've changed as
+// far as /albums/sync and If-Modified-Since are concerned, and an older
+// timestamp would hide that from both. The mode must have been checked with
+// parseRestoreMode.
+func restoreArchive(ctx context.Context, client *spanner.Client, audit *auditLog, a *Archive, mode string) (err error) {
+	defer func() { err = spannerError(err) }()
+
+	var m []*spanner.Mutation
+	var recs []AuditRecord
+
+	if mode == RestoreReplace {
+		// Albums go too: they're interleaved ON DELETE CASCADE.
+		m = append(m, spanner.Delete("Singers", spanner.AllKeys()))
+		recs = append(recs, AuditRecord{Action: AuditDelete, Table: "Singers", Key: spanner.Key{}})
+	}
+
+	for _, s := range a.Singers {
+		m = append(m, spanner.InsertOrUpdate("Singers",
+			[]string{"SingerId", "FirstName", "LastName", "SingerInfo"},
+			[]interface{}{s.SingerID, s.FirstName, s.LastName, s.SingerInfo}))
+		recs = append(recs, singerAudit(AuditInsertOrUpdate, &Singer{SingerID: s.SingerID, FirstName: s.FirstName, LastName: s.LastName}))
+
+		for _, al := range s.Albums {
+			m = append(m, spanner.InsertOrUpdate("Albums",
+				[]string{"SingerId", "AlbumId", "AlbumTitle", "MarketingBudget", "LastUpdateTime"},
+				[]interface{}{s.SingerID, al.AlbumID, al.AlbumTitle, al.MarketingBudget, spanner.CommitTimestamp}))
+			recs = append(recs, albumAudit(AuditInsertOrUpdate, &Album{
+				SingerID: s.SingerID, AlbumID: al.AlbumID, AlbumTitle: al.AlbumTitle, MarketingBudget: al.MarketingBudget,
+			}))
+		}
+	}
+
+	var ts time.Time
+
+	ts, err = readWriteTransaction(ctx, client, "restoreArchive", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return txn.BufferWrite(m)
+	})
+	if err != nil {
+		return
+	}
+
+	logCommit("restoreArchive", ts)
+	noteAlbumWrite(ts)
+	audit.record(ctx, recs...)
+	return
+}
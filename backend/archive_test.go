@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// gzipJSON returns v as gzipped JSON, the way archives are sent.
+func gzipJSON(t *testing.T, v interface{}) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadArchive(t *testing.T) {
+	past := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+	album := ArchiveAlbum{AlbumID: 1, LastUpdateTime: past}
+
+	tests := []struct {
+		name    string
+		archive Archive
+		wantErr string
+	}{
+		{name: "valid", archive: Archive{Version: archiveVersion, Singers: []ArchiveSinger{
+			{SingerID: 1, Albums: []ArchiveAlbum{album, {AlbumID: 2, LastUpdateTime: past}}},
+			{SingerID: 2, Albums: []ArchiveAlbum{album}},
+		}}},
+		{name: "version", archive: Archive{Version: archiveVersion + 1}, wantErr: "unsupported archive version"},
+		{name: "duplicate singer", archive: Archive{Version: archiveVersion, Singers: []ArchiveSinger{{SingerID: 1}, {SingerID: 1}}},
+			wantErr: "duplicate singer_id"},
+		{name: "duplicate album", archive: Archive{Version: archiveVersion, Singers: []ArchiveSinger{{SingerID: 1, Albums: []ArchiveAlbum{album, album}}}},
+			wantErr: "duplicate album_id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := readArchive(gzipJSON(t, tt.archive))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Timestamps keep their full precision.
+				if got := a.Singers[0].Albums[0].LastUpdateTime; !got.Equal(past) {
+					t.Errorf("last_update_time = %v, want %v", got, past)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := readArchive(strings.NewReader(`{"version":1}`)); err == nil || !strings.Contains(err.Error(), "isn't gzipped") {
+		t.Errorf("plain JSON: got %v, want a gzip error", err)
+	}
+}
+
+func TestParseRestoreMode(t *testing.T) {
+	for in, want := range map[string]string{"": RestoreUpsert, RestoreUpsert: RestoreUpsert, RestoreReplace: RestoreReplace} {
+		if got, err := parseRestoreMode(in); err != nil || got != want {
+			t.Errorf("parseRestoreMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseRestoreMode("merge"); err == nil {
+		t.Error("parseRestoreMode(merge) succeeded")
+	}
+}
+
+// exportedArchive exports client's database and reads it back, as a restore
+// would.
+func exportedArchive(t *testing.T, client *spanner.Client) *Archive {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := exportArchive(context.Background(), client, &buf); err != nil {
+		t.Fatalf("exportArchive: %v", err)
+	}
+	a, err := readArchive(&buf)
+	if err != nil {
+		t.Fatalf("readArchive: %v", err)
+	}
+	return a
+}
+
+// TestArchiveRoundTrip exports a database, restores the archive into another
+// in each mode, and exports that: the singers and albums should come back the
+// same, except every album's LastUpdateTime is the restore's, so clients
+// syncing or caching /albums see the change.
+func TestArchiveRoundTrip(t *testing.T) {
+	src := newTestDB(t)
+	ctx := context.Background()
+
+	seedAlbums(t, src,
+		&Album{SingerID: 1, AlbumID: 1, AlbumTitle: nullString("Total Junk"), MarketingBudget: spanner.NullInt64{Int64: 100, Valid: true}},
+		&Album{SingerID: 1, AlbumID: 2},
+	)
+	seedAlbums(t, src, &Album{SingerID: 2, AlbumID: 1, AlbumTitle: nullString("Green")})
+	if _, err := src.Apply(ctx, []*spanner.Mutation{
+		spanner.Update("Singers", []string{"SingerId", "FirstName", "LastName", "SingerInfo"}, []interface{}{1, "Marc", "Richards", []byte{1, 2, 3}}),
+		// A singer without albums.
+		spanner.Insert("Singers", []string{"SingerId", "FirstName"}, []interface{}{3, "Alice"}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := exportedArchive(t, src)
+	if len(want.Singers) != 3 {
+		t.Fatalf("exported %d singers, want 3", len(want.Singers))
+	}
+
+	tests := []struct {
+		mode      string
+		wantStray bool
+	}{
+		{mode: RestoreReplace},
+		{mode: RestoreUpsert, wantStray: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			dst := newTestDB(t)
+			// Something the archive doesn't have.
+			seedAlbums(t, dst, &Album{SingerID: 9, AlbumID: 1})
+
+			if err := restoreArchive(ctx, dst, nil, want, tt.mode); err != nil {
+				t.Fatalf("restoreArchive: %v", err)
+			}
+
+			got := exportedArchive(t, dst)
+
+			singers := got.Singers
+			if n := len(singers); n > 0 && singers[n-1].SingerID == 9 {
+				singers = singers[:n-1]
+				if !tt.wantStray {
+					t.Errorf("singer 9 survived a %s restore", tt.mode)
+				}
+			} else if tt.wantStray {
+				t.Errorf("singer 9 didn't survive a %s restore", tt.mode)
+			}
+
+			for _, s := range singers {
+				for i, al := range s.Albums {
+					if !al.LastUpdateTime.After(want.ExportedAt) {
+						t.Errorf("singer %d album %d: last_update_time %v isn't after the export at %v", s.SingerID, al.AlbumID, al.LastUpdateTime, want.ExportedAt)
+					}
+					s.Albums[i].LastUpdateTime = time.Time{}
+				}
+			}
+			if !reflect.DeepEqual(singers, withoutUpdateTimes(want.Singers)) {
+				t.Errorf("restored %+v\nwant %+v", singers, want.Singers)
+			}
+		})
+	}
+}
+
+// withoutUpdateTimes returns a copy of singers with every album's
+// LastUpdateTime cleared.
+func withoutUpdateTimes(singers []ArchiveSinger) []ArchiveSinger {
+	out := make([]ArchiveSinger, len(singers))
+	for i, s := range singers {
+		s.Albums = append([]ArchiveAlbum{}, s.Albums...)
+		for j := range s.Albums {
+			s.Albums[j].LastUpdateTime = time.Time{}
+		}
+		out[i] = s
+	}
+	return out
+}
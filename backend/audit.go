@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+const (
+	AuditSinkStdout  = "stdout"
+	AuditSinkSpanner = "spanner"
+
+	AuditInsert         = "insert"
+	AuditUpdate         = "update"
+	AuditInsertOrUpdate = "insert_or_update"
+	AuditDelete         = "delete"
+)
+
+// auditActions maps write modes onto the audit action they record.
+var auditActions = map[string]string{
+	"":          AuditInsertOrUpdate,
+	WriteInsert: AuditInsert,
+	WriteUpdate: AuditUpdate,
+	WriteUpsert: AuditInsertOrUpdate,
+}
+
+// AuditRecord describes a single row change. Before and After hold the columns
+// the write touched; Before is left out for blind writes, where we never read
+// the old values.
+type AuditRecord struct {
+	Time      time.Time              `json:"time"`
+	Principal string                 `json:"principal"`
+	Action    string                 `json:"action"`
+	Table     string                 `json:"table"`
+	Key       spanner.Key            `json:"key"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty"`
+}
+
+type auditSink interface {
+	write(ctx context.Context, recs []AuditRecord) error
+}
+
+// auditLog records every write made through the data functions. Reads are
+// never audited. A nil *auditLog is valid and records nothing, which is what
+// we use when auditing is disabled.
+type auditLog struct {
+	sink auditSink
+}
+
+func newAuditLog(sink string, client *spanner.Client) (*auditLog, error) {
+	switch sink {
+	case "":
+		return nil, nil
+	case AuditSinkStdout:
+		return &auditLog{sink: &jsonAuditSink{w: os.Stdout}}, nil
+	case AuditSinkSpanner:
+		return &auditLog{sink: &spannerAuditSink{client: client}}, nil
+	}
+	return nil, fmt.Errorf("invalid audit sink %q, expected %s or %s", sink, AuditSinkStdout, AuditSinkSpanner)
+}
+
+// auditTimeout bounds writing out the records for one write.
+const auditTimeout = 10 * time.Second
+
+// record stamps recs with the time and the principal from ctx and writes them
+// out. It's called after the write has committed, so a failure here can't undo
+// the write; we log it loudly instead. For the same reason the records are
+// written on a context of their own, which keeps only the principal from ctx:
+// a client that hangs up once its write has committed mustn't cancel the
+// write's audit trail.
+func (a *auditLog) record(ctx context.Context, recs ...AuditRecord) {
+	if a == nil || len(recs) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	principal := principalName(ctx)
+	for i := range recs {
+		recs[i].Time = now
+		recs[i].Principal = principal
+	}
+
+	ctx, cancel := context.WithTimeout(withPrincipal(context.Background(), principalFromContext(ctx)), auditTimeout)
+	defer cancel()
+
+	if err := a.sink.write(ctx, recs); err != nil {
+		log.Printf("Error: writing %d audit records: %s", len(recs), err.Error())
+	}
+}
+
+// jsonAuditSink writes one JSON object per line.
+type jsonAuditSink struct {
+	w io.Writer
+}
+
+func (s *jsonAuditSink) write(ctx context.Context, recs []AuditRecord) error {
+	enc := json.NewEncoder(s.w)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spannerAuditSink writes records to the AuditLog table.
+type spannerAuditSink struct {
+	client *spanner.Client
+}
+
+func (s *spannerAuditSink) write(ctx context.Context, recs []AuditRecord) error {
+	cols := []string{"AuditId", "Time", "Principal", "Action", "TableName", "RowKey", "Before", "After"}
+
+	m := make([]*spanner.Mutation, 0, len(recs))
+	for _, rec := range recs {
+		id, err := newAuditID()
+		if err != nil {
+			return err
+		}
+
+		key, _ := json.Marshal(rec.Key)
+		before, err := auditColumns(rec.Before)
+		if err != nil {
+			return err
+		}
+		after, err := auditColumns(rec.After)
+		if err != nil {
+			return err
+		}
+
+		m = append(m, spanner.Insert("AuditLog", cols, []interface{}{
+			id, rec.Time, rec.Principal, rec.Action, rec.Table, string(key), before, after,
+		}))
+	}
+
+	_, err := s.client.Apply(ctx, m, applyOptions("audit")...)
+	return err
+}
+
+func auditColumns(cols map[string]interface{}) (spanner.NullString, error) {
+	if cols == nil {
+		return spanner.NullString{}, nil
+	}
+	b, err := json.Marshal(cols)
+	if err != nil {
+		return spanner.NullString{}, err
+	}
+	return nullString(string(b)), nil
+}
+
+// newAuditID returns a random hex ID, so audit rows don't hotspot on a
+// monotonically increasing key.
+func newAuditID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func singerAudit(action string, s *Singer) AuditRecord {
+	return AuditRecord{
+		Action: action,
+		Table:  "Singers",
+		Key:    spanner.Key{s.SingerID},
+		After: map[string]interface{}{
+			"FirstName": s.FirstName,
+			"LastName":  s.LastName,
+		},
+	}
+}
+
+func albumAudit(action string, a *Album) AuditRecord {
+	after := map[string]interface{}{
+		"AlbumTitle": a.AlbumTitle,
+	}
+	if a.MarketingBudget.Valid {
+		after["MarketingBudget"] = a.MarketingBudget
+	}
+
+	return AuditRecord{
+		Action: action,
+		Table:  "Albums",
+		Key:    spanner.Key{a.SingerID, a.AlbumID},
+		After:  after,
+	}
+}
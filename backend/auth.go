@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AuthModeAPIKey = "apikey"
+	AuthModeJWT    = "jwt"
+
+	apiKeyHeader = "X-API-Key"
+)
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal is who a request was made by.
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// Authenticator works out who made a request. It returns an error wrapping
+// ErrUnauthenticated if the request has no valid credentials.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// withPrincipal attaches the principal responsible for a request, and so for
+// any writes made with ctx.
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns the principal set with withPrincipal, or nil.
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// principalName returns the name of the principal in ctx, or "system" for
+// writes we make ourselves, such as seeding at startup.
+func principalName(ctx context.Context) string {
+	if p := principalFromContext(ctx); p != nil && p.Name != "" {
+		return p.Name
+	}
+	return "system"
+}
+
+// newAuthenticator returns the Authenticator for mode, or nil if mode is
+// empty and requests aren't authenticated at all.
+func newAuthenticator(cfg Config) (Authenticator, error) {
+	switch cfg.AuthMode {
+	case "":
+		return nil, nil
+	case AuthModeAPIKey:
+		if len(cfg.AuthAPIKeys) == 0 {
+			return nil, errors.New("apikey auth needs at least one key in AUTH_API_KEYS")
+		}
+		return &apiKeyAuthenticator{keys: cfg.AuthAPIKeys, roles: cfg.AuthAPIKeyRoles}, nil
+	case AuthModeJWT:
+		return newJWTAuthenticator(cfg.AuthJWTAlg, cfg.AuthJWTSecret, cfg.AuthJWTPublicKeyFile)
+	}
+	return nil, fmt.Errorf("invalid auth mode %q, expected %s or %s", cfg.AuthMode, AuthModeAPIKey, AuthModeJWT)
+}
+
+// authMiddleware authenticates every request except those to public paths,
+// such as probes, and answers 401 if that fails. A nil Authenticator lets
+// everything through.
+func authMiddleware(auth Authenticator, public []string) func(http.Handler) http.Handler {
+	open := make(map[string]bool, len(public))
+	for _, p := range public {
+		open[p] = true
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth == nil || open[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			p, err := auth.Authenticate(r)
+			if err != nil {
+				writeJSONError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// apiKeyAuthenticator accepts a static API key in the X-API-Key header. keys
+// maps each principal's name to their key, and roles to their space-separated
+// roles.
+type apiKeyAuthenticator struct {
+	keys  map[string]string
+	roles map[string]string
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, fmt.Errorf("%w: missing %s header", ErrUnauthenticated, apiKeyHeader)
+	}
+
+	// Compare against every key so the time taken doesn't give away which
+	// one nearly matched.
+	var name string
+	for n, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: invalid API key", ErrUnauthenticated)
+	}
+
+	return &Principal{Name: name, Roles: strings.Fields(a.roles[name])}, nil
+}
+
+// jwtAuthenticator accepts a bearer JWT signed with HS256 or RS256. Only the
+// configured algorithm is accepted, whatever the token's header says, and the
+// token must carry an exp claim so it can't be used forever. The principal is
+// the sub claim, with roles taken from the roles claim.
+type jwtAuthenticator struct {
+	alg    string
+	secret []byte
+	key    *rsa.PublicKey
+}
+
+func newJWTAuthenticator(alg, secret, publicKeyFile string) (*jwtAuthenticator, error) {
+	switch alg {
+	case "HS256":
+		if secret == "" {
+			return nil, errors.New("HS256 JWT auth needs AUTH_JWT_SECRET")
+		}
+		return &jwtAuthenticator{alg: alg, secret: []byte(secret)}, nil
+	case "RS256":
+		key, err := readRSAPublicKey(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &jwtAuthenticator{alg: alg, key: key}, nil
+	}
+	return nil, fmt.Errorf("invalid JWT algorithm %q, expected HS256 or RS256", alg)
+}
+
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWT public key: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWT public key: %w", err)
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("JWT public key in %s isn't an RSA key", path)
+	}
+
+	return key, nil
+}
+
+type jwtClaims struct {
+	Sub   string   `json:"sub"`
+	Exp   *float64 `json:"exp"`
+	Nbf   *float64 `json:"nbf"`
+	Roles []string `json:"roles"`
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, err.Error())
+	}
+
+	return &Principal{Name: claims.Sub, Roles: claims.Roles}, nil
+}
+
+func (a *jwtAuthenticator) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != a.alg {
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch a.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	case "RS256":
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(a.key, crypto.SHA256, sum[:], sig); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	unix := float64(now.Unix())
+	if claims.Exp == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if unix >= *claims.Exp {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != nil && unix < *claims.Nbf {
+		return nil, errors.New("token not valid yet")
+	}
+	if claims.Sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "test-secret"
+
+// signJWT builds a token with alg in its header, signed with key: a []byte
+// secret for HS256 or an *rsa.PrivateKey for RS256. Any other key leaves the
+// signature empty.
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	part := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := part(map[string]string{"alg": alg, "typ": "JWT"}) + "." + part(claims)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claimsFor returns valid claims for sub, expiring in an hour.
+func claimsFor(sub string, roles ...string) map[string]interface{} {
+	return map[string]interface{}{"sub": sub, "exp": time.Now().Add(time.Hour).Unix(), "roles": roles}
+}
+
+// writeRSAPublicKey writes key's public half to a PEM file and returns its path.
+func writeRSAPublicKey(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveAuth sends r through authMiddleware and returns the response, along
+// with the principal the handler saw, if it was reached.
+func serveAuth(auth Authenticator, r *http.Request) (*httptest.ResponseRecorder, *Principal) {
+	var got *Principal
+	h := authMiddleware(auth, []string{"/healthz"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = principalFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w, got
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	auth := &apiKeyAuthenticator{
+		keys:  map[string]string{"ci": "ci-key", "ops": "ops-key"},
+		roles: map[string]string{"ops": "admin reader"},
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		key       string
+		wantCode  int
+		wantName  string
+		wantRoles []string
+	}{
+		{name: "valid key", path: "/albums", key: "ci-key", wantCode: http.StatusOK, wantName: "ci"},
+		{name: "roles", path: "/albums", key: "ops-key", wantCode: http.StatusOK, wantName: "ops", wantRoles: []string{"admin", "reader"}},
+		{name: "wrong key", path: "/albums", key: "nope", wantCode: http.StatusUnauthorized},
+		{name: "key prefix", path: "/albums", key: "ci-ke", wantCode: http.StatusUnauthorized},
+		{name: "missing key", path: "/albums", wantCode: http.StatusUnauthorized},
+		{name: "public path", path: "/healthz", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.key != "" {
+				r.Header.Set(apiKeyHeader, tt.key)
+			}
+
+			w, p := serveAuth(auth, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantName == "" {
+				if p != nil {
+					t.Errorf("handler saw principal %+v, want none", p)
+				}
+				return
+			}
+			if p == nil || p.Name != tt.wantName || strings.Join(p.Roles, " ") != strings.Join(tt.wantRoles, " ") {
+				t.Errorf("principal = %+v, want %s with roles %v", p, tt.wantName, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey := mustRSAKey(t)
+	hs256, err := newJWTAuthenticator("HS256", testJWTSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256, err := newJWTAuthenticator("RS256", "", writeRSAPublicKey(t, rsaKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte(testJWTSecret)
+	hour := time.Hour
+	at := func(d time.Duration) int64 { return time.Now().Add(d).Unix() }
+
+	tests := []struct {
+		name     string
+		auth     Authenticator
+		header   string
+		wantCode int
+		wantName string
+		wantErr  string
+	}{
+		{name: "HS256", auth: hs256, header: "Bearer " + signJWT(t, "HS256", secret, claimsFor("alice", "admin")), wantCode: http.StatusOK, wantName: "alice"},
+		{name: "RS256", auth: rs256, header: "Bearer " + signJWT(t, "RS256", rsaKey, claimsFor("bob")), wantCode: http.StatusOK, wantName: "bob"},
+		{name: "wrong secret", auth: hs256, header: "Bearer " + signJWT(t, "HS256", []byte("other"), claimsFor("alice")), wantCode: http.StatusUnauthorized, wantErr: "invalid signature"},
+		{name: "wrong RSA key", auth: rs256, header: "Bearer " + signJWT(t, "RS256", mustRSAKey(t), claimsFor("bob")), wantCode: http.StatusUnauthorized, wantErr: "invalid signature"},
+		{name: "alg none", auth: hs256, header: "Bearer " + signJWT(t, "none", nil, claimsFor("alice")), wantCode: http.StatusUnauthorized, wantErr: "unexpected algorithm"},
+		{name: "HS256 token for RS256", auth: rs256, header: "Bearer " + signJWT(t, "HS256", secret, claimsFor("bob")), wantCode: http.StatusUnauthorized, wantErr: "unexpected algorithm"},
+		{name: "RS256 token for HS256", auth: hs256, header: "Bearer " + signJWT(t, "RS256", rsaKey, claimsFor("alice")), wantCode: http.StatusUnauthorized, wantErr: "unexpected algorithm"},
+		{name: "expired", auth: hs256, header: "Bearer " + signJWT(t, "HS256", secret, map[string]interface{}{"sub": "alice", "exp": at(-hour)}), wantCode: http.StatusUnauthorized, wantErr: "token expired"},
+		{name: "no exp", auth: hs256, header: "Bearer " + signJWT(t, "HS256", secret, map[string]interface{}{"sub": "alice"}), wantCode: http.StatusUnauthorized, wantErr: "token has no expiry"},
+		{name: "not valid yet", auth: hs256, header: "Bearer " + signJWT(t, "HS256", secret, map[string]interface{}{"sub": "alice", "exp": at(2 * hour), "nbf": at(hour)}), wantCode: http.StatusUnauthorized, wantErr: "token not valid yet"},
+		{name: "no subject", auth: hs256, header: "Bearer " + signJWT(t, "HS256", secret, map[string]interface{}{"exp": at(hour)}), wantCode: http.StatusUnauthorized, wantErr: "token has no subject"},
+		{name: "malformed", auth: hs256, header: "Bearer abc.def", wantCode: http.StatusUnauthorized, wantErr: "malformed token"},
+		{name: "not bearer", auth: hs256, header: "Basic YWxpY2U6cHc=", wantCode: http.StatusUnauthorized, wantErr: "missing bearer token"},
+		{name: "missing", auth: hs256, wantCode: http.StatusUnauthorized, wantErr: "missing bearer token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/albums", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			w, p := serveAuth(tt.auth, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantErr != "" && !strings.Contains(w.Body.String(), tt.wantErr) {
+				t.Errorf("body = %s, want it to mention %q", w.Body, tt.wantErr)
+			}
+			if tt.wantName != "" && (p == nil || p.Name != tt.wantName) {
+				t.Errorf("principal = %+v, want %s", p, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	w, p := serveAuth(nil, httptest.NewRequest(http.MethodGet, "/albums", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if p != nil {
+		t.Errorf("handler saw principal %+v, want none", p)
+	}
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
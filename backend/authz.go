@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const AdminRole = "admin"
+
+func (p *Principal) hasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredRole returns the role a request needs. routeRoles overrides it per
+// route name; otherwise /admin routes need the admin role and everything else
+// is open to any authenticated principal.
+func requiredRole(r *http.Request, routeRoles map[string]string) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if role, ok := routeRoles[route.GetName()]; ok {
+			return role
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return AdminRole
+	}
+	return ""
+}
+
+// authzMiddleware answers 403 when the authenticated principal doesn't have
+// the role a route needs. It runs after authMiddleware; with authentication
+// switched off there's no principal, and nothing is checked.
+func authzMiddleware(enabled bool, routeRoles map[string]string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := requiredRole(r, routeRoles)
+			if !enabled || role == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			p := principalFromContext(r.Context())
+			if p == nil {
+				writeJSONError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			if !p.hasRole(role) {
+				writeJSONError(w, http.StatusForbidden, "requires role "+role)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
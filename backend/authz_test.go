@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newAuthzRouter returns a router with the auth middleware chain in front of
+// a few named routes, authenticating with API keys.
+func newAuthzRouter(routeRoles map[string]string) *mux.Router {
+	auth := &apiKeyAuthenticator{
+		keys:  map[string]string{"reader": "reader-key", "writer": "writer-key", "ops": "ops-key"},
+		roles: map[string]string{"writer": "writer", "ops": "admin"},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r := mux.NewRouter()
+	r.Use(authMiddleware(auth, []string{"/healthz"}), authzMiddleware(true, routeRoles))
+	r.Handle("/healthz", ok).Name("healthz")
+	r.Handle("/albums", ok).Methods(http.MethodGet).Name("albums.list")
+	r.Handle("/albums", ok).Methods(http.MethodPost).Name("albums.create")
+	r.Handle("/admin/flags", ok).Name("admin.flags")
+	r.Handle("/admin/status", ok).Name("admin.status")
+	return r
+}
+
+func TestAuthzMiddleware(t *testing.T) {
+	router := newAuthzRouter(map[string]string{
+		"albums.create": "writer",
+		"admin.status":  "",
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		key      string
+		wantCode int
+	}{
+		{name: "open route", method: http.MethodGet, path: "/albums", key: "reader-key", wantCode: http.StatusOK},
+		{name: "named route denied", method: http.MethodPost, path: "/albums", key: "reader-key", wantCode: http.StatusForbidden},
+		{name: "named route allowed", method: http.MethodPost, path: "/albums", key: "writer-key", wantCode: http.StatusOK},
+		{name: "admin route denied", method: http.MethodGet, path: "/admin/flags", key: "writer-key", wantCode: http.StatusForbidden},
+		{name: "admin route allowed", method: http.MethodGet, path: "/admin/flags", key: "ops-key", wantCode: http.StatusOK},
+		{name: "admin route opened by name", method: http.MethodGet, path: "/admin/status", key: "reader-key", wantCode: http.StatusOK},
+		{name: "unauthenticated", method: http.MethodPost, path: "/albums", wantCode: http.StatusUnauthorized},
+		{name: "public path", method: http.MethodGet, path: "/healthz", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.key != "" {
+				r.Header.Set(apiKeyHeader, tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("%s %s as %q: status = %d, want %d: %s", tt.method, tt.path, tt.key, w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthzMiddlewareNeedsPrincipal(t *testing.T) {
+	// A route needing a role, reached without authMiddleware having set a
+	// principal, is refused rather than let through.
+	h := authzMiddleware(true, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/flags", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthzMiddlewareDisabled(t *testing.T) {
+	h := authzMiddleware(false, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/flags", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// logConfig logs the run mode and every resolved config setting as key=value
+// pairs, so operators can check the configuration at a glance. Fields tagged
+// secret:"true" are redacted.
+func logConfig(cfg Config) {
+	mode := "cloud"
+	if host, ok := os.LookupEnv("SPANNER_EMULATOR_HOST"); ok {
+		mode = "emulator (" + host + ")"
+	}
+	if cfg.Datastore == DatastoreMemory {
+		mode = DatastoreMemory
+	}
+	log.Printf("Starting in %s mode", mode)
+
+	v := reflect.ValueOf(cfg)
+	t := v.Type()
+
+	var pairs []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		val := fmt.Sprint(v.Field(i).Interface())
+		if f.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			val = "<redacted>"
+		}
+
+		pairs = append(pairs, f.Name+"="+quoteIfNeeded(val))
+	}
+
+	log.Printf("Config: %s", strings.Join(pairs, " "))
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
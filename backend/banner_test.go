@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the standard logger's output to the returned buffer until
+// the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestLogConfig(t *testing.T) {
+	t.Setenv("SPANNER_EMULATOR_HOST", "localhost:9010")
+	out := captureLog(t)
+
+	logConfig(Config{
+		GCloudProject:     "my-project",
+		SpannerInstanceID: "test instance",
+		SpannerDatabaseID: "albums",
+		MySQLDSN:          "user:hunter2@tcp(db:3306)/albums",
+		AuthJWTSecret:     "s3cret",
+	})
+	got := out.String()
+
+	for _, want := range []string{
+		"Starting in emulator (localhost:9010) mode\n",
+		"GCloudProject=my-project ",
+		`SpannerInstanceID="test instance" `,
+		"SpannerDatabaseID=albums ",
+		"MySQLDSN=<redacted> ",
+		"AuthJWTSecret=<redacted>",
+		// Unset secrets show as unset rather than redacted.
+		"AuthAPIKeys=map[] ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("banner doesn't have %q:\n%s", want, got)
+		}
+	}
+	for _, secret := range []string{"hunter2", "s3cret"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("banner gives away %q:\n%s", secret, got)
+		}
+	}
+}
+
+func TestLogConfigCloudMode(t *testing.T) {
+	withoutEmulator(t)
+	out := captureLog(t)
+
+	logConfig(Config{})
+	if !strings.HasPrefix(out.String(), "Starting in cloud mode\n") {
+		t.Errorf("banner = %q, want it to start with the cloud mode", out)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+)
+
+// bootstrapSteps holds how long each startup step took and whether it worked,
+// so slow steps can be compared across deployments.
+var bootstrapSteps = expvar.NewMap("bootstrap")
+
+type stepTiming struct {
+	DurationMs float64 `json:"duration_ms"`
+	OK         bool    `json:"ok"`
+}
+
+func (t stepTiming) String() string {
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+// timeStep runs a startup step, recording and logging its duration.
+func timeStep(name string, step func() error) error {
+	start := time.Now()
+	err := step()
+	d := time.Since(start)
+
+	bootstrapSteps.Set(name, stepTiming{
+		DurationMs: float64(d) / float64(time.Millisecond),
+		OK:         err == nil,
+	})
+
+	status := "done"
+	if err != nil {
+		status = "failed"
+	}
+	log.Printf("Bootstrap step %s %s in %s", name, status, d)
+
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+)
+
+// TestTimeStep runs the bootstrap steps with stand-ins and checks each one's
+// timing and outcome ends up in the bootstrap expvar.
+func TestTimeStep(t *testing.T) {
+	bootstrapSteps.Init()
+	t.Cleanup(func() { bootstrapSteps.Init() })
+
+	errSeed := errors.New("seed failed")
+	steps := []struct {
+		name string
+		err  error
+	}{
+		{name: "create_instance"},
+		{name: "create_database"},
+		{name: "migrate"},
+		{name: "seed", err: errSeed},
+		{name: "update_budgets"},
+		{name: "transfer_budgets"},
+	}
+
+	const stepTime = 5 * time.Millisecond
+	for _, s := range steps {
+		err := timeStep(s.name, func() error {
+			time.Sleep(stepTime)
+			return s.err
+		})
+		if err != s.err {
+			t.Errorf("timeStep(%s) = %v, want the step's own error %v", s.name, err, s.err)
+		}
+	}
+
+	// Read back the way /debug/vars serves it.
+	var got map[string]stepTiming
+	if err := json.Unmarshal([]byte(expvar.Get("bootstrap").String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(steps) {
+		t.Errorf("%d steps recorded, want %d: %v", len(got), len(steps), got)
+	}
+	for _, s := range steps {
+		timing, ok := got[s.name]
+		if !ok {
+			t.Errorf("no timing for %s", s.name)
+			continue
+		}
+		if timing.OK != (s.err == nil) {
+			t.Errorf("%s: ok = %v, want %v", s.name, timing.OK, s.err == nil)
+		}
+		if timing.DurationMs < float64(stepTime)/float64(time.Millisecond) {
+			t.Errorf("%s: took %vms, want at least %s", s.name, timing.DurationMs, stepTime)
+		}
+	}
+}
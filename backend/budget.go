@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// How a NULL MarketingBudget is rendered in responses. null is the default and
+// the only one that tells "no budget set" apart from a budget of 0; zero and
+// omit are for clients that can't handle JSON null, and lose that distinction.
+const (
+	NullBudgetNull = "null"
+	NullBudgetZero = "zero"
+	NullBudgetOmit = "omit"
+)
+
+// nullBudget is set once from config at startup.
+var nullBudget = NullBudgetNull
+
+func setNullBudget(mode string, projection bool) error {
+	switch mode {
+	case NullBudgetNull, NullBudgetZero:
+	case NullBudgetOmit:
+		// TO_JSON_STRING always writes every field of the struct.
+		if projection {
+			return errors.New("null budget mode omit can't be used with JSON projection")
+		}
+	default:
+		return fmt.Errorf("invalid null budget mode %q, expected %s, %s or %s", mode, NullBudgetNull, NullBudgetZero, NullBudgetOmit)
+	}
+	nullBudget = mode
+	return nil
+}
+
+// jsonBudgetColumn renders the MarketingBudget column in the configured null
+// budget mode when Spanner serializes it with TO_JSON_STRING.
+func jsonBudgetColumn(col string) string {
+	if nullBudget == NullBudgetZero {
+		return "IFNULL(" + col + ", 0)"
+	}
+	return col
+}
+
+func (a Album) MarshalJSON() ([]byte, error) {
+	// album has Album's fields but not this method, so marshaling it doesn't
+	// recurse.
+	type album Album
+
+	if a.MarketingBudget.Valid || nullBudget == NullBudgetNull {
+		return json.Marshal(album(a))
+	}
+
+	if nullBudget == NullBudgetZero {
+		a.MarketingBudget.Valid = true
+		return json.Marshal(album(a))
+	}
+
+	// The outer field hides the embedded one, and omitempty drops it.
+	return json.Marshal(struct {
+		album
+		MarketingBudget *int64 `json:"marketing_budget,omitempty"`
+	}{album: album(a)})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+)
+
+// withNullBudget sets the null budget mode for the rest of the test.
+func withNullBudget(t *testing.T, mode string) {
+	t.Helper()
+
+	prev := nullBudget
+	if err := setNullBudget(mode, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nullBudget = prev })
+}
+
+func TestSetNullBudget(t *testing.T) {
+	tests := []struct {
+		mode       string
+		projection bool
+		wantErr    bool
+	}{
+		{mode: NullBudgetNull},
+		{mode: NullBudgetNull, projection: true},
+		{mode: NullBudgetZero},
+		{mode: NullBudgetZero, projection: true},
+		{mode: NullBudgetOmit},
+		{mode: NullBudgetOmit, projection: true, wantErr: true},
+		{mode: "", wantErr: true},
+		{mode: "empty", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		prev := nullBudget
+		err := setNullBudget(tt.mode, tt.projection)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("setNullBudget(%q, %v): %v, want error %v", tt.mode, tt.projection, err, tt.wantErr)
+		}
+		if err != nil && nullBudget != prev {
+			t.Errorf("setNullBudget(%q, %v) failed but changed the mode to %q", tt.mode, tt.projection, nullBudget)
+		}
+		nullBudget = prev
+	}
+}
+
+func TestAlbumMarshalJSONNullBudget(t *testing.T) {
+	withTimeFormat(t, TimeFormatRFC3339)
+
+	unset := Album{SingerID: 1, AlbumID: 2}
+	set := Album{SingerID: 1, AlbumID: 2, MarketingBudget: spanner.NullInt64{Int64: 500, Valid: true}}
+
+	tests := []struct {
+		mode      string
+		album     Album
+		want      string
+		wantQuery string
+	}{
+		{
+			mode:      NullBudgetNull,
+			album:     unset,
+			want:      `{"singer_id":1,"album_id":2,"album_title":null,"marketing_budget":null,"last_update_time":null}`,
+			wantQuery: "MarketingBudget",
+		},
+		{
+			mode:      NullBudgetZero,
+			album:     unset,
+			want:      `{"singer_id":1,"album_id":2,"album_title":null,"marketing_budget":0,"last_update_time":null}`,
+			wantQuery: "IFNULL(MarketingBudget, 0)",
+		},
+		{
+			mode:      NullBudgetOmit,
+			album:     unset,
+			want:      `{"singer_id":1,"album_id":2,"album_title":null,"last_update_time":null}`,
+			wantQuery: "MarketingBudget",
+		},
+		{
+			mode:  NullBudgetNull,
+			album: set,
+			want:  `{"singer_id":1,"album_id":2,"album_title":null,"marketing_budget":500,"last_update_time":null}`,
+		},
+		{
+			mode:  NullBudgetZero,
+			album: set,
+			want:  `{"singer_id":1,"album_id":2,"album_title":null,"marketing_budget":500,"last_update_time":null}`,
+		},
+		{
+			mode:  NullBudgetOmit,
+			album: set,
+			want:  `{"singer_id":1,"album_id":2,"album_title":null,"marketing_budget":500,"last_update_time":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			withNullBudget(t, tt.mode)
+
+			b, err := json.Marshal(tt.album)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("got %s, want %s", b, tt.want)
+			}
+
+			// A pointer marshals the same way.
+			b, err = json.Marshal(&tt.album)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("pointer: got %s, want %s", b, tt.want)
+			}
+
+			if tt.wantQuery != "" {
+				if got := jsonBudgetColumn("MarketingBudget"); got != tt.wantQuery {
+					t.Errorf("jsonBudgetColumn = %q, want %q", got, tt.wantQuery)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cacheStats = expvar.NewMap("cache")
+
+// responseCache is a small in-memory TTL cache for read endpoints, keyed by the
+// endpoint and its query parameters. A nil *responseCache is valid and caches
+// nothing, which is what we use when caching is disabled.
+//
+// Entries are kept for a further stale period after they expire so they can
+// still be served, marked as stale, if a fresh read fails.
+//
+// Every invalidation bumps gen. A read that started before one may have seen
+// the data from before the write, so fetch drops its result rather than
+// caching it over the invalidation.
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	stale   time.Duration
+	maxSize int
+	entries map[string]cacheEntry
+	gen     uint64
+
+	// now is the clock, swapped out in tests.
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newResponseCache(ttl, stale time.Duration, maxSize int) *responseCache {
+	if ttl <= 0 || maxSize <= 0 {
+		return nil
+	}
+	return &responseCache{
+		ttl:     ttl,
+		stale:   stale,
+		maxSize: maxSize,
+		entries: make(map[string]cacheEntry),
+		now:     time.Now,
+	}
+}
+
+func (c *responseCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || c.now().After(e.expires) {
+		cacheStats.Add("misses", 1)
+		return nil, false
+	}
+
+	cacheStats.Add("hits", 1)
+	return e.value, true
+}
+
+// getStale returns an entry that's expired but still within the stale period.
+func (c *responseCache) getStale(key string) (interface{}, bool) {
+	if c == nil || c.stale <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || c.now().After(e.expires.Add(c.stale)) {
+		return nil, false
+	}
+
+	cacheStats.Add("stale_hits", 1)
+	return e.value, true
+}
+
+func (c *responseCache) set(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setLocked(key, value)
+}
+
+// generation returns the current generation, to pass to setIfCurrent.
+func (c *responseCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// setIfCurrent caches value unless the cache has been invalidated since gen,
+// in which case value may be out of date and is dropped.
+func (c *responseCache) setIfCurrent(key string, value interface{}, gen uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		cacheStats.Add("dropped_fills", 1)
+		return
+	}
+	c.setLocked(key, value)
+}
+
+func (c *responseCache) setLocked(key string, value interface{}) {
+	now := c.now()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		// Make room by dropping entries that are past their stale period, or
+		// failing that the entry closest to expiring.
+		var oldest string
+		for k, e := range c.entries {
+			if now.After(e.expires.Add(c.stale)) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.maxSize {
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+// fetch returns key's value from the cache, or else from load, caching what
+// load returns unless the cache was invalidated while it ran. If load fails
+// and there's an entry still within its stale period, that's returned with
+// stale set, along with load's error for the caller to log.
+func (c *responseCache) fetch(key string, load func() (interface{}, error)) (v interface{}, stale bool, err error) {
+	if v, ok := c.get(key); ok {
+		return v, false, nil
+	}
+
+	gen := c.generation()
+	v, err = load()
+	if err != nil {
+		if v, ok := c.getStale(key); ok {
+			return v, true, err
+		}
+		return nil, false, err
+	}
+
+	c.setIfCurrent(key, v, gen)
+	return v, false, nil
+}
+
+// invalidate drops every entry whose key starts with prefix. Write paths call
+// this for the endpoints whose results they change.
+func (c *responseCache) invalidate(prefix string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for k := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.entries, k)
+		}
+	}
+	cacheStats.Add("invalidations", 1)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests move by hand.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestCache(ttl, stale time.Duration, maxSize int) (*responseCache, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)}
+	c := newResponseCache(ttl, stale, maxSize)
+	c.now = clock.now
+	return c, clock
+}
+
+func TestResponseCacheGet(t *testing.T) {
+	const ttl, stale = time.Minute, 5 * time.Minute
+
+	tests := []struct {
+		name      string
+		set       []string
+		advance   time.Duration
+		get       string
+		wantHit   bool
+		wantStale bool
+	}{
+		{name: "hit", set: []string{"/albums?a=1"}, get: "/albums?a=1", wantHit: true, wantStale: true},
+		{name: "miss", set: []string{"/albums?a=1"}, get: "/albums?a=2"},
+		{name: "empty", get: "/albums"},
+		{name: "just before expiry", set: []string{"/albums"}, advance: ttl, get: "/albums", wantHit: true, wantStale: true},
+		{name: "expired but stale", set: []string{"/albums"}, advance: ttl + time.Second, get: "/albums", wantStale: true},
+		{name: "past stale period", set: []string{"/albums"}, advance: ttl + stale + time.Second, get: "/albums"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, clock := newTestCache(ttl, stale, 10)
+			for _, k := range tt.set {
+				c.set(k, k)
+			}
+			clock.advance(tt.advance)
+
+			v, ok := c.get(tt.get)
+			if ok != tt.wantHit {
+				t.Errorf("get(%q) hit = %v, want %v", tt.get, ok, tt.wantHit)
+			}
+			if ok && v != tt.get {
+				t.Errorf("get(%q) = %v, want %v", tt.get, v, tt.get)
+			}
+
+			if _, ok := c.getStale(tt.get); ok != tt.wantStale {
+				t.Errorf("getStale(%q) hit = %v, want %v", tt.get, ok, tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestResponseCacheInvalidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   map[string]bool
+	}{
+		{
+			name:   "prefix",
+			prefix: "/albums",
+			want:   map[string]bool{"/albums": false, "/albums?singer_id=1": false, "/albums/top": false, "/singers/1": true},
+		},
+		{
+			name:   "exact key only",
+			prefix: "/singers/1",
+			want:   map[string]bool{"/albums": true, "/albums?singer_id=1": true, "/albums/top": true, "/singers/1": false},
+		},
+		{
+			name:   "no match",
+			prefix: "/admin",
+			want:   map[string]bool{"/albums": true, "/albums?singer_id=1": true, "/albums/top": true, "/singers/1": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestCache(time.Minute, time.Minute, 10)
+			for k := range tt.want {
+				c.set(k, k)
+			}
+
+			c.invalidate(tt.prefix)
+
+			for k, want := range tt.want {
+				if _, ok := c.get(k); ok != want {
+					t.Errorf("after invalidate(%q), get(%q) hit = %v, want %v", tt.prefix, k, ok, want)
+				}
+				// Invalidated entries can't be served stale either.
+				if _, ok := c.getStale(k); ok != want {
+					t.Errorf("after invalidate(%q), getStale(%q) hit = %v, want %v", tt.prefix, k, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseCacheEvictsWhenFull(t *testing.T) {
+	c, clock := newTestCache(time.Minute, 0, 2)
+
+	c.set("a", 1)
+	clock.advance(time.Second)
+	c.set("b", 2)
+	clock.advance(time.Second)
+	c.set("c", 3)
+
+	if _, ok := c.get("a"); ok {
+		t.Error("a, the entry closest to expiring, wasn't evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+}
+
+func TestResponseCacheFetch(t *testing.T) {
+	const ttl, stale = time.Minute, 5 * time.Minute
+	errSpanner := errors.New("spanner unavailable")
+
+	tests := []struct {
+		name      string
+		cached    bool
+		advance   time.Duration
+		loadErr   error
+		wantLoads int
+		want      interface{}
+		wantStale bool
+		wantErr   bool
+	}{
+		{name: "fresh", cached: true, loadErr: errSpanner, want: "cached"},
+		{name: "expired, load ok", cached: true, advance: ttl + time.Second, wantLoads: 1, want: "loaded"},
+		// The read failed after the entry expired: the stale entry is
+		// served instead of an error.
+		{name: "expired, load fails", cached: true, advance: ttl + time.Second, loadErr: errSpanner, wantLoads: 1, want: "cached", wantStale: true, wantErr: true},
+		{name: "past stale period", cached: true, advance: ttl + stale + time.Second, loadErr: errSpanner, wantLoads: 1, wantErr: true},
+		{name: "nothing cached", loadErr: errSpanner, wantLoads: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, clock := newTestCache(ttl, stale, 10)
+			if tt.cached {
+				c.set("/albums", "cached")
+			}
+			clock.advance(tt.advance)
+
+			loads := 0
+			v, isStale, err := c.fetch("/albums", func() (interface{}, error) {
+				loads++
+				if tt.loadErr != nil {
+					return nil, tt.loadErr
+				}
+				return "loaded", nil
+			})
+
+			if loads != tt.wantLoads {
+				t.Errorf("loaded %d times, want %d", loads, tt.wantLoads)
+			}
+			if v != tt.want {
+				t.Errorf("got %v, want %v", v, tt.want)
+			}
+			if isStale != tt.wantStale {
+				t.Errorf("stale = %v, want %v", isStale, tt.wantStale)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestResponseCacheFetchDuringInvalidate checks a read that was in flight
+// when a write invalidated the cache doesn't cache what it read, which may be
+// from before the write.
+func TestResponseCacheFetchDuringInvalidate(t *testing.T) {
+	c, _ := newTestCache(time.Minute, time.Minute, 10)
+
+	v, _, err := c.fetch("/albums", func() (interface{}, error) {
+		// The write lands and invalidates while the read is running.
+		c.invalidate("/albums")
+		return "before the write", nil
+	})
+	if err != nil || v != "before the write" {
+		t.Fatalf("fetch = %v, %v", v, err)
+	}
+	if v, ok := c.get("/albums"); ok {
+		t.Errorf("read from before the invalidation was cached: %v", v)
+	}
+
+	// The next read isn't overtaken by a write and is cached as usual.
+	c.fetch("/albums", func() (interface{}, error) { return "after the write", nil })
+	if v, ok := c.get("/albums"); !ok || v != "after the write" {
+		t.Errorf("get = %v, %v; want the read from after the write", v, ok)
+	}
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	for _, c := range []*responseCache{newResponseCache(0, time.Minute, 10), newResponseCache(time.Minute, time.Minute, 0)} {
+		c.set("/albums", 1)
+		if _, ok := c.get("/albums"); ok {
+			t.Error("disabled cache returned a hit")
+		}
+		c.invalidate("/albums")
+	}
+}
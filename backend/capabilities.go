@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// Features that not every Spanner backend supports.
+const (
+	FeatureBackups = "backups"
+)
+
+// emulatorUnsupported lists the features the emulator doesn't implement, with
+// the reason we give callers.
+var emulatorUnsupported = map[string]string{
+	FeatureBackups: "backups are not supported by the Spanner emulator",
+}
+
+// checkSupported returns an ErrUnsupported error if feature isn't available on
+// the Spanner we're talking to. Anything relying on such a feature should
+// check here first rather than let it fail with whatever the backend returns.
+func checkSupported(feature string) error {
+	if !usingEmulator() {
+		return nil
+	}
+	if reason, ok := emulatorUnsupported[feature]; ok {
+		return fmt.Errorf("%w: %s", ErrUnsupported, reason)
+	}
+	return nil
+}
+
+// checkCommitTimestamps confirms that a PENDING_COMMIT_TIMESTAMP() write lands
+// as the transaction's commit timestamp. The emulator has differed from
+// Spanner here before, and when it does everything ordered or synced by
+// LastUpdateTime misbehaves in ways that are hard to trace back, so it's
+// checked once at startup against a seeded album. This bumps that album's
+// LastUpdateTime.
+func checkCommitTimestamps(ctx context.Context, client *spanner.Client) (err error) {
+	defer func() { err = spannerError(err) }()
+
+	var ts time.Time
+
+	ts, err = readWriteTransaction(ctx, client, "checkCommitTimestamps", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		_, err := txn.Update(ctx, spanner.Statement{
+			SQL: sqlTouchAlbums,
+			Params: map[string]interface{}{
+				"SingerIds": []int64{1},
+				"AlbumIds":  []int64{1},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	var row *spanner.Row
+	if row, err = client.Single().ReadRow(ctx, "Albums", spanner.Key{1, 1}, []string{"LastUpdateTime"}); err != nil {
+		return
+	}
+
+	var got spanner.NullTime
+	if err = row.Column(0, &got); err != nil {
+		return
+	}
+	if !got.Valid || !got.Time.Equal(ts) {
+		err = fmt.Errorf("commit timestamp write stored %s, but the transaction committed at %s", got, ts.UTC().Format(time.RFC3339Nano))
+	}
+	return
+}
+
+// checkEmulatorCommitTimestamps runs check, normally checkCommitTimestamps,
+// when we're on the emulator, and reports whether it ran. Spanner itself isn't
+// checked. A failure is only logged: the emulator is for development, and a
+// clear warning there beats a test failing somewhere further on.
+func checkEmulatorCommitTimestamps(check func() error) bool {
+	if !usingEmulator() {
+		return false
+	}
+
+	log.Print("Checking emulator commit timestamps ...")
+	if err := check(); err != nil {
+		log.Printf("Warning: the emulator isn't writing commit timestamps as Spanner would, so "+
+			"LastUpdateTime ordering, ?since syncs and Last-Modified may be off: %s", err.Error())
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// TestCheckEmulatorCommitTimestamps checks the startup commit timestamp check
+// runs only on the emulator, and that a failing check doesn't stop startup.
+func TestCheckEmulatorCommitTimestamps(t *testing.T) {
+	tests := []struct {
+		name     string
+		emulator bool
+		err      error
+		wantRun  bool
+	}{
+		{name: "spanner", emulator: false, wantRun: false},
+		{name: "emulator", emulator: true, wantRun: true},
+		{name: "emulator failing", emulator: true, err: errors.New("stored NULL"), wantRun: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Setenv restores the variable afterwards, even if it's then unset.
+			t.Setenv("SPANNER_EMULATOR_HOST", "localhost:9010")
+			if !tt.emulator {
+				os.Unsetenv("SPANNER_EMULATOR_HOST")
+			}
+
+			called := false
+			ran := checkEmulatorCommitTimestamps(func() error {
+				called = true
+				return tt.err
+			})
+
+			if ran != tt.wantRun || called != tt.wantRun {
+				t.Errorf("ran = %v, check called = %v, want %v", ran, called, tt.wantRun)
+			}
+		})
+	}
+}
+
+func TestCheckCommitTimestamps(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1})
+
+	if err := checkCommitTimestamps(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+}
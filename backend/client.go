@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+const (
+	clientRetryBaseDelay = 500 * time.Millisecond
+	clientRetryMaxDelay  = 10 * time.Second
+)
+
+// newClientWithRetry creates a Spanner client, retrying with exponential
+// backoff up to attempts times. Creating a client doesn't talk to Spanner, but
+// it does fetch credentials, which can fail for a while after boot on GCP
+// until the metadata server is ready.
+func newClientWithRetry(ctx context.Context, dbPath string, attempts int) (client *spanner.Client, err error) {
+	err = retryClientCreation(ctx, attempts, clientRetryBaseDelay, func() (err error) {
+		client, err = spanner.NewClient(ctx, dbPath, spannerOptions...)
+		return
+	})
+	return
+}
+
+// retryClientCreation runs create until it succeeds or has failed attempts
+// times, waiting delay after the first failure and twice as long after each
+// one after that, up to clientRetryMaxDelay.
+func retryClientCreation(ctx context.Context, attempts int, delay time.Duration, create func() error) error {
+	for i := 1; ; i++ {
+		err := create()
+		if err == nil {
+			return nil
+		}
+		if i >= attempts {
+			return fmt.Errorf("creating Spanner client, giving up after %d attempts: %w", i, err)
+		}
+
+		log.Printf("Creating Spanner client failed (attempt %d/%d), retrying in %s: %s", i, attempts, delay, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > clientRetryMaxDelay {
+			delay = clientRetryMaxDelay
+		}
+	}
+}
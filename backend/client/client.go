@@ -0,0 +1,336 @@
+// Package client is a Go client for the backend's REST API.
+//
+//	c := client.New("http://localhost:8080", client.WithTimeout(5*time.Second))
+//	page, err := c.ListAlbums(ctx, client.ListAlbumsOptions{SingerIDs: []int64{1}})
+//	if errors.Is(err, client.ErrUnavailable) { ... }
+//
+// Non-2xx responses are returned as an *APIError, which matches the Err*
+// values with errors.Is. Idempotent requests that fail with 502, 503, 504 or
+// a network error are retried; see WithRetries.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 30 * time.Second
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+	apiKey  string
+
+	attempts  int
+	retryBase time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the *http.Client requests go through. It replaces any
+// timeout given with WithTimeout before it.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithTimeout sets the timeout of each request, including reading the body.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		hc := *c.http
+		hc.Timeout = d
+		c.http = &hc
+	}
+}
+
+// WithAPIKey sends key in the X-API-Key header, for servers using API key
+// auth.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// New returns a client for the API at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: defaultTimeout},
+
+		attempts:  defaultAttempts,
+		retryBase: retryBaseDelay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ListAlbumsOptions filters ListAlbums. The zero value lists the newest
+// albums.
+type ListAlbumsOptions struct {
+	SingerIDs []int64
+	// AsOf reads the albums as they were at a time in the past.
+	AsOf time.Time
+	// UpdatedAfter and UpdatedBefore limit the list to albums last updated in
+	// [UpdatedAfter, UpdatedBefore).
+	UpdatedAfter  Time
+	UpdatedBefore Time
+	// Order is a comma-separated list of sort keys, e.g. "singer,-budget".
+	Order string
+	// Limit is the most albums to return, up to 1000. Zero leaves it to the
+	// server, which returns 10.
+	Limit int
+	// PageToken is NextPageToken from the previous page. It can't be combined
+	// with Order.
+	PageToken string
+}
+
+// ListAlbums returns a page of albums, newest first unless opts.Order says
+// otherwise.
+func (c *Client) ListAlbums(ctx context.Context, opts ListAlbumsOptions) (*AlbumList, error) {
+	q := url.Values{"envelope": {"true"}}
+	for _, id := range opts.SingerIDs {
+		q.Add("singer_id", strconv.FormatInt(id, 10))
+	}
+	if !opts.AsOf.IsZero() {
+		q.Set("asOf", opts.AsOf.UTC().Format(time.RFC3339))
+	}
+	if !opts.UpdatedAfter.IsZero() {
+		q.Set("updatedAfter", opts.UpdatedAfter.param())
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		q.Set("updatedBefore", opts.UpdatedBefore.param())
+	}
+	if opts.Order != "" {
+		q.Set("order", opts.Order)
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.PageToken != "" {
+		q.Set("page_token", opts.PageToken)
+	}
+
+	albums := []Album{}
+	meta, err := c.list(ctx, "/albums", q, &albums)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AlbumList{Albums: albums, Count: meta.Count, Limit: meta.Limit, NextPageToken: meta.NextPageToken}, nil
+}
+
+// SyncAlbums returns the albums changed after since. Pass the zero Time for a
+// first pull, then NextPageToken from each result to SyncAlbumsAfter.
+func (c *Client) SyncAlbums(ctx context.Context, since Time) (*AlbumSync, error) {
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Set("since", since.param())
+	}
+	return c.syncAlbums(ctx, q)
+}
+
+// SyncAlbumsAfter returns the albums changed since the pull that returned
+// pageToken as its NextPageToken.
+func (c *Client) SyncAlbumsAfter(ctx context.Context, pageToken string) (*AlbumSync, error) {
+	return c.syncAlbums(ctx, url.Values{"page_token": {pageToken}})
+}
+
+func (c *Client) syncAlbums(ctx context.Context, q url.Values) (*AlbumSync, error) {
+	res := &AlbumSync{}
+	if err := c.do(ctx, http.MethodGet, "/albums/sync", q, nil, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Write modes for PutAlbum.
+const (
+	WriteInsert = "insert"
+	WriteUpdate = "update"
+	WriteUpsert = "upsert"
+)
+
+// PutAlbum writes a.AlbumTitle and a.MarketingBudget to the album with a's
+// ids. Inserting an album that exists fails with ErrConflict, and updating one
+// that doesn't with ErrNotFound.
+func (c *Client) PutAlbum(ctx context.Context, a Album, mode string) error {
+	path := fmt.Sprintf("/albums/%d/%d", a.SingerID, a.AlbumID)
+	q := url.Values{"mode": {mode}}
+	body := albumBody{AlbumTitle: a.AlbumTitle, MarketingBudget: a.MarketingBudget}
+
+	return c.do(ctx, http.MethodPut, path, q, body, nil)
+}
+
+// CreateAlbum creates an album for a.SingerID. If a.AlbumID is zero the server
+// picks the next free id. The created album is returned.
+func (c *Client) CreateAlbum(ctx context.Context, a Album) (*Album, error) {
+	path := fmt.Sprintf("/singers/%d/albums", a.SingerID)
+	body := albumBody{AlbumID: a.AlbumID, AlbumTitle: a.AlbumTitle, MarketingBudget: a.MarketingBudget}
+
+	res := &Album{}
+	if err := c.do(ctx, http.MethodPost, path, nil, body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// TransferBudgets applies transfers in order, all or nothing. If one fails,
+// the *APIError's TransferIndex says which.
+func (c *Client) TransferBudgets(ctx context.Context, transfers []Transfer) error {
+	return c.do(ctx, http.MethodPost, "/albums/transfers/batch", nil, transfers, nil)
+}
+
+func (c *Client) GetSinger(ctx context.Context, id int64) (*Singer, error) {
+	res := &Singer{}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/singers/%d", id), nil, nil, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetSingerWithAlbums returns a singer and all of their albums, read at the
+// same point in time.
+func (c *Client) GetSingerWithAlbums(ctx context.Context, id int64) (*SingerWithAlbums, error) {
+	q := url.Values{"embed": {"albums"}}
+
+	res := &SingerWithAlbums{}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/singers/%d", id), q, nil, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListSingersWithoutAlbums returns every singer that has no albums.
+func (c *Client) ListSingersWithoutAlbums(ctx context.Context) ([]Singer, error) {
+	singers := []Singer{}
+	if _, err := c.list(ctx, "/singers/empty", url.Values{"envelope": {"true"}}, &singers); err != nil {
+		return nil, err
+	}
+	return singers, nil
+}
+
+type listMeta struct {
+	Count         int
+	Limit         int
+	NextPageToken string
+}
+
+// list fetches a list endpoint with the envelope on, decoding the items into
+// out.
+func (c *Client) list(ctx context.Context, path string, q url.Values, out interface{}) (listMeta, error) {
+	var env listEnvelope
+	if err := c.do(ctx, http.MethodGet, path, q, nil, &env); err != nil {
+		return listMeta{}, err
+	}
+	if err := json.Unmarshal(env.Data, out); err != nil {
+		return listMeta{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	return listMeta{Count: env.Meta.Count, Limit: env.Meta.Limit, NextPageToken: env.Meta.NextPageToken}, nil
+}
+
+// do sends a request with body, if it's not nil, as JSON, and decodes a 2xx
+// response into out, if it's not nil. Failures are retried as described in
+// retry.go.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body, out interface{}) error {
+	u := c.baseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.try(ctx, method, u, b, out)
+
+		delay, retry := c.retryDelay(ctx, method, attempt, err)
+		if !retry {
+			return err
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// try sends one request for do.
+func (c *Client) try(ctx context.Context, method, u string, body []byte, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return readError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s: %w", method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// maxErrorBody caps how much of an error response we read.
+const maxErrorBody = 64 << 10
+
+// readError turns an error response into an *APIError. The server sends
+// errors as JSON, with the failed transfer's index for batch transfers, but
+// anything in between, like a proxy, may not, so other bodies are kept as
+// text.
+func readError(resp *http.Response) error {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return newAPIError(resp, "")
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var er errorResponse
+		if err := json.Unmarshal(b, &er); err == nil && er.Error.Message != "" {
+			e := newAPIError(resp, er.Error.Message)
+			if er.Error.Index != nil {
+				e.TransferIndex = *er.Error.Index
+			}
+			return e
+		}
+	}
+
+	return newAPIError(resp, strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,304 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sentRequest is what the test server saw of a request.
+type sentRequest struct {
+	Method, Path, Query, Body string
+	Header                    http.Header
+}
+
+// newTestServer returns a client for a server that records each request and
+// answers with respond.
+func newTestServer(t *testing.T, respond http.HandlerFunc, opts ...Option) (*Client, *[]sentRequest) {
+	t.Helper()
+
+	var sent []sentRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sent = append(sent, sentRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: string(b), Header: r.Header})
+		respond(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := New(srv.URL+"/", opts...)
+	c.retryBase = time.Millisecond
+	return c, &sent
+}
+
+func respondJSON(code int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	ctx := context.Background()
+	title := "Go, Go, Go"
+
+	tests := []struct {
+		name    string
+		call    func(c *Client) error
+		respond string
+		wantReq sentRequest
+	}{
+		{
+			name: "list albums",
+			call: func(c *Client) error {
+				page, err := c.ListAlbums(ctx, ListAlbumsOptions{SingerIDs: []int64{1, 2}, Limit: 5, PageToken: "tok"})
+				if err == nil && (len(page.Albums) != 1 || page.Count != 1 || page.Limit != 5 || page.NextPageToken != "next") {
+					t.Errorf("ListAlbums = %+v", page)
+				}
+				return err
+			},
+			respond: `{"data":[{"singer_id":1,"album_id":1}],"meta":{"count":1,"limit":5,"next_page_token":"next"}}`,
+			wantReq: sentRequest{Method: http.MethodGet, Path: "/albums", Query: "envelope=true&limit=5&page_token=tok&singer_id=1&singer_id=2"},
+		},
+		{
+			name: "put album",
+			call: func(c *Client) error {
+				return c.PutAlbum(ctx, Album{SingerID: 1, AlbumID: 2, AlbumTitle: &title}, WriteInsert)
+			},
+			respond: `{}`,
+			wantReq: sentRequest{Method: http.MethodPut, Path: "/albums/1/2", Query: "mode=insert", Body: `{"album_title":"Go, Go, Go","marketing_budget":null}`},
+		},
+		{
+			name: "create album",
+			call: func(c *Client) error {
+				a, err := c.CreateAlbum(ctx, Album{SingerID: 3, AlbumTitle: &title})
+				if err == nil && a.AlbumID != 7 {
+					t.Errorf("CreateAlbum = %+v, want album 7", a)
+				}
+				return err
+			},
+			respond: `{"singer_id":3,"album_id":7}`,
+			wantReq: sentRequest{Method: http.MethodPost, Path: "/singers/3/albums", Body: `{"album_title":"Go, Go, Go","marketing_budget":null}`},
+		},
+		{
+			name:    "sync after",
+			call:    func(c *Client) error { _, err := c.SyncAlbumsAfter(ctx, "tok"); return err },
+			respond: `{"albums":[],"next_since":null,"next_page_token":"tok","has_more":false}`,
+			wantReq: sentRequest{Method: http.MethodGet, Path: "/albums/sync", Query: "page_token=tok"},
+		},
+		{
+			name:    "singer with albums",
+			call:    func(c *Client) error { _, err := c.GetSingerWithAlbums(ctx, 4); return err },
+			respond: `{"singer_id":4,"albums":[]}`,
+			wantReq: sentRequest{Method: http.MethodGet, Path: "/singers/4", Query: "embed=albums"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, sent := newTestServer(t, respondJSON(http.StatusOK, tt.respond), WithAPIKey("key"))
+			if err := tt.call(c); err != nil {
+				t.Fatal(err)
+			}
+			if len(*sent) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(*sent))
+			}
+
+			got := (*sent)[0]
+			if got.Method != tt.wantReq.Method || got.Path != tt.wantReq.Path || got.Query != tt.wantReq.Query || got.Body != tt.wantReq.Body {
+				t.Errorf("sent %s %s?%s %s\nwant %s %s?%s %s", got.Method, got.Path, got.Query, got.Body,
+					tt.wantReq.Method, tt.wantReq.Path, tt.wantReq.Query, tt.wantReq.Body)
+			}
+			if k := got.Header.Get("X-API-Key"); k != "key" {
+				t.Errorf("X-API-Key = %q", k)
+			}
+			if ct, want := got.Header.Get("Content-Type"), map[bool]string{true: "application/json"}[tt.wantReq.Body != ""]; ct != want {
+				t.Errorf("Content-Type = %q, want %q", ct, want)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           int
+		contentType    string
+		body           string
+		retryAfter     string
+		wantIs         error
+		wantMessage    string
+		wantIndex      int
+		wantRetryAfter time.Duration
+	}{
+		{name: "not found", code: http.StatusNotFound, contentType: "application/json",
+			body: `{"error":{"code":404,"message":"album not found"}}`, wantIs: ErrNotFound, wantMessage: "album not found", wantIndex: -1},
+		{name: "conflict", code: http.StatusConflict, contentType: "application/json; charset=utf-8",
+			body: `{"error":{"code":409,"message":"album exists"}}`, wantIs: ErrConflict, wantMessage: "album exists", wantIndex: -1},
+		{name: "transfer", code: http.StatusBadRequest, contentType: "application/json",
+			body: `{"error":{"code":400,"message":"insufficient budget","index":2}}`, wantIs: ErrBadRequest, wantMessage: "insufficient budget", wantIndex: 2},
+		{name: "maintenance", code: http.StatusServiceUnavailable, contentType: "application/json", retryAfter: "300",
+			body: `{"error":{"code":503,"message":"down for maintenance"}}`, wantIs: ErrUnavailable, wantMessage: "down for maintenance", wantIndex: -1, wantRetryAfter: 5 * time.Minute},
+		{name: "proxy text", code: http.StatusBadGateway, contentType: "text/plain",
+			body: "upstream gone\n", wantIs: ErrServer, wantMessage: "upstream gone", wantIndex: -1},
+		{name: "internal", code: http.StatusInternalServerError, contentType: "application/json",
+			body: `{"error":{"code":500,"message":"internal error"}}`, wantIs: ErrServer, wantMessage: "internal error", wantIndex: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.code)
+				io.WriteString(w, tt.body)
+			}, WithRetries(1))
+
+			_, err := c.GetSinger(context.Background(), 1)
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want an *APIError", err)
+			}
+			if !errors.Is(err, tt.wantIs) {
+				t.Errorf("got %v, want errors.Is %v", err, tt.wantIs)
+			}
+			if apiErr.StatusCode != tt.code || apiErr.Message != tt.wantMessage || apiErr.TransferIndex != tt.wantIndex || apiErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("got %+v", apiErr)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		method       string
+		failures     int
+		code         int
+		retryAfter   string
+		opts         []Option
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "get recovers", method: http.MethodGet, failures: 2, code: http.StatusServiceUnavailable, wantAttempts: 3},
+		{name: "put recovers", method: http.MethodPut, failures: 1, code: http.StatusGatewayTimeout, wantAttempts: 2},
+		{name: "get gives up", method: http.MethodGet, failures: 3, code: http.StatusServiceUnavailable, wantAttempts: 3, wantErr: true},
+		{name: "post not retried", method: http.MethodPost, failures: 1, code: http.StatusServiceUnavailable, wantAttempts: 1, wantErr: true},
+		{name: "client error not retried", method: http.MethodGet, failures: 1, code: http.StatusNotFound, wantAttempts: 1, wantErr: true},
+		{name: "server error not retried", method: http.MethodGet, failures: 1, code: http.StatusInternalServerError, wantAttempts: 1, wantErr: true},
+		{name: "short retry-after waited", method: http.MethodGet, failures: 1, code: http.StatusServiceUnavailable, retryAfter: "0", wantAttempts: 2},
+		{name: "long retry-after returned", method: http.MethodGet, failures: 1, code: http.StatusServiceUnavailable, retryAfter: "300", wantAttempts: 1, wantErr: true},
+		{name: "retries off", method: http.MethodGet, failures: 1, code: http.StatusServiceUnavailable, opts: []Option{WithRetries(1)}, wantAttempts: 1, wantErr: true},
+		{name: "more retries", method: http.MethodGet, failures: 4, code: http.StatusBadGateway, opts: []Option{WithRetries(5)}, wantAttempts: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if int(atomic.AddInt32(&attempts, 1)) <= tt.failures {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					respondJSON(tt.code, `{"error":{"message":"nope"}}`)(w, r)
+					return
+				}
+				respondJSON(http.StatusOK, `{}`)(w, r)
+			}, tt.opts...)
+
+			err := c.do(ctx, tt.method, "/albums/1/1", nil, map[string]string{"album_title": "t"}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+			if got := int(atomic.LoadInt32(&attempts)); got != tt.wantAttempts {
+				t.Errorf("sent %d requests, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// TestRetriesResendBody checks a retried request sends its body again, not an
+// empty one.
+func TestRetriesResendBody(t *testing.T) {
+	var attempts int32
+	c, sent := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			respondJSON(http.StatusServiceUnavailable, `{}`)(w, r)
+			return
+		}
+		respondJSON(http.StatusOK, `{}`)(w, r)
+	})
+
+	title := "t"
+	if err := c.PutAlbum(context.Background(), Album{SingerID: 1, AlbumID: 1, AlbumTitle: &title}, WriteUpsert); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 2 || (*sent)[0].Body != (*sent)[1].Body || (*sent)[1].Body == "" {
+		t.Errorf("sent %+v, want the same body twice", *sent)
+	}
+}
+
+// TestRetriesNetworkError checks a request whose connection drops is retried
+// if it's idempotent, and not if it isn't.
+func TestRetriesNetworkError(t *testing.T) {
+	for _, tt := range []struct {
+		method       string
+		wantAttempts int32
+	}{
+		{method: http.MethodGet, wantAttempts: 2},
+		{method: http.MethodPost, wantAttempts: 1},
+	} {
+		t.Run(tt.method, func(t *testing.T) {
+			var attempts int32
+			c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					conn.Close()
+					return
+				}
+				respondJSON(http.StatusOK, `{}`)(w, r)
+			})
+
+			err := c.do(context.Background(), tt.method, "/albums", nil, nil, nil)
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("sent %d requests, want %d (err %v)", got, tt.wantAttempts, err)
+			}
+			if (err != nil) != (tt.wantAttempts == 1) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestRetriesStopWithContext(t *testing.T) {
+	var attempts int32
+	c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		respondJSON(http.StatusServiceUnavailable, `{}`)(w, r)
+	}, WithRetries(10))
+	c.retryBase = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.do(ctx, http.MethodGet, "/albums", nil, nil, nil); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want the last error", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("sent %d requests, want 1", got)
+	}
+}
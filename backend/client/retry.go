@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Requests with an idempotent method are retried when they don't reach the
+// server or it answers 502, 503 or 504, waiting retryBaseDelay and doubling
+// each time, or the server's Retry-After if that's longer. A Retry-After over
+// maxRetryDelay, as in maintenance mode, is returned to the caller instead of
+// waited out. POST is never retried: a create that timed out may still have
+// happened.
+const (
+	defaultAttempts = 3
+	retryBaseDelay  = 200 * time.Millisecond
+	maxRetryDelay   = 5 * time.Second
+)
+
+// WithRetries sets how many times a request may be tried in all, counting
+// the first. 1 turns retries off.
+func WithRetries(attempts int) Option {
+	return func(c *Client) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		c.attempts = attempts
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before trying again after attempt
+// failed with err, and false if it shouldn't be tried again.
+func (c *Client) retryDelay(ctx context.Context, method string, attempt int, err error) (time.Duration, bool) {
+	if err == nil || attempt >= c.attempts || !idempotent(method) || ctx.Err() != nil {
+		return 0, false
+	}
+
+	delay := c.retryBase << (attempt - 1)
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	var apiErr *APIError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &apiErr):
+		switch apiErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return 0, false
+		}
+		if apiErr.RetryAfter > maxRetryDelay {
+			return 0, false
+		}
+		if apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+	case errors.As(err, &urlErr):
+		// Didn't reach the server, or the response didn't reach us.
+	default:
+		return 0, false
+	}
+	return delay, true
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type Singer struct {
+	SingerID  int64   `json:"singer_id"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+}
+
+type SingerWithAlbums struct {
+	Singer
+	Albums []Album `json:"albums"`
+}
+
+// Album is an album as the API returns it. Nullable columns are pointers.
+type Album struct {
+	SingerID        int64   `json:"singer_id"`
+	AlbumID         int64   `json:"album_id"`
+	AlbumTitle      *string `json:"album_title"`
+	MarketingBudget *int64  `json:"marketing_budget"`
+	LastUpdateTime  Time    `json:"last_update_time"`
+}
+
+// AlbumList is a page of albums. Limit is the page size the server applied,
+// and NextPageToken is empty unless it has another page.
+type AlbumList struct {
+	Albums        []Album
+	Count         int
+	Limit         int
+	NextPageToken string
+}
+
+// AlbumSync is one pull of changed albums. Pass NextPageToken to
+// SyncAlbumsAfter for the next pull; HasMore says whether it has albums
+// waiting already.
+type AlbumSync struct {
+	Albums        []Album `json:"albums"`
+	NextSince     Time    `json:"next_since"`
+	NextPageToken string  `json:"next_page_token"`
+	HasMore       bool    `json:"has_more"`
+}
+
+type Transfer struct {
+	FromSingerID int64 `json:"from_singer_id"`
+	FromAlbumID  int64 `json:"from_album_id"`
+	ToSingerID   int64 `json:"to_singer_id"`
+	ToAlbumID    int64 `json:"to_album_id"`
+	Amount       int64 `json:"amount"`
+}
+
+// albumBody is what album writes send; the server sets the timestamp itself.
+type albumBody struct {
+	AlbumID         int64   `json:"album_id,omitempty"`
+	AlbumTitle      *string `json:"album_title"`
+	MarketingBudget *int64  `json:"marketing_budget"`
+}
+
+type listEnvelope struct {
+	Data json.RawMessage `json:"data"`
+	Meta struct {
+		Count         int    `json:"count"`
+		Limit         int    `json:"limit"`
+		NextPageToken string `json:"next_page_token"`
+	} `json:"meta"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Index   *int   `json:"index"`
+	} `json:"error"`
+}
+
+// Time is a timestamp in whichever format the server is configured with, an
+// RFC3339 string or milliseconds since the epoch. The zero Time is null.
+//
+// A Time from a response remembers how it was written, so passing it back, as
+// with AlbumSync.NextSince, gives the server exactly what it sent.
+type Time struct {
+	time.Time
+	raw string
+}
+
+func (t *Time) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*t = Time{}
+		return nil
+	}
+
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		v, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		*t = Time{Time: v, raw: s}
+		return nil
+	}
+
+	ms, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", b)
+	}
+	*t = Time{Time: time.UnixMilli(ms).UTC(), raw: string(b)}
+	return nil
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
+
+// param renders t as a query parameter.
+func (t Time) param() string {
+	if t.raw != "" {
+		return t.raw
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryClientCreation(t *testing.T) {
+	errCreds := errors.New("metadata server not ready")
+
+	tests := []struct {
+		name      string
+		attempts  int
+		failures  int // how many creations fail before one succeeds
+		wantCalls int
+		wantErr   string
+	}{
+		{name: "first try", attempts: 3, failures: 0, wantCalls: 1},
+		{name: "succeeds later", attempts: 3, failures: 2, wantCalls: 3},
+		{name: "gives up", attempts: 3, failures: 5, wantCalls: 3, wantErr: "giving up after 3 attempts: metadata server not ready"},
+		{name: "single attempt", attempts: 1, failures: 1, wantCalls: 1, wantErr: "giving up after 1 attempts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryClientCreation(context.Background(), tt.attempts, time.Millisecond, func() error {
+				calls++
+				if calls <= tt.failures {
+					return errCreds
+				}
+				return nil
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("%d creation attempts, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.Is(err, errCreds) {
+				t.Errorf("err = %v, want one wrapping the cause and containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryClientCreationCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	err := retryClientCreation(ctx, 10, time.Hour, func() error {
+		calls++
+		cancel()
+		return errors.New("not yet")
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("%d attempts after canceling, want 1", calls)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// coalescer shares one in-flight read between concurrent identical requests.
+// A nil *coalescer is valid for forget, which then does nothing.
+// Only calls that overlap are shared: nothing is kept once a call returns, so
+// an error is seen by the requests that were waiting on it and the next
+// request tries again.
+//
+// The shared call runs on its own context rather than the first caller's, so
+// one client going away doesn't fail everyone else's request. It's canceled
+// once every caller waiting on it has gone.
+//
+// This is singleflight plus that cancellation. singleflight.DoChan lets a
+// caller stop waiting, but it has no idea how many callers are left, so the
+// query would keep running for nobody, or be canceled with the first caller's
+// context and fail the rest.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+type sharedCall struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+
+	// done is closed once val and err are set.
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*sharedCall)}
+}
+
+// do calls fn for key, or waits for the call already in flight for key. It
+// returns early with ctx's error if ctx is done first.
+//
+// A call is only ever joined while it's in calls, and it's taken out under
+// the same lock before it finishes or is canceled, so nobody can join a call
+// that's over.
+func (c *coalescer) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.Background())
+		call = &sharedCall{ctx: callCtx, cancel: cancel, done: make(chan struct{})}
+		c.calls[key] = call
+		go c.run(key, call, fn)
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		c.leave(key, call)
+		return call.val, call.err
+	case <-ctx.Done():
+		c.leave(key, call)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *coalescer) run(key string, call *sharedCall, fn func(ctx context.Context) (interface{}, error)) {
+	call.val, call.err = fn(call.ctx)
+
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+
+	call.cancel()
+	close(call.done)
+}
+
+// leave drops a waiter, canceling the call if it was the last one. The key is
+// forgotten too, so a request that comes in afterwards starts a new call
+// instead of joining the canceled one.
+func (c *coalescer) leave(key string, call *sharedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
+
+// forget stops new callers joining the calls in flight for keys starting with
+// prefix, so they start calls of their own. Write paths call it along with
+// responseCache.invalidate: a read in flight may have started before the
+// write, and a request made after the write must not get its result. Callers
+// already waiting on such a call still get it.
+func (c *coalescer) forget(prefix string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.calls {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.calls, k)
+		}
+	}
+}
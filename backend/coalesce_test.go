@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesConcurrentCalls(t *testing.T) {
+	c := newCoalescer()
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "albums", nil
+	}
+
+	const n = 20
+	var started, finished sync.WaitGroup
+	started.Add(n)
+	finished.Add(n)
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer finished.Done()
+			started.Done()
+			v, err := c.do(context.Background(), "/albums", fn)
+			if err == nil && v != "albums" {
+				err = errors.New("wrong value")
+			}
+			errs <- err
+		}()
+	}
+
+	started.Wait()
+	waitForWaiters(t, c, "/albums", n)
+	close(release)
+	finished.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("do: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fn called %d times, want 1", got)
+	}
+}
+
+// TestCoalescerKeepsKeysApart checks concurrent calls for different keys,
+// such as reads of different albums, each run and get their own result.
+func TestCoalescerKeepsKeysApart(t *testing.T) {
+	c := newCoalescer()
+
+	var calls int32
+	release := make(chan struct{})
+
+	keys := []string{"/albums?singer_id=1", "/albums?singer_id=2", "/albums?singer_id=3"}
+	results := make(map[string]chan interface{})
+	for _, key := range keys {
+		key := key
+		results[key] = make(chan interface{}, 1)
+		go func() {
+			v, err := c.do(context.Background(), key, func(ctx context.Context) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return key, nil
+			})
+			if err != nil {
+				t.Errorf("do(%s): %v", key, err)
+			}
+			results[key] <- v
+		}()
+	}
+
+	// All in flight at once, and none joined another.
+	for _, key := range keys {
+		waitForWaiters(t, c, key, 1)
+	}
+	close(release)
+
+	for _, key := range keys {
+		if v := <-results[key]; v != key {
+			t.Errorf("do(%s) = %v, want its own result", key, v)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != int32(len(keys)) {
+		t.Errorf("fn called %d times, want %d", got, len(keys))
+	}
+}
+
+func TestCoalescerCanceledWaiterDoesNotFailOthers(t *testing.T) {
+	c := newCoalescer()
+
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "albums", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := c.do(ctx, "/albums", fn)
+		canceled <- err
+	}()
+	waitForWaiters(t, c, "/albums", 1)
+
+	other := make(chan error, 1)
+	go func() {
+		_, err := c.do(context.Background(), "/albums", fn)
+		other <- err
+	}()
+	waitForWaiters(t, c, "/albums", 2)
+
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled waiter got %v, want context.Canceled", err)
+	}
+
+	close(release)
+	if err := <-other; err != nil {
+		t.Errorf("other waiter got %v, want nil", err)
+	}
+}
+
+func TestCoalescerLastWaiterCancelsCall(t *testing.T) {
+	c := newCoalescer()
+
+	stopped := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(stopped)
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.do(ctx, "/albums", fn)
+	waitForWaiters(t, c, "/albums", 1)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("call not canceled after its only waiter left")
+	}
+}
+
+// TestCoalescerNewCallerAfterCancel checks a caller arriving after the last
+// waiter left, while the canceled call is still winding down, gets a call of
+// its own instead of the canceled one's error.
+func TestCoalescerNewCallerAfterCancel(t *testing.T) {
+	c := newCoalescer()
+
+	canceled := make(chan struct{})
+	finish := make(chan struct{})
+	first := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(canceled)
+		// Slow to notice, like a query mid-stream.
+		<-finish
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.do(ctx, "/albums", first)
+	waitForWaiters(t, c, "/albums", 1)
+	cancel()
+	<-canceled
+
+	v, err := c.do(context.Background(), "/albums", func(ctx context.Context) (interface{}, error) {
+		return "albums", ctx.Err()
+	})
+	close(finish)
+
+	if err != nil || v != "albums" {
+		t.Errorf("do after the last waiter left = %v, %v; want a fresh call", v, err)
+	}
+}
+
+func TestCoalescerStartsAfreshOnceCallIsDone(t *testing.T) {
+	c := newCoalescer()
+
+	var calls int32
+	fn := func(ctx context.Context) (interface{}, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	for i := 1; i <= 100; i++ {
+		v, err := c.do(context.Background(), "/albums", fn)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if v != int32(i) {
+			t.Fatalf("call %d returned %v, want a fresh call", i, v)
+		}
+	}
+}
+
+// waitForWaiters waits until n callers are waiting on key's call.
+func waitForWaiters(t *testing.T, c *coalescer, key string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		call, ok := c.calls[key]
+		waiters := 0
+		if ok {
+			waiters = call.waiters
+		}
+		c.mu.Unlock()
+
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters on %s", n, key)
+}
+
+// TestCoalescerForget checks a caller that comes after forget, as a read after
+// a write does, gets a call of its own rather than the one already in flight,
+// which still answers the callers waiting on it. Other keys are left alone.
+func TestCoalescerForget(t *testing.T) {
+	c := newCoalescer()
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			<-release
+		}
+		return n, nil
+	}
+
+	first := make(chan interface{})
+	go func() {
+		v, _ := c.do(context.Background(), "/albums?limit=10", fn)
+		first <- v
+	}()
+	waitForWaiters(t, c, "/albums?limit=10", 1)
+
+	c.mu.Lock()
+	c.calls["/singers/empty"] = &sharedCall{}
+	c.mu.Unlock()
+
+	c.forget("/albums")
+
+	// Joining the first call would wait until it's released below.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	v, err := c.do(ctx, "/albums?limit=10", fn)
+	if err != nil || v != int32(2) {
+		t.Errorf("do after forget = %v, %v; want a fresh call", v, err)
+	}
+
+	close(release)
+	if v := <-first; v != int32(1) {
+		t.Errorf("the waiter from before forget got %v, want the first call's result", v)
+	}
+
+	c.mu.Lock()
+	_, ok := c.calls["/singers/empty"]
+	c.mu.Unlock()
+	if !ok {
+		t.Error("forget(/albums) dropped /singers/empty")
+	}
+
+	var nilCoalescer *coalescer
+	nilCoalescer.forget("/albums")
+}
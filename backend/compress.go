@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings we can compress responses with, in order of preference when the
+// client gives them the same q-value.
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// Encoders are pooled across responses: a zstd encoder allocates megabytes of
+// state up front, far more than most responses, and a gzip writer is no
+// small thing either. They're reset onto each response's writer, and back to
+// nil before going back in the pool.
+var (
+	zstdEncoders = sync.Pool{New: func() interface{} {
+		// Only fails on invalid options.
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	}}
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+)
+
+// compressHandler compresses responses with the best encoding the client
+// accepts. Responses smaller than minSize are sent as is, since compressing
+// them costs more than it saves.
+func compressHandler(minSize int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		enc, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if !ok {
+			writeJSONError(w, http.StatusNotAcceptable, "no acceptable content encoding, expected one of "+strings.Join(supportedEncodings, ", ")+" or identity")
+			return
+		}
+		if enc == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: enc, minSize: minSize}
+		defer cw.Close()
+
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks an encoding from an Accept-Encoding header, returning
+// "" for identity. It returns false if the client rules out identity, with
+// identity;q=0 or *;q=0, and accepts nothing we support either.
+func negotiateEncoding(header string) (string, bool) {
+	if header == "" {
+		return "", true
+	}
+
+	q := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := cutString(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		v := 1.0
+		if p := strings.TrimSpace(params); strings.HasPrefix(p, "q=") {
+			f, err := strconv.ParseFloat(p[2:], 64)
+			if err != nil {
+				continue
+			}
+			v = f
+		}
+		q[name] = v
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range supportedEncodings {
+		v, ok := q[enc]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > bestQ {
+			best, bestQ = enc, v
+		}
+	}
+
+	// identity wins if the client lists it and prefers it.
+	if id, ok := q["identity"]; ok && id > 0 && id >= bestQ {
+		return "", true
+	}
+	if best != "" {
+		return best, true
+	}
+
+	// Nothing we compress with is acceptable, so it's identity, unless
+	// that's ruled out too.
+	id, ok := q["identity"]
+	if !ok {
+		id, ok = q["*"]
+	}
+	return "", !ok || id > 0
+}
+
+// compressWriter buffers the start of a response until it knows whether it's
+// big enough to be worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	buf         bytes.Buffer
+	enc         io.WriteCloser
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.passthrough {
+		return cw.ResponseWriter.Write(p)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+
+	cw.buf.Write(p)
+	if cw.buf.Len() < cw.minSize {
+		return len(p), nil
+	}
+
+	if err := cw.start(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start decides how to send the response once the buffer is full, then
+// flushes the buffer through.
+func (cw *compressWriter) start() error {
+	h := cw.Header()
+
+	if h.Get("Content-Encoding") != "" || precompressed(h.Get("Content-Type")) || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		cw.passthrough = true
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+		return err
+	}
+
+	switch cw.encoding {
+	case "zstd":
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(cw.ResponseWriter)
+		cw.enc = enc
+	default:
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(cw.ResponseWriter)
+		cw.enc = gz
+	}
+
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	_, err := cw.enc.Write(cw.buf.Bytes())
+	return err
+}
+
+// Flush sends everything written so far. A response flushed before it reaches
+// minSize is compressed anyway: it's being streamed, so its size isn't known.
+func (cw *compressWriter) Flush() {
+	if cw.enc == nil && !cw.passthrough {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.start(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.enc != nil {
+		err := cw.enc.Close()
+		switch enc := cw.enc.(type) {
+		case *zstd.Encoder:
+			enc.Reset(nil)
+			zstdEncoders.Put(enc)
+		case *gzip.Writer:
+			enc.Reset(nil)
+			gzipWriters.Put(enc)
+		}
+		return err
+	}
+	if cw.passthrough {
+		return nil
+	}
+
+	// Never reached minSize, send the response uncompressed.
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+	return err
+}
+
+// precompressed reports whether a Content-Type is already compressed, like the
+// gzipped archive from GET /admin/archive, so compressing it again would only
+// cost time.
+func precompressed(contentType string) bool {
+	mediaType, _, _ := cutString(contentType, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/gzip", "application/zstd", "application/zip":
+		return true
+	}
+	return false
+}
+
+// cutString is strings.Cut, which we can't use until we're on Go 1.18.
+func cutString(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		wantOK bool
+	}{
+		{header: "", want: "", wantOK: true},
+		{header: "gzip", want: "gzip", wantOK: true},
+		{header: "zstd", want: "zstd", wantOK: true},
+		{header: "GZIP", want: "gzip", wantOK: true},
+		// Same q-value: our preference.
+		{header: "gzip, zstd", want: "zstd", wantOK: true},
+		{header: "gzip;q=1, zstd;q=0.5", want: "gzip", wantOK: true},
+		{header: "gzip; q=0.2, zstd;q=0.8", want: "zstd", wantOK: true},
+		{header: "zstd;q=0, gzip;q=0.1", want: "gzip", wantOK: true},
+		{header: "*", want: "zstd", wantOK: true},
+		{header: "*;q=0.1, gzip;q=0.5", want: "gzip", wantOK: true},
+		{header: "gzip;q=nope", want: "", wantOK: true},
+		{header: "br", want: "", wantOK: true},
+		// identity only wins when it's asked for.
+		{header: "identity", want: "", wantOK: true},
+		{header: "gzip;q=0.5, identity", want: "", wantOK: true},
+		{header: "gzip, identity;q=0.5", want: "gzip", wantOK: true},
+		{header: "identity;q=0, gzip", want: "gzip", wantOK: true},
+		// identity ruled out and nothing else we support.
+		{header: "identity;q=0", wantOK: false},
+		{header: "br, identity;q=0", wantOK: false},
+		{header: "*;q=0", wantOK: false},
+		{header: "gzip;q=0, zstd;q=0, identity;q=0", wantOK: false},
+		{header: "br, *;q=0", wantOK: false},
+		{header: "*;q=0, identity", want: "", wantOK: true},
+	}
+
+	for _, tt := range tests {
+		got, ok := negotiateEncoding(tt.header)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("negotiateEncoding(%q) = %q, %v; want %q, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// decodeBody undoes the response's Content-Encoding.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var r io.Reader = w.Body
+	switch enc := w.Header().Get("Content-Encoding"); enc {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		t.Fatalf("unexpected Content-Encoding %q", enc)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s body: %v", w.Header().Get("Content-Encoding"), err)
+	}
+	return string(b)
+}
+
+func TestCompressHandler(t *testing.T) {
+	const minSize = 64
+	big := strings.Repeat(`{"album_title":"Total Junk"}`, 20)
+	tiny := `{"ok":true}`
+
+	tests := []struct {
+		name           string
+		accept         string
+		body           string
+		status         int
+		wantCode       int
+		wantEncoding   string
+		wantUnmodified bool
+	}{
+		{name: "zstd", accept: "gzip, zstd", body: big, wantCode: http.StatusOK, wantEncoding: "zstd"},
+		{name: "gzip", accept: "gzip", body: big, wantCode: http.StatusOK, wantEncoding: "gzip"},
+		{name: "gzip preferred", accept: "zstd;q=0.1, gzip", body: big, wantCode: http.StatusOK, wantEncoding: "gzip"},
+		{name: "no header", body: big, wantCode: http.StatusOK},
+		{name: "identity preferred", accept: "gzip;q=0.5, identity", body: big, wantCode: http.StatusOK},
+		{name: "tiny body", accept: "gzip, zstd", body: tiny, wantCode: http.StatusOK},
+		{name: "status kept", accept: "gzip", body: big, status: http.StatusCreated, wantCode: http.StatusCreated, wantEncoding: "gzip"},
+		{name: "identity ruled out", accept: "br, identity;q=0", body: big, wantCode: http.StatusNotAcceptable, wantUnmodified: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compressHandler(minSize, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				io.WriteString(w, tt.body)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/albums", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q", got)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if tt.wantUnmodified {
+				return
+			}
+			if got := decodeBody(t, w); got != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+// TestCompressHandlerReusesEncoders sends many responses at once through
+// each encoding, so pooled encoders are reused across responses, and checks
+// every one decodes to its own body.
+func TestCompressHandlerReusesEncoders(t *testing.T) {
+	h := compressHandler(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat(r.URL.Query().Get("v"), 100))
+	}))
+
+	var wg sync.WaitGroup
+	for _, enc := range []string{"zstd", "gzip"} {
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(enc string, i int) {
+				defer wg.Done()
+
+				v := fmt.Sprintf("response-%d.", i)
+				r := httptest.NewRequest(http.MethodGet, "/?v="+v, nil)
+				r.Header.Set("Accept-Encoding", enc)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+
+				if got := w.Header().Get("Content-Encoding"); got != enc {
+					t.Errorf("Content-Encoding = %q, want %q", got, enc)
+					return
+				}
+				if got := decodeBody(t, w); got != strings.Repeat(v, 100) {
+					t.Errorf("%s response %d decoded to %.40q...", enc, i, got)
+				}
+			}(enc, i)
+		}
+	}
+	wg.Wait()
+}
+
+func TestCompressHandlerPassthrough(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 128)
+
+	tests := []struct {
+		name         string
+		header       string
+		value        string
+		wantEncoding string
+	}{
+		// Already encoded by the handler.
+		{name: "encoded", header: "Content-Encoding", value: "br", wantEncoding: "br"},
+		// Already compressed, like the archive export.
+		{name: "gzip body", header: "Content-Type", value: "application/gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compressHandler(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(tt.header, tt.value)
+				w.Write(body)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if !bytes.Equal(w.Body.Bytes(), body) {
+				t.Error("body was changed")
+			}
+		})
+	}
+}
+
+// TestCompressHandlerFlush checks a response flushed before it reaches the
+// minimum size is compressed and sent as it goes.
+func TestCompressHandlerFlush(t *testing.T) {
+	h := compressHandler(1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "second\n")
+	}))
+
+	for _, enc := range []string{"zstd", "gzip"} {
+		t.Run(enc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", enc)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if !w.Flushed {
+				t.Error("response wasn't flushed")
+			}
+			if got := w.Header().Get("Content-Encoding"); got != enc {
+				t.Errorf("Content-Encoding = %q, want %q", got, enc)
+			}
+			if got := decodeBody(t, w); got != "first\nsecond\n" {
+				t.Errorf("body = %q", got)
+			}
+		})
+	}
+}
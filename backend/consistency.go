@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+)
+
+// Violation is an album that breaks one of the invariants checkAlbums looks
+// for.
+type Violation struct {
+	SingerID int64  `json:"singer_id"`
+	AlbumID  int64  `json:"album_id"`
+	Problem  string `json:"problem"`
+}
+
+type ConsistencyReport struct {
+	Scanned    int64        `json:"scanned"`
+	Partitions int          `json:"partitions"`
+	Violations []*Violation `json:"violations"`
+}
+
+// ScanProgress is reported after each partition checkAlbums reads. Rows counts
+// the rows read from Table so far.
+type ScanProgress struct {
+	Table      string `json:"table"`
+	Partition  int    `json:"partition"`
+	Partitions int    `json:"partitions"`
+	Rows       int64  `json:"rows"`
+}
+
+// checkAlbums scans every album with a partitioned read and reports those with
+// no title, a negative budget or a singer that doesn't exist. All partitions
+// read from the same snapshot, so the singer check is consistent with the
+// albums. Progress is logged after each partition, and passed to progress if
+// it isn't nil.
+func checkAlbums(ctx context.Context, client *spanner.Client, progress func(ScanProgress)) (res *ConsistencyReport, err error) {
+	defer func() { err = spannerError(err) }()
+
+	var txn *spanner.BatchReadOnlyTransaction
+
+	txn, err = client.BatchReadOnlyTransaction(ctx, spanner.StrongRead())
+	if err != nil {
+		return
+	}
+	defer txn.Cleanup(ctx)
+
+	singers := make(map[int64]bool)
+	if _, err = scanTable(ctx, txn, "Singers", []string{"SingerId"}, progress, func(row *spanner.Row) error {
+		var id int64
+		if err := row.Column(0, &id); err != nil {
+			return err
+		}
+		singers[id] = true
+		return nil
+	}); err != nil {
+		return
+	}
+
+	res = &ConsistencyReport{Violations: []*Violation{}}
+
+	res.Partitions, err = scanTable(ctx, txn, "Albums", albumColumns, progress, func(row *spanner.Row) error {
+		a, err := albumFromRow(row)
+		if err != nil {
+			return err
+		}
+		res.Scanned++
+
+		add := func(problem string) {
+			res.Violations = append(res.Violations, &Violation{SingerID: a.SingerID, AlbumID: a.AlbumID, Problem: problem})
+		}
+		if !a.AlbumTitle.Valid || a.AlbumTitle.StringVal == "" {
+			add("missing title")
+		}
+		if a.MarketingBudget.Valid && a.MarketingBudget.Int64 < 0 {
+			add(fmt.Sprintf("negative budget %d", a.MarketingBudget.Int64))
+		}
+		if !singers[a.SingerID] {
+			add(fmt.Sprintf("singer %d does not exist", a.SingerID))
+		}
+		return nil
+	})
+	if err != nil {
+		res = nil
+	}
+	return
+}
+
+// scanTable reads all of table one partition at a time, calling fn for each
+// row and progress, if it isn't nil, after each partition. It returns how many
+// partitions there were.
+func scanTable(ctx context.Context, txn *spanner.BatchReadOnlyTransaction, table string, cols []string, progress func(ScanProgress), fn func(*spanner.Row) error) (int, error) {
+	partitions, err := txn.PartitionRead(ctx, table, spanner.AllKeys(), cols, spanner.PartitionOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	var rows int64
+	count := func(row *spanner.Row) error {
+		rows++
+		return fn(row)
+	}
+
+	for i, p := range partitions {
+		if err := scanPartition(ctx, txn, p, count); err != nil {
+			return 0, err
+		}
+		log.Printf("Scanned %s partition %d/%d", table, i+1, len(partitions))
+		if progress != nil {
+			progress(ScanProgress{Table: table, Partition: i + 1, Partitions: len(partitions), Rows: rows})
+		}
+	}
+
+	return len(partitions), nil
+}
+
+func scanPartition(ctx context.Context, txn *spanner.BatchReadOnlyTransaction, p *spanner.Partition, fn func(*spanner.Row) error) error {
+	iter := txn.Execute(ctx, p)
+	defer iter.Stop()
+
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// ConsistencyLine is one line of GET /admin/audit/albums?progress=true: one
+// of progress after each partition, then the report, or an error if the scan
+// fails part way through.
+type ConsistencyLine struct {
+	Progress *ScanProgress      `json:"progress,omitempty"`
+	Report   *ConsistencyReport `json:"report,omitempty"`
+	Error    *ErrorDetail       `json:"error,omitempty"`
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+)
+
+// seedViolations writes a good album, one with no title and one with a
+// negative budget, and returns the violations checkAlbums should report.
+func seedViolations(t *testing.T, client *spanner.Client) []*Violation {
+	t.Helper()
+
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, AlbumTitle: spanner.NullString{StringVal: "Good", Valid: true}},
+		&Album{SingerID: 1, AlbumID: 2},
+		&Album{SingerID: 2, AlbumID: 1, AlbumTitle: spanner.NullString{StringVal: "Broke", Valid: true}, MarketingBudget: spanner.NullInt64{Int64: -5, Valid: true}},
+	)
+
+	return []*Violation{
+		{SingerID: 1, AlbumID: 2, Problem: "missing title"},
+		{SingerID: 2, AlbumID: 1, Problem: "negative budget -5"},
+	}
+}
+
+func checkViolations(t *testing.T, got, want []*Violation) {
+	t.Helper()
+
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.Marshal(got)
+		w, _ := json.Marshal(want)
+		t.Errorf("violations = %s, want %s", g, w)
+	}
+}
+
+func TestCheckAlbums(t *testing.T) {
+	client := newTestDB(t)
+	want := seedViolations(t, client)
+
+	var progress []ScanProgress
+	res, err := checkAlbums(context.Background(), client, func(p ScanProgress) {
+		progress = append(progress, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Scanned != 3 {
+		t.Errorf("scanned %d albums, want 3", res.Scanned)
+	}
+	checkViolations(t, res.Violations, want)
+
+	if len(progress) == 0 {
+		t.Fatal("no progress reported")
+	}
+	last := progress[len(progress)-1]
+	if last.Table != "Albums" || last.Partition != last.Partitions || last.Rows != 3 {
+		t.Errorf("last progress = %+v, want all 3 Albums rows read", last)
+	}
+}
+
+// TestCheckAlbumsStream checks ?progress=true streams progress lines and ends
+// with the report.
+func TestCheckAlbumsStream(t *testing.T) {
+	client := newTestDB(t)
+	want := seedViolations(t, client)
+
+	router := mux.NewRouter()
+	registerAdminRoutes(router, Config{}, client, nil, "", nil, nil, nil, nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit/albums?progress=true", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	if !w.Flushed {
+		t.Error("progress wasn't flushed")
+	}
+
+	var lines []ConsistencyLine
+	s := bufio.NewScanner(w.Body)
+	for s.Scan() {
+		var l ConsistencyLine
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("line %q: %v", s.Text(), err)
+		}
+		lines = append(lines, l)
+	}
+
+	if len(lines) < 2 {
+		t.Fatalf("got %d lines, want progress then a report", len(lines))
+	}
+	for _, l := range lines[:len(lines)-1] {
+		if l.Progress == nil {
+			t.Errorf("line before the last = %+v, want progress", l)
+		}
+	}
+	report := lines[len(lines)-1].Report
+	if report == nil {
+		t.Fatalf("last line = %+v, want the report", lines[len(lines)-1])
+	}
+	checkViolations(t, report.Violations, want)
+}
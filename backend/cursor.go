@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// albumCursor is the position after the last album of a page in the default
+// album order, LastUpdateTime DESC then SingerId, AlbumId. It goes to clients
+// as an opaque ?page_token.
+type albumCursor struct {
+	LastUpdateTime time.Time `json:"t"`
+	SingerID       int64     `json:"s"`
+	AlbumID        int64     `json:"a"`
+}
+
+var errInvalidPageToken = errors.New("invalid page_token")
+
+func newAlbumCursor(a *Album) *albumCursor {
+	return &albumCursor{LastUpdateTime: a.LastUpdateTime.Time, SingerID: a.SingerID, AlbumID: a.AlbumID}
+}
+
+func (c *albumCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAlbumCursor(token string) (*albumCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+
+	c := &albumCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.LastUpdateTime.IsZero() {
+		return nil, errInvalidPageToken
+	}
+	return c, nil
+}
+
+// albumsAfterCursor is the WHERE condition for the albums after c in the
+// default order. Albums updated in the same commit share a LastUpdateTime, so
+// ties are broken by key the same way the ORDER BY does; otherwise a page
+// boundary inside a tie would skip or repeat albums.
+func albumsAfterCursor(c *albumCursor, params map[string]interface{}) string {
+	params["cursorTime"] = c.LastUpdateTime
+	params["cursorSinger"] = c.SingerID
+	params["cursorAlbum"] = c.AlbumID
+
+	return `(LastUpdateTime < @cursorTime OR (LastUpdateTime = @cursorTime AND
+                (SingerId > @cursorSinger OR (SingerId = @cursorSinger AND AlbumId > @cursorAlbum))))`
+}
+
+// albumsSinceCursor is albumsAfterCursor for the sync order, LastUpdateTime
+// ascending then SingerId, AlbumId.
+func albumsSinceCursor(c *albumCursor, params map[string]interface{}) string {
+	params["cursorTime"] = c.LastUpdateTime
+	params["cursorSinger"] = c.SingerID
+	params["cursorAlbum"] = c.AlbumID
+
+	return `(LastUpdateTime > @cursorTime OR (LastUpdateTime = @cursorTime AND
+                (SingerId > @cursorSinger OR (SingerId = @cursorSinger AND AlbumId > @cursorAlbum))))`
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAlbumCursorRoundTrip(t *testing.T) {
+	want := &albumCursor{LastUpdateTime: time.Date(2022, 7, 1, 12, 0, 0, 123456000, time.UTC), SingerID: 3, AlbumID: 7}
+
+	got, err := decodeAlbumCursor(want.encode())
+	if err != nil {
+		t.Fatalf("decodeAlbumCursor: %v", err)
+	}
+	if !got.LastUpdateTime.Equal(want.LastUpdateTime) || got.SingerID != want.SingerID || got.AlbumID != want.AlbumID {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeAlbumCursorRejectsGarbage(t *testing.T) {
+	for _, token := range []string{
+		"not base64!",
+		"bm90IGpzb24",      // "not json"
+		"e30",              // {}, no timestamp
+		"eyJ0IjoxMjN9",     // {"t":123}
+		"eyJ0IjoiIiwicyI6", // truncated
+	} {
+		if _, err := decodeAlbumCursor(token); err != errInvalidPageToken {
+			t.Errorf("decodeAlbumCursor(%q) = %v, want errInvalidPageToken", token, err)
+		}
+	}
+}
+
+func TestParseListOptionsPageTokenWithOrder(t *testing.T) {
+	token := (&albumCursor{LastUpdateTime: time.Now(), SingerID: 1, AlbumID: 1}).encode()
+
+	if _, err := parseListOptions(url.Values{"page_token": {token}}, Config{}); err != nil {
+		t.Errorf("page_token alone: %v", err)
+	}
+	if _, err := parseListOptions(url.Values{"page_token": {token}, "order": {"title"}}, Config{}); err == nil {
+		t.Error("page_token with order: got nil error")
+	}
+}
+
+// TestGetAlbumsPagesThroughTies pages through albums that share a
+// LastUpdateTime, with page boundaries falling inside the tie, and checks
+// every album comes back exactly once, in order.
+func TestGetAlbumsPagesThroughTies(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	// Two commits, so two groups of tied LastUpdateTimes; the second is newer
+	// and comes first.
+	var older, newer []*Album
+	for _, k := range [][2]int64{{1, 1}, {1, 2}, {2, 1}, {2, 2}, {3, 1}} {
+		older = append(older, &Album{SingerID: k[0], AlbumID: k[1], AlbumTitle: nullString("old")})
+	}
+	for _, k := range [][2]int64{{1, 3}, {2, 3}, {3, 2}} {
+		newer = append(newer, &Album{SingerID: k[0], AlbumID: k[1], AlbumTitle: nullString("new")})
+	}
+	seedAlbums(t, client, older...)
+	seedAlbums(t, client, newer...)
+
+	want := []string{"1/3", "2/3", "3/2", "1/1", "1/2", "2/1", "2/2", "3/1"}
+
+	for _, limit := range []int{1, 2, 3, len(want), len(want) + 1} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			var got []string
+			opts := ListOptions{Limit: limit}
+
+			for pages := 0; ; pages++ {
+				if pages > len(want) {
+					t.Fatalf("still paging after %d pages, got %v", pages, got)
+				}
+
+				albums, next, err := getAlbums(ctx, client, opts)
+				if err != nil {
+					t.Fatalf("getAlbums: %v", err)
+				}
+				for _, a := range albums {
+					got = append(got, fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID))
+				}
+				if next == nil {
+					break
+				}
+				if len(albums) != limit {
+					t.Errorf("page of %d albums has a next page, want a full page of %d", len(albums), limit)
+				}
+
+				// Round-trip the cursor as a client would.
+				if opts.After, err = decodeAlbumCursor(next.encode()); err != nil {
+					t.Fatalf("decoding next page token: %v", err)
+				}
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetAlbumsNoNextPageWithOrder(t *testing.T) {
+	client := newTestDB(t)
+
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, AlbumTitle: nullString("b")},
+		&Album{SingerID: 1, AlbumID: 2, AlbumTitle: nullString("a")},
+	)
+
+	order, err := parseOrder("title")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	albums, next, err := getAlbums(context.Background(), client, ListOptions{Limit: 1, Order: order})
+	if err != nil {
+		t.Fatalf("getAlbums: %v", err)
+	}
+	if len(albums) != 1 {
+		t.Fatalf("got %d albums, want 1", len(albums))
+	}
+	if next != nil {
+		t.Errorf("got next page %+v with a custom order, want none", next)
+	}
+}
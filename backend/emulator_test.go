@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+)
+
+const (
+	testProject  = "test-project"
+	testInstance = "test-instance"
+)
+
+var createTestInstance sync.Once
+
+// newTestDB creates a database with the app's schema on the Spanner emulator
+// and returns a client for it. The database is dropped when the test ends.
+// Tests using it are skipped unless SPANNER_EMULATOR_HOST is set.
+func newTestDB(t *testing.T) *spanner.Client {
+	t.Helper()
+
+	if !usingEmulator() {
+		t.Skip("SPANNER_EMULATOR_HOST not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// The instance may be left over from an earlier run; if it's really
+	// missing, createDB fails below.
+	createTestInstance.Do(func() {
+		_ = createInstance(ctx, testProject, testInstance)
+	})
+
+	// Database ids are at most 30 characters and start with a letter.
+	id := "t" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := createDB(ctx, testProject, testInstance, id); err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+
+	adminClient, err := database.NewDatabaseAdminClient(context.Background(), spannerOptions...)
+	if err != nil {
+		t.Fatalf("creating admin client: %v", err)
+	}
+
+	dbPath := fmt.Sprintf("projects/%s/instances/%s/databases/%s", testProject, testInstance, id)
+	if err := applyDDL(ctx, adminClient, dbPath, migrations); err != nil {
+		adminClient.Close()
+		t.Fatalf("applying migrations: %v", err)
+	}
+
+	client, err := spanner.NewClient(context.Background(), dbPath, spannerOptions...)
+	if err != nil {
+		adminClient.Close()
+		t.Fatalf("creating client: %v", err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		defer adminClient.Close()
+
+		if err := adminClient.DropDatabase(context.Background(), &adminpb.DropDatabaseRequest{Database: dbPath}); err != nil {
+			t.Logf("dropping %s: %v", dbPath, err)
+		}
+	})
+
+	return client
+}
+
+// seedAlbums writes a singer for each singer id in albums, then albums, all in
+// one commit so they share a LastUpdateTime.
+func seedAlbums(t *testing.T, client *spanner.Client, albums ...*Album) time.Time {
+	t.Helper()
+
+	seen := make(map[int64]bool)
+	var m []*spanner.Mutation
+	for _, a := range albums {
+		if !seen[a.SingerID] {
+			seen[a.SingerID] = true
+			m = append(m, insertOrUpdateSingerMutation(&Singer{SingerID: a.SingerID}))
+		}
+		m = append(m, insertOrUpdateAlbumMutation(a))
+	}
+
+	ts, err := client.Apply(context.Background(), m)
+	if err != nil {
+		t.Fatalf("seeding albums: %v", err)
+	}
+	return ts
+}
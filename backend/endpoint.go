@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// spannerOptions are passed to every Spanner data and admin client we create.
+// They're set once from config at startup.
+var spannerOptions []option.ClientOption
+
+// setSpannerEndpoint points the Spanner clients at a custom endpoint, such as a
+// private one, instead of spanner.googleapis.com. If caFile is set, the
+// endpoint's certificate is verified against it rather than the system roots,
+// and serverName, if set, overrides the name checked in the certificate.
+//
+// The emulator is configured with SPANNER_EMULATOR_HOST, so the endpoint is
+// ignored when it's in use.
+func setSpannerEndpoint(endpoint, caFile, serverName string) error {
+	if endpoint == "" {
+		return nil
+	}
+	if usingEmulator() {
+		log.Printf("Ignoring Spanner endpoint %s, using the emulator", endpoint)
+		return nil
+	}
+	if err := validateEndpoint(endpoint); err != nil {
+		return err
+	}
+
+	opts := []option.ClientOption{option.WithEndpoint(endpoint)}
+
+	if caFile != "" {
+		creds, err := credentials.NewClientTLSFromFile(caFile, serverName)
+		if err != nil {
+			return fmt.Errorf("loading Spanner CA file: %w", err)
+		}
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithTransportCredentials(creds)))
+	}
+
+	spannerOptions = opts
+	return nil
+}
+
+// setSpannerCompression has the Spanner clients gzip their requests and ask for
+// gzipped responses. It trades CPU on both ends for less data on the wire,
+// which pays off for large result sets over a slow or metered link and not
+// much otherwise.
+func setSpannerCompression(enabled bool) {
+	if !enabled {
+		return
+	}
+	spannerOptions = append(spannerOptions,
+		option.WithGRPCDialOption(grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name))))
+}
+
+// validateEndpoint checks endpoint is a host:port pair.
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid Spanner endpoint %q, expected host:port: %w", endpoint, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid Spanner endpoint %q, missing host", endpoint)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid Spanner endpoint %q, bad port %q", endpoint, port)
+	}
+	return nil
+}
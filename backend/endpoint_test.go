@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"google.golang.org/api/option"
+	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/stats"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{endpoint: "spanner.example.internal:443"},
+		{endpoint: "10.0.0.1:9443"},
+		{endpoint: "[::1]:443"},
+		{endpoint: "spanner.example.internal", wantErr: true},
+		{endpoint: ":443", wantErr: true},
+		{endpoint: "host:0", wantErr: true},
+		{endpoint: "host:65536", wantErr: true},
+		{endpoint: "host:https", wantErr: true},
+		{endpoint: "https://host:443", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateEndpoint(tt.endpoint); (err != nil) != tt.wantErr {
+			t.Errorf("validateEndpoint(%q) = %v, want error %v", tt.endpoint, err, tt.wantErr)
+		}
+	}
+}
+
+// withSpannerOptions puts spannerOptions back when the test ends.
+func withSpannerOptions(t *testing.T) {
+	t.Helper()
+
+	prev := spannerOptions
+	spannerOptions = nil
+	t.Cleanup(func() { spannerOptions = prev })
+}
+
+// TestSetSpannerEndpoint points an admin client at a local TLS server with
+// the endpoint options, and expects the call to reach it only when the
+// server's certificate checks out against the CA file and server name.
+func TestSetSpannerEndpoint(t *testing.T) {
+	caFile, cert := newTestCert(t, "spanner.test")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	adminpb.RegisterDatabaseAdminServer(s, &fakeDatabaseAdmin{retention: "1h"})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	tests := []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{serverName: "spanner.test"},
+		{serverName: "elsewhere.test", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			withSpannerOptions(t)
+			withoutEmulator(t)
+
+			if err := setSpannerEndpoint(lis.Addr().String(), caFile, tt.serverName); err != nil {
+				t.Fatal(err)
+			}
+
+			// A failing call is retried until the deadline.
+			timeout := 5 * time.Second
+			if tt.wantErr {
+				timeout = time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			adminClient, err := database.NewDatabaseAdminClient(ctx, append(spannerOptions, option.WithoutAuthentication())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer adminClient.Close()
+
+			db, err := adminClient.GetDatabase(ctx, &adminpb.GetDatabaseRequest{Name: "projects/p/instances/i/databases/d"})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("GetDatabase succeeded against a certificate for another name")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetDatabase through the endpoint: %v", err)
+			}
+			if db.VersionRetentionPeriod != "1h" {
+				t.Errorf("got %v from somewhere other than the test server", db)
+			}
+		})
+	}
+}
+
+func TestSetSpannerEndpointSkipped(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		caFile   string
+		emulator bool
+		wantErr  bool
+	}{
+		{name: "unset"},
+		{name: "emulator", endpoint: "spanner.example.internal:443", emulator: true},
+		// Not validated either, since it isn't used.
+		{name: "bad endpoint on the emulator", endpoint: "nope", emulator: true},
+		{name: "bad endpoint", endpoint: "nope", wantErr: true},
+		{name: "missing CA file", endpoint: "spanner.example.internal:443", caFile: "missing.pem", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSpannerOptions(t)
+			t.Setenv("SPANNER_EMULATOR_HOST", "localhost:9010")
+			if !tt.emulator {
+				withoutEmulator(t)
+			}
+
+			caFile := ""
+			if tt.caFile != "" {
+				caFile = filepath.Join(t.TempDir(), tt.caFile)
+			}
+
+			err := setSpannerEndpoint(tt.endpoint, caFile, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if len(spannerOptions) != 0 {
+				t.Errorf("%d options set, want none", len(spannerOptions))
+			}
+		})
+	}
+}
+
+// compressionRecorder records the compression of each request the server
+// receives.
+type compressionRecorder struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (r *compressionRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *compressionRecorder) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if h, ok := s.(*stats.InHeader); ok {
+		r.mu.Lock()
+		r.seen = append(r.seen, h.Compression)
+		r.mu.Unlock()
+	}
+}
+
+func (r *compressionRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (r *compressionRecorder) HandleConn(context.Context, stats.ConnStats) {}
+
+// TestSetSpannerCompression checks a client built with spannerOptions sends
+// gzipped requests when compression is on, and plain ones otherwise.
+func TestSetSpannerCompression(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled %v", enabled), func(t *testing.T) {
+			withSpannerOptions(t)
+			setSpannerCompression(enabled)
+
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := &compressionRecorder{}
+			s := grpc.NewServer(grpc.StatsHandler(rec))
+			adminpb.RegisterDatabaseAdminServer(s, &fakeDatabaseAdmin{retention: "1h"})
+			go s.Serve(lis)
+			defer s.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			opts := append([]option.ClientOption{
+				option.WithEndpoint(lis.Addr().String()),
+				option.WithoutAuthentication(),
+				option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			}, spannerOptions...)
+			adminClient, err := database.NewDatabaseAdminClient(ctx, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer adminClient.Close()
+
+			if _, err := adminClient.GetDatabase(ctx, &adminpb.GetDatabaseRequest{Name: "projects/p/instances/i/databases/d"}); err != nil {
+				t.Fatal(err)
+			}
+
+			want := ""
+			if enabled {
+				want = gzip.Name
+			}
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if len(rec.seen) != 1 || rec.seen[0] != want {
+				t.Errorf("request compression %q, want [%q]", rec.seen, want)
+			}
+		})
+	}
+}
+
+// withoutEmulator unsets SPANNER_EMULATOR_HOST until the test ends.
+func withoutEmulator(t *testing.T) {
+	t.Helper()
+
+	// Setenv restores the variable afterwards, even once it's unset.
+	t.Setenv("SPANNER_EMULATOR_HOST", "")
+	os.Unsetenv("SPANNER_EMULATOR_HOST")
+}
+
+// newTestCert writes a self-signed certificate for host, valid for 127.0.0.1,
+// to a PEM file and returns the file's path and the certificate.
+func newTestCert(t *testing.T, host string) (string, tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by the data functions. Handlers should check for these with
+// errors.Is rather than looking at gRPC codes directly.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPrecondition       = errors.New("precondition failed")
+	ErrInsufficientBudget = errors.New("insufficient budget")
+	ErrUnsupported        = errors.New("not supported")
+	// ErrUnavailable is a failure that's worth retrying, such as a pooled
+	// session that Spanner no longer knows about.
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// storeError tags an underlying Spanner error with one of the errors above.
+type storeError struct {
+	kind error
+	err  error
+}
+
+func (e *storeError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
+
+func (e *storeError) Is(target error) bool {
+	return target == e.kind
+}
+
+// spannerError maps the gRPC status of a Spanner error onto a typed error.
+// Only the failures the data functions cause on purpose are mapped: a row
+// that's missing, a row that already exists, and an operation that's gone.
+// Anything else, such as a missing database or instance, is returned
+// unchanged, to be answered with a 500.
+//
+// "Session not found" is a NotFound too, but it's about our session rather
+// than the row asked for, so it's made ErrUnavailable instead.
+func spannerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if isSessionNotFound(err) {
+		return &storeError{kind: ErrUnavailable, err: err}
+	}
+
+	var kind error
+
+	switch desc := status.Convert(err).Message(); spanner.ErrCode(err) {
+	case codes.NotFound:
+		if !rowNotFound.MatchString(desc) {
+			return err
+		}
+		kind = ErrNotFound
+	case codes.AlreadyExists:
+		if !rowExists.MatchString(desc) {
+			return err
+		}
+		kind = ErrConflict
+	default:
+		return err
+	}
+
+	return &storeError{kind: kind, err: err}
+}
+
+// rowNotFound and rowExists match the descriptions of the errors spannerError
+// maps, from Spanner and from its emulator, which words them differently.
+var (
+	// A ReadRow of a missing row, an update of one, a write whose parent row
+	// is missing, or an operation that's gone.
+	rowNotFound = regexp.MustCompile(`^(row not found\(|Row \[|Parent row for row \[|Table \w+: Row |Insert failed because key was not found in parent table|Operation not found)`)
+	// An insert of a row that's already there.
+	rowExists = regexp.MustCompile(`^(Row \[|Table \w+: Row )`)
+)
+
+// isSessionNotFound reports whether err is Spanner's "Session not found" error,
+// which a stale pooled session can cause.
+func isSessionNotFound(err error) bool {
+	return spanner.ErrCode(err) == codes.NotFound && strings.Contains(err.Error(), "Session not found")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSpannerError(t *testing.T) {
+	typed := []error{ErrNotFound, ErrConflict, ErrPrecondition, ErrUnavailable}
+
+	tests := []struct {
+		code codes.Code
+		msg  string
+		want error // nil if the error should come back unchanged
+	}{
+		{code: codes.NotFound, msg: "row not found(Table: Singers, PrimaryKey: (99))", want: ErrNotFound},
+		{code: codes.NotFound, msg: "Row [99,1] in table Albums is missing. Row cannot be updated.", want: ErrNotFound},
+		{code: codes.NotFound, msg: "Parent row for row [99,1] in table Albums is missing. Row cannot be written.", want: ErrNotFound},
+		{code: codes.NotFound, msg: "Table Albums: Row {Int64(99), Int64(1)} not found.", want: ErrNotFound},
+		{code: codes.NotFound, msg: "Insert failed because key was not found in parent table:  Parent Table: Singers  Child Table: Albums  Key: {Int64(99)}", want: ErrNotFound},
+		{code: codes.NotFound, msg: "Operation not found: projects/p/instances/i/databases/d/operations/o", want: ErrNotFound},
+		{code: codes.NotFound, msg: "Session not found: projects/p/instances/i/databases/d/sessions/s", want: ErrUnavailable},
+		// Not found, but not a row: these are 500s, not 404s.
+		{code: codes.NotFound, msg: "Database not found: projects/p/instances/i/databases/d"},
+		{code: codes.NotFound, msg: "Instance not found: projects/p/instances/i"},
+		{code: codes.NotFound, msg: "Table not found: Albums"},
+		{code: codes.AlreadyExists, msg: "Row [1,1] in table Albums already exists", want: ErrConflict},
+		{code: codes.AlreadyExists, msg: "Table Albums: Row {Int64(1), Int64(1)} already exists.", want: ErrConflict},
+		{code: codes.AlreadyExists, msg: "Database already exists: projects/p/instances/i/databases/d"},
+		// The store checks its own preconditions; Spanner's are 500s.
+		{code: codes.FailedPrecondition},
+		{code: codes.Aborted},
+		{code: codes.DeadlineExceeded},
+		{code: codes.InvalidArgument},
+		{code: codes.Unavailable},
+		{code: codes.Unknown},
+	}
+
+	for _, tt := range tests {
+		msg := tt.msg
+		if msg == "" {
+			msg = "boom"
+		}
+
+		t.Run(tt.code.String()+"/"+msg, func(t *testing.T) {
+			in := spanner.ToSpannerError(status.Error(tt.code, msg))
+			got := spannerError(in)
+
+			if tt.want == nil {
+				if got != in {
+					t.Fatalf("spannerError(%v) = %v, want it unchanged", in, got)
+				}
+			} else if !errors.Is(got, tt.want) {
+				t.Fatalf("spannerError(%v) = %v, want errors.Is %v", in, got, tt.want)
+			}
+
+			for _, kind := range typed {
+				if kind != tt.want && errors.Is(got, kind) {
+					t.Errorf("spannerError(%v) matches %v too", in, kind)
+				}
+			}
+			// The original error stays reachable for logging.
+			if tt.want != nil && errors.Unwrap(got) != in {
+				t.Errorf("spannerError(%v) unwraps to %v, want the original error", in, errors.Unwrap(got))
+			}
+		})
+	}
+}
+
+func TestSpannerErrorNonSpanner(t *testing.T) {
+	if err := spannerError(nil); err != nil {
+		t.Errorf("spannerError(nil) = %v, want nil", err)
+	}
+
+	plain := errors.New("plain")
+	if err := spannerError(plain); err != plain {
+		t.Errorf("spannerError(%v) = %v, want it unchanged", plain, err)
+	}
+}
+
+// TestDataErrorsFromSpanner checks errors from real Spanner failures, not
+// just hand-built statuses, come out of the data functions typed.
+func TestDataErrorsFromSpanner(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1})
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{
+			name: "missing singer",
+			run:  func() error { _, err := getSinger(ctx, client, 99); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "album exists",
+			run:  func() error { _, err := createAlbum(ctx, client, nil, Album{SingerID: 1, AlbumID: 1}); return err },
+			want: ErrConflict,
+		},
+		{
+			name: "album's singer missing",
+			run:  func() error { _, err := createAlbum(ctx, client, nil, Album{SingerID: 99, AlbumID: 1}); return err },
+			want: ErrNotFound,
+		},
+		{
+			name: "update of a missing album",
+			run:  func() error { return saveAlbum(ctx, client, nil, &Album{SingerID: 1, AlbumID: 99}, WriteUpdate) },
+			want: ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want errors.Is %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrySessionNotFound(t *testing.T) {
+	sessionNotFound := spanner.ToSpannerError(status.Error(codes.NotFound, "Session not found: projects/p/instances/i/databases/d/sessions/s"))
+	other := spanner.ToSpannerError(status.Error(codes.NotFound, "Table not found: Albums"))
+
+	tests := []struct {
+		name      string
+		errs      []error // returned by each read in turn
+		wantReads int
+		wantErr   error
+	}{
+		{name: "ok", errs: []error{nil}, wantReads: 1},
+		{name: "recovers", errs: []error{sessionNotFound, nil}, wantReads: 2},
+		// Only one retry, however often it happens.
+		{name: "gives up", errs: []error{sessionNotFound, sessionNotFound, nil}, wantReads: 2, wantErr: sessionNotFound},
+		{name: "other error", errs: []error{other, nil}, wantReads: 1, wantErr: other},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := 0
+			err := retrySessionNotFound("albums", func() error {
+				reads++
+				return tt.errs[reads-1]
+			})
+
+			if reads != tt.wantReads {
+				t.Errorf("read %d times, want %d", reads, tt.wantReads)
+			}
+			if err != tt.wantErr {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
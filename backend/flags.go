@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+// featureFlags turns named routes on and off at runtime. Flags are read from a
+// JSON object of route name to bool, and reloaded on SIGHUP. Routes that aren't
+// named, or aren't listed in the file, are enabled.
+type featureFlags struct {
+	mu    sync.RWMutex
+	path  string
+	flags map[string]bool
+}
+
+func newFeatureFlags(path string) (*featureFlags, error) {
+	ff := &featureFlags{path: path, flags: make(map[string]bool)}
+	if err := ff.load(); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+// load replaces the current flags with the contents of the flags file. With no
+// file configured every route stays enabled.
+func (ff *featureFlags) load() error {
+	if ff.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(ff.path)
+	if err != nil {
+		return err
+	}
+
+	flags := make(map[string]bool)
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return err
+	}
+
+	ff.mu.Lock()
+	ff.flags = flags
+	ff.mu.Unlock()
+
+	return nil
+}
+
+// reloadOnSignal reloads the flags file every time we get a SIGHUP. A file that
+// fails to load leaves the previous flags in place.
+func (ff *featureFlags) reloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	for range ch {
+		if err := ff.load(); err != nil {
+			log.Printf("Error reloading feature flags: %s", err.Error())
+			continue
+		}
+		log.Printf("Reloaded feature flags from %s", ff.path)
+	}
+}
+
+func (ff *featureFlags) enabled(name string) bool {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+
+	on, ok := ff.flags[name]
+	return !ok || on
+}
+
+func (ff *featureFlags) snapshot() map[string]bool {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+
+	flags := make(map[string]bool, len(ff.flags))
+	for k, v := range ff.flags {
+		flags[k] = v
+	}
+	return flags
+}
+
+// middleware answers 404 for routes whose flag is turned off, as though they
+// were never registered.
+func (ff *featureFlags) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if name := route.GetName(); name != "" && !ff.enabled(name) {
+				notFound(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func writeFlagsFile(t *testing.T, path, contents string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveFlagged serves target through flags' middleware on a router with a
+// named route, an unnamed one, and /admin/flags.
+func serveFlagged(flags *featureFlags, target string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Use(flags.middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	router.HandleFunc("/export", ok).Name("export")
+	router.HandleFunc("/reset", ok).Name("reset")
+	router.HandleFunc("/unnamed", ok)
+	registerAdminRoutes(router, Config{}, nil, nil, "", nil, nil, nil, flags, nil, nil)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestFeatureFlagsMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	writeFlagsFile(t, path, `{"export": false, "reset": true}`)
+
+	flags, err := newFeatureFlags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target   string
+		wantCode int
+	}{
+		{target: "/export", wantCode: http.StatusNotFound},
+		{target: "/reset", wantCode: http.StatusOK},
+		{target: "/unnamed", wantCode: http.StatusOK},
+		{target: "/admin/flags", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		if w := serveFlagged(flags, tt.target); w.Code != tt.wantCode {
+			t.Errorf("GET %s: status = %d, want %d", tt.target, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestFeatureFlagsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	writeFlagsFile(t, path, `{"export": false}`)
+
+	flags, err := newFeatureFlags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFlagsFile(t, path, `{"export": true, "reset": false}`)
+	if err := flags.load(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveFlagged(flags, "/export"); w.Code != http.StatusOK {
+		t.Errorf("export after turning it on: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serveFlagged(flags, "/reset"); w.Code != http.StatusNotFound {
+		t.Errorf("reset after turning it off: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// A broken file keeps the flags we had.
+	writeFlagsFile(t, path, `{"export": `)
+	if err := flags.load(); err == nil {
+		t.Error("loading a broken file succeeded")
+	}
+	if w := serveFlagged(flags, "/reset"); w.Code != http.StatusNotFound {
+		t.Errorf("reset after a failed reload: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w := serveFlagged(flags, "/admin/flags")
+	var got map[string]bool
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %s: %v", w.Body, err)
+	}
+	if len(got) != 2 || !got["export"] || got["reset"] {
+		t.Errorf("/admin/flags = %v, want export on and reset off", got)
+	}
+}
+
+func TestFeatureFlagsNoFile(t *testing.T) {
+	flags, err := newFeatureFlags("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveFlagged(flags, "/export"); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d with no flags file", w.Code, http.StatusOK)
+	}
+
+	if _, err := newFeatureFlags(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("a missing flags file loaded")
+	}
+}
@@ -4,12 +4,16 @@ go 1.17
 
 require (
 	cloud.google.com/go/spanner v1.34.1
+	github.com/anrid/docker-dev-env-example/proto v0.0.0-20220708084834-62bb0ed3bcc6
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/klauspost/compress v1.15.9
 	google.golang.org/api v0.86.0
 	google.golang.org/genproto v0.0.0-20220706185917-7780775163c4
+	google.golang.org/grpc v1.47.0
+	google.golang.org/protobuf v1.28.0
 )
 
 require (
@@ -34,6 +38,4 @@ require (
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
 	google.golang.org/appengine v1.6.7 // indirect
-	google.golang.org/grpc v1.47.0 // indirect
-	google.golang.org/protobuf v1.28.0 // indirect
 )
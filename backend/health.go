@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// dialHealth sets up a connection to the gRPC health service. The dial doesn't
+// block; if the service is down or restarts, the connection reconnects in the
+// background using exponential backoff.
+func dialHealth(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  500 * time.Millisecond,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   15 * time.Second,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+	)
+}
+
+// warmHealth starts connecting to the health service and waits up to timeout
+// for the connection to be ready, so the first /grpc-health call doesn't pay
+// for the dial. If the service isn't up yet we carry on without it, and keep
+// connecting in the background until it is.
+func warmHealth(conn *grpc.ClientConn, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn.Connect()
+
+	for {
+		s := conn.GetState()
+		if s == connectivity.Ready {
+			log.Printf("Health service connection ready")
+			return
+		}
+		if !conn.WaitForStateChange(ctx, s) {
+			log.Printf("Health service not ready after %s (%s), connecting in the background", timeout, conn.GetState())
+			go keepConnecting(conn)
+			return
+		}
+	}
+}
+
+// keepConnecting reconnects conn each time it goes idle, until it's ready or
+// closed. A connection that fails to connect goes idle once its backoff is up
+// and otherwise waits for the next call before trying again.
+func keepConnecting(conn *grpc.ClientConn) {
+	for {
+		s := conn.GetState()
+		switch s {
+		case connectivity.Ready, connectivity.Shutdown:
+			return
+		case connectivity.Idle:
+			conn.Connect()
+		}
+		conn.WaitForStateChange(context.Background(), s)
+	}
+}
+
+type HealthStatus struct {
+	Status string `json:"status"`
+}
+
+// grpcHealthHandler proxies a Check call to the gRPC health service. A service
+// that's unreachable or not serving is reported as 503 so probes can retry,
+// anything else unexpected is a 500.
+func grpcHealthHandler(c pb.HealthClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		res, err := c.Check(ctx, &pb.HealthCheckRequest{Service: r.URL.Query().Get("service")})
+		if err != nil {
+			switch status.Code(err) {
+			case codes.Unavailable, codes.DeadlineExceeded:
+				log.Printf("Health service unavailable: %s", err.Error())
+				writeJSON(w, http.StatusServiceUnavailable, HealthStatus{Status: "UNAVAILABLE"})
+			default:
+				log.Printf("Error: %s", err.Error())
+				writeJSONError(w, http.StatusInternalServerError, internalErrorMessage)
+			}
+			return
+		}
+
+		code := http.StatusOK
+		if res.Status != pb.HealthCheckResponse_SERVING {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, code, HealthStatus{Status: res.Status.String()})
+	}
+}
+
+// hedgedHealthClient sends a second Check if the first hasn't answered within
+// delay, and returns whichever finishes first. At most maxHedges hedged calls
+// are in flight at once, so a slow health service doesn't get twice the load.
+type hedgedHealthClient struct {
+	pb.HealthClient
+	delay  time.Duration
+	hedges chan struct{}
+}
+
+func newHedgedHealthClient(c pb.HealthClient, delay time.Duration, maxHedges int) pb.HealthClient {
+	if delay <= 0 || maxHedges <= 0 {
+		return c
+	}
+	return &hedgedHealthClient{HealthClient: c, delay: delay, hedges: make(chan struct{}, maxHedges)}
+}
+
+type checkResult struct {
+	res *pb.HealthCheckResponse
+	err error
+}
+
+func (h *hedgedHealthClient) Check(ctx context.Context, in *pb.HealthCheckRequest, opts ...grpc.CallOption) (*pb.HealthCheckResponse, error) {
+	// Canceling ctx on return stops whichever call is still running.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan checkResult, 2)
+	call := func() {
+		res, err := h.HealthClient.Check(ctx, in, opts...)
+		results <- checkResult{res, err}
+	}
+
+	go call()
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return r.res, r.err
+	case <-timer.C:
+	}
+
+	select {
+	case h.hedges <- struct{}{}:
+		go func() {
+			defer func() { <-h.hedges }()
+			call()
+		}()
+	default:
+		// Too many hedges in flight already, wait on the first call.
+	}
+
+	r := <-results
+	return r.res, r.err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
+)
+
+// fakeHealthServer answers Check with SERVING, first waiting for whatever
+// delay returns for the call, which is numbered from 1.
+type fakeHealthServer struct {
+	pb.UnimplementedHealthServer
+	calls int32
+	delay func(call int32) time.Duration
+}
+
+func (s *fakeHealthServer) Check(ctx context.Context, in *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	n := atomic.AddInt32(&s.calls, 1)
+	if s.delay != nil {
+		select {
+		case <-time.After(s.delay(n)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING}, nil
+}
+
+// startHealthServer serves srv on addr, or a free port if addr is empty, until
+// the test ends or the returned server is stopped.
+func startHealthServer(t *testing.T, addr string, srv pb.HealthServer) (*grpc.Server, string) {
+	t.Helper()
+
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer()
+	pb.RegisterHealthServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return s, lis.Addr().String()
+}
+
+func dialTestHealth(t *testing.T, addr string) *grpc.ClientConn {
+	t.Helper()
+
+	conn, err := dialHealth(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestHedgedHealthClient checks a Check that hasn't answered within the delay
+// is hedged, and the hedge's answer is returned without waiting for the slow
+// first call.
+func TestHedgedHealthClient(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	srv := &fakeHealthServer{delay: func(call int32) time.Duration {
+		if call == 1 {
+			return time.Minute
+		}
+		return 0
+	}}
+	_, addr := startHealthServer(t, "", srv)
+	conn := dialTestHealth(t, addr)
+	warmHealth(conn, 5*time.Second)
+
+	c := newHedgedHealthClient(pb.NewHealthClient(conn), delay, 1)
+
+	start := time.Now()
+	res, err := c.Check(context.Background(), &pb.HealthCheckRequest{})
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != pb.HealthCheckResponse_SERVING {
+		t.Errorf("status = %s, want SERVING", res.Status)
+	}
+	if n := atomic.LoadInt32(&srv.calls); n != 2 {
+		t.Errorf("server got %d calls, want 2", n)
+	}
+	if elapsed < delay {
+		t.Errorf("answered after %s, before the hedge delay of %s", elapsed, delay)
+	}
+	if elapsed > 10*time.Second {
+		t.Errorf("answered after %s, want the hedge's answer rather than the first call's", elapsed)
+	}
+}
+
+// TestHedgedHealthClientFastAnswer checks a Check answered within the delay
+// isn't hedged at all.
+func TestHedgedHealthClientFastAnswer(t *testing.T) {
+	srv := &fakeHealthServer{}
+	_, addr := startHealthServer(t, "", srv)
+	conn := dialTestHealth(t, addr)
+	warmHealth(conn, 5*time.Second)
+
+	c := newHedgedHealthClient(pb.NewHealthClient(conn), time.Minute, 1)
+	if _, err := c.Check(context.Background(), &pb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&srv.calls); n != 1 {
+		t.Errorf("server got %d calls, want 1", n)
+	}
+}
+
+// TestGRPCHealthRecovers checks /grpc-health goes back to 200 by itself once
+// the health server comes back after a restart, on the same connection.
+func TestGRPCHealthRecovers(t *testing.T) {
+	s, addr := startHealthServer(t, "", &fakeHealthServer{})
+	conn := dialTestHealth(t, addr)
+	warmHealth(conn, 5*time.Second)
+
+	h := grpcHealthHandler(pb.NewHealthClient(conn))
+	check := func() int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/grpc-health", nil))
+		return w.Code
+	}
+
+	if code := check(); code != http.StatusOK {
+		t.Fatalf("before the restart: status = %d, want %d", code, http.StatusOK)
+	}
+
+	s.Stop()
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Errorf("while down: status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	startHealthServer(t, addr, &fakeHealthServer{})
+
+	// The connection reconnects with dialHealth's backoff.
+	deadline := time.Now().Add(20 * time.Second)
+	for check() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("/grpc-health didn't recover after the health server restarted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// TestWarmHealth checks the connection is ready once warmHealth returns, so
+// the first proxied /grpc-health call doesn't wait on the dial.
+func TestWarmHealth(t *testing.T) {
+	srv := &fakeHealthServer{}
+	_, addr := startHealthServer(t, "", srv)
+	conn := dialTestHealth(t, addr)
+
+	if s := conn.GetState(); s == connectivity.Ready {
+		t.Fatalf("state = %s before warming up, want a connection that hasn't dialed yet", s)
+	}
+
+	warmHealth(conn, 5*time.Second)
+
+	if s := conn.GetState(); s != connectivity.Ready {
+		t.Fatalf("state = %s after warming up, want READY", s)
+	}
+	if n := atomic.LoadInt32(&srv.calls); n != 0 {
+		t.Errorf("server got %d calls while warming up, want none", n)
+	}
+
+	w := httptest.NewRecorder()
+	grpcHealthHandler(pb.NewHealthClient(conn))(w, httptest.NewRequest(http.MethodGet, "/grpc-health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("first /grpc-health: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// TestWarmHealthServerDown checks warming up gives up after the timeout when
+// the health server isn't up, and the connection still comes up by itself
+// once it is.
+func TestWarmHealthServerDown(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	conn := dialTestHealth(t, addr)
+
+	const timeout = 200 * time.Millisecond
+	start := time.Now()
+	warmHealth(conn, timeout)
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 5*time.Second {
+		t.Errorf("warmHealth returned after %s, want about %s", elapsed, timeout)
+	}
+	if s := conn.GetState(); s == connectivity.Ready {
+		t.Fatalf("state = %s with no server, want not ready", s)
+	}
+
+	startHealthServer(t, addr, &fakeHealthServer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for s := conn.GetState(); s != connectivity.Ready; s = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, s) {
+			t.Fatalf("connection still %s after the health server came up", s)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// checkNotModified sets the headers that let CDNs and browsers cache a read
+// response, and answers 304 if the client's copy is still current, in which
+// case it returns true and the caller shouldn't write a body. Vary is set by
+// compressHandler for every response.
+//
+// private is set when requests are authenticated. The response is then only
+// for the caller's own cache: Vary: Accept-Encoding alone would let a shared
+// cache hand it to anyone.
+//
+// lastModified is the newest LastUpdateTime in the response, and is zero if
+// the response is empty. For lists, pass it through albumsLastModified, so
+// other writes count as changes too.
+func checkNotModified(w http.ResponseWriter, r *http.Request, maxAge time.Duration, private bool, lastModified time.Time) bool {
+	if maxAge > 0 {
+		scope := "public"
+		if private {
+			scope = "private"
+		}
+		w.Header().Set("Cache-Control", scope+", max-age="+strconv.Itoa(int(maxAge/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if lastModified.IsZero() {
+		return false
+	}
+
+	// HTTP dates only have second precision.
+	lastModified = lastModified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil && !lastModified.After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// lastAlbumWrite is the commit timestamp, in Unix nanoseconds, of the newest
+// album write made by this process.
+var lastAlbumWrite int64
+
+// noteAlbumWrite records that albums were written, or deleted, at ts.
+func noteAlbumWrite(ts time.Time) {
+	ns := ts.UnixNano()
+	for {
+		last := atomic.LoadInt64(&lastAlbumWrite)
+		if ns <= last || atomic.CompareAndSwapInt64(&lastAlbumWrite, last, ns) {
+			return
+		}
+	}
+}
+
+// albumsLastModified is the Last-Modified for an album list whose newest
+// LastUpdateTime is rows. The rows alone miss writes that took albums out of
+// the list: a delete takes its LastUpdateTime with it, and an update can move
+// an album out of a filter or ?updatedBefore window. So the newest album
+// write of any kind counts as a modification of every list. It's only the
+// writes this process made that are known: writes through another replica
+// still go unnoticed by this one, for up to the client's own max-age.
+func albumsLastModified(rows time.Time) time.Time {
+	if ns := atomic.LoadInt64(&lastAlbumWrite); ns > 0 {
+		if written := time.Unix(0, ns); written.After(rows) {
+			return written
+		}
+	}
+	return rows
+}
+
+// albumETag is an album's entity tag: its LastUpdateTime as an RFC3339 string
+// with full precision, so clients can build it from a listed album's
+// last_update_time as well as take it from a write's ETag header.
+func albumETag(lastUpdate time.Time) string {
+	return strconv.Quote(lastUpdate.UTC().Format(time.RFC3339Nano))
+}
+
+// etagMatches reports whether an If-Match header matches etag, either as one
+// of its comma-separated tags or as "*". Weak tags never match, as If-Match
+// requires a strong comparison.
+func etagMatches(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := albumETag(time.Date(2022, 7, 1, 12, 0, 0, 123456789, time.UTC))
+
+	tests := []struct {
+		ifMatch string
+		want    bool
+	}{
+		{ifMatch: etag, want: true},
+		{ifMatch: "*", want: true},
+		{ifMatch: `"other", ` + etag, want: true},
+		{ifMatch: `"other"`},
+		{ifMatch: "W/" + etag},
+		{ifMatch: albumETag(time.Date(2022, 7, 1, 12, 0, 0, 123456000, time.UTC))},
+	}
+
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%s, %s) = %v, want %v", tt.ifMatch, etag, got, tt.want)
+		}
+	}
+}
+
+func TestAlbumETagIgnoresZone(t *testing.T) {
+	utc := time.Date(2022, 7, 1, 12, 0, 0, 5, time.UTC)
+	if albumETag(utc) != albumETag(utc.In(time.FixedZone("JST", 9*60*60))) {
+		t.Error("the same instant in two zones got different ETags")
+	}
+	if want := `"2022-07-01T12:00:00.000000005Z"`; albumETag(utc) != want {
+		t.Errorf("albumETag = %s, want %s", albumETag(utc), want)
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	lastModified := time.Date(2022, 7, 1, 12, 0, 0, 500000000, time.UTC)
+	const httpDate = "Fri, 01 Jul 2022 12:00:00 GMT"
+
+	tests := []struct {
+		name             string
+		maxAge           time.Duration
+		private          bool
+		lastModified     time.Time
+		ifModifiedSince  string
+		wantCacheControl string
+		wantLastModified string
+		want304          bool
+	}{
+		{name: "max-age", maxAge: time.Minute, lastModified: lastModified,
+			wantCacheControl: "public, max-age=60", wantLastModified: httpDate},
+		{name: "private", maxAge: time.Minute, private: true, lastModified: lastModified,
+			wantCacheControl: "private, max-age=60", wantLastModified: httpDate},
+		{name: "revalidate", lastModified: lastModified,
+			wantCacheControl: "no-cache", wantLastModified: httpDate},
+		{name: "empty list", wantCacheControl: "no-cache"},
+		// Last-Modified is truncated to the second, so the client's copy of
+		// it matches.
+		{name: "unchanged", lastModified: lastModified, ifModifiedSince: httpDate,
+			wantCacheControl: "no-cache", wantLastModified: httpDate, want304: true},
+		{name: "newer copy", lastModified: lastModified, ifModifiedSince: "Fri, 01 Jul 2022 13:00:00 GMT",
+			wantCacheControl: "no-cache", wantLastModified: httpDate, want304: true},
+		{name: "changed", lastModified: lastModified, ifModifiedSince: "Fri, 01 Jul 2022 11:59:59 GMT",
+			wantCacheControl: "no-cache", wantLastModified: httpDate},
+		{name: "bad date", lastModified: lastModified, ifModifiedSince: "yesterday",
+			wantCacheControl: "no-cache", wantLastModified: httpDate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/albums", nil)
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			w := httptest.NewRecorder()
+
+			got := checkNotModified(w, r, tt.maxAge, tt.private, tt.lastModified)
+
+			if got != tt.want304 {
+				t.Errorf("checkNotModified = %v, want %v", got, tt.want304)
+			}
+			if tt.want304 && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotModified)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCacheControl)
+			}
+			if got := w.Header().Get("Last-Modified"); got != tt.wantLastModified {
+				t.Errorf("Last-Modified = %q, want %q", got, tt.wantLastModified)
+			}
+		})
+	}
+}
+
+// TestAlbumsLastModifiedDelete checks a delete makes a list modified even
+// though none of its remaining rows changed.
+func TestAlbumsLastModifiedDelete(t *testing.T) {
+	defer func(last int64) { lastAlbumWrite = last }(lastAlbumWrite)
+	lastAlbumWrite = 0
+
+	rows := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	if got := albumsLastModified(rows); !got.Equal(rows) {
+		t.Errorf("with no writes: got %v, want %v", got, rows)
+	}
+
+	deleted := rows.Add(time.Hour)
+	noteAlbumWrite(deleted)
+	// An older delete committing later doesn't move it back.
+	noteAlbumWrite(rows.Add(time.Minute))
+
+	if got := albumsLastModified(rows); !got.Equal(deleted) {
+		t.Errorf("after a delete: got %v, want %v", got, deleted)
+	}
+	if got := albumsLastModified(time.Time{}); !got.Equal(deleted) {
+		t.Errorf("empty list after a delete: got %v, want %v", got, deleted)
+	}
+	if later := deleted.Add(time.Hour); !albumsLastModified(later).Equal(later) {
+		t.Errorf("row newer than the delete: got %v, want %v", albumsLastModified(later), later)
+	}
+
+	// A client holding the list from before the delete gets it again.
+	r := httptest.NewRequest(http.MethodGet, "/albums", nil)
+	r.Header.Set("If-Modified-Since", rows.Format(http.TimeFormat))
+	if checkNotModified(httptest.NewRecorder(), r, 0, false, albumsLastModified(rows)) {
+		t.Error("got 304 for a list that lost a row")
+	}
+}
+
+// TestAlbumsLastModifiedWrite checks an update that moves an album out of a
+// list makes the list modified, though the rows left in it are older.
+func TestAlbumsLastModifiedWrite(t *testing.T) {
+	defer func(last int64) { lastAlbumWrite = last }(lastAlbumWrite)
+
+	ctx := context.Background()
+	s := newMemoryStore(nil)
+	opts := ListOptions{UpdatedBefore: time.Now().Add(time.Second), Limit: 10}
+	before, err := s.ListAlbums(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/albums", nil)
+	r.Header.Set("If-Modified-Since", albumsLastModified(before.LastModified).Format(http.TimeFormat))
+
+	// Updating the album takes it out of the ?updatedBefore window.
+	time.Sleep(time.Until(opts.UpdatedBefore))
+	a, err := s.GetAlbum(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveAlbum(ctx, a, WriteUpdate); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := s.ListAlbums(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Count != before.Count-1 {
+		t.Fatalf("got %d albums after the update, want %d", after.Count, before.Count-1)
+	}
+	if checkNotModified(httptest.NewRecorder(), r, 0, false, albumsLastModified(after.LastModified)) {
+		t.Error("got 304 for a list an update took a row out of")
+	}
+}
@@ -1,30 +1,196 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
 
 	"cloud.google.com/go/spanner"
 	database "cloud.google.com/go/spanner/admin/database/apiv1"
 	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
-	"google.golang.org/api/iterator"
 	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
 	instancepb "google.golang.org/genproto/googleapis/spanner/admin/instance/v1"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
 )
 
 type Config struct {
-	GCloudProject     string `required:"true" envconfig:"GCLOUD_PROJECT"`
-	SpannerInstanceID string `required:"true" split_words:"true"`
-	SpannerDatabaseID string `required:"true" split_words:"true"`
+	// Datastore is where the album endpoints keep albums: spanner, or memory
+	// to run them without a database, starting from the demo data and lost on
+	// restart. The other endpoints are only served from Spanner. The Spanner
+	// settings below are required with spanner.
+	Datastore string `envconfig:"DATASTORE" default:"spanner"`
+
+	GCloudProject     string `envconfig:"GCLOUD_PROJECT"`
+	SpannerInstanceID string `split_words:"true"`
+	SpannerDatabaseID string `split_words:"true"`
+	AdminEnabled      bool   `split_words:"true"`
+	JSONEnvelope      bool   `split_words:"true"`
+	HealthAddr        string `split_words:"true"`
+	JSONProjection    bool   `split_words:"true"`
+
+	// HealthHedgeDelay enables hedging of /grpc-health calls: if the health
+	// service hasn't answered after this long a second Check is sent. At most
+	// HealthMaxHedges hedged calls are in flight at once.
+	HealthHedgeDelay time.Duration `split_words:"true"`
+	HealthMaxHedges  int           `split_words:"true" default:"10"`
+
+	// HealthWarmupTimeout is how long startup waits for the health service
+	// connection to be ready. Zero skips the wait and dials on first use.
+	HealthWarmupTimeout time.Duration `split_words:"true" default:"5s"`
+
+	// ReadyCacheTTL is how long /readyz reuses its last Spanner ping, less up
+	// to a fifth as jitter. Zero pings on every probe.
+	ReadyCacheTTL time.Duration `split_words:"true" default:"2s"`
+
+	// VersionRetentionPeriod should match the database's version_retention_period
+	// option; it bounds how far back ?asOf reads can go.
+	VersionRetentionPeriod time.Duration `split_words:"true" default:"1h"`
+
+	// CacheTTL enables caching of read endpoints when set.
+	CacheTTL     time.Duration `split_words:"true"`
+	CacheMaxSize int           `split_words:"true" default:"1000"`
+	// CacheStaleIfError lets reads fall back to a cached response up to this
+	// long past its TTL when Spanner fails.
+	CacheStaleIfError time.Duration `split_words:"true"`
+
+	// HTTPCacheMaxAge is the Cache-Control max-age for /albums responses.
+	// Without it clients are told to revalidate with If-Modified-Since.
+	HTTPCacheMaxAge time.Duration `envconfig:"HTTP_CACHE_MAX_AGE"`
+
+	// SingerInfoContentType is the Content-Type of GET /singers/{id}/info.
+	SingerInfoContentType string `split_words:"true" default:"application/octet-stream"`
+
+	// CompressionMinSize is the smallest response body, in bytes, we bother
+	// compressing.
+	CompressionMinSize int `split_words:"true" default:"1024"`
+
+	// HTTPDisableKeepAlives closes every connection after one response, for
+	// load balancers that don't cope with reused connections.
+	HTTPDisableKeepAlives bool `envconfig:"HTTP_DISABLE_KEEP_ALIVES"`
+
+	// HTTPIdleTimeout is how long an idle keep-alive connection is kept open.
+	// Set it below the load balancer's own idle timeout so the server is never
+	// the one to close a connection the load balancer is about to reuse.
+	HTTPIdleTimeout time.Duration `envconfig:"HTTP_IDLE_TIMEOUT" default:"2m"`
+
+	// ShutdownTimeout is how long in-flight requests get to finish after a
+	// SIGINT or SIGTERM. Keep it under the pod's termination grace period.
+	ShutdownTimeout time.Duration `split_words:"true" default:"10s"`
+
+	// AccessLogSkip lists paths that aren't written to the access log.
+	AccessLogSkip []string `split_words:"true" default:"/metrics,/readyz,/healthz,/livez"`
+
+	// FlagsFile is a JSON file of route name to bool used to switch endpoints
+	// off without a redeploy. It's reloaded on SIGHUP.
+	FlagsFile string `split_words:"true"`
+
+	// MaintenanceFile turns maintenance mode on while it exists, and is
+	// where PUT /admin/maintenance switches it. It's checked once a second.
+	// Point the health server's -maintenance-file at the same path.
+	MaintenanceFile string `split_words:"true"`
+
+	// MaintenanceRetryAfter is the Retry-After sent with writes rejected in
+	// maintenance mode.
+	MaintenanceRetryAfter time.Duration `split_words:"true" default:"5m"`
+
+	// TimeFormat is how timestamps are rendered in responses: rfc3339 or
+	// unixmillis.
+	TimeFormat string `split_words:"true" default:"rfc3339"`
+
+	// JSONNaming is the key convention of JSON responses, snake (singer_id)
+	// or camel (singerId). Request bodies and query parameters keep their
+	// usual names either way.
+	JSONNaming string `split_words:"true" default:"snake"`
+
+	// NullBudget is how a NULL marketing_budget is rendered: null, zero or
+	// omit. omit can't be combined with JSONProjection.
+	NullBudget string `split_words:"true" default:"null"`
+
+	// SlowQueryThreshold logs every Spanner query that takes at least this
+	// long. Zero turns the log off. SlowQueryRows adds the number of rows the
+	// query returned.
+	SlowQueryThreshold time.Duration `split_words:"true"`
+	SlowQueryRows      bool          `split_words:"true"`
+
+	// SpannerWritePriority is the priority of every write: low, medium or
+	// high. Unset leaves it to Spanner, which treats it as high.
+	SpannerWritePriority string `split_words:"true"`
+
+	// SpannerTxnTagPrefix tags every write with this prefix followed by the
+	// write's name, e.g. myapp.saveAlbum, for Spanner's transaction stats.
+	SpannerTxnTagPrefix string `split_words:"true"`
+
+	// TxnDebug logs the commit timestamp of every write transaction and the
+	// read timestamp of read-only transactions.
+	TxnDebug bool `split_words:"true"`
+	// TxnMaxAttempts caps how many times an aborted read-write transaction is
+	// tried before failing; zero means no cap.
+	TxnMaxAttempts int `split_words:"true" default:"10"`
+
+	// AuditSink is where write audit records go: stdout, spanner (the AuditLog
+	// table) or nowhere when empty.
+	AuditSink string `split_words:"true"`
+
+	// SpannerEndpoint overrides the Spanner API endpoint (host:port) outside
+	// the emulator. SpannerCAFile and SpannerTLSServerName customize how its
+	// certificate is verified.
+	SpannerEndpoint      string `split_words:"true"`
+	SpannerCAFile        string `envconfig:"SPANNER_CA_FILE"`
+	SpannerTLSServerName string `envconfig:"SPANNER_TLS_SERVER_NAME"`
+
+	// SpannerCompression gzips traffic between us and Spanner.
+	SpannerCompression bool `split_words:"true"`
+
+	// SpannerClientAttempts is how many times creating the Spanner client is
+	// tried at startup before giving up.
+	SpannerClientAttempts int `split_words:"true" default:"5"`
+
+	// RouteTimeout bounds how long a request may take, and RouteTimeouts
+	// overrides it per route name, e.g. "albums:2s,admin.operations:30s". A
+	// zero timeout means no limit.
+	RouteTimeout  time.Duration            `split_words:"true" default:"10s"`
+	RouteTimeouts map[string]time.Duration `split_words:"true"`
+
+	// MySQLDSN enables the MySQL store. The pool settings default to those of
+	// database/sql; see MySQLPool.
+	MySQLDSN             string        `envconfig:"MYSQL_DSN" secret:"true"`
+	MySQLMaxOpenConns    int           `envconfig:"MYSQL_MAX_OPEN_CONNS"`
+	MySQLMaxIdleConns    int           `envconfig:"MYSQL_MAX_IDLE_CONNS" default:"2"`
+	MySQLConnMaxLifetime time.Duration `envconfig:"MYSQL_CONN_MAX_LIFETIME"`
+
+	// AuthMode is how requests are authenticated: apikey, jwt, or not at all
+	// when empty. AuthAPIKeys maps principal names to their keys, e.g.
+	// "ci:abc123". AuthPublicPaths are never authenticated.
+	AuthMode             string            `split_words:"true"`
+	AuthAPIKeys          map[string]string `envconfig:"AUTH_API_KEYS" secret:"true"`
+	AuthJWTAlg           string            `envconfig:"AUTH_JWT_ALG" default:"HS256"`
+	AuthJWTSecret        string            `envconfig:"AUTH_JWT_SECRET" secret:"true"`
+	AuthJWTPublicKeyFile string            `envconfig:"AUTH_JWT_PUBLIC_KEY_FILE"`
+	AuthPublicPaths      []string          `split_words:"true" default:"/metrics,/readyz,/healthz,/livez"`
+
+	// AuthAPIKeyRoles gives API key principals space-separated roles, e.g.
+	// "ci:admin reader". JWT principals get theirs from the roles claim.
+	AuthAPIKeyRoles map[string]string `split_words:"true"`
+	// RouteRoles sets the role needed for a route by name, e.g.
+	// "albums:reader". /admin routes need the admin role by default and
+	// others are open to any authenticated principal.
+	RouteRoles map[string]string `split_words:"true"`
 }
 
 func main() {
@@ -33,146 +199,864 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	if err := checkDatastore(cfg); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := setTimeFormat(cfg.TimeFormat); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := setSpannerEndpoint(cfg.SpannerEndpoint, cfg.SpannerCAFile, cfg.SpannerTLSServerName); err != nil {
+		log.Fatal(err.Error())
+	}
+	setSpannerCompression(cfg.SpannerCompression)
 
-	format := `
-	GCloud Project      : %v
-	Spanner Instance ID : %s
-	Spanner Database ID : %s
-	Use Spanner Emu     : %t (%s)
-	` + "\n"
+	logConfig(cfg)
 
-	spannerEmuHost, isUseEmu := os.LookupEnv("SPANNER_EMULATOR_HOST")
-	_, err = fmt.Printf(format, cfg.GCloudProject, cfg.SpannerInstanceID, cfg.SpannerDatabaseID, isUseEmu, spannerEmuHost)
-	if err != nil {
+	if err := setJSONNaming(cfg.JSONNaming); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := setNullBudget(cfg.NullBudget, cfg.JSONProjection); err != nil {
 		log.Fatal(err.Error())
 	}
 
+	if err := setWriteOptions(cfg.SpannerWritePriority, cfg.SpannerTxnTagPrefix); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	txnDebug = cfg.TxnDebug
+	slowQueryThreshold = cfg.SlowQueryThreshold
+	slowQueryRows = cfg.SlowQueryRows
+	txnMaxAttempts = cfg.TxnMaxAttempts
+
 	ctx := context.Background()
 
-	if isUseEmu {
+	var (
+		client      *spanner.Client
+		adminClient *database.DatabaseAdminClient
+		dbPath      string
+		audit       *auditLog
+	)
+	if cfg.Datastore == DatastoreMemory {
+		log.Print("Keeping albums in memory, Spanner endpoints disabled")
+		if audit, err = newAuditLog(cfg.AuditSink, nil); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		client, adminClient, dbPath, audit = bootstrapSpanner(ctx, cfg)
+		defer client.Close()
+		defer adminClient.Close()
+	}
+
+	var mysqlDB *sql.DB
+	if cfg.MySQLDSN != "" {
+		mysqlDB, err = openMySQL(cfg.MySQLDSN, MySQLPool{
+			MaxOpenConns:    cfg.MySQLMaxOpenConns,
+			MaxIdleConns:    cfg.MySQLMaxIdleConns,
+			ConnMaxLifetime: cfg.MySQLConnMaxLifetime,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer mysqlDB.Close()
+	}
+
+	log.Print("HTTP server listening on port 8000")
+
+	cache := newResponseCache(cfg.CacheTTL, cfg.CacheStaleIfError, cfg.CacheMaxSize)
+	reads := newCoalescer()
+
+	flags, err := newFeatureFlags(cfg.FlagsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Without a file there's nothing to reload, so leave SIGHUP alone.
+	if cfg.FlagsFile != "" {
+		go flags.reloadOnSignal()
+	}
+
+	maintenance := newMaintenanceMode(cfg.MaintenanceFile, cfg.MaintenanceRetryAfter)
+
+	r := mux.NewRouter()
+	timeouts := &routeTimeouts{fallback: cfg.RouteTimeout, overrides: cfg.RouteTimeouts}
+
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r.Use(
+		recordOutcomes,
+		authMiddleware(auth, cfg.AuthPublicPaths),
+		authzMiddleware(auth != nil, cfg.RouteRoles),
+		flags.middleware,
+		maintenance.middleware,
+		timeouts.middleware,
+	)
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+
+	r.Handle("/metrics", expvar.Handler()).Methods(http.MethodGet)
+
+	r.HandleFunc("/livez", livezHandler).Methods(http.MethodGet)
+
+	if cfg.Datastore == DatastoreMemory {
+		// There's no database to wait for or lose.
+		r.HandleFunc("/readyz", livezHandler).Methods(http.MethodGet)
+		r.HandleFunc("/healthz", livezHandler).Methods(http.MethodGet)
+
+		registerAlbumRoutes(r, cfg, newMemoryStore(audit), cache, reads)
+	} else {
+		ready := newReadiness(cfg.ReadyCacheTTL, client, adminClient, dbPath)
+		go ready.warmUp(ctx)
+
+		r.HandleFunc("/readyz", readyzHandler(ready)).Methods(http.MethodGet)
+		r.HandleFunc("/healthz", healthzHandler(client)).Methods(http.MethodGet)
+
+		registerRoutes(r, cfg, client, audit, cache, reads)
+	}
+
+	if cfg.HealthAddr != "" {
+		conn, err := dialHealth(cfg.HealthAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		if cfg.HealthWarmupTimeout > 0 {
+			warmHealth(conn, cfg.HealthWarmupTimeout)
+		}
+
+		r.HandleFunc("/grpc-health", grpcHealthHandler(newHedgedHealthClient(pb.NewHealthClient(conn), cfg.HealthHedgeDelay, cfg.HealthMaxHedges))).Methods(http.MethodGet).Name("grpc-health")
+	}
+
+	if cfg.AdminEnabled {
+		log.Print("Admin endpoints enabled")
+		registerAdminRoutes(r, cfg, client, adminClient, dbPath, audit, cache, reads, flags, maintenance, mysqlDB)
+	}
+
+	srv := newHTTPServer(cfg, accessLogHandler(os.Stdout, cfg.AccessLogSkip, compressHandler(cfg.CompressionMinSize, r)))
+	if cfg.HTTPDisableKeepAlives {
+		log.Print("HTTP keep-alives disabled")
+	} else {
+		log.Printf("HTTP keep-alives enabled, idle timeout %s", cfg.HTTPIdleTimeout)
+	}
+
+	stop, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-stop.Done()
+	// Stop catching signals, so a second one kills us outright.
+	cancel()
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests ...", cfg.ShutdownTimeout)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error: shutting down: %s", err.Error())
+	}
+	// The deferred closes, the Spanner client last, run as we return.
+	log.Print("Server stopped")
+}
+
+// bootstrapSpanner readies Spanner for serving: on the emulator it creates the
+// instance and database afresh, then it connects, migrates the schema and
+// seeds the demo data. It exits if any of that fails.
+func bootstrapSpanner(ctx context.Context, cfg Config) (client *spanner.Client, adminClient *database.DatabaseAdminClient, dbPath string, audit *auditLog) {
+	if usingEmulator() {
 		log.Print("Deleting Spanner instance ...")
-		deleteInstance(ctx, cfg.GCloudProject, cfg.SpannerInstanceID)
+		// The instance won't exist on a fresh emulator, so a failure here is
+		// recorded but otherwise ignored.
+		_ = timeStep("delete_instance", func() error {
+			return deleteInstance(ctx, cfg.GCloudProject, cfg.SpannerInstanceID)
+		})
 
 		log.Print("Creating Spanner instance ...")
-		if err := createInstance(ctx, cfg.GCloudProject, cfg.SpannerInstanceID); err != nil {
+		if err := timeStep("create_instance", func() error {
+			return createInstance(ctx, cfg.GCloudProject, cfg.SpannerInstanceID)
+		}); err != nil {
 			log.Fatal(err)
 		}
 
 		log.Print("Creating Spanner database ...")
-		if err := createDB(ctx, cfg.GCloudProject, cfg.SpannerInstanceID, cfg.SpannerDatabaseID); err != nil {
+		if err := timeStep("create_database", func() error {
+			return createDB(ctx, cfg.GCloudProject, cfg.SpannerInstanceID, cfg.SpannerDatabaseID)
+		}); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	dbPath := fmt.Sprintf("projects/%s/instances/%s/databases/%s", cfg.GCloudProject, cfg.SpannerInstanceID, cfg.SpannerDatabaseID)
+	dbPath = fmt.Sprintf("projects/%s/instances/%s/databases/%s", cfg.GCloudProject, cfg.SpannerInstanceID, cfg.SpannerDatabaseID)
 
-	log.Print("Inserting data into tables: Singers, Albums ...")
-	if err := insertOrUpdate(ctx, dbPath); err != nil {
+	// Client creation can fail transiently right after boot, before we've
+	// talked to Spanner at all, so it's retried separately from the checks
+	// below. Everything shares this one client and its session pool.
+	log.Print("Creating Spanner client ...")
+	if err := timeStep("create_client", func() (err error) {
+		client, err = newClientWithRetry(ctx, dbPath, cfg.SpannerClientAttempts)
+		return err
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Likewise one admin client serves the pre-flight, migrations, readiness
+	// probes and admin endpoints. Creating one dials a connection of its own.
+	adminClient, err := database.NewDatabaseAdminClient(ctx, spannerOptions...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Bootstrap goes through the admin API while serving only needs the data
+	// API, so check the admin side up front rather than failing halfway
+	// through the migrations.
+	log.Print("Checking Spanner admin API ...")
+	if err := timeStep("admin_check", func() error { return checkAdminAPI(ctx, adminClient, dbPath) }); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Applying %d schema migrations ...", len(migrations))
+	if err := timeStep("migrate", func() error { return applyDDL(ctx, adminClient, dbPath, migrations) }); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Print("Adding a MarketingBudget column to table Albums ...")
-	if err := addMarketingBudgetColumn(ctx, dbPath); err != nil {
+	audit, err = newAuditLog(cfg.AuditSink, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("Inserting data into tables: Singers, Albums ...")
+	if err := timeStep("seed", func() error { return insertOrUpdate(ctx, client, audit) }); err != nil {
 		log.Fatal(err)
 	}
 
 	log.Print("Updating MarketingBudgets ...")
-	if err := updateMarketingBudgets(ctx, dbPath); err != nil {
+	if err := timeStep("update_budgets", func() error { return updateMarketingBudgets(ctx, client, audit) }); err != nil {
 		log.Fatal(err)
 	}
 
 	log.Print("Transferring MarketingBudgets ...")
-	if err := transferMarketingBudgets(ctx, dbPath); err != nil {
-		log.Fatal(err)
+	if err := timeStep("transfer_budgets", func() error { return transferMarketingBudgets(ctx, client, audit) }); err != nil {
+		if !errors.Is(err, ErrInsufficientBudget) {
+			log.Fatal(err)
+		}
+		log.Printf("Skipped transfer: %s", err.Error())
 	}
 
-	log.Print("HTTP server listening on port 8000")
+	checkEmulatorCommitTimestamps(func() error {
+		return timeStep("check_commit_timestamps", func() error { return checkCommitTimestamps(ctx, client) })
+	})
 
-	r := mux.NewRouter()
+	return
+}
 
-	r.HandleFunc("/albums", func(w http.ResponseWriter, r *http.Request) {
-		albums, err := getAlbums(r.Context(), dbPath, 3)
+// registerRoutes adds the album and singer endpoints to the router, with the
+// album endpoints served from Spanner.
+func registerRoutes(r *mux.Router, cfg Config, client *spanner.Client, audit *auditLog, cache *responseCache, reads *coalescer) {
+	registerAlbumRoutes(r, cfg, newSpannerStore(client, audit, cfg.JSONProjection), cache, reads)
+
+	// GET /albums/sync pulls up to ?limit albums changed after ?since, or
+	// after ?page_token, which is the next_page_token from the last pull and
+	// picks up exactly where it left off. since is rounded up like any other
+	// bound, so passing back a millisecond next_since never resends albums;
+	// only the token can carry on inside a commit a pull stopped part way
+	// through.
+	r.HandleFunc("/albums/sync", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		limit := maxAlbumLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := parseLimit(v)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			limit = n
+		}
+
+		from := sinceCursor(time.Time{})
+		switch since, token := q.Get("since"), q.Get("page_token"); {
+		case since != "" && token != "":
+			writeJSONError(w, http.StatusBadRequest, "since and page_token can't be used together")
+			return
+		case since != "":
+			t, err := parseTimestampRoundUp(since)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "since: "+err.Error())
+				return
+			}
+			from = sinceCursor(t)
+		case token != "":
+			c, err := decodeAlbumCursor(token)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			from = c
+		}
+
+		res, err := syncAlbums(r.Context(), client, from, limit)
 		if err != nil {
-			log.Printf("Error: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, err)
 			return
 		}
 
-		enc := json.NewEncoder(w)
-		enc.SetIndent("", "  ")
-		enc.Encode(albums)
-	})
+		writeJSON(w, http.StatusOK, res)
+	}).Methods(http.MethodGet).Name("albums.sync")
 
-	log.Fatal(http.ListenAndServe(":8000", handlers.LoggingHandler(os.Stdout, r)))
-}
+	r.HandleFunc("/albums/top", func(w http.ResponseWriter, r *http.Request) {
+		n, err := parseTopN(r.URL.Query().Get("n"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-type Album struct {
-	SingerID        int64             `json:"singer_id"`
-	AlbumID         int64             `json:"album_id"`
-	MarketingBudget spanner.NullInt64 `json:"marketing_budget"`
-	LastUpdateTime  spanner.NullTime  `json:"last_update_time"`
-}
+		albums, err := getTopAlbums(r.Context(), client, n)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
 
-func getAlbums(ctx context.Context, dbPath string, max int) (albums []*Album, err error) {
-	var client *spanner.Client
+		writeList(w, r, cfg.JSONEnvelope, albums, len(albums), 0, "")
+	}).Methods(http.MethodGet).Name("albums.top")
 
-	client, err = spanner.NewClient(ctx, dbPath)
-	if err != nil {
-		return
-	}
-	defer client.Close()
+	r.HandleFunc("/singers/{id}/info", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
+			return
+		}
 
-	stmt := spanner.Statement{
-		SQL: `SELECT SingerId, AlbumId, MarketingBudget, LastUpdateTime
-              FROM Albums
-			  ORDER BY LastUpdateTime DESC
-			  LIMIT @max
-			  `,
-		Params: map[string]interface{}{
-			"max": max,
-		},
+		info, err := getSingerInfo(r.Context(), client, id)
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no info for singer %d", id))
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", cfg.SingerInfoContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(info)))
+		w.Write(info)
+	}).Methods(http.MethodGet).Name("singers.info.get")
+
+	r.HandleFunc("/singers/{id}/info", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
+			return
+		}
+
+		// Reading one byte past the limit tells a body that's too large apart
+		// from one that couldn't be read.
+		info, err := io.ReadAll(io.LimitReader(r.Body, maxSingerInfoSize+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "reading info: "+err.Error())
+			return
+		}
+		if len(info) > maxSingerInfoSize {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("info must be at most %d bytes", maxSingerInfoSize))
+			return
+		}
+
+		err = setSingerInfo(r.Context(), client, audit, id, info)
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("singer %d not found", id))
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPut).Name("singers.info.put")
+
+	// Registered before /singers/{id}, which would otherwise match it.
+	r.HandleFunc("/singers/empty", func(w http.ResponseWriter, r *http.Request) {
+		singers, err := getSingersWithoutAlbums(r.Context(), client)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeList(w, r, cfg.JSONEnvelope, singers, len(singers), 0, "")
+	}).Methods(http.MethodGet).Name("singers.empty")
+
+	r.HandleFunc("/singers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
+			return
+		}
+
+		var res interface{}
+
+		switch embed := r.URL.Query().Get("embed"); embed {
+		case "":
+			res, err = getSinger(r.Context(), client, id)
+		case "albums":
+			res, err = getSingerWithAlbums(r.Context(), client, id)
+		default:
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid embed %q, expected albums", embed))
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("singer %d not found", id))
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}).Methods(http.MethodGet).Name("singers.get")
+}
+
+// registerAlbumRoutes adds the endpoints that only need an AlbumStore, which
+// are all that's served with DATASTORE=memory.
+func registerAlbumRoutes(r *mux.Router, cfg Config, store AlbumStore, cache *responseCache, reads *coalescer) {
+	// invalidateAlbums is called after every album write, so that later reads
+	// neither come from the cache nor share a read that began before it.
+	invalidateAlbums := func() {
+		cache.invalidate("/albums")
+		reads.forget("/albums")
 	}
-	iter := client.Single().Query(ctx, stmt)
-	defer iter.Stop()
 
-	for {
-		var row *spanner.Row
-		row, err = iter.Next()
-		if err == iterator.Done {
-			err = nil
+	r.HandleFunc("/albums", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseListOptions(r.URL.Query(), cfg)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Pages are enveloped whatever the config says, so the next page's
+		// token is in the body, as meta.next_page_token. A client that asks
+		// for a bare array with ?envelope=false only gets it in the
+		// X-Next-Page-Token header. Either way it's left out on the last
+		// page.
+		writePage := func(page AlbumPage) {
+			if checkNotModified(w, r, cfg.HTTPCacheMaxAge, cfg.AuthMode != "", albumsLastModified(page.LastModified)) {
+				return
+			}
+			writeList(w, r, true, page.Items, page.Count, opts.Limit, page.NextPageToken)
+		}
+
+		key := cacheKey(r)
+		v, stale, err := cache.fetch(key, func() (interface{}, error) {
+			// Identical requests that miss the cache together share one
+			// query.
+			return reads.do(r.Context(), key, func(ctx context.Context) (interface{}, error) {
+				return store.ListAlbums(ctx, opts)
+			})
+		})
+		switch {
+		case errors.Is(err, ErrUnsupported):
+			writeJSONError(w, http.StatusNotImplemented, err.Error())
+			return
+		case stale:
+			log.Printf("Serving stale albums after error: %s", err.Error())
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+		case err != nil:
+			writeInternalError(w, err)
+			return
+		}
+
+		writePage(v.(AlbumPage))
+	}).Methods(http.MethodGet).Name("albums")
+
+	r.HandleFunc("/albums", func(w http.ResponseWriter, r *http.Request) {
+		a := &Album{}
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if a.SingerID <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "singer_id must be positive")
+			return
+		}
+		if a.AlbumID <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "album_id must be positive")
+			return
+		}
+
+		err := store.InsertAlbum(r.Context(), a)
+		switch {
+		case errors.Is(err, ErrConflict):
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("album %d/%d already exists", a.SingerID, a.AlbumID))
+			return
+		case errors.Is(err, ErrNotFound):
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("singer %d not found", a.SingerID))
+			return
+		case err != nil:
+			writeInternalError(w, err)
+			return
+		}
+
+		invalidateAlbums()
+
+		setCommitTimestamp(w, a.LastUpdateTime.Time)
+		w.Header().Set("ETag", albumETag(a.LastUpdateTime.Time))
+		writeJSON(w, http.StatusCreated, a)
+	}).Methods(http.MethodPost).Name("albums.create")
+
+	r.HandleFunc("/albums/transfers/batch", func(w http.ResponseWriter, r *http.Request) {
+		var transfers []Transfer
+		if err := json.NewDecoder(r.Body).Decode(&transfers); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := validateTransfers(transfers); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ts, err := store.TransferBudgets(r.Context(), transfers)
+
+		var te *TransferError
+		switch {
+		case errors.As(err, &te) && errors.Is(err, ErrNotFound):
+			writeTransferError(w, http.StatusNotFound, te)
+			return
+		case errors.As(err, &te) && (errors.Is(err, ErrInsufficientBudget) || errors.Is(err, ErrConflict)):
+			writeTransferError(w, http.StatusConflict, te)
+			return
+		case err != nil:
+			writeInternalError(w, err)
+			return
+		}
+
+		invalidateAlbums()
+
+		setCommitTimestamp(w, ts)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost).Name("albums.transfers.batch")
+
+	r.HandleFunc("/albums/{singer_id}/{album_id}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		singerID, err := strconv.ParseInt(vars["singer_id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
 			return
 		}
+		albumID, err := strconv.ParseInt(vars["album_id"], 10, 64)
 		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid album id")
+			return
+		}
+
+		a, err := store.GetAlbum(r.Context(), singerID, albumID)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("album %d/%d not found", singerID, albumID))
+			return
+		case err != nil:
+			writeInternalError(w, err)
 			return
 		}
 
-		a := new(Album)
+		w.Header().Set("ETag", albumETag(a.LastUpdateTime.Time))
+		writeJSON(w, http.StatusOK, a)
+	}).Methods(http.MethodGet).Name("albums.get")
 
-		if err = row.ColumnByName("SingerId", &a.SingerID); err != nil {
+	r.HandleFunc("/albums/{singer_id}/{album_id}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		singerID, err := strconv.ParseInt(vars["singer_id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
 			return
 		}
-		if err = row.ColumnByName("AlbumId", &a.AlbumID); err != nil {
+		albumID, err := strconv.ParseInt(vars["album_id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid album id")
+			return
+		}
+
+		mode := r.URL.Query().Get("mode")
+		if _, err := parseWriteMode(mode); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		if err = row.ColumnByName("MarketingBudget", &a.MarketingBudget); err != nil {
+
+		a := &Album{}
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
 			return
 		}
-		if err = row.ColumnByName("LastUpdateTime", &a.LastUpdateTime); err != nil {
+		a.SingerID, a.AlbumID = singerID, albumID
+
+		err = store.SaveAlbum(r.Context(), a, mode)
+		switch {
+		case errors.Is(err, ErrConflict):
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("album %d/%d already exists", singerID, albumID))
+			return
+		case errors.Is(err, ErrNotFound):
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("album %d/%d not found", singerID, albumID))
+			return
+		case err != nil:
+			writeInternalError(w, err)
+			return
+		}
+
+		invalidateAlbums()
+
+		setCommitTimestamp(w, a.LastUpdateTime.Time)
+		w.Header().Set("ETag", albumETag(a.LastUpdateTime.Time))
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPut).Name("albums.put")
+
+	r.HandleFunc("/albums/{singer_id}/{album_id}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		singerID, err := strconv.ParseInt(vars["singer_id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
+			return
+		}
+		albumID, err := strconv.ParseInt(vars["album_id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid album id")
 			return
 		}
 
-		albums = append(albums, a)
+		ts, err := store.DeleteAlbum(r.Context(), singerID, albumID, r.Header.Get("If-Match"))
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("album %d/%d not found", singerID, albumID))
+			return
+		case errors.Is(err, ErrPrecondition):
+			writeJSONError(w, http.StatusPreconditionFailed, fmt.Sprintf("album %d/%d has changed since the given ETag", singerID, albumID))
+			return
+		case err != nil:
+			writeInternalError(w, err)
+			return
+		}
+
+		invalidateAlbums()
+
+		setCommitTimestamp(w, ts)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodDelete).Name("albums.delete")
+
+	r.HandleFunc("/singers/{id}/albums", func(w http.ResponseWriter, r *http.Request) {
+		singerID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid singer id")
+			return
+		}
+
+		var a Album
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if a.AlbumID < 0 {
+			writeJSONError(w, http.StatusBadRequest, "album_id must be positive")
+			return
+		}
+		a.SingerID = singerID
+
+		res, err := store.CreateAlbum(r.Context(), a)
+		switch {
+		case errors.Is(err, ErrConflict):
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("album %d/%d already exists", singerID, a.AlbumID))
+			return
+		case errors.Is(err, ErrNotFound):
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("singer %d not found", singerID))
+			return
+		case err != nil:
+			writeInternalError(w, err)
+			return
+		}
+
+		invalidateAlbums()
+
+		setCommitTimestamp(w, res.LastUpdateTime.Time)
+		w.Header().Set("ETag", albumETag(res.LastUpdateTime.Time))
+		writeJSON(w, http.StatusCreated, res)
+	}).Methods(http.MethodPost).Name("singers.albums.create")
+}
+
+// newHTTPServer is the server for h, with the keep-alive settings from cfg.
+// With keep-alives off the server answers every request with
+// Connection: close.
+func newHTTPServer(cfg Config, h http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:        ":8000",
+		Handler:     h,
+		IdleTimeout: cfg.HTTPIdleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(!cfg.HTTPDisableKeepAlives)
+	return srv
+}
+
+// usingEmulator reports whether the Spanner client libraries will talk to the
+// emulator rather than a real instance.
+func usingEmulator() bool {
+	_, ok := os.LookupEnv("SPANNER_EMULATOR_HOST")
+	return ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if jsonNaming == JSONNamingCamel {
+		writeCamelJSON(w, status, v)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// internalErrorMessage is all a client is told about a 500. The error itself
+// is logged, but may name tables, queries or hosts it has no business seeing.
+const internalErrorMessage = "internal server error"
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Index is the item that failed, for batches that fail on one.
+	Index *int `json:"index,omitempty"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, ErrorResponse{Error: ErrorDetail{Code: status, Message: msg}})
+}
+
+// unavailableRetryAfter is the Retry-After sent with a 503 for an error that's
+// worth retrying.
+const unavailableRetryAfter = "1"
+
+// writeInternalError logs an error a handler didn't expect and answers 500, or
+// 503 with a Retry-After if it's ErrUnavailable and worth retrying.
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Printf("Error: %s", err.Error())
+
+	if errors.Is(err, ErrUnavailable) {
+		w.Header().Set("Retry-After", unavailableRetryAfter)
+		writeJSONError(w, http.StatusServiceUnavailable, "service unavailable, try again")
+		return
 	}
+	writeJSONError(w, http.StatusInternalServerError, internalErrorMessage)
 }
 
-func transferMarketingBudgets(ctx context.Context, dbPath string) error {
-	client, err := spanner.NewClient(ctx, dbPath)
+// writeTransferError is writeJSONError for a batch that failed on one
+// transfer, naming it in the error's index.
+func writeTransferError(w http.ResponseWriter, status int, te *TransferError) {
+	writeJSON(w, status, ErrorResponse{Error: ErrorDetail{Code: status, Message: te.Error(), Index: &te.Index}})
+}
+
+// writeCamelJSON is writeJSON with camelCase keys. The body has to be built
+// in full before it's rewritten, so unlike writeJSON a value that fails to
+// marshal is a 500.
+func writeCamelJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err == nil {
+		b, err = camelCaseKeys(b)
+	}
+	var out bytes.Buffer
+	if err == nil {
+		err = json.Indent(&out, b, "", "  ")
+	}
 	if err != nil {
-		return err
+		writeInternalError(w, err)
+		return
+	}
+	out.WriteByte('\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out.Bytes())
+}
+
+// cacheKey identifies a read by its path and query, ignoring parameters that
+// only change how the response is rendered.
+func cacheKey(r *http.Request) string {
+	q := r.URL.Query()
+	q.Del("envelope")
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// ListMeta describes the page of items returned in an enveloped list response.
+type ListMeta struct {
+	Count int `json:"count"`
+	// Limit is the most items the list could have held, for paged lists.
+	Limit         int    `json:"limit,omitempty"`
+	NextPageToken string `json:"next_page_token,omitempty"`
+	// NextCursor is the old name for NextPageToken, kept so clients written
+	// against it still see a null on the last page and the token otherwise.
+	//
+	// Deprecated: use NextPageToken.
+	NextCursor *string `json:"next_cursor"`
+}
+
+type ListEnvelope struct {
+	Data interface{} `json:"data"`
+	Meta ListMeta    `json:"meta"`
+}
+
+// writeList writes a list response. Lists are returned as a bare JSON array
+// unless envelope is set, from config or by the caller, or requested with
+// ?envelope=true, in which case they're wrapped as {"data": [...], "meta":
+// {...}}; ?envelope=false always asks for the bare array.
+//
+// A paged list passes its limit and the token for the next page, if there is
+// one; others pass 0 and "". They go in the meta and, because a bare array has
+// nowhere to put them, always in the X-Limit and X-Next-Page-Token headers as
+// well, so a bare-array client can still page: it follows X-Next-Page-Token
+// until a response comes back without one.
+func writeList(w http.ResponseWriter, r *http.Request, envelope bool, items interface{}, count, limit int, nextPageToken string) {
+	if v := r.URL.Query().Get("envelope"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid envelope parameter: %q", v))
+			return
+		}
+		envelope = b
+	}
+
+	if limit > 0 {
+		w.Header().Set("X-Limit", strconv.Itoa(limit))
+	}
+	if nextPageToken != "" {
+		w.Header().Set("X-Next-Page-Token", nextPageToken)
+	}
+
+	if !envelope {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	meta := ListMeta{Count: count, Limit: limit, NextPageToken: nextPageToken}
+	if nextPageToken != "" {
+		meta.NextCursor = &nextPageToken
 	}
-	defer client.Close()
+	writeJSON(w, http.StatusOK, ListEnvelope{Data: items, Meta: meta})
+}
+
+func transferMarketingBudgets(ctx context.Context, client *spanner.Client, audit *auditLog) error {
+	var recs []AuditRecord
+
+	ts, err := readWriteTransaction(ctx, client, "transferMarketingBudgets", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// The function may be retried, so start the audit records afresh.
+		recs = nil
 
-	_, err = client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
 		// getBudget returns the budget for a record with a given albumId and singerId.
 		getBudget := func(albumID, singerID int64) (int64, error) {
 			key := spanner.Key{albumID, singerID}
@@ -189,9 +1073,7 @@ func transferMarketingBudgets(ctx context.Context, dbPath string) error {
 		// updateBudget updates the budget for a record with a given albumId and singerId.
 		updateBudget := func(singerID, albumID, albumBudget int64) error {
 			stmt := spanner.Statement{
-				SQL: `UPDATE Albums
-                      SET MarketingBudget = @AlbumBudget
-                      WHERE SingerId = @SingerId and AlbumId = @AlbumId`,
+				SQL: sqlUpdateAlbumBudget,
 				Params: map[string]interface{}{
 					"SingerId":    singerID,
 					"AlbumId":     albumID,
@@ -201,6 +1083,15 @@ func transferMarketingBudgets(ctx context.Context, dbPath string) error {
 			_, err := txn.Update(ctx, stmt)
 			return err
 		}
+		budgetAudit := func(singerID, albumID, before, after int64) AuditRecord {
+			return AuditRecord{
+				Action: AuditUpdate,
+				Table:  "Albums",
+				Key:    spanner.Key{singerID, albumID},
+				Before: map[string]interface{}{"MarketingBudget": before},
+				After:  map[string]interface{}{"MarketingBudget": after},
+			}
+		}
 
 		// Transfer the marketing budget from one album to another. By keeping the actions
 		// in a single transaction, it ensures the movement is atomic.
@@ -214,110 +1105,184 @@ func transferMarketingBudgets(ctx context.Context, dbPath string) error {
 		// The transaction will only be committed if this condition still holds at the time
 		// of commit. Otherwise it will be aborted and the callable will be rerun by the
 		// client library.
-		if album2Budget >= transferAmt {
-			album1Budget, err := getBudget(1, 1)
-			if err != nil {
-				return err
-			}
+		if album2Budget < transferAmt {
+			return fmt.Errorf("%w: album 2 has %d, need %d", ErrInsufficientBudget, album2Budget, transferAmt)
+		}
 
-			if err = updateBudget(1, 1, album1Budget+transferAmt); err != nil {
-				return err
-			}
+		album1Budget, err := getBudget(1, 1)
+		if err != nil {
+			return err
+		}
 
-			if err = updateBudget(2, 2, album2Budget-transferAmt); err != nil {
-				return err
-			}
+		if err = updateBudget(1, 1, album1Budget+transferAmt); err != nil {
+			return err
+		}
 
-			stmt := spanner.Statement{
-				SQL: `UPDATE Albums
-                      SET LastUpdateTime = PENDING_COMMIT_TIMESTAMP()
-                      WHERE SingerId IN UNNEST(@SingerIds) AND AlbumId IN UNNEST(@AlbumIds)`,
-				Params: map[string]interface{}{
-					"SingerIds": []int64{1, 2},
-					"AlbumIds":  []int64{1, 2},
-				},
-			}
-			if _, err = txn.Update(ctx, stmt); err != nil {
-				return err
-			}
+		if err = updateBudget(2, 2, album2Budget-transferAmt); err != nil {
+			return err
+		}
 
-			log.Printf("Moved %d from Album2's MarketingBudget to Album1's", transferAmt)
+		recs = append(recs,
+			budgetAudit(1, 1, album1Budget, album1Budget+transferAmt),
+			budgetAudit(2, 2, album2Budget, album2Budget-transferAmt),
+		)
+
+		stmt := spanner.Statement{
+			SQL: sqlTouchAlbums,
+			Params: map[string]interface{}{
+				"SingerIds": []int64{1, 2},
+				"AlbumIds":  []int64{1, 2},
+			},
 		}
+		if _, err = txn.Update(ctx, stmt); err != nil {
+			return err
+		}
+
+		log.Printf("Moved %d from Album2's MarketingBudget to Album1's", transferAmt)
 		return nil
 	})
-	return err
-}
-
-func updateMarketingBudgets(ctx context.Context, dbPath string) error {
-	client, err := spanner.NewClient(ctx, dbPath)
 	if err != nil {
-		return err
+		return spannerError(err)
 	}
-	defer client.Close()
+	logCommit("transferMarketingBudgets", ts)
+	noteAlbumWrite(ts)
+
+	audit.record(ctx, recs...)
+	return nil
+}
 
+func updateMarketingBudgets(ctx context.Context, client *spanner.Client, audit *auditLog) error {
 	cols := []string{"SingerId", "AlbumId", "MarketingBudget"}
-	_, err = client.Apply(ctx, []*spanner.Mutation{
+	ts, err := client.Apply(ctx, []*spanner.Mutation{
 		spanner.Update("Albums", cols, []interface{}{1, 1, 100000}),
 		spanner.Update("Albums", cols, []interface{}{2, 2, 500000}),
-	})
-	return err
+	}, applyOptions("updateMarketingBudgets")...)
+	if err != nil {
+		return spannerError(err)
+	}
+	logCommit("updateMarketingBudgets", ts)
+	noteAlbumWrite(ts)
+
+	audit.record(ctx,
+		AuditRecord{Action: AuditUpdate, Table: "Albums", Key: spanner.Key{1, 1}, After: map[string]interface{}{"MarketingBudget": 100000}},
+		AuditRecord{Action: AuditUpdate, Table: "Albums", Key: spanner.Key{2, 2}, After: map[string]interface{}{"MarketingBudget": 500000}},
+	)
+	return nil
 }
 
-func addMarketingBudgetColumn(ctx context.Context, dbPath string) error {
-	adminClient, err := database.NewDatabaseAdminClient(ctx)
-	if err != nil {
-		return err
+// migrations are the DDL statements applied to the database on startup, in
+// order, on top of the tables created by createDB.
+var migrations = []string{
+	"ALTER TABLE Albums ADD COLUMN MarketingBudget INT64",
+	`CREATE TABLE AuditLog (
+		AuditId   STRING(32) NOT NULL,
+		Time      TIMESTAMP NOT NULL,
+		Principal STRING(MAX) NOT NULL,
+		Action    STRING(MAX) NOT NULL,
+		TableName STRING(MAX) NOT NULL,
+		RowKey    STRING(MAX) NOT NULL,
+		Before    STRING(MAX),
+		After     STRING(MAX)
+	) PRIMARY KEY (AuditId)`,
+}
+
+// adminCheckTimeout bounds the admin API pre-flight.
+const adminCheckTimeout = 10 * time.Second
+
+// checkAdminAPI makes a cheap GetDatabase call to confirm the database admin
+// API is reachable and that we're allowed to use it.
+func checkAdminAPI(ctx context.Context, adminClient *database.DatabaseAdminClient, dbPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, adminCheckTimeout)
+	defer cancel()
+
+	if _, err := adminClient.GetDatabase(ctx, &adminpb.GetDatabaseRequest{Name: dbPath}); err != nil {
+		return fmt.Errorf("admin API pre-flight: GetDatabase %s: %w", dbPath, err)
+	}
+
+	return nil
+}
+
+// applyDDL applies the statements in a single UpdateDatabaseDdl call, which
+// Spanner executes in order server side. If one fails, the statements before it
+// have already been committed and the error names the one that failed.
+func applyDDL(ctx context.Context, adminClient *database.DatabaseAdminClient, dbPath string, statements []string) error {
+	if len(statements) == 0 {
+		return nil
 	}
-	defer adminClient.Close()
 
 	op, err := adminClient.UpdateDatabaseDdl(ctx, &adminpb.UpdateDatabaseDdlRequest{
-		Database: dbPath,
-		Statements: []string{
-			"ALTER TABLE Albums ADD COLUMN MarketingBudget INT64",
-		},
+		Database:   dbPath,
+		Statements: statements,
 	})
 	if err != nil {
 		return err
 	}
 	if err := op.Wait(ctx); err != nil {
-		return err
+		md, mdErr := op.Metadata()
+		if mdErr != nil || md == nil {
+			return err
+		}
+		// One commit timestamp is recorded per statement that was applied.
+		i := len(md.GetCommitTimestamps())
+		if i >= len(statements) {
+			return err
+		}
+		return fmt.Errorf("DDL statement %d of %d failed (%q): %v", i+1, len(statements), statements[i], err)
 	}
 
-	log.Print("Added MarketingBudget column to table Albums")
+	for _, stmt := range statements {
+		log.Printf("Applied DDL: %s", stmt)
+	}
 
 	return nil
 }
 
-func insertOrUpdate(ctx context.Context, dbPath string) error {
-	client, err := spanner.NewClient(ctx, dbPath)
-	if err != nil {
-		return err
+// demoSingers and demoAlbums are the rows insertOrUpdate seeds the database
+// with at startup. The memory store starts out with them too.
+var (
+	demoSingers = []*Singer{
+		{SingerID: 1, FirstName: nullString("Marc"), LastName: nullString("Richards")},
+		{SingerID: 2, FirstName: nullString("Catalina"), LastName: nullString("Smith")},
+		{SingerID: 3, FirstName: nullString("Alice"), LastName: nullString("Trentor")},
+		{SingerID: 4, FirstName: nullString("Lea"), LastName: nullString("Martin")},
+		{SingerID: 5, FirstName: nullString("David"), LastName: nullString("Lomond")},
 	}
-	defer client.Close()
-
-	singerColumns := []string{"SingerId", "FirstName", "LastName"}
-	albumColumns := []string{"SingerId", "AlbumId", "AlbumTitle", "LastUpdateTime"}
+	demoAlbums = []*Album{
+		{SingerID: 1, AlbumID: 1, AlbumTitle: nullString("Total Junk")},
+		{SingerID: 1, AlbumID: 2, AlbumTitle: nullString("Go, Go, Go")},
+		{SingerID: 2, AlbumID: 1, AlbumTitle: nullString("Green")},
+		{SingerID: 2, AlbumID: 2, AlbumTitle: nullString("Forever Hold Your Peace")},
+		{SingerID: 2, AlbumID: 3, AlbumTitle: nullString("Terrified")},
+	}
+)
 
-	m := []*spanner.Mutation{
-		spanner.InsertOrUpdate("Singers", singerColumns, []interface{}{1, "Marc", "Richards"}),
-		spanner.InsertOrUpdate("Singers", singerColumns, []interface{}{2, "Catalina", "Smith"}),
-		spanner.InsertOrUpdate("Singers", singerColumns, []interface{}{3, "Alice", "Trentor"}),
-		spanner.InsertOrUpdate("Singers", singerColumns, []interface{}{4, "Lea", "Martin"}),
-		spanner.InsertOrUpdate("Singers", singerColumns, []interface{}{5, "David", "Lomond"}),
-		spanner.InsertOrUpdate("Albums", albumColumns, []interface{}{1, 1, "Total Junk", spanner.CommitTimestamp}),
-		spanner.InsertOrUpdate("Albums", albumColumns, []interface{}{1, 2, "Go, Go, Go", spanner.CommitTimestamp}),
-		spanner.InsertOrUpdate("Albums", albumColumns, []interface{}{2, 1, "Green", spanner.CommitTimestamp}),
-		spanner.InsertOrUpdate("Albums", albumColumns, []interface{}{2, 2, "Forever Hold Your Peace", spanner.CommitTimestamp}),
-		spanner.InsertOrUpdate("Albums", albumColumns, []interface{}{2, 3, "Terrified", spanner.CommitTimestamp}),
+func insertOrUpdate(ctx context.Context, client *spanner.Client, audit *auditLog) error {
+	var (
+		m    []*spanner.Mutation
+		recs []AuditRecord
+	)
+	for _, s := range demoSingers {
+		m = append(m, insertOrUpdateSingerMutation(s))
+		recs = append(recs, singerAudit(AuditInsertOrUpdate, s))
+	}
+	for _, a := range demoAlbums {
+		m = append(m, insertOrUpdateAlbumMutation(a))
+		recs = append(recs, albumAudit(AuditInsertOrUpdate, a))
 	}
 
-	_, err = client.Apply(ctx, m)
+	ts, err := client.Apply(ctx, m, applyOptions("insertOrUpdate")...)
+	if err != nil {
+		return spannerError(err)
+	}
+	logCommit("insertOrUpdate", ts)
+	noteAlbumWrite(ts)
 
-	return err
+	audit.record(ctx, recs...)
+	return nil
 }
 
 func deleteInstance(ctx context.Context, projectID, instanceID string) error {
-	instanceAdmin, err := instance.NewInstanceAdminClient(ctx)
+	instanceAdmin, err := instance.NewInstanceAdminClient(ctx, spannerOptions...)
 	if err != nil {
 		return err
 	}
@@ -339,7 +1304,7 @@ func deleteInstance(ctx context.Context, projectID, instanceID string) error {
 }
 
 func createInstance(ctx context.Context, projectID, instanceID string) error {
-	instanceAdmin, err := instance.NewInstanceAdminClient(ctx)
+	instanceAdmin, err := instance.NewInstanceAdminClient(ctx, spannerOptions...)
 	if err != nil {
 		return err
 	}
@@ -376,7 +1341,7 @@ func createInstance(ctx context.Context, projectID, instanceID string) error {
 }
 
 func createDB(ctx context.Context, projectID, instanceID, databaseID string) error {
-	c, err := database.NewDatabaseAdminClient(ctx)
+	c, err := database.NewDatabaseAdminClient(ctx, spannerOptions...)
 	if err != nil {
 		return err
 	}
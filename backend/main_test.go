@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteList(t *testing.T) {
+	items := []string{"a", "b"}
+
+	tests := []struct {
+		name         string
+		query        string
+		envelope     bool
+		limit        int
+		next         string
+		wantCode     int
+		wantEnvelope bool
+		wantMeta     string
+	}{
+		{name: "bare by default", wantCode: http.StatusOK},
+		{name: "envelope from config", envelope: true, wantCode: http.StatusOK, wantEnvelope: true,
+			wantMeta: `{"count":2,"next_cursor":null}`},
+		{name: "envelope requested", query: "?envelope=true", wantCode: http.StatusOK, wantEnvelope: true,
+			wantMeta: `{"count":2,"next_cursor":null}`},
+		{name: "bare requested over config", query: "?envelope=false", envelope: true, wantCode: http.StatusOK},
+		{name: "paged, more to come", query: "?envelope=1", limit: 2, next: "tok", wantCode: http.StatusOK, wantEnvelope: true,
+			wantMeta: `{"count":2,"limit":2,"next_page_token":"tok","next_cursor":"tok"}`},
+		{name: "paged, last page", envelope: true, limit: 5, wantCode: http.StatusOK, wantEnvelope: true,
+			wantMeta: `{"count":2,"limit":5,"next_cursor":null}`},
+		{name: "paged bare", limit: 2, next: "tok", wantCode: http.StatusOK},
+		{name: "invalid envelope", query: "?envelope=maybe", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeList(w, httptest.NewRequest(http.MethodGet, "/albums"+tt.query, nil), tt.envelope, items, len(items), tt.limit, tt.next)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			// The headers are set either way, so bare-array clients can page.
+			wantLimit := ""
+			if tt.limit > 0 {
+				wantLimit = strconv.Itoa(tt.limit)
+			}
+			if got := w.Header().Get("X-Limit"); got != wantLimit {
+				t.Errorf("X-Limit = %q, want %q", got, wantLimit)
+			}
+			if got := w.Header().Get("X-Next-Page-Token"); got != tt.next {
+				t.Errorf("X-Next-Page-Token = %q, want %q", got, tt.next)
+			}
+
+			if !tt.wantEnvelope {
+				var got []string
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("body %s isn't a bare array: %v", w.Body, err)
+				}
+				if len(got) != len(items) {
+					t.Errorf("got %v, want %v", got, items)
+				}
+				return
+			}
+
+			var got struct {
+				Data []string        `json:"data"`
+				Meta json.RawMessage `json:"meta"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body %s isn't an envelope: %v", w.Body, err)
+			}
+			if len(got.Data) != len(items) {
+				t.Errorf("data = %v, want %v", got.Data, items)
+			}
+			var meta bytes.Buffer
+			if err := json.Compact(&meta, got.Meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta.String() != tt.wantMeta {
+				t.Errorf("meta = %s, want %s", meta.String(), tt.wantMeta)
+			}
+		})
+	}
+}
+
+// serveCachedAlbums serves GET target through the album routes with page
+// already cached for it, so the handler runs without Spanner.
+func serveCachedAlbums(t *testing.T, cfg Config, target string, page AlbumPage) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	cache := newResponseCache(time.Minute, 0, 10)
+	cache.set(cacheKey(r), page)
+
+	router := mux.NewRouter()
+	registerRoutes(router, cfg, nil, nil, cache, newCoalescer())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAlbumsLimitKeepsShape(t *testing.T) {
+	page := AlbumPage{Items: []*Album{{SingerID: 1, AlbumID: 1}}, Count: 1}
+
+	tests := []struct {
+		name         string
+		envelope     bool
+		target       string
+		wantLimit    string
+		wantEnvelope bool
+	}{
+		// Pages are enveloped by default, so the next page token is in the
+		// body, whatever the config says.
+		{name: "default limit", target: "/albums", wantLimit: "10", wantEnvelope: true},
+		{name: "limit", target: "/albums?limit=2", wantLimit: "2", wantEnvelope: true},
+		{name: "max limit", target: "/albums?limit=1000", wantLimit: "1000", wantEnvelope: true},
+		{name: "limit, envelope requested", target: "/albums?limit=2&envelope=true", wantLimit: "2", wantEnvelope: true},
+		{name: "limit, envelope from config", envelope: true, target: "/albums?limit=2", wantLimit: "2", wantEnvelope: true},
+		{name: "limit, bare requested", target: "/albums?limit=2&envelope=false", wantLimit: "2"},
+		{name: "limit, bare requested over config", envelope: true, target: "/albums?limit=2&envelope=false", wantLimit: "2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveCachedAlbums(t, Config{JSONEnvelope: tt.envelope}, tt.target, page)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Limit"); got != tt.wantLimit {
+				t.Errorf("X-Limit = %q, want %q", got, tt.wantLimit)
+			}
+
+			body := bytes.TrimSpace(w.Body.Bytes())
+			if isEnvelope := bytes.HasPrefix(body, []byte("{")); isEnvelope != tt.wantEnvelope {
+				t.Errorf("body %s: enveloped = %v, want %v", body, isEnvelope, tt.wantEnvelope)
+			}
+		})
+	}
+}
+
+func TestAlbumsNextPageToken(t *testing.T) {
+	items := []*Album{{SingerID: 1, AlbumID: 1}}
+
+	tests := []struct {
+		name string
+		bare bool
+		next string
+	}{
+		{name: "bare, more to come", bare: true, next: "tok"},
+		{name: "bare, last page", bare: true},
+		{name: "envelope, more to come", next: "tok"},
+		{name: "envelope, last page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := AlbumPage{Items: items, Count: len(items), NextPageToken: tt.next}
+			target := "/albums?limit=1"
+			if tt.bare {
+				target += "&envelope=false"
+			}
+			w := serveCachedAlbums(t, Config{}, target, page)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			if got := w.Header().Get("X-Next-Page-Token"); got != tt.next {
+				t.Errorf("X-Next-Page-Token = %q, want %q", got, tt.next)
+			}
+			if _, ok := w.Header()["X-Next-Page-Token"]; ok && tt.next == "" {
+				t.Error("X-Next-Page-Token sent, empty, on the last page")
+			}
+			if tt.bare {
+				return
+			}
+
+			var env struct {
+				Meta map[string]interface{} `json:"meta"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := env.Meta["next_page_token"]
+			if tt.next == "" && ok {
+				t.Errorf("meta has next_page_token %v on the last page", got)
+			}
+			if tt.next != "" && got != tt.next {
+				t.Errorf("meta.next_page_token = %v, want %q", got, tt.next)
+			}
+		})
+	}
+}
+
+// TestAlbumsPagesThroughHandler pages through GET /albums as a client would,
+// in both shapes, following the next page token until it's left out.
+func TestAlbumsPagesThroughHandler(t *testing.T) {
+	client := newTestDB(t)
+
+	var albums []*Album
+	for _, k := range [][2]int64{{1, 1}, {1, 2}, {2, 1}, {2, 2}, {3, 1}} {
+		albums = append(albums, &Album{SingerID: k[0], AlbumID: k[1]})
+	}
+	// One commit, so every album ties on LastUpdateTime and pages split
+	// the tie.
+	seedAlbums(t, client, albums...)
+	want := "[1/1 1/2 2/1 2/2 3/1]"
+
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	for _, envelope := range []bool{false, true} {
+		t.Run(fmt.Sprintf("envelope=%v", envelope), func(t *testing.T) {
+			query := "&envelope=" + strconv.FormatBool(envelope)
+
+			var got []string
+			target := "/albums?limit=2" + query
+			for pages := 1; ; pages++ {
+				if pages > len(albums) {
+					t.Fatalf("still paging after %d pages, got %v", pages, got)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("GET %s: status = %d: %s", target, w.Code, w.Body)
+				}
+
+				var page []struct {
+					SingerID int64 `json:"singer_id"`
+					AlbumID  int64 `json:"album_id"`
+				}
+				next := w.Header().Get("X-Next-Page-Token")
+				if envelope {
+					var env struct {
+						Data json.RawMessage `json:"data"`
+						Meta ListMeta        `json:"meta"`
+					}
+					if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+						t.Fatal(err)
+					}
+					if env.Meta.NextPageToken != next {
+						t.Errorf("meta.next_page_token = %q, header = %q", env.Meta.NextPageToken, next)
+					}
+					if err := json.Unmarshal(env.Data, &page); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatalf("body %s isn't a bare array: %v", w.Body, err)
+				}
+
+				for _, a := range page {
+					got = append(got, fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID))
+				}
+				if next == "" {
+					break
+				}
+				target = "/albums?limit=2&page_token=" + url.QueryEscape(next) + query
+			}
+
+			if fmt.Sprint(got) != want {
+				t.Errorf("got %v, want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestAlbumsLastPageOmitsToken checks the last page of /albums, including
+// one that's exactly full, has no next page token in either shape: no header,
+// and no next_page_token in the envelope's meta.
+func TestAlbumsLastPageOmitsToken(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 1, AlbumID: 2}, &Album{SingerID: 2, AlbumID: 1})
+
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	for _, envelope := range []bool{false, true} {
+		for _, limit := range []int{3, 10} {
+			t.Run(fmt.Sprintf("envelope=%v/limit=%d", envelope, limit), func(t *testing.T) {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/albums?limit=%d&envelope=%v", limit, envelope), nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+
+				if v, ok := w.Header()["X-Next-Page-Token"]; ok {
+					t.Errorf("X-Next-Page-Token = %q on the last page", v)
+				}
+				if !envelope {
+					return
+				}
+
+				var env struct {
+					Meta map[string]interface{} `json:"meta"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+					t.Fatal(err)
+				}
+				if v, ok := env.Meta["next_page_token"]; ok {
+					t.Errorf("meta.next_page_token = %v on the last page", v)
+				}
+				if v, ok := env.Meta["next_cursor"]; !ok || v != nil {
+					t.Errorf("meta.next_cursor = %v, want null", v)
+				}
+			})
+		}
+	}
+}
+
+func TestWriteInternalError(t *testing.T) {
+	sessionGone := spannerError(spanner.ToSpannerError(status.Error(codes.NotFound, "Session not found: projects/p/instances/i/databases/d/sessions/s")))
+
+	tests := []struct {
+		name           string
+		err            error
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{name: "unexpected", err: errors.New("projects/p/instances/i: boom"), wantCode: http.StatusInternalServerError},
+		{name: "session not found", err: sessionGone, wantCode: http.StatusServiceUnavailable, wantRetryAfter: unavailableRetryAfter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeInternalError(w, tt.err)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			// The error itself is only logged.
+			if strings.Contains(w.Body.String(), "projects/") {
+				t.Errorf("body %s gives away the error", w.Body)
+			}
+		})
+	}
+}
+
+func TestAlbumsSingerIDBadRequest(t *testing.T) {
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, nil, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	tooMany := url.Values{}
+	for i := 0; i <= maxSingerIDFilters; i++ {
+		tooMany.Add("singer_id", strconv.Itoa(i))
+	}
+
+	for _, target := range []string{
+		"/albums?singer_id=x",
+		"/albums?singer_id=1&singer_id=2.5",
+		"/albums?" + tooMany.Encode(),
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %.60s: status = %d, want %d: %s", target, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
+
+func TestAlbumsSyncBadRequest(t *testing.T) {
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, nil, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	for _, target := range []string{
+		"/albums/sync?limit=0",
+		"/albums/sync?since=yesterday",
+		"/albums/sync?page_token=bm9wZQ",
+		"/albums/sync?since=2024-05-01T12:00:00Z&page_token=" + (&albumCursor{LastUpdateTime: time.Now(), SingerID: 1, AlbumID: 1}).encode(),
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d, want %d: %s", target, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
+
+// TestAlbumsSync pulls changes through GET /albums/sync as a client would:
+// following next_page_token until has_more is unset, then pulling again with
+// nothing new, then again after a write.
+func TestAlbumsSync(t *testing.T) {
+	ctx := context.Background()
+
+	for _, format := range []string{TimeFormatRFC3339, TimeFormatUnixMillis} {
+		t.Run(format, func(t *testing.T) {
+			withTimeFormat(t, format)
+
+			client := newTestDB(t)
+			// Three albums share a commit, so a pull with limit 2 stops
+			// inside it.
+			seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 1, AlbumID: 2}, &Album{SingerID: 2, AlbumID: 1})
+			seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 3})
+
+			router := mux.NewRouter()
+			registerRoutes(router, Config{}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+			pull := func(q url.Values) (keys []string, res struct {
+				NextSince     json.RawMessage `json:"next_since"`
+				NextPageToken string          `json:"next_page_token"`
+				HasMore       bool            `json:"has_more"`
+				Albums        []struct {
+					SingerID int64 `json:"singer_id"`
+					AlbumID  int64 `json:"album_id"`
+				} `json:"albums"`
+			}) {
+				t.Helper()
+
+				target := "/albums/sync?" + q.Encode()
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("GET %s: status = %d: %s", target, w.Code, w.Body)
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatal(err)
+				}
+				keys = []string{}
+				for _, a := range res.Albums {
+					keys = append(keys, fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID))
+				}
+				return
+			}
+
+			var got []string
+			keys, res := pull(url.Values{"limit": {"2"}})
+			got = append(got, keys...)
+			for pulls := 1; res.HasMore; pulls++ {
+				if pulls > 4 {
+					t.Fatalf("still pulling after %d pulls, got %v", pulls, got)
+				}
+				keys, res = pull(url.Values{"limit": {"2"}, "page_token": {res.NextPageToken}})
+				got = append(got, keys...)
+			}
+			if s, want := strings.Join(got, " "), "1/1 1/2 2/1 1/3"; s != want {
+				t.Fatalf("pulled %s, want %s", s, want)
+			}
+
+			// Pulling again, from either the token or next_since, sends
+			// nothing the client already has.
+			token := res.NextPageToken
+			keys, res = pull(url.Values{"page_token": {token}})
+			if len(keys) != 0 || res.HasMore || res.NextPageToken != token {
+				t.Errorf("repeated pull = %v, has_more %v, token %q; want nothing new from %q", keys, res.HasMore, res.NextPageToken, token)
+			}
+			since := strings.Trim(string(res.NextSince), `"`)
+			if keys, _ := pull(url.Values{"since": {since}}); len(keys) != 0 {
+				t.Errorf("pull since=%s = %v, want nothing new", since, keys)
+			}
+
+			a, err := createAlbum(ctx, client, nil, Album{SingerID: 2, AlbumID: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, _ = pull(url.Values{"page_token": {token}})
+			if want := fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID); strings.Join(keys, " ") != want {
+				t.Errorf("pull after a write = %v, want [%s]", keys, want)
+			}
+		})
+	}
+}
+
+func TestApplyDDL(t *testing.T) {
+	statements := []string{
+		"CREATE TABLE A (Id INT64) PRIMARY KEY (Id)",
+		"CREATE TABLE B (Id INT64) PRIMARY KEY (Id)",
+		"CREATE TABLE C (Id INT64) PRIMARY KEY (Id)",
+	}
+
+	tests := []struct {
+		name    string
+		failAt  int
+		wantErr string
+	}{
+		{name: "all applied"},
+		{name: "second fails", failAt: 2, wantErr: `DDL statement 2 of 3 failed ("CREATE TABLE B (Id INT64) PRIMARY KEY (Id)")`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeDatabaseAdmin{failAt: tt.failAt}
+			err := applyDDL(context.Background(), newFakeAdminClient(t, f), "projects/p/instances/i/databases/d", statements)
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want one containing %s", err, tt.wantErr)
+			}
+
+			// Failed or not, the statements go in one request.
+			if len(f.requests) != 1 {
+				t.Fatalf("%d UpdateDatabaseDdl requests, want 1", len(f.requests))
+			}
+			if got := strings.Join(f.requests[0], "; "); got != strings.Join(statements, "; ") {
+				t.Errorf("statements = %s, want %s", got, strings.Join(statements, "; "))
+			}
+		})
+	}
+}
+
+func TestApplyDDLNothingToDo(t *testing.T) {
+	f := &fakeDatabaseAdmin{}
+	if err := applyDDL(context.Background(), newFakeAdminClient(t, f), "projects/p/instances/i/databases/d", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.requests) != 0 {
+		t.Errorf("%d requests for no statements, want none", len(f.requests))
+	}
+}
+
+// TestCheckAdminAPI checks an admin API failure is reported as the admin
+// pre-flight, so it can't be mistaken for a data API problem.
+func TestCheckAdminAPI(t *testing.T) {
+	const dbPath = "projects/p/instances/i/databases/d"
+
+	f := &fakeDatabaseAdmin{}
+	adminClient := newFakeAdminClient(t, f)
+	if err := checkAdminAPI(context.Background(), adminClient, dbPath); err != nil {
+		t.Fatalf("reachable admin API: %v", err)
+	}
+
+	f.getErr = status.Error(codes.PermissionDenied, "caller lacks spanner.databases.get")
+	err := checkAdminAPI(context.Background(), adminClient, dbPath)
+	if err == nil {
+		t.Fatal("no error when GetDatabase is denied")
+	}
+	want := "admin API pre-flight: GetDatabase " + dbPath + ": "
+	if !strings.HasPrefix(err.Error(), want) || !strings.Contains(err.Error(), "caller lacks spanner.databases.get") {
+		t.Errorf("err = %q, want it to start %q and keep the cause", err, want)
+	}
+}
+
+func TestGetSinger(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 1, AlbumID: 2}, &Album{SingerID: 2, AlbumID: 1})
+
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	tests := []struct {
+		target     string
+		wantCode   int
+		wantSinger int64
+		wantAlbums string // album keys, or "" for no albums field
+	}{
+		{target: "/singers/1", wantCode: http.StatusOK, wantSinger: 1},
+		{target: "/singers/1?embed=albums", wantCode: http.StatusOK, wantSinger: 1, wantAlbums: "[1/1 1/2]"},
+		{target: "/singers/2?embed=albums", wantCode: http.StatusOK, wantSinger: 2, wantAlbums: "[2/1]"},
+		{target: "/singers/9", wantCode: http.StatusNotFound},
+		{target: "/singers/9?embed=albums", wantCode: http.StatusNotFound},
+		{target: "/singers/1?embed=songs", wantCode: http.StatusBadRequest},
+		{target: "/singers/one", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				SingerID int64 `json:"singer_id"`
+				Albums   *[]struct {
+					SingerID int64 `json:"singer_id"`
+					AlbumID  int64 `json:"album_id"`
+				} `json:"albums"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.SingerID != tt.wantSinger {
+				t.Errorf("singer_id = %d, want %d", got.SingerID, tt.wantSinger)
+			}
+
+			if tt.wantAlbums == "" {
+				if got.Albums != nil {
+					t.Errorf("body %s has albums without ?embed", w.Body)
+				}
+				return
+			}
+			if got.Albums == nil {
+				t.Fatalf("body %s has no albums", w.Body)
+			}
+			var keys []string
+			for _, a := range *got.Albums {
+				keys = append(keys, fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID))
+			}
+			if fmt.Sprint(keys) != tt.wantAlbums {
+				t.Errorf("albums = %v, want %s", keys, tt.wantAlbums)
+			}
+		})
+	}
+}
+
+// TestSingersWithoutAlbums checks /singers/empty lists the singers with no
+// albums, and none of the ones with albums.
+func TestSingersWithoutAlbums(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 3, AlbumID: 1})
+	_, err := client.Apply(context.Background(), []*spanner.Mutation{
+		insertOrUpdateSingerMutation(&Singer{SingerID: 2}),
+		insertOrUpdateSingerMutation(&Singer{SingerID: 4}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/singers/empty", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var singers []struct {
+		SingerID int64 `json:"singer_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &singers); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, s := range singers {
+		ids = append(ids, s.SingerID)
+	}
+	if fmt.Sprint(ids) != "[2 4]" {
+		t.Errorf("singers = %v, want [2 4]", ids)
+	}
+}
+
+func TestSingerInfoRoundTrip(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1})
+
+	router := mux.NewRouter()
+	registerRoutes(router, Config{SingerInfoContentType: "application/octet-stream"}, client, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	serve := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/singers/1/info", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET before any info: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Not valid UTF-8, so it can't have been through a string.
+	info := append([]byte{0x00, 0xff, 0xfe}, bytes.Repeat([]byte("info"), 4096)...)
+	if w := serve(http.MethodPut, "/singers/1/info", info); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: status = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+
+	w := serve(http.MethodGet, "/singers/1/info", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(info)) {
+		t.Errorf("Content-Length = %s, want %d", cl, len(info))
+	}
+	if !bytes.Equal(w.Body.Bytes(), info) {
+		t.Errorf("GET returned %d bytes that differ from the %d put", w.Body.Len(), len(info))
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		if w := serve(method, "/singers/9/info", info); w.Code != http.StatusNotFound {
+			t.Errorf("%s for a missing singer: status = %d, want %d", method, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestSingerInfoBadRequest(t *testing.T) {
+	router := mux.NewRouter()
+	registerRoutes(router, Config{}, nil, nil, newResponseCache(0, 0, 0), newCoalescer())
+
+	tests := []struct {
+		method string
+		target string
+		body   []byte
+		// readErr fails the read after body.
+		readErr  bool
+		wantCode int
+	}{
+		{method: http.MethodGet, target: "/singers/one/info", wantCode: http.StatusBadRequest},
+		{method: http.MethodPut, target: "/singers/one/info", wantCode: http.StatusBadRequest},
+		{method: http.MethodPut, target: "/singers/1/info", body: make([]byte, maxSingerInfoSize+1), wantCode: http.StatusRequestEntityTooLarge},
+		// A body that breaks off isn't too large, just bad.
+		{method: http.MethodPut, target: "/singers/1/info", body: []byte("info"), readErr: true, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		var body io.Reader = bytes.NewReader(tt.body)
+		if tt.readErr {
+			body = io.MultiReader(body, iotest.ErrReader(errors.New("connection reset")))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, body))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s with %d bytes: status = %d, want %d", tt.method, tt.target, len(tt.body), w.Code, tt.wantCode)
+		}
+	}
+}
+
+// TestHTTPServerKeepAlives checks the server closes every connection after
+// one response when keep-alives are disabled, and reuses it otherwise.
+func TestHTTPServerKeepAlives(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disabled %v", disable), func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			ts := httptest.NewUnstartedServer(h)
+			ts.Config = newHTTPServer(Config{HTTPDisableKeepAlives: disable, HTTPIdleTimeout: time.Minute}, h)
+			ts.Start()
+			defer ts.Close()
+
+			var reused []bool
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+				reused = append(reused, info.Reused)
+			}}
+
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, ts.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+
+				// The client takes Connection: close out of the headers
+				// and sets Close instead.
+				if res.Close != disable {
+					t.Errorf("request %d: Connection: close sent %v, want %v", i, res.Close, disable)
+				}
+			}
+
+			if len(reused) != 2 || reused[1] == disable {
+				t.Errorf("connections reused %v, want the second reused %v", reused, !disable)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maintenanceMode rejects writes with 503 while it's on, so the database can be
+// migrated underneath us without reads going down too.
+//
+// With a maintenance file configured, the file is the switch: maintenance mode
+// is on while it exists, and PUT /admin/maintenance creates or removes it. The
+// health server checks the same file, so either way of switching flips both.
+// Without one, PUT /admin/maintenance switches this process alone.
+//
+// The file is checked at most once every statEvery rather than on every
+// request, so switching it from outside takes up to that long to be seen.
+type maintenanceMode struct {
+	on         int32
+	path       string
+	retryAfter time.Duration
+	statEvery  time.Duration
+
+	mu      sync.Mutex
+	fileOn  bool
+	checked time.Time
+}
+
+func newMaintenanceMode(path string, retryAfter time.Duration) *maintenanceMode {
+	return &maintenanceMode{path: path, retryAfter: retryAfter, statEvery: time.Second}
+}
+
+func (m *maintenanceMode) set(on bool) error {
+	was := m.enabled()
+
+	switch {
+	case m.path == "":
+		var v int32
+		if on {
+			v = 1
+		}
+		atomic.StoreInt32(&m.on, v)
+	case on:
+		f, err := os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	default:
+		if err := os.Remove(m.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if m.path != "" {
+		m.mu.Lock()
+		m.fileOn, m.checked = on, time.Now()
+		m.mu.Unlock()
+	}
+
+	if was != on {
+		log.Printf("Maintenance mode on: %t", on)
+	}
+	return nil
+}
+
+func (m *maintenanceMode) enabled() bool {
+	if m.path != "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if time.Since(m.checked) >= m.statEvery {
+			_, err := os.Stat(m.path)
+			m.fileOn, m.checked = err == nil, time.Now()
+		}
+		return m.fileOn
+	}
+	return atomic.LoadInt32(&m.on) == 1
+}
+
+// middleware answers writes with 503 and a Retry-After while maintenance mode
+// is on. Anything that isn't GET, HEAD or OPTIONS counts as a write, admin
+// writes such as archive restores included, except /admin/maintenance itself,
+// which has to keep working to switch maintenance mode off.
+func (m *maintenanceMode) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.enabled() && isWrite(r) && r.URL.Path != "/admin/maintenance" {
+			w.Header().Set("Retry-After", strconv.Itoa(int(m.retryAfter/time.Second)))
+			writeJSONError(w, http.StatusServiceUnavailable, "down for maintenance, writes are disabled")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// Maintenance is the body of GET and PUT /admin/maintenance.
+type Maintenance struct {
+	Enabled bool `json:"enabled"`
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newMaintenanceRouter returns a router with the maintenance middleware in
+// front of the maintenance routes and a couple of album routes.
+func newMaintenanceRouter(m *maintenanceMode) *mux.Router {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	r := mux.NewRouter()
+	r.Use(m.middleware)
+	registerAdminRoutes(r, Config{}, nil, nil, "", nil, nil, nil, nil, m, nil)
+	r.Handle("/albums", ok).Methods(http.MethodGet, http.MethodPost)
+	return r
+}
+
+func serveMaintenance(router *mux.Router, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestMaintenanceMiddleware(t *testing.T) {
+	m := newMaintenanceMode("", 30*time.Second)
+	router := newMaintenanceRouter(m)
+
+	tests := []struct {
+		on       bool
+		method   string
+		path     string
+		wantCode int
+	}{
+		{on: false, method: http.MethodPost, path: "/albums", wantCode: http.StatusOK},
+		{on: true, method: http.MethodGet, path: "/albums", wantCode: http.StatusOK},
+		{on: true, method: http.MethodPost, path: "/albums", wantCode: http.StatusServiceUnavailable},
+		// Admin writes keep working, or maintenance mode couldn't be
+		// switched off.
+		{on: true, method: http.MethodPut, path: "/admin/maintenance", wantCode: http.StatusOK},
+		// Other admin writes are writes too: a restore in replace mode
+		// wipes Singers and Albums.
+		{on: true, method: http.MethodPost, path: "/admin/archive", wantCode: http.StatusServiceUnavailable},
+		{on: true, method: http.MethodPut, path: "/admin/version-retention", wantCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		if err := m.set(tt.on); err != nil {
+			t.Fatal(err)
+		}
+
+		w := serveMaintenance(router, tt.method, tt.path, `{"enabled":true}`)
+		if w.Code != tt.wantCode {
+			t.Errorf("on=%v %s %s: status = %d, want %d", tt.on, tt.method, tt.path, w.Code, tt.wantCode)
+		}
+		if wantRetry := tt.wantCode == http.StatusServiceUnavailable; (w.Header().Get("Retry-After") == "30") != wantRetry {
+			t.Errorf("on=%v %s %s: Retry-After = %q", tt.on, tt.method, tt.path, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// TestMaintenanceFile checks the maintenance file is the one switch when it's
+// configured: PUT /admin/maintenance creates and removes it, as the health
+// server expects, and touching or removing it directly takes effect without
+// a reload.
+func TestMaintenanceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance")
+	m := newMaintenanceMode(path, time.Minute)
+	m.statEvery = 0
+	router := newMaintenanceRouter(m)
+
+	fileExists := func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	wantWrites := func(code int) {
+		t.Helper()
+		if w := serveMaintenance(router, http.MethodPost, "/albums", ""); w.Code != code {
+			t.Errorf("POST /albums: status = %d, want %d", w.Code, code)
+		}
+	}
+
+	wantWrites(http.StatusOK)
+
+	if w := serveMaintenance(router, http.MethodPut, "/admin/maintenance", `{"enabled":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/maintenance: status = %d: %s", w.Code, w.Body)
+	}
+	if !fileExists() {
+		t.Error("switching maintenance mode on didn't create the file")
+	}
+	wantWrites(http.StatusServiceUnavailable)
+
+	if w := serveMaintenance(router, http.MethodPut, "/admin/maintenance", `{"enabled":false}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/maintenance: status = %d: %s", w.Code, w.Body)
+	}
+	if fileExists() {
+		t.Error("switching maintenance mode off didn't remove the file")
+	}
+	wantWrites(http.StatusOK)
+
+	// Switched from outside, such as by a deploy script.
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wantWrites(http.StatusServiceUnavailable)
+	if w := serveMaintenance(router, http.MethodGet, "/admin/maintenance", ""); !strings.Contains(w.Body.String(), `"enabled": true`) {
+		t.Errorf("GET /admin/maintenance = %s, want enabled", w.Body)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	wantWrites(http.StatusOK)
+
+	// Switching off when it's already off is fine.
+	if err := m.set(false); err != nil {
+		t.Errorf("set(false) with no file: %v", err)
+	}
+}
+
+// TestMaintenanceFileCached checks the file isn't looked at on every request,
+// but switching through the API still takes effect straight away.
+func TestMaintenanceFileCached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance")
+	m := newMaintenanceMode(path, time.Minute)
+	m.statEvery = time.Hour
+
+	if m.enabled() {
+		t.Fatal("enabled with no file")
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if m.enabled() {
+		t.Error("file created from outside was seen before statEvery passed")
+	}
+
+	if err := m.set(false); err != nil {
+		t.Fatal(err)
+	}
+	if m.enabled() {
+		t.Error("enabled after set(false)")
+	}
+	if err := m.set(true); err != nil {
+		t.Fatal(err)
+	}
+	if !m.enabled() {
+		t.Error("not enabled after set(true)")
+	}
+
+	m.statEvery = 0
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if m.enabled() {
+		t.Error("file removed from outside wasn't seen once statEvery passed")
+	}
+}
+
+func TestMaintenanceFileUnwritable(t *testing.T) {
+	m := newMaintenanceMode(filepath.Join(t.TempDir(), "missing", "maintenance"), time.Minute)
+	router := newMaintenanceRouter(m)
+
+	if w := serveMaintenance(router, http.MethodPut, "/admin/maintenance", `{"enabled":true}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("PUT /admin/maintenance: status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// memoryStore is an AlbumStore kept in memory, for running without Spanner.
+// It behaves like spannerStore down to the errors, order and paging, except
+// that it keeps no old versions to read ?asOf, and it starts out with the
+// same demo data the database is seeded with. It's lost on restart.
+type memoryStore struct {
+	// audit is left nil while the demo data is seeded.
+	audit *auditLog
+
+	mu      sync.Mutex
+	singers map[int64]*Singer
+	albums  map[albumKey]*Album
+	// lastCommit is the timestamp of the last write. Every write gets a later
+	// one, like commit timestamps in Spanner.
+	lastCommit time.Time
+}
+
+func newMemoryStore(audit *auditLog) *memoryStore {
+	s := &memoryStore{
+		singers: make(map[int64]*Singer),
+		albums:  make(map[albumKey]*Album),
+	}
+
+	// The same writes the Spanner bootstrap makes, in the same commits: see
+	// insertOrUpdate, updateMarketingBudgets and transferMarketingBudgets.
+	ts := s.commitTimestamp()
+	for _, singer := range demoSingers {
+		c := *singer
+		s.singers[c.SingerID] = &c
+	}
+	for _, a := range demoAlbums {
+		c := *a
+		c.LastUpdateTime = newTimestamp(ts)
+		s.albums[albumKey{c.SingerID, c.AlbumID}] = &c
+	}
+	s.albums[albumKey{1, 1}].MarketingBudget = spanner.NullInt64{Int64: 100000, Valid: true}
+	s.albums[albumKey{2, 2}].MarketingBudget = spanner.NullInt64{Int64: 500000, Valid: true}
+	if _, err := s.TransferBudgets(context.Background(), []Transfer{{FromSingerID: 2, FromAlbumID: 2, ToSingerID: 1, ToAlbumID: 1, Amount: 200000}}); err != nil {
+		log.Printf("Skipped transfer: %s", err.Error())
+	}
+
+	s.audit = audit
+	return s
+}
+
+// commitTimestamp returns the timestamp of a new write, and notes the write
+// for albumsLastModified. It's called with mu held, once the write can't fail.
+func (s *memoryStore) commitTimestamp() time.Time {
+	ts := time.Now().UTC().Truncate(time.Microsecond)
+	if !ts.After(s.lastCommit) {
+		ts = s.lastCommit.Add(time.Microsecond)
+	}
+	s.lastCommit = ts
+	noteAlbumWrite(ts)
+	return ts
+}
+
+func (s *memoryStore) ListAlbums(ctx context.Context, opts ListOptions) (AlbumPage, error) {
+	if !opts.AsOf.IsZero() {
+		return AlbumPage{}, fmt.Errorf("%w: the memory store can't read asOf a past time", ErrUnsupported)
+	}
+
+	s.mu.Lock()
+	var albums []*Album
+	for _, a := range s.albums {
+		if albumMatches(a, opts) {
+			c := *a
+			albums = append(albums, &c)
+		}
+	}
+	s.mu.Unlock()
+
+	order := opts.Order
+	if len(order) == 0 {
+		order = defaultAlbumOrder
+	}
+	terms := albumOrderTerms(order)
+	sort.Slice(albums, func(i, j int) bool {
+		for _, k := range terms {
+			c := compareAlbumColumn(albums[i], albums[j], k.column)
+			if k.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	var next *albumCursor
+	if len(albums) > opts.Limit {
+		albums = albums[:opts.Limit]
+		if len(opts.Order) == 0 {
+			next = newAlbumCursor(albums[len(albums)-1])
+		}
+	}
+
+	var lastModified time.Time
+	for _, a := range albums {
+		if a.LastUpdateTime.Time.After(lastModified) {
+			lastModified = a.LastUpdateTime.Time
+		}
+	}
+
+	return AlbumPage{Items: albums, Count: len(albums), LastModified: lastModified, NextPageToken: pageToken(next)}, nil
+}
+
+// defaultAlbumOrder is sqlListAlbumsOrder as order keys.
+var defaultAlbumOrder = []orderKey{{column: "LastUpdateTime", desc: true}}
+
+// albumMatches is albumsWhere for the memory store.
+func albumMatches(a *Album, opts ListOptions) bool {
+	if len(opts.SingerIDs) > 0 {
+		found := false
+		for _, id := range opts.SingerIDs {
+			if a.SingerID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	t := a.LastUpdateTime.Time
+	if !opts.UpdatedAfter.IsZero() && t.Before(opts.UpdatedAfter) {
+		return false
+	}
+	if !opts.UpdatedBefore.IsZero() && !t.Before(opts.UpdatedBefore) {
+		return false
+	}
+
+	// See albumsAfterCursor.
+	if c := opts.After; c != nil {
+		switch {
+		case !t.Equal(c.LastUpdateTime):
+			return t.Before(c.LastUpdateTime)
+		case a.SingerID != c.SingerID:
+			return a.SingerID > c.SingerID
+		}
+		return a.AlbumID > c.AlbumID
+	}
+
+	return true
+}
+
+// compareAlbumColumn compares a and b by one of albumOrderColumns' columns in
+// ascending order, where, as in Spanner, NULL sorts first.
+func compareAlbumColumn(a, b *Album, col string) int {
+	switch col {
+	case "SingerId":
+		return compareInt64(a.SingerID, b.SingerID)
+	case "AlbumId":
+		return compareInt64(a.AlbumID, b.AlbumID)
+	case "AlbumTitle":
+		if a.AlbumTitle.Valid != b.AlbumTitle.Valid {
+			return compareNull(a.AlbumTitle.Valid)
+		}
+		return strings.Compare(a.AlbumTitle.StringVal, b.AlbumTitle.StringVal)
+	case "MarketingBudget":
+		if a.MarketingBudget.Valid != b.MarketingBudget.Valid {
+			return compareNull(a.MarketingBudget.Valid)
+		}
+		return compareInt64(a.MarketingBudget.Int64, b.MarketingBudget.Int64)
+	case "LastUpdateTime":
+		ta, tb := a.LastUpdateTime.Time, b.LastUpdateTime.Time
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareNull compares a value with a NULL, or a NULL with a value when valid
+// is false.
+func compareNull(valid bool) int {
+	if valid {
+		return 1
+	}
+	return -1
+}
+
+func (s *memoryStore) GetAlbum(ctx context.Context, singerID, albumID int64) (*Album, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.albums[albumKey{singerID, albumID}]
+	if !ok {
+		return nil, fmt.Errorf("%w: album %d/%d", ErrNotFound, singerID, albumID)
+	}
+	c := *a
+	return &c, nil
+}
+
+func (s *memoryStore) InsertAlbum(ctx context.Context, a *Album) error {
+	return s.SaveAlbum(ctx, a, WriteInsert)
+}
+
+func (s *memoryStore) SaveAlbum(ctx context.Context, a *Album, mode string) error {
+	if _, err := parseWriteMode(mode); err != nil {
+		return err
+	}
+
+	if err := s.save(a, mode); err != nil {
+		return err
+	}
+
+	s.audit.record(ctx, albumAudit(auditActions[mode], a))
+	return nil
+}
+
+// save writes a the way albumMutation does, with the given write mode.
+func (s *memoryStore) save(a *Album, mode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := albumKey{a.SingerID, a.AlbumID}
+	old, exists := s.albums[key]
+
+	switch {
+	case mode == WriteInsert && exists:
+		return fmt.Errorf("%w: album %d/%d already exists", ErrConflict, a.SingerID, a.AlbumID)
+	case mode == WriteUpdate && !exists:
+		return fmt.Errorf("%w: album %d/%d", ErrNotFound, a.SingerID, a.AlbumID)
+	case !exists && s.singers[a.SingerID] == nil:
+		return fmt.Errorf("%w: singer %d", ErrNotFound, a.SingerID)
+	}
+
+	c := *a
+	if exists && !c.MarketingBudget.Valid {
+		c.MarketingBudget = old.MarketingBudget
+	}
+	c.LastUpdateTime = newTimestamp(s.commitTimestamp())
+	s.albums[key] = &c
+
+	a.LastUpdateTime = c.LastUpdateTime
+	return nil
+}
+
+func (s *memoryStore) CreateAlbum(ctx context.Context, a Album) (*Album, error) {
+	res, err := s.create(a)
+	if err != nil {
+		return nil, err
+	}
+
+	s.audit.record(ctx, albumAudit(AuditInsert, res))
+	return res, nil
+}
+
+func (s *memoryStore) create(a Album) (*Album, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.singers[a.SingerID] == nil {
+		return nil, fmt.Errorf("%w: singer %d", ErrNotFound, a.SingerID)
+	}
+
+	// See sqlNextAlbumID.
+	if a.AlbumID == 0 {
+		for k := range s.albums {
+			if k.SingerID == a.SingerID && k.AlbumID > a.AlbumID {
+				a.AlbumID = k.AlbumID
+			}
+		}
+		a.AlbumID++
+	}
+
+	key := albumKey{a.SingerID, a.AlbumID}
+	if _, exists := s.albums[key]; exists {
+		return nil, fmt.Errorf("%w: album %d/%d already exists", ErrConflict, a.SingerID, a.AlbumID)
+	}
+
+	a.LastUpdateTime = newTimestamp(s.commitTimestamp())
+	c := a
+	s.albums[key] = &c
+
+	return &a, nil
+}
+
+func (s *memoryStore) DeleteAlbum(ctx context.Context, singerID, albumID int64, ifMatch string) (time.Time, error) {
+	before, ts, err := s.delete(singerID, albumID, ifMatch)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	rec := albumAudit(AuditDelete, before)
+	rec.Before, rec.After = rec.After, nil
+	s.audit.record(ctx, rec)
+	return ts, nil
+}
+
+func (s *memoryStore) delete(singerID, albumID int64, ifMatch string) (*Album, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := albumKey{singerID, albumID}
+	before, ok := s.albums[key]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("%w: album %d/%d", ErrNotFound, singerID, albumID)
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, albumETag(before.LastUpdateTime.Time)) {
+		return nil, time.Time{}, fmt.Errorf("%w: album %d/%d has changed", ErrPrecondition, singerID, albumID)
+	}
+
+	delete(s.albums, key)
+	return before, s.commitTimestamp(), nil
+}
+
+func (s *memoryStore) TransferBudgets(ctx context.Context, transfers []Transfer) (time.Time, error) {
+	ts, recs, err := s.transfer(transfers)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	s.audit.record(ctx, recs...)
+	return ts, nil
+}
+
+func (s *memoryStore) transfer(transfers []Transfer) (time.Time, []AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := make(map[albumKey]int64)
+	for _, t := range transfers {
+		for _, k := range []albumKey{{t.FromSingerID, t.FromAlbumID}, {t.ToSingerID, t.ToAlbumID}} {
+			if a, ok := s.albums[k]; ok {
+				before[k] = a.MarketingBudget.Int64
+			}
+		}
+	}
+
+	budgets, err := applyTransfers(transfers, before)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	ts := s.commitTimestamp()
+	var recs []AuditRecord
+	for k, v := range budgets {
+		if v == before[k] {
+			continue
+		}
+		a := s.albums[k]
+		a.MarketingBudget = spanner.NullInt64{Int64: v, Valid: true}
+		a.LastUpdateTime = newTimestamp(ts)
+		recs = append(recs, transferAudit(k, before[k], v))
+	}
+
+	return ts, recs, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newAlbumRouter serves the album routes from store.
+func newAlbumRouter(cfg Config, store AlbumStore) *mux.Router {
+	r := mux.NewRouter()
+	registerAlbumRoutes(r, cfg, store, newResponseCache(0, 0, 0), newCoalescer())
+	return r
+}
+
+// storedAlbum is the part of a rendered album the handler tests look at.
+type storedAlbum struct {
+	SingerID        int64  `json:"singer_id"`
+	AlbumID         int64  `json:"album_id"`
+	MarketingBudget *int64 `json:"marketing_budget"`
+	LastUpdateTime  string `json:"last_update_time"`
+}
+
+func (a storedAlbum) key() string {
+	return fmt.Sprintf("%d/%d", a.SingerID, a.AlbumID)
+}
+
+func listedKeys(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+
+	var env struct {
+		Data []storedAlbum `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	keys := []string{}
+	for _, a := range env.Data {
+		keys = append(keys, a.key())
+	}
+	return keys
+}
+
+func wantKeys(want ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if got := listedKeys(t, w); !reflect.DeepEqual(got, want) {
+			t.Errorf("albums = %v, want %v", got, want)
+		}
+	}
+}
+
+// wantAlbum checks the response is the album with the given key and budget,
+// nil for a NULL one, tagged with its ETag.
+func wantAlbum(key string, budget *int64) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		var a storedAlbum
+		if err := json.Unmarshal(w.Body.Bytes(), &a); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		if a.key() != key {
+			t.Errorf("album = %s, want %s", a.key(), key)
+		}
+		if !reflect.DeepEqual(a.MarketingBudget, budget) {
+			t.Errorf("marketing_budget = %s, want %s", mustMarshal(t, a.MarketingBudget), mustMarshal(t, budget))
+		}
+
+		ts, err := time.Parse(time.RFC3339Nano, a.LastUpdateTime)
+		if err != nil {
+			t.Fatalf("last_update_time %q: %v", a.LastUpdateTime, err)
+		}
+		if got, want := w.Header().Get("ETag"), albumETag(ts); got != want {
+			t.Errorf("ETag = %s, want %s", got, want)
+		}
+	}
+}
+
+func budget(n int64) *int64 {
+	return &n
+}
+
+// testAlbumHandlers runs the album routes through their paces against store,
+// which must hold the demo data and nothing else. Every store must pass it
+// the same way.
+func testAlbumHandlers(t *testing.T, store AlbumStore) {
+	r := newAlbumRouter(Config{}, store)
+
+	const transfer = `[{"from_singer_id":%d,"from_album_id":%d,"to_singer_id":%d,"to_album_id":%d,"amount":%d}]`
+
+	steps := []struct {
+		method  string
+		target  string
+		body    string
+		ifMatch string
+		want    int
+		check   func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{method: http.MethodGet, target: "/albums?order=singer,album", want: http.StatusOK, check: wantKeys("1/1", "1/2", "2/1", "2/2", "2/3")},
+		{method: http.MethodGet, target: "/albums?singer_id=1", want: http.StatusOK, check: wantKeys("1/1", "1/2")},
+		{method: http.MethodGet, target: "/albums/2/2", want: http.StatusOK, check: wantAlbum("2/2", budget(300000))},
+		{method: http.MethodGet, target: "/albums/2/3", want: http.StatusOK, check: wantAlbum("2/3", nil)},
+		{method: http.MethodGet, target: "/albums/9/9", want: http.StatusNotFound},
+
+		{method: http.MethodPost, target: "/albums", body: `{"singer_id":3,"album_id":1,"album_title":"New"}`, want: http.StatusCreated},
+		{method: http.MethodPost, target: "/albums", body: `{"singer_id":3,"album_id":1}`, want: http.StatusConflict},
+		{method: http.MethodPost, target: "/albums", body: `{"singer_id":9,"album_id":1}`, want: http.StatusNotFound},
+
+		{method: http.MethodPut, target: "/albums/3/1?mode=insert", body: `{}`, want: http.StatusConflict},
+		{method: http.MethodPut, target: "/albums/3/2?mode=update", body: `{}`, want: http.StatusNotFound},
+		{method: http.MethodPut, target: "/albums/3/2", body: `{"album_title":"Upserted"}`, want: http.StatusNoContent},
+		{method: http.MethodPut, target: "/albums/9/1", body: `{}`, want: http.StatusNotFound},
+		// An update without a budget leaves the budget alone.
+		{method: http.MethodPut, target: "/albums/2/2?mode=update", body: `{"album_title":"Renamed"}`, want: http.StatusNoContent},
+		{method: http.MethodGet, target: "/albums/2/2", want: http.StatusOK, check: wantAlbum("2/2", budget(300000))},
+
+		{method: http.MethodPost, target: "/singers/3/albums", body: `{}`, want: http.StatusCreated, check: wantAlbum("3/3", nil)},
+		{method: http.MethodPost, target: "/singers/9/albums", body: `{}`, want: http.StatusNotFound},
+
+		{method: http.MethodPost, target: "/albums/transfers/batch", body: fmt.Sprintf(transfer, 1, 1, 3, 1, 1000), want: http.StatusNoContent},
+		{method: http.MethodGet, target: "/albums/3/1", want: http.StatusOK, check: wantAlbum("3/1", budget(1000))},
+		{method: http.MethodGet, target: "/albums/1/1", want: http.StatusOK, check: wantAlbum("1/1", budget(299000))},
+		// A NULL budget counts as 0.
+		{method: http.MethodPost, target: "/albums/transfers/batch", body: fmt.Sprintf(transfer, 3, 2, 1, 1, 5), want: http.StatusConflict},
+		{method: http.MethodPost, target: "/albums/transfers/batch", body: fmt.Sprintf(transfer, 1, 1, 9, 9, 5), want: http.StatusNotFound},
+
+		{method: http.MethodDelete, target: "/albums/3/1", ifMatch: `"stale"`, want: http.StatusPreconditionFailed},
+		{method: http.MethodDelete, target: "/albums/3/1", ifMatch: "*", want: http.StatusNoContent},
+		{method: http.MethodGet, target: "/albums/3/1", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/albums/3/1", want: http.StatusNotFound},
+
+		// NULL budgets sort first, so last when descending.
+		{method: http.MethodGet, target: "/albums?order=-budget", want: http.StatusOK, check: wantKeys("2/2", "1/1", "1/2", "2/1", "2/3", "3/2", "3/3")},
+	}
+
+	for i, step := range steps {
+		req := httptest.NewRequest(step.method, step.target, strings.NewReader(step.body))
+		if step.ifMatch != "" {
+			req.Header.Set("If-Match", step.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != step.want {
+			t.Fatalf("step %d, %s %s: status = %d, want %d: %s", i, step.method, step.target, w.Code, step.want, w.Body)
+		}
+		if step.check != nil {
+			step.check(t, w)
+		}
+	}
+
+	// Paging by twos through ties in LastUpdateTime sees every album once.
+	var keys []string
+	target := "/albums?limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d: %s", target, w.Code, w.Body)
+		}
+		keys = append(keys, listedKeys(t, w)...)
+
+		token := w.Header().Get("X-Next-Page-Token")
+		if token == "" {
+			break
+		}
+		target = "/albums?limit=2&page_token=" + token
+	}
+	sort.Strings(keys)
+	if want := []string{"1/1", "1/2", "2/1", "2/2", "2/3", "3/2", "3/3"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("paged through %v, want %v", keys, want)
+	}
+}
+
+func TestAlbumHandlersMemory(t *testing.T) {
+	testAlbumHandlers(t, newMemoryStore(nil))
+}
+
+func TestAlbumHandlersSpanner(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	if err := insertOrUpdate(ctx, client, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMarketingBudgets(ctx, client, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := transferMarketingBudgets(ctx, client, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testAlbumHandlers(t, newSpannerStore(client, nil, false))
+}
+
+// TestMemoryStoreAsOf checks ?asOf, which needs old versions the memory store
+// doesn't keep, is reported as not implemented rather than failing.
+func TestMemoryStoreAsOf(t *testing.T) {
+	r := newAlbumRouter(Config{VersionRetentionPeriod: time.Hour}, newMemoryStore(nil))
+
+	asOf := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums?asOf="+asOf, nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotImplemented, w.Body)
+	}
+}
+
+// TestMemoryStoreConcurrentCreate checks concurrent creates for one singer
+// each get an id of their own, like the Spanner store's.
+func TestMemoryStoreConcurrentCreate(t *testing.T) {
+	store := newMemoryStore(nil)
+	ctx := context.Background()
+
+	const n = 20
+	ids := make([]int64, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, err := store.CreateAlbum(ctx, Album{SingerID: 4})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = a.AlbumID
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("got album ids %v, want 1 to %d", ids, n)
+		}
+	}
+
+	page, err := store.ListAlbums(ctx, ListOptions{Limit: maxAlbumLimit, SingerIDs: []int64{4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Count != n {
+		t.Errorf("singer 4 has %d albums, want %d", page.Count, n)
+	}
+}
+
+func TestCheckDatastore(t *testing.T) {
+	valid := Config{Datastore: DatastoreSpanner, GCloudProject: "p", SpannerInstanceID: "i", SpannerDatabaseID: "d"}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "spanner", cfg: valid},
+		{name: "spanner without a database", cfg: Config{Datastore: DatastoreSpanner, GCloudProject: "p", SpannerInstanceID: "i"}, wantErr: true},
+		{name: "memory", cfg: Config{Datastore: DatastoreMemory, AuditSink: AuditSinkStdout}},
+		{name: "memory with admin", cfg: Config{Datastore: DatastoreMemory, AdminEnabled: true}, wantErr: true},
+		{name: "memory with spanner audit", cfg: Config{Datastore: DatastoreMemory, AuditSink: AuditSinkSpanner}, wantErr: true},
+		{name: "unknown", cfg: Config{Datastore: "mysql"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := checkDatastore(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+)
+
+type Singer struct {
+	SingerID  int64              `json:"singer_id"`
+	FirstName spanner.NullString `json:"first_name"`
+	LastName  spanner.NullString `json:"last_name"`
+}
+
+// The builders below add each column together with its value so the two can't
+// drift out of alignment the way parallel column and value slices can.
+
+type mutationOp func(table string, cols []string, vals []interface{}) *spanner.Mutation
+
+func singerMutation(op mutationOp, s *Singer) *spanner.Mutation {
+	cols := []string{"SingerId", "FirstName", "LastName"}
+	vals := []interface{}{s.SingerID, s.FirstName, s.LastName}
+
+	return op("Singers", cols, vals)
+}
+
+// albumMutation always stamps LastUpdateTime with the commit timestamp.
+// MarketingBudget is only written when set, so upserting an album doesn't
+// clear an existing budget.
+func albumMutation(op mutationOp, a *Album) *spanner.Mutation {
+	cols := []string{"SingerId", "AlbumId", "AlbumTitle", "LastUpdateTime"}
+	vals := []interface{}{a.SingerID, a.AlbumID, a.AlbumTitle, spanner.CommitTimestamp}
+
+	if a.MarketingBudget.Valid {
+		cols = append(cols, "MarketingBudget")
+		vals = append(vals, a.MarketingBudget)
+	}
+
+	return op("Albums", cols, vals)
+}
+
+// Write modes callers can choose between. insert fails if the row exists,
+// update fails if it doesn't, and upsert does either.
+const (
+	WriteInsert = "insert"
+	WriteUpdate = "update"
+	WriteUpsert = "upsert"
+)
+
+var writeModes = map[string]mutationOp{
+	WriteInsert: spanner.Insert,
+	WriteUpdate: spanner.Update,
+	WriteUpsert: spanner.InsertOrUpdate,
+}
+
+// parseWriteMode returns the mutation for a write mode, defaulting to upsert.
+func parseWriteMode(mode string) (mutationOp, error) {
+	if mode == "" {
+		mode = WriteUpsert
+	}
+	op, ok := writeModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("invalid mode %q, expected %s, %s or %s", mode, WriteInsert, WriteUpdate, WriteUpsert)
+	}
+	return op, nil
+}
+
+func insertOrUpdateSingerMutation(s *Singer) *spanner.Mutation {
+	return singerMutation(spanner.InsertOrUpdate, s)
+}
+
+func insertAlbumMutation(a *Album) *spanner.Mutation {
+	return albumMutation(spanner.Insert, a)
+}
+
+func insertOrUpdateAlbumMutation(a *Album) *spanner.Mutation {
+	return albumMutation(spanner.InsertOrUpdate, a)
+}
+
+func nullString(s string) spanner.NullString {
+	return spanner.NullString{StringVal: s, Valid: true}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+)
+
+func TestParseWriteMode(t *testing.T) {
+	for _, mode := range []string{"", WriteInsert, WriteUpdate, WriteUpsert} {
+		if _, err := parseWriteMode(mode); err != nil {
+			t.Errorf("parseWriteMode(%q): %v", mode, err)
+		}
+	}
+	for _, mode := range []string{"replace", "INSERT", "delete"} {
+		if _, err := parseWriteMode(mode); err == nil {
+			t.Errorf("parseWriteMode(%q): got nil error", mode)
+		}
+	}
+}
+
+// TestMutationsByWriteMode checks each write mode builds the matching kind of
+// mutation, with every column lined up with its value.
+func TestMutationsByWriteMode(t *testing.T) {
+	singer := &Singer{SingerID: 1, FirstName: nullString("Marc"), LastName: nullString("Richards")}
+	album := &Album{SingerID: 1, AlbumID: 2, AlbumTitle: nullString("Total Junk")}
+	budgeted := &Album{SingerID: 1, AlbumID: 3, MarketingBudget: spanner.NullInt64{Int64: 100, Valid: true}}
+
+	tests := []struct {
+		mode string
+		want mutationOp
+	}{
+		{mode: "", want: spanner.InsertOrUpdate},
+		{mode: WriteInsert, want: spanner.Insert},
+		{mode: WriteUpdate, want: spanner.Update},
+		{mode: WriteUpsert, want: spanner.InsertOrUpdate},
+	}
+
+	for _, tt := range tests {
+		op, err := parseWriteMode(tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := singerMutation(op, singer)
+		want := tt.want("Singers",
+			[]string{"SingerId", "FirstName", "LastName"},
+			[]interface{}{int64(1), nullString("Marc"), nullString("Richards")})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %q: singerMutation = %+v, want %+v", tt.mode, got, want)
+		}
+
+		// MarketingBudget is left out unless it's set.
+		got = albumMutation(op, album)
+		want = tt.want("Albums",
+			[]string{"SingerId", "AlbumId", "AlbumTitle", "LastUpdateTime"},
+			[]interface{}{int64(1), int64(2), nullString("Total Junk"), spanner.CommitTimestamp})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %q: albumMutation = %+v, want %+v", tt.mode, got, want)
+		}
+
+		got = albumMutation(op, budgeted)
+		want = tt.want("Albums",
+			[]string{"SingerId", "AlbumId", "AlbumTitle", "LastUpdateTime", "MarketingBudget"},
+			[]interface{}{int64(1), int64(3), spanner.NullString{}, spanner.CommitTimestamp, spanner.NullInt64{Int64: 100, Valid: true}})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %q: albumMutation with a budget = %+v, want %+v", tt.mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// MySQLPool holds the database/sql pool settings for the MySQL store. A zero
+// MaxOpenConns or ConnMaxLifetime means no limit, while a zero MaxIdleConns
+// keeps no idle connections at all.
+type MySQLPool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func (p MySQLPool) validate() error {
+	if p.MaxOpenConns < 0 || p.MaxIdleConns < 0 || p.ConnMaxLifetime < 0 {
+		return errors.New("MySQL pool settings must not be negative")
+	}
+	return nil
+}
+
+// openMySQL opens the MySQL store with the given pool settings. Like
+// sql.Open, it doesn't connect until the pool is first used.
+func openMySQL(dsn string, pool MySQLPool) (*sql.DB, error) {
+	if err := pool.validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.apply(db)
+	return db, nil
+}
+
+func (p MySQLPool) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMySQLDriver stands in for MySQL. Its connections answer
+// sqlCountAlbumsBySinger with the counts registered under the data source
+// name, and nothing else.
+type fakeMySQLDriver struct{}
+
+var (
+	fakeMySQLMu     sync.Mutex
+	fakeMySQLCounts = make(map[string]map[int64]int64)
+)
+
+func (fakeMySQLDriver) Open(name string) (driver.Conn, error) {
+	fakeMySQLMu.Lock()
+	defer fakeMySQLMu.Unlock()
+	return fakeMySQLConn{counts: fakeMySQLCounts[name]}, nil
+}
+
+type fakeMySQLConn struct {
+	counts map[int64]int64
+}
+
+func (c fakeMySQLConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	if query != sqlCountAlbumsBySinger {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	rows := &fakeMySQLRows{}
+	for id, n := range c.counts {
+		rows.values = append(rows.values, []driver.Value{id, n})
+	}
+	return rows, nil
+}
+
+func (fakeMySQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (fakeMySQLConn) Close() error              { return nil }
+func (fakeMySQLConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeMySQLRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeMySQLRows) Columns() []string { return []string{"SingerId", "COUNT(*)"} }
+func (r *fakeMySQLRows) Close() error      { return nil }
+
+func (r *fakeMySQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("fakemysql", fakeMySQLDriver{})
+}
+
+// openFakeMySQL opens a fake MySQL store with counts as its albums per
+// singer.
+func openFakeMySQL(t *testing.T, counts map[int64]int64) *sql.DB {
+	t.Helper()
+
+	fakeMySQLMu.Lock()
+	fakeMySQLCounts[t.Name()] = counts
+	fakeMySQLMu.Unlock()
+
+	db, err := sql.Open("fakemysql", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMySQLPoolValidate(t *testing.T) {
+	tests := []struct {
+		pool    MySQLPool
+		wantErr bool
+	}{
+		{pool: MySQLPool{}},
+		{pool: MySQLPool{MaxOpenConns: 10, MaxIdleConns: 5, ConnMaxLifetime: time.Minute}},
+		{pool: MySQLPool{MaxOpenConns: -1}, wantErr: true},
+		{pool: MySQLPool{MaxIdleConns: -1}, wantErr: true},
+		{pool: MySQLPool{ConnMaxLifetime: -time.Second}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.pool.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.validate() = %v, want error %v", tt.pool, err, tt.wantErr)
+		}
+	}
+
+	if _, err := openMySQL("user@tcp(127.0.0.1:3306)/db", MySQLPool{MaxIdleConns: -1}); err == nil {
+		t.Error("openMySQL took a negative pool setting")
+	}
+}
+
+// TestMySQLPoolApply checks each setting by how the pool behaves.
+func TestMySQLPoolApply(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("open and idle", func(t *testing.T) {
+		db := openFakeMySQL(t, nil)
+		MySQLPool{MaxOpenConns: 3, MaxIdleConns: 1}.apply(db)
+
+		var conns []*sql.Conn
+		for i := 0; i < 3; i++ {
+			c, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, c)
+		}
+
+		// A fourth has to wait for one of the three.
+		waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		if c, err := db.Conn(waitCtx); err == nil {
+			c.Close()
+			t.Error("got a fourth connection with MaxOpenConns 3")
+		}
+
+		for _, c := range conns {
+			c.Close()
+		}
+
+		stats := db.Stats()
+		if stats.MaxOpenConnections != 3 {
+			t.Errorf("MaxOpenConnections = %d, want 3", stats.MaxOpenConnections)
+		}
+		if stats.Idle != 1 || stats.MaxIdleClosed != 2 {
+			t.Errorf("%d idle, %d closed as over the idle limit; want 1 and 2", stats.Idle, stats.MaxIdleClosed)
+		}
+	})
+
+	t.Run("lifetime", func(t *testing.T) {
+		db := openFakeMySQL(t, nil)
+		MySQLPool{MaxIdleConns: 1, ConnMaxLifetime: time.Millisecond}.apply(db)
+
+		c, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		time.Sleep(10 * time.Millisecond)
+
+		// The expired connection isn't reused.
+		if c, err = db.Conn(ctx); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		if n := db.Stats().MaxLifetimeClosed; n == 0 {
+			t.Error("no connections closed for their lifetime")
+		}
+	})
+}
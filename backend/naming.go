@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	JSONNamingSnake = "snake"
+	JSONNamingCamel = "camel"
+)
+
+// jsonNaming is the key naming convention of every JSON response. It's set
+// once from config at startup.
+var jsonNaming = JSONNamingSnake
+
+func setJSONNaming(n string) error {
+	switch n {
+	case JSONNamingSnake, JSONNamingCamel:
+		jsonNaming = n
+		return nil
+	}
+	return fmt.Errorf("invalid JSON naming %q, expected %s or %s", n, JSONNamingSnake, JSONNamingCamel)
+}
+
+// camelCaseKeys rewrites every object key in a JSON document from snake_case
+// to camelCase, keeping keys in the order they were written. Responses are
+// all written with snake_case struct tags and converted here, which keeps the
+// two conventions from drifting apart. Map keys are converted too, but none
+// of ours hold data with underscores in it.
+func camelCaseKeys(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var buf bytes.Buffer
+	if err := rewriteKeys(dec, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func rewriteKeys(dec *json.Decoder, buf *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		v, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		buf.Write(v)
+		return nil
+	}
+
+	buf.WriteRune(rune(delim))
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if delim == '{' {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k, _ := json.Marshal(snakeToCamel(key.(string)))
+			buf.Write(k)
+			buf.WriteByte(':')
+		}
+		if err := rewriteKeys(dec, buf); err != nil {
+			return err
+		}
+	}
+
+	// The closing delimiter.
+	end, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	buf.WriteRune(rune(end.(json.Delim)))
+	return nil
+}
+
+// snakeToCamel turns singer_id into singerId.
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+)
+
+// withJSONNaming sets the JSON key convention for the rest of the test.
+func withJSONNaming(t *testing.T, n string) {
+	t.Helper()
+
+	prev := jsonNaming
+	if err := setJSONNaming(n); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { jsonNaming = prev })
+}
+
+func TestSetJSONNaming(t *testing.T) {
+	for _, n := range []string{"", "kebab", "Camel"} {
+		prev := jsonNaming
+		if err := setJSONNaming(n); err == nil {
+			t.Errorf("setJSONNaming(%q) succeeded", n)
+		}
+		if jsonNaming != prev {
+			t.Errorf("setJSONNaming(%q) failed but changed the naming to %q", n, jsonNaming)
+		}
+	}
+}
+
+func TestSnakeToCamel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "singer_id", want: "singerId"},
+		{in: "last_update_time", want: "lastUpdateTime"},
+		{in: "count", want: "count"},
+		{in: "next_", want: "next"},
+		{in: "a__b", want: "aB"},
+		{in: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := snakeToCamel(tt.in); got != tt.want {
+			t.Errorf("snakeToCamel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCamelCaseKeys(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: `{"singer_id":1,"album_id":2}`, want: `{"singerId":1,"albumId":2}`},
+		// Keys keep the order they were written in.
+		{in: `{"z_key":1,"a_key":2}`, want: `{"zKey":1,"aKey":2}`},
+		{in: `{"items":[{"album_title":"under_score"}],"meta":{"next_cursor":null}}`, want: `{"items":[{"albumTitle":"under_score"}],"meta":{"nextCursor":null}}`},
+		// Numbers come through exactly, however large.
+		{in: `[{"marketing_budget":9007199254740993}]`, want: `[{"marketingBudget":9007199254740993}]`},
+		{in: `"not_an_object"`, want: `"not_an_object"`},
+		{in: `{}`, want: `{}`},
+	}
+
+	for _, tt := range tests {
+		got, err := camelCaseKeys([]byte(tt.in))
+		if err != nil {
+			t.Errorf("camelCaseKeys(%s): %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("camelCaseKeys(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := camelCaseKeys([]byte(`{"singer_id":`)); err == nil {
+		t.Error("camelCaseKeys accepted truncated JSON")
+	}
+}
+
+// TestWriteJSONNaming checks a response is written with snake_case keys by
+// default and camelCase keys when configured, errors included.
+func TestWriteJSONNaming(t *testing.T) {
+	withTimeFormat(t, TimeFormatRFC3339)
+	withNullBudget(t, NullBudgetNull)
+
+	album := &Album{SingerID: 1, AlbumID: 2, AlbumTitle: spanner.NullString{StringVal: "Total_Junk", Valid: true}}
+
+	tests := []struct {
+		naming    string
+		wantAlbum string
+		wantError string
+	}{
+		{
+			naming: JSONNamingSnake,
+			wantAlbum: `{
+  "singer_id": 1,
+  "album_id": 2,
+  "album_title": "Total_Junk",
+  "marketing_budget": null,
+  "last_update_time": null
+}
+`,
+			wantError: `{
+  "error": {
+    "code": 404,
+    "message": "not_found"
+  }
+}
+`,
+		},
+		{
+			naming: JSONNamingCamel,
+			wantAlbum: `{
+  "singerId": 1,
+  "albumId": 2,
+  "albumTitle": "Total_Junk",
+  "marketingBudget": null,
+  "lastUpdateTime": null
+}
+`,
+			wantError: `{
+  "error": {
+    "code": 404,
+    "message": "not_found"
+  }
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.naming, func(t *testing.T) {
+			withJSONNaming(t, tt.naming)
+
+			w := httptest.NewRecorder()
+			writeJSON(w, http.StatusOK, album)
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("status %d, Content-Type %q; want %d, application/json", w.Code, w.Header().Get("Content-Type"), http.StatusOK)
+			}
+			if w.Body.String() != tt.wantAlbum {
+				t.Errorf("album body\n%s\nwant\n%s", w.Body, tt.wantAlbum)
+			}
+
+			w = httptest.NewRecorder()
+			writeJSONError(w, http.StatusNotFound, "not_found")
+			if w.Code != http.StatusNotFound {
+				t.Errorf("error status %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if w.Body.String() != tt.wantError {
+				t.Errorf("error body\n%s\nwant\n%s", w.Body, tt.wantError)
+			}
+		})
+	}
+}
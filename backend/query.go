@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// Queries taking at least slowQueryThreshold are logged, with their row count
+// if slowQueryRows is set. A zero threshold turns the log off. Both are set
+// once from config at startup.
+var (
+	slowQueryThreshold time.Duration
+	slowQueryRows      bool
+)
+
+// querier is anything we can run a query in: a single-use or read-only
+// transaction, or a read-write one.
+type querier interface {
+	Query(ctx context.Context, statement spanner.Statement) *spanner.RowIterator
+}
+
+// queryRows runs stmt in q and calls fn for each row, stopping at the first
+// error. name identifies the query in the slow query log. Time spent in fn
+// counts towards the query's duration, as rows are streamed while fn runs.
+func queryRows(ctx context.Context, q querier, name string, stmt spanner.Statement, fn func(row *spanner.Row) error) error {
+	start := time.Now()
+	rows := 0
+
+	iter := q.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		rows++
+		return fn(row)
+	})
+
+	logSlowQuery(name, time.Since(start), rows)
+	return err
+}
+
+func logSlowQuery(name string, d time.Duration, rows int) {
+	if slowQueryThreshold <= 0 || d < slowQueryThreshold {
+		return
+	}
+	if slowQueryRows {
+		log.Printf("Warning: slow query %s took %s, %d rows", name, d, rows)
+		return
+	}
+	log.Printf("Warning: slow query %s took %s", name, d)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// withSlowQueryLog sets the slow query threshold and row logging for the rest
+// of the test.
+func withSlowQueryLog(t *testing.T, threshold time.Duration, rows bool) {
+	t.Helper()
+
+	prevThreshold, prevRows := slowQueryThreshold, slowQueryRows
+	slowQueryThreshold, slowQueryRows = threshold, rows
+	t.Cleanup(func() { slowQueryThreshold, slowQueryRows = prevThreshold, prevRows })
+}
+
+func TestLogSlowQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		rows      bool
+		took      time.Duration
+		want      string
+	}{
+		{name: "off", took: time.Hour},
+		{name: "fast", threshold: time.Second, took: 999 * time.Millisecond},
+		{name: "at the threshold", threshold: time.Second, took: time.Second, want: "Warning: slow query getAlbums took 1s\n"},
+		{name: "slow", threshold: time.Second, took: 1500 * time.Millisecond, want: "Warning: slow query getAlbums took 1.5s\n"},
+		{name: "slow with rows", threshold: time.Second, rows: true, took: 2 * time.Second, want: "Warning: slow query getAlbums took 2s, 7 rows\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSlowQueryLog(t, tt.threshold, tt.rows)
+			out := captureLog(t)
+
+			logSlowQuery("getAlbums", tt.took, 7)
+
+			if out.String() != tt.want {
+				t.Errorf("logged %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+// TestQueryRowsLogsSlowQuery slows a real query down by sleeping on each row,
+// and expects it in the slow query log with its row count.
+func TestQueryRowsLogsSlowQuery(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 1, AlbumID: 2})
+
+	withSlowQueryLog(t, 20*time.Millisecond, true)
+	out := captureLog(t)
+
+	stmt := spanner.Statement{SQL: "SELECT AlbumId FROM Albums"}
+	err := queryRows(context.Background(), client.Single(), "slowAlbums", stmt, func(row *spanner.Row) error {
+		time.Sleep(15 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := out.String()
+	if !strings.HasPrefix(line, "Warning: slow query slowAlbums took ") || !strings.HasSuffix(line, ", 2 rows\n") {
+		t.Errorf("logged %q, want a slow query line for slowAlbums with 2 rows", line)
+	}
+}
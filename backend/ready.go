@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+)
+
+const (
+	StateStarting   = "STARTING"
+	StateServing    = "SERVING"
+	StateNotServing = "NOT_SERVING"
+
+	pingTimeout = 2 * time.Second
+
+	// readyCacheJitter is the most a cached result's lifetime is cut short by,
+	// as a fraction of the TTL, so replicas probed in step don't all ping
+	// Spanner at the same moment.
+	readyCacheJitter = 0.2
+)
+
+// Readiness sub-checks. The data plane serves our queries and the admin plane
+// schema changes, backups and operations; either can be down while the other
+// is up.
+const (
+	CheckData  = "data"
+	CheckAdmin = "admin"
+)
+
+// readiness tracks whether we can serve traffic. It starts out STARTING and
+// only moves on once both Spanner planes have answered, so orchestrators can
+// tell a cold start apart from a failure. After that it's SERVING while both
+// answer and NOT_SERVING while either doesn't.
+//
+// Probes reuse the last result for up to ttl, so frequent probing doesn't
+// turn into a stream of pings.
+type readiness struct {
+	mu      sync.Mutex
+	state   string
+	checks  map[string]CheckResult
+	expires time.Time
+
+	// pingData and pingAdmin run the sub-checks.
+	pingData  func(ctx context.Context) error
+	pingAdmin func(ctx context.Context) error
+
+	ttl time.Duration
+	// warmUpEvery is how often warmUp retries while we're STARTING.
+	warmUpEvery time.Duration
+	// refresh lets only one probe at a time go to Spanner; the rest wait for
+	// its result.
+	refresh sync.Mutex
+}
+
+// CheckResult is the outcome of one sub-check.
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkErrors are what a failed sub-check reports. /readyz is unauthenticated,
+// so the error itself, which names the database and can carry details from
+// Spanner, is only logged.
+var checkErrors = map[string]string{
+	CheckData:  "spanner unavailable",
+	CheckAdmin: "spanner admin API unavailable",
+}
+
+func newCheckResult(check string, err error) CheckResult {
+	if err != nil {
+		log.Printf("Readiness check %s failed: %s", check, err.Error())
+		return CheckResult{Status: StateNotServing, Error: checkErrors[check]}
+	}
+	return CheckResult{Status: StateServing}
+}
+
+func newReadiness(ttl time.Duration, client *spanner.Client, adminClient *database.DatabaseAdminClient, dbPath string) *readiness {
+	return &readiness{
+		state:       StateStarting,
+		ttl:         ttl,
+		warmUpEvery: time.Second,
+		pingData: func(ctx context.Context) error {
+			return pingSpanner(ctx, client)
+		},
+		pingAdmin: func(ctx context.Context) error {
+			return pingAdminAPI(ctx, adminClient, dbPath)
+		},
+	}
+}
+
+func (rd *readiness) get() (string, map[string]CheckResult) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	return rd.state, rd.checks
+}
+
+// check runs both sub-checks and records the result. A failure while STARTING
+// leaves us STARTING rather than NOT_SERVING. If ctx is done by the time the
+// pings return, their failures say nothing about Spanner, so nothing is
+// recorded and the last result is returned instead.
+func (rd *readiness) check(ctx context.Context) (string, map[string]CheckResult) {
+	var dataErr, adminErr error
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dataErr = rd.pingData(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		adminErr = rd.pingAdmin(ctx)
+	}()
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return rd.get()
+	}
+
+	checks := map[string]CheckResult{
+		CheckData:  newCheckResult(CheckData, dataErr),
+		CheckAdmin: newCheckResult(CheckAdmin, adminErr),
+	}
+
+	err := dataErr
+	if err == nil {
+		err = adminErr
+	}
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.checks = checks
+	if rd.ttl > 0 {
+		jitter := time.Duration(rand.Int63n(int64(float64(rd.ttl)*readyCacheJitter) + 1))
+		rd.expires = time.Now().Add(rd.ttl - jitter)
+	}
+
+	switch {
+	case err == nil:
+		if rd.state != StateServing {
+			log.Printf("Readiness: %s -> %s", rd.state, StateServing)
+		}
+		rd.state = StateServing
+	case rd.state != StateStarting:
+		if rd.state != StateNotServing {
+			log.Printf("Readiness: %s -> %s: %s", rd.state, StateNotServing, err.Error())
+		}
+		rd.state = StateNotServing
+	}
+
+	return rd.state, rd.checks
+}
+
+// cachedCheck returns the last result if it's younger than the TTL, and runs
+// the checks otherwise. Results are never older than the TTL, so an outage
+// shows up within one TTL of starting.
+//
+// The checks run on a context of their own rather than the probe's: other
+// probes wait for the result and it's cached for all of them, so one probe
+// hanging up mustn't fail it.
+func (rd *readiness) cachedCheck() (string, map[string]CheckResult) {
+	if state, checks, ok := rd.fresh(); ok {
+		return state, checks
+	}
+
+	rd.refresh.Lock()
+	defer rd.refresh.Unlock()
+
+	// Someone else may have refreshed while we waited.
+	if state, checks, ok := rd.fresh(); ok {
+		return state, checks
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return rd.check(ctx)
+}
+
+func (rd *readiness) fresh() (string, map[string]CheckResult, bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.checks == nil || !time.Now().Before(rd.expires) {
+		return "", nil, false
+	}
+	return rd.state, rd.checks, true
+}
+
+// warmUp runs the checks until they first pass so we leave STARTING without
+// waiting for a probe to come along.
+func (rd *readiness) warmUp(ctx context.Context) {
+	for {
+		if state, _ := rd.check(ctx); state != StateStarting {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rd.warmUpEvery):
+		}
+	}
+}
+
+// Readiness is the /readyz body. Status is the worst of Checks.
+type Readiness struct {
+	Status   string                 `json:"status"`
+	Starting bool                   `json:"starting"`
+	Checks   map[string]CheckResult `json:"checks"`
+}
+
+func readyzHandler(rd *readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, checks := rd.cachedCheck()
+
+		code := http.StatusOK
+		if state != StateServing {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, code, Readiness{Status: state, Starting: state == StateStarting, Checks: checks})
+	}
+}
+
+// Health is the /healthz and /livez body when all is well.
+type Health struct {
+	Status string `json:"status"`
+}
+
+// healthzHandler pings Spanner's data plane, and nothing else, on every call.
+// It's for load balancers and probes that want a plain yes or no; /readyz has
+// the detail. It's unauthenticated, so a failure is logged but the caller only
+// gets a generic error.
+func healthzHandler(client *spanner.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := pingSpanner(r.Context(), client); err != nil {
+			log.Printf("Health check failed: %s", err.Error())
+			writeJSONError(w, http.StatusServiceUnavailable, "spanner unavailable")
+			return
+		}
+		writeJSON(w, http.StatusOK, Health{Status: "ok"})
+	}
+}
+
+// livezHandler always succeeds: if we can answer at all, we're alive. Spanner
+// being down is no reason to restart us.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Health{Status: "ok"})
+}
+
+func pingSpanner(ctx context.Context, client *spanner.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	iter := client.Single().Query(ctx, spanner.Statement{SQL: sqlPing})
+	defer iter.Stop()
+
+	_, err := iter.Next()
+	return err
+}
+
+// pingAdminAPI is checkAdminAPI with the ping timeout.
+func pingAdminAPI(ctx context.Context, adminClient *database.DatabaseAdminClient, dbPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	return checkAdminAPI(ctx, adminClient, dbPath)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// detailedErr is the kind of error a ping fails with: it names the database.
+var detailedErr = errors.New("rpc error: code = PermissionDenied desc = projects/p/instances/i/databases/d: caller lacks spanner.databases.select")
+
+func TestNewCheckResult(t *testing.T) {
+	for _, check := range []string{CheckData, CheckAdmin} {
+		if got := newCheckResult(check, nil); got != (CheckResult{Status: StateServing}) {
+			t.Errorf("%s passing: got %+v", check, got)
+		}
+
+		got := newCheckResult(check, detailedErr)
+		if got.Status != StateNotServing || got.Error != checkErrors[check] || got.Error == "" {
+			t.Errorf("%s failing: got %+v, want %s with %q", check, got, StateNotServing, checkErrors[check])
+		}
+	}
+}
+
+// TestReadyzHidesErrors checks /readyz reports which check failed but not
+// the error it failed with.
+func TestReadyzHidesErrors(t *testing.T) {
+	rd := &readiness{
+		state: StateNotServing,
+		checks: map[string]CheckResult{
+			CheckData:  newCheckResult(CheckData, detailedErr),
+			CheckAdmin: newCheckResult(CheckAdmin, nil),
+		},
+		ttl:     time.Minute,
+		expires: time.Now().Add(time.Minute),
+	}
+
+	w := httptest.NewRecorder()
+	readyzHandler(rd)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(w.Body.String(), "projects/") || strings.Contains(w.Body.String(), "PermissionDenied") {
+		t.Errorf("body %s gives away the error", w.Body)
+	}
+
+	var got Readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if c := got.Checks[CheckData]; c.Status != StateNotServing || c.Error != "spanner unavailable" {
+		t.Errorf("data check = %+v", c)
+	}
+	if c := got.Checks[CheckAdmin]; c.Status != StateServing || c.Error != "" {
+		t.Errorf("admin check = %+v", c)
+	}
+}
+
+// TestWarmUp checks failed checks leave us STARTING, rather than NOT_SERVING,
+// and warmUp keeps checking until both planes answer and we're SERVING.
+func TestWarmUp(t *testing.T) {
+	var pings int32
+	rd := newReadiness(time.Minute, nil, nil, "")
+	rd.warmUpEvery = time.Millisecond
+	// The data plane comes up on the third try.
+	rd.pingData = func(ctx context.Context) error {
+		if atomic.AddInt32(&pings, 1) < 3 {
+			return detailedErr
+		}
+		return nil
+	}
+	rd.pingAdmin = func(ctx context.Context) error { return nil }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if state, _ := rd.check(ctx); state != StateStarting {
+		t.Fatalf("state after a failed check = %s, want %s", state, StateStarting)
+	}
+
+	rd.warmUp(ctx)
+
+	state, checks := rd.get()
+	if state != StateServing {
+		t.Errorf("state after warmUp = %s, want %s", state, StateServing)
+	}
+	for _, check := range []string{CheckData, CheckAdmin} {
+		if checks[check].Status != StateServing {
+			t.Errorf("%s check = %+v, want %s", check, checks[check], StateServing)
+		}
+	}
+	if n := atomic.LoadInt32(&pings); n != 3 {
+		t.Errorf("pinged the data plane %d times, want 3", n)
+	}
+}
+
+// probeReadyz makes one /readyz probe and returns its status code.
+func probeReadyz(rd *readiness) int {
+	w := httptest.NewRecorder()
+	readyzHandler(rd)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return w.Code
+}
+
+// TestReadyzCachesPings probes /readyz as fast as several callers can for a
+// few TTLs, and expects Spanner to be pinged at most once per TTL window, and
+// only once by probes that arrive together.
+func TestReadyzCachesPings(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+
+	var pings int32
+	rd := newReadiness(ttl, nil, nil, "")
+	rd.state = StateServing
+	rd.pingData = func(ctx context.Context) error {
+		atomic.AddInt32(&pings, 1)
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	rd.pingAdmin = func(ctx context.Context) error { return nil }
+
+	start := time.Now()
+	deadline := start.Add(3 * ttl)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if code := probeReadyz(rd); code != http.StatusOK {
+					t.Errorf("status = %d, want %d", code, http.StatusOK)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Jitter can cut a window down to 80% of the TTL.
+	windows := int32(elapsed/time.Duration(float64(ttl)*(1-readyCacheJitter))) + 1
+	if n := atomic.LoadInt32(&pings); n < 2 || n > windows {
+		t.Errorf("pinged %d times in %s, want between 2 and %d", n, elapsed, windows)
+	}
+}
+
+// TestReadyzDetectsOutageWithinTTL checks a cached SERVING result doesn't
+// hide an outage for longer than the TTL.
+func TestReadyzDetectsOutageWithinTTL(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+
+	var down int32
+	rd := newReadiness(ttl, nil, nil, "")
+	rd.state = StateServing
+	rd.pingData = func(ctx context.Context) error {
+		if atomic.LoadInt32(&down) == 1 {
+			return detailedErr
+		}
+		return nil
+	}
+	rd.pingAdmin = func(ctx context.Context) error { return nil }
+
+	if code := probeReadyz(rd); code != http.StatusOK {
+		t.Fatalf("status = %d before the outage, want %d", code, http.StatusOK)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	start := time.Now()
+	for probeReadyz(rd) != http.StatusServiceUnavailable {
+		if time.Since(start) > ttl+50*time.Millisecond {
+			t.Fatalf("outage still not reported after %s, with a TTL of %s", time.Since(start), ttl)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestReadyzIgnoresProbeContext checks a probe that has already hung up still
+// refreshes the cached result from pings that weren't canceled along with it.
+func TestReadyzIgnoresProbeContext(t *testing.T) {
+	rd := newReadiness(time.Minute, nil, nil, "")
+	rd.state = StateServing
+	rd.pingData = func(ctx context.Context) error { return ctx.Err() }
+	rd.pingAdmin = func(ctx context.Context) error { return ctx.Err() }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	readyzHandler(rd)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if state, _ := rd.get(); state != StateServing {
+		t.Errorf("state = %s, want %s", state, StateServing)
+	}
+}
+
+// TestCheckCanceled checks pings that fail because check's own context was
+// canceled don't take us out of SERVING or get cached.
+func TestCheckCanceled(t *testing.T) {
+	rd := newReadiness(time.Minute, nil, nil, "")
+	rd.state = StateServing
+	rd.pingData = func(ctx context.Context) error { return ctx.Err() }
+	rd.pingAdmin = func(ctx context.Context) error { return ctx.Err() }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if state, _ := rd.check(ctx); state != StateServing {
+		t.Errorf("state = %s, want %s", state, StateServing)
+	}
+	if _, _, ok := rd.fresh(); ok {
+		t.Error("the canceled result was cached")
+	}
+}
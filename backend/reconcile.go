@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"cloud.google.com/go/spanner"
+)
+
+// SingerCount compares how many albums a singer has in each store.
+type SingerCount struct {
+	SingerID int64 `json:"singer_id"`
+	Spanner  int64 `json:"spanner"`
+	MySQL    int64 `json:"mysql"`
+	Match    bool  `json:"match"`
+}
+
+type Reconciliation struct {
+	Match   bool           `json:"match"`
+	Singers []*SingerCount `json:"singers"`
+}
+
+// reconcileAlbums counts albums per singer in Spanner and MySQL, for checking
+// a migration between the two. Singers missing from one store count as zero
+// there.
+func reconcileAlbums(ctx context.Context, client *spanner.Client, mysqlDB *sql.DB) (*Reconciliation, error) {
+	spannerCounts, err := countSpannerAlbums(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	mysqlCounts, err := countMySQLAlbums(ctx, mysqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	return compareAlbumCounts(spannerCounts, mysqlCounts), nil
+}
+
+// compareAlbumCounts matches up per-singer album counts from each store.
+func compareAlbumCounts(spannerCounts, mysqlCounts map[int64]int64) *Reconciliation {
+	counts := make(map[int64]*SingerCount)
+	get := func(id int64) *SingerCount {
+		c, ok := counts[id]
+		if !ok {
+			c = &SingerCount{SingerID: id}
+			counts[id] = c
+		}
+		return c
+	}
+	for id, n := range spannerCounts {
+		get(id).Spanner = n
+	}
+	for id, n := range mysqlCounts {
+		get(id).MySQL = n
+	}
+
+	res := &Reconciliation{Match: true, Singers: make([]*SingerCount, 0, len(counts))}
+	for _, c := range counts {
+		c.Match = c.Spanner == c.MySQL
+		if !c.Match {
+			res.Match = false
+		}
+		res.Singers = append(res.Singers, c)
+	}
+	sort.Slice(res.Singers, func(i, j int) bool { return res.Singers[i].SingerID < res.Singers[j].SingerID })
+
+	return res
+}
+
+func countSpannerAlbums(ctx context.Context, client *spanner.Client) (counts map[int64]int64, err error) {
+	defer func() { err = spannerError(err) }()
+
+	counts = make(map[int64]int64)
+
+	err = queryRows(ctx, client.Single(), "countSpannerAlbums", spanner.Statement{SQL: sqlCountAlbumsBySinger}, func(row *spanner.Row) error {
+		var id, n int64
+		if err := row.Columns(&id, &n); err != nil {
+			return err
+		}
+		counts[id] = n
+		return nil
+	})
+	if err != nil {
+		counts = nil
+	}
+	return
+}
+
+func countMySQLAlbums(ctx context.Context, db *sql.DB) (map[int64]int64, error) {
+	rows, err := db.QueryContext(ctx, sqlCountAlbumsBySinger)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int64)
+	for rows.Next() {
+		var id, n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+
+	return counts, rows.Err()
+}
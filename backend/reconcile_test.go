@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCompareAlbumCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		spanner   map[int64]int64
+		mysql     map[int64]int64
+		wantMatch bool
+		want      string
+	}{
+		{name: "empty", wantMatch: true, want: `[]`},
+		{
+			name:      "same",
+			spanner:   map[int64]int64{1: 2, 2: 1},
+			mysql:     map[int64]int64{2: 1, 1: 2},
+			wantMatch: true,
+			want:      `[{"singer_id":1,"spanner":2,"mysql":2,"match":true},{"singer_id":2,"spanner":1,"mysql":1,"match":true}]`,
+		},
+		{
+			name:    "diverged",
+			spanner: map[int64]int64{1: 2, 2: 1, 3: 4},
+			mysql:   map[int64]int64{1: 2, 2: 3, 4: 1},
+			want: `[{"singer_id":1,"spanner":2,"mysql":2,"match":true},` +
+				`{"singer_id":2,"spanner":1,"mysql":3,"match":false},` +
+				`{"singer_id":3,"spanner":4,"mysql":0,"match":false},` +
+				`{"singer_id":4,"spanner":0,"mysql":1,"match":false}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := compareAlbumCounts(tt.spanner, tt.mysql)
+			if res.Match != tt.wantMatch {
+				t.Errorf("match = %v, want %v", res.Match, tt.wantMatch)
+			}
+			if got := mustMarshal(t, res.Singers); got != tt.want {
+				t.Errorf("singers = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountMySQLAlbums(t *testing.T) {
+	want := map[int64]int64{1: 2, 2: 1}
+	got, err := countMySQLAlbums(context.Background(), openFakeMySQL(t, want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+}
+
+// TestReconcile counts albums in Spanner against a MySQL store that's missing
+// one, through GET /admin/reconcile.
+func TestReconcile(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client, &Album{SingerID: 1, AlbumID: 1}, &Album{SingerID: 1, AlbumID: 2}, &Album{SingerID: 2, AlbumID: 1})
+	mysqlDB := openFakeMySQL(t, map[int64]int64{1: 1, 2: 1})
+
+	router := mux.NewRouter()
+	registerAdminRoutes(router, Config{}, client, nil, "", nil, nil, nil, nil, nil, mysqlDB)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/reconcile", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var res Reconciliation
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"singer_id":1,"spanner":2,"mysql":1,"match":false},{"singer_id":2,"spanner":1,"mysql":1,"match":true}]`
+	if res.Match || mustMarshal(t, res.Singers) != want {
+		t.Errorf("reconciliation = %s, want a mismatch with singers %s", w.Body, want)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// allowMethods are the methods we check for when building an Allow header.
+var allowMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// notFound answers 404 with a JSON body. It's the router's NotFoundHandler,
+// and is also used for routes that are switched off.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "no route for "+r.URL.Path)
+}
+
+// methodNotAllowedHandler answers 405 with an Allow header listing the
+// methods the router has routes for at the request's path.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allow := allowedMethods(router, r)
+
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed, expected one of %s", r.Method, strings.Join(allow, ", ")))
+	})
+}
+
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	allow := []string{}
+	for _, m := range allowMethods {
+		req := r.Clone(r.Context())
+		req.Method = m
+
+		var match mux.RouteMatch
+		if router.Match(req, &match) && match.MatchErr == nil {
+			allow = append(allow, m)
+		}
+	}
+	return allow
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter returns a router set up like main's, with a few album routes.
+func newTestRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	r.HandleFunc("/albums", ok).Methods(http.MethodGet)
+	r.HandleFunc("/albums", ok).Methods(http.MethodPost)
+	r.HandleFunc("/albums/{singerId}/{albumId}", ok).Methods(http.MethodPut, http.MethodDelete)
+	return r
+}
+
+// decodeError decodes a JSON error response, checking its content type and
+// that its code matches the status.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) ErrorDetail {
+	t.Helper()
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("body %s: %v", w.Body, err)
+	}
+	if res.Error.Code != w.Code {
+		t.Errorf("error code = %d, status = %d", res.Error.Code, w.Code)
+	}
+	return res.Error
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method    string
+		target    string
+		wantAllow string
+	}{
+		{method: http.MethodDelete, target: "/albums", wantAllow: "GET, POST"},
+		{method: http.MethodPatch, target: "/albums", wantAllow: "GET, POST"},
+		{method: http.MethodGet, target: "/albums/1/2", wantAllow: "PUT, DELETE"},
+	}
+
+	router := newTestRouter()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if e := decodeError(t, w); !strings.Contains(e.Message, tt.method) {
+				t.Errorf("message %q doesn't name the method", e.Message)
+			}
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	router := newTestRouter()
+
+	for _, target := range []string{"/nope", "/albums/1", "/albums/1/2/3"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want %d", target, w.Code, http.StatusNotFound)
+			continue
+		}
+		if e := decodeError(t, w); e.Message != "no route for "+target {
+			t.Errorf("GET %s: message = %q", target, e.Message)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+)
+
+// SingerWithAlbums is a singer with their albums nested in, for ?embed=albums.
+type SingerWithAlbums struct {
+	*Singer
+	Albums []*Album `json:"albums"`
+}
+
+var (
+	singerColumns = []string{"SingerId", "FirstName", "LastName"}
+	albumColumns  = []string{"SingerId", "AlbumId", "AlbumTitle", "MarketingBudget", "LastUpdateTime"}
+)
+
+// getSinger reads a single singer, returning ErrNotFound if there isn't one.
+func getSinger(ctx context.Context, client *spanner.Client, id int64) (s *Singer, err error) {
+	defer func() { err = spannerError(err) }()
+
+	return readSinger(ctx, client.Single(), id)
+}
+
+// getSingerWithAlbums reads a singer and all of their albums in one read-only
+// transaction, so the two are consistent with each other.
+func getSingerWithAlbums(ctx context.Context, client *spanner.Client, id int64) (res *SingerWithAlbums, err error) {
+	defer func() { err = spannerError(err) }()
+
+	txn := client.ReadOnlyTransaction()
+	defer txn.Close()
+
+	var s *Singer
+	if s, err = readSinger(ctx, txn, id); err != nil {
+		return
+	}
+
+	res = &SingerWithAlbums{Singer: s, Albums: []*Album{}}
+	logReadTimestamp("getSingerWithAlbums", txn)
+
+	// Albums are interleaved in Singers, so the singer's key is a prefix of
+	// all of their albums' keys.
+	iter := txn.Read(ctx, "Albums", spanner.Key{id}.AsPrefix(), albumColumns)
+	defer iter.Stop()
+
+	for {
+		var row *spanner.Row
+		row, err = iter.Next()
+		if err == iterator.Done {
+			err = nil
+			return
+		}
+		if err != nil {
+			res = nil
+			return
+		}
+
+		var a *Album
+		if a, err = albumFromRow(row); err != nil {
+			res = nil
+			return
+		}
+
+		res.Albums = append(res.Albums, a)
+	}
+}
+
+// getSingersWithoutAlbums returns every singer that has no albums, by id.
+func getSingersWithoutAlbums(ctx context.Context, client *spanner.Client) (singers []*Singer, err error) {
+	defer func() { err = spannerError(err) }()
+
+	singers = []*Singer{}
+
+	err = queryRows(ctx, client.Single(), "getSingersWithoutAlbums", spanner.Statement{SQL: sqlSingersWithoutAlbums}, func(row *spanner.Row) error {
+		s := &Singer{}
+		if err := row.Columns(&s.SingerID, &s.FirstName, &s.LastName); err != nil {
+			return err
+		}
+		singers = append(singers, s)
+		return nil
+	})
+	if err != nil {
+		singers = nil
+	}
+	return
+}
+
+type rowReader interface {
+	ReadRow(ctx context.Context, table string, key spanner.Key, columns []string) (*spanner.Row, error)
+}
+
+func readSinger(ctx context.Context, rr rowReader, id int64) (*Singer, error) {
+	row, err := rr.ReadRow(ctx, "Singers", spanner.Key{id}, singerColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Singer{}
+	if err := row.Columns(&s.SingerID, &s.FirstName, &s.LastName); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// maxSingerInfoSize is Spanner's limit on the size of a single cell.
+const maxSingerInfoSize = 10 << 20
+
+// getSingerInfo returns a singer's SingerInfo bytes. Spanner returns the whole
+// value in one go, so there's no streaming it, but it's bounded by the cell
+// size limit. A missing singer and a NULL SingerInfo are both ErrNotFound.
+func getSingerInfo(ctx context.Context, client *spanner.Client, id int64) (info []byte, err error) {
+	defer func() { err = spannerError(err) }()
+
+	var row *spanner.Row
+
+	row, err = client.Single().ReadRow(ctx, "Singers", spanner.Key{id}, []string{"SingerInfo"})
+	if err != nil {
+		return
+	}
+	if err = row.Column(0, &info); err != nil {
+		return
+	}
+	if info == nil {
+		err = fmt.Errorf("%w: singer %d has no info", ErrNotFound, id)
+	}
+	return
+}
+
+// setSingerInfo replaces a singer's SingerInfo bytes, failing with ErrNotFound
+// if there's no such singer.
+func setSingerInfo(ctx context.Context, client *spanner.Client, audit *auditLog, id int64, info []byte) (err error) {
+	defer func() { err = spannerError(err) }()
+
+	var ts time.Time
+
+	ts, err = client.Apply(ctx, []*spanner.Mutation{
+		spanner.Update("Singers", []string{"SingerId", "SingerInfo"}, []interface{}{id, info}),
+	}, applyOptions("setSingerInfo")...)
+	if err != nil {
+		return
+	}
+	logCommit("setSingerInfo", ts)
+
+	// The bytes themselves can be large and aren't useful in the audit log.
+	audit.record(ctx, AuditRecord{
+		Action: AuditUpdate,
+		Table:  "Singers",
+		Key:    spanner.Key{id},
+		After:  map[string]interface{}{"SingerInfo": fmt.Sprintf("%d bytes", len(info))},
+	})
+	return
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routeOutcomes holds a routeStats for each route, keyed by route name, or by
+// path template for unnamed routes. Client errors (4xx) are counted apart from
+// server errors (5xx) since only the latter burn the error budget.
+var routeOutcomes = expvar.NewMap("http_route_outcomes")
+
+var routeOutcomesMu sync.Mutex
+
+// latencyBucketsMs are the upper bounds of the latency histogram buckets.
+var latencyBucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// latencyPercentiles are reported as the upper bound of the bucket they fall
+// in, so they're only as precise as the buckets.
+var latencyPercentiles = map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99}
+
+type routeStats struct {
+	mu           sync.Mutex
+	requests     int64
+	clientErrors int64
+	serverErrors int64
+	buckets      []int64
+	overflow     int64
+	sumMs        float64
+}
+
+func newRouteStats() *routeStats {
+	return &routeStats{buckets: make([]int64, len(latencyBucketsMs))}
+}
+
+func (s *routeStats) observe(status int, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	switch {
+	case status >= 500:
+		s.serverErrors++
+	case status >= 400:
+		s.clientErrors++
+	}
+
+	s.sumMs += ms
+	for i, b := range latencyBucketsMs {
+		if ms <= b {
+			s.buckets[i]++
+			return
+		}
+	}
+	s.overflow++
+}
+
+// percentile returns the upper bound of the bucket holding the p'th request,
+// or -1 if it's past the last bucket.
+func (s *routeStats) percentile(p float64) float64 {
+	rank := int64(p*float64(s.requests) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var n int64
+	for i, c := range s.buckets {
+		n += c
+		if n >= rank {
+			return latencyBucketsMs[i]
+		}
+	}
+	return -1
+}
+
+func (s *routeStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := make(map[string]int64, len(s.buckets)+1)
+	for i, b := range latencyBucketsMs {
+		buckets[jsonNumber(b)] = s.buckets[i]
+	}
+	buckets["+Inf"] = s.overflow
+
+	latency := map[string]interface{}{
+		"buckets": buckets,
+		"sum":     s.sumMs,
+	}
+	if s.requests > 0 {
+		for name, p := range latencyPercentiles {
+			latency[name] = s.percentile(p)
+		}
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"requests":      s.requests,
+		"success":       s.requests - s.clientErrors - s.serverErrors,
+		"client_errors": s.clientErrors,
+		"server_errors": s.serverErrors,
+		"latency_ms":    latency,
+	})
+	return string(b)
+}
+
+func jsonNumber(f float64) string {
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+func statsForRoute(key string) *routeStats {
+	routeOutcomesMu.Lock()
+	defer routeOutcomesMu.Unlock()
+
+	s, ok := routeOutcomes.Get(key).(*routeStats)
+	if !ok {
+		s = newRouteStats()
+		routeOutcomes.Set(key, s)
+	}
+	return s
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Flush passes through to the wrapped writer, so streamed responses still
+// stream.
+func (sr *statusRecorder) Flush() {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordOutcomes records the status and latency of every request to a matched
+// route. It should run outermost so requests rejected by the other middleware,
+// such as auth failures and timeouts, are counted too.
+func recordOutcomes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := route.GetName()
+		if key == "" {
+			key, _ = route.GetPathTemplate()
+		}
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		statsForRoute(key).observe(sr.status, time.Since(start))
+	})
+}
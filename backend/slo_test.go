@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TestRecordOutcomes checks client and server errors are counted apart from
+// each other and from successes.
+func TestRecordOutcomes(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(recordOutcomes)
+	r.HandleFunc("/status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(mux.Vars(r)["code"])
+		w.WriteHeader(code)
+	}).Name("test.outcomes")
+	r.HandleFunc("/implicit", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, code := range []int{200, 201, 204, 400, 404, 404, 500, 503} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/status/"+strconv.Itoa(code), nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/implicit", nil))
+
+	tests := []struct {
+		key                                       string
+		requests, success, clientErrs, serverErrs int64
+	}{
+		{key: "test.outcomes", requests: 8, success: 3, clientErrs: 3, serverErrs: 2},
+		// Unnamed routes are keyed by their path template, and a handler
+		// that writes nothing is a 200.
+		{key: "/implicit", requests: 1, success: 1},
+	}
+
+	for _, tt := range tests {
+		v := routeOutcomes.Get(tt.key)
+		if v == nil {
+			t.Errorf("nothing recorded for %s", tt.key)
+			continue
+		}
+
+		var got struct {
+			Requests     int64 `json:"requests"`
+			Success      int64 `json:"success"`
+			ClientErrors int64 `json:"client_errors"`
+			ServerErrors int64 `json:"server_errors"`
+		}
+		if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Requests != tt.requests || got.Success != tt.success || got.ClientErrors != tt.clientErrs || got.ServerErrors != tt.serverErrs {
+			t.Errorf("%s: got %+v, want %d requests, %d success, %d client errors, %d server errors",
+				tt.key, got, tt.requests, tt.success, tt.clientErrs, tt.serverErrs)
+		}
+	}
+}
+
+func TestRouteStatsPercentile(t *testing.T) {
+	s := newRouteStats()
+	for i := 0; i < 90; i++ {
+		s.observe(http.StatusOK, 3*time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		s.observe(http.StatusOK, 200*time.Millisecond)
+	}
+	s.observe(http.StatusOK, time.Minute)
+
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{p: 0.5, want: 5},
+		{p: 0.9, want: 5},
+		{p: 0.99, want: 250},
+		{p: 1, want: -1},
+	}
+
+	for _, tt := range tests {
+		if got := s.percentile(tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
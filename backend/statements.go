@@ -0,0 +1,64 @@
+package main
+
+// SQL used by the data functions. Endpoints that read the same rows share the
+// same text here so their columns and ordering can't drift apart.
+const (
+	sqlSelectAlbums = `SELECT SingerId, AlbumId, AlbumTitle, MarketingBudget, LastUpdateTime
+              FROM Albums`
+
+	// sqlSelectAlbumsJSON takes the expressions for marketing_budget and
+	// last_update_time, which depend on config; see jsonBudgetColumn and
+	// jsonTimeColumn. The raw LastUpdateTime and the key are selected too, for
+	// Last-Modified and the next page token.
+	sqlSelectAlbumsJSON = `SELECT TO_JSON_STRING(STRUCT(
+                SingerId        AS singer_id,
+                AlbumId         AS album_id,
+                AlbumTitle      AS album_title,
+                %s AS marketing_budget,
+                %s AS last_update_time
+              )), LastUpdateTime, SingerId, AlbumId
+              FROM Albums`
+
+	// sqlListAlbumsOrder is the default ORDER BY for the album list, used
+	// when no ?order is given; see albumsOrderBy. LastUpdateTime is NOT NULL
+	// in the schema, so there are no nulls to place, and ties are broken by
+	// key so the order is stable.
+	sqlListAlbumsOrder = `ORDER BY LastUpdateTime DESC, SingerId, AlbumId`
+
+	sqlListAlbumsLimit = `LIMIT @max`
+
+	// sqlSyncAlbums takes the WHERE condition from albumsSinceCursor.
+	sqlSyncAlbums = sqlSelectAlbums + `
+              WHERE %s
+              ORDER BY LastUpdateTime, SingerId, AlbumId
+              LIMIT @max`
+
+	sqlSelectBudgets = `SELECT SingerId, AlbumId, MarketingBudget
+              FROM Albums
+              WHERE STRUCT<SingerId INT64, AlbumId INT64>(SingerId, AlbumId) IN UNNEST(@keys)`
+
+	sqlNextAlbumID = `SELECT IFNULL(MAX(AlbumId), 0) + 1 FROM Albums WHERE SingerId = @singerId`
+
+	sqlUpdateAlbumBudget = `UPDATE Albums
+              SET MarketingBudget = @AlbumBudget
+              WHERE SingerId = @SingerId and AlbumId = @AlbumId`
+
+	sqlTouchAlbums = `UPDATE Albums
+              SET LastUpdateTime = PENDING_COMMIT_TIMESTAMP()
+              WHERE SingerId IN UNNEST(@SingerIds) AND AlbumId IN UNNEST(@AlbumIds)`
+
+	// sqlCountAlbumsBySinger is run against both Spanner and MySQL.
+	sqlCountAlbumsBySinger = `SELECT SingerId, COUNT(*) FROM Albums GROUP BY SingerId`
+
+	sqlTopAlbumsByBudget = `SELECT a.SingerId, a.AlbumId, a.AlbumTitle, a.MarketingBudget, s.FirstName, s.LastName
+                    FROM Albums AS a JOIN Singers AS s ON s.SingerId = a.SingerId
+                    WHERE a.MarketingBudget IS NOT NULL
+                    ORDER BY a.MarketingBudget DESC, a.SingerId, a.AlbumId
+                    LIMIT @n`
+
+	sqlSingersWithoutAlbums = `SELECT s.SingerId, s.FirstName, s.LastName FROM Singers AS s
+                       WHERE NOT EXISTS (SELECT 1 FROM Albums AS a WHERE a.SingerId = s.SingerId)
+                       ORDER BY s.SingerId`
+
+	sqlPing = `SELECT 1`
+)
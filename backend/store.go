@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// Datastores the album routes can be served from.
+const (
+	DatastoreSpanner = "spanner"
+	DatastoreMemory  = "memory"
+)
+
+// AlbumStore is what the album routes read and write albums through. Every
+// implementation fails with the same typed errors, so the handlers don't care
+// which one they're given.
+type AlbumStore interface {
+	// ListAlbums returns the page of albums opts selects.
+	ListAlbums(ctx context.Context, opts ListOptions) (AlbumPage, error)
+	// GetAlbum returns one album, or ErrNotFound.
+	GetAlbum(ctx context.Context, singerID, albumID int64) (*Album, error)
+	// InsertAlbum inserts a with the ids it's given. It fails with
+	// ErrConflict if the album exists and ErrNotFound if its singer doesn't.
+	InsertAlbum(ctx context.Context, a *Album) error
+	// CreateAlbum inserts a, assigning the singer's next free album id if
+	// a.AlbumID is zero, and returns it with its id and LastUpdateTime.
+	CreateAlbum(ctx context.Context, a Album) (*Album, error)
+	// SaveAlbum writes a with the given write mode; see saveAlbum.
+	SaveAlbum(ctx context.Context, a *Album, mode string) error
+	// DeleteAlbum deletes an album, returning when it was deleted; see
+	// deleteAlbum.
+	DeleteAlbum(ctx context.Context, singerID, albumID int64, ifMatch string) (time.Time, error)
+	// TransferBudgets applies transfers all or nothing; see
+	// batchTransferBudgets.
+	TransferBudgets(ctx context.Context, transfers []Transfer) (time.Time, error)
+}
+
+// checkDatastore checks cfg.Datastore is one we know, and that the rest of cfg
+// works with it: Spanner needs its project, instance and database, and the
+// memory store can't serve what only Spanner has.
+func checkDatastore(cfg Config) error {
+	switch cfg.Datastore {
+	case DatastoreSpanner:
+		if cfg.GCloudProject == "" || cfg.SpannerInstanceID == "" || cfg.SpannerDatabaseID == "" {
+			return errors.New("the Spanner project, instance and database are required with DATASTORE=spanner")
+		}
+	case DatastoreMemory:
+		if cfg.AdminEnabled {
+			return errors.New("admin endpoints need DATASTORE=spanner")
+		}
+		if cfg.AuditSink == AuditSinkSpanner {
+			return errors.New("audit sink spanner needs DATASTORE=spanner")
+		}
+	default:
+		return fmt.Errorf("invalid datastore %q, expected %s or %s", cfg.Datastore, DatastoreSpanner, DatastoreMemory)
+	}
+	return nil
+}
+
+// spannerStore is the AlbumStore backed by Spanner. projection has Spanner
+// serialize listed albums itself; see listAlbums.
+type spannerStore struct {
+	client     *spanner.Client
+	audit      *auditLog
+	projection bool
+}
+
+func newSpannerStore(client *spanner.Client, audit *auditLog, projection bool) *spannerStore {
+	return &spannerStore{client: client, audit: audit, projection: projection}
+}
+
+func (s *spannerStore) ListAlbums(ctx context.Context, opts ListOptions) (AlbumPage, error) {
+	return listAlbums(ctx, s.client, opts, s.projection)
+}
+
+func (s *spannerStore) GetAlbum(ctx context.Context, singerID, albumID int64) (*Album, error) {
+	return getAlbum(ctx, s.client, singerID, albumID)
+}
+
+func (s *spannerStore) InsertAlbum(ctx context.Context, a *Album) error {
+	return insertAlbum(ctx, s.client, s.audit, a)
+}
+
+func (s *spannerStore) CreateAlbum(ctx context.Context, a Album) (*Album, error) {
+	return createAlbum(ctx, s.client, s.audit, a)
+}
+
+func (s *spannerStore) SaveAlbum(ctx context.Context, a *Album, mode string) error {
+	return saveAlbum(ctx, s.client, s.audit, a, mode)
+}
+
+func (s *spannerStore) DeleteAlbum(ctx context.Context, singerID, albumID int64, ifMatch string) (time.Time, error) {
+	return deleteAlbum(ctx, s.client, s.audit, singerID, albumID, ifMatch)
+}
+
+func (s *spannerStore) TransferBudgets(ctx context.Context, transfers []Transfer) (time.Time, error) {
+	return batchTransferBudgets(ctx, s.client, s.audit, transfers)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const timeoutBody = `{"error": {"code": 503, "message": "request timed out"}}`
+
+// routeTimeouts bounds how long each named route may take, so slow endpoints
+// like exports can be given longer than list reads. The deadline is set on the
+// request context, so Spanner calls made with it are canceled too.
+type routeTimeouts struct {
+	fallback  time.Duration
+	overrides map[string]time.Duration
+}
+
+func (rt *routeTimeouts) timeout(name string) time.Duration {
+	if d, ok := rt.overrides[name]; ok {
+		return d
+	}
+	return rt.fallback
+}
+
+// middleware answers 503 with a JSON body once a route's timeout passes. A
+// zero timeout leaves the route unbounded.
+func (rt *routeTimeouts) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		if route := mux.CurrentRoute(r); route != nil {
+			name = route.GetName()
+		}
+
+		d := rt.timeout(name)
+		if d <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// TimeoutHandler writes its body straight to w on a timeout, so the
+		// content type has to be set up front. Handlers that finish in time
+		// overwrite it with their own.
+		w.Header().Set("Content-Type", "application/json")
+		http.TimeoutHandler(h, d, timeoutBody).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	rt := &routeTimeouts{
+		fallback:  20 * time.Millisecond,
+		overrides: map[string]time.Duration{"export": time.Minute, "unbounded": 0},
+	}
+
+	// Each handler takes 100ms, or until its request is canceled, and
+	// reports which.
+	canceled := make(chan bool, 1)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			canceled <- false
+			writeJSON(w, http.StatusOK, map[string]string{"done": "yes"})
+		case <-r.Context().Done():
+			canceled <- r.Context().Err() == context.DeadlineExceeded
+		}
+	}
+
+	router := mux.NewRouter()
+	router.Use(rt.middleware)
+	router.HandleFunc("/albums", slow).Name("albums")
+	router.HandleFunc("/export", slow).Name("export")
+	router.HandleFunc("/unbounded", slow).Name("unbounded")
+
+	tests := []struct {
+		target       string
+		wantCode     int
+		wantCanceled bool
+	}{
+		// Over the fallback: the client gets a 503 and the handler's
+		// context is canceled.
+		{target: "/albums", wantCode: http.StatusServiceUnavailable, wantCanceled: true},
+		// Within its override.
+		{target: "/export", wantCode: http.StatusOK},
+		{target: "/unbounded", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+
+			select {
+			case got := <-canceled:
+				if got != tt.wantCanceled {
+					t.Errorf("handler context canceled = %v, want %v", got, tt.wantCanceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler didn't return")
+			}
+
+			if tt.wantCode != http.StatusServiceUnavailable {
+				return
+			}
+			var res ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("timeout body %s: %v", w.Body, err)
+			}
+			if res.Error.Code != http.StatusServiceUnavailable || res.Error.Message != "request timed out" {
+				t.Errorf("error = %+v", res.Error)
+			}
+		})
+	}
+}
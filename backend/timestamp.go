@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+const (
+	TimeFormatRFC3339    = "rfc3339"
+	TimeFormatUnixMillis = "unixmillis"
+)
+
+// jsonTimeFormat is how every Timestamp in a response is rendered. It's set
+// once from config at startup.
+var jsonTimeFormat = TimeFormatRFC3339
+
+func setTimeFormat(f string) error {
+	switch f {
+	case TimeFormatRFC3339, TimeFormatUnixMillis:
+		jsonTimeFormat = f
+		return nil
+	}
+	return fmt.Errorf("invalid time format %q, expected %s or %s", f, TimeFormatRFC3339, TimeFormatUnixMillis)
+}
+
+// Timestamp is a spanner.NullTime that renders in the configured time format:
+// an RFC3339 string or a number of milliseconds since the epoch. Null renders
+// as null either way.
+type Timestamp struct {
+	spanner.NullTime
+}
+
+func newTimestamp(t time.Time) Timestamp {
+	return Timestamp{spanner.NullTime{Time: t, Valid: !t.IsZero()}}
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if !t.Valid {
+		return []byte("null"), nil
+	}
+	if jsonTimeFormat == TimeFormatUnixMillis {
+		return []byte(strconv.FormatInt(t.Time.UnixMilli(), 10)), nil
+	}
+	return json.Marshal(t.Time.UTC().Format(time.RFC3339Nano))
+}
+
+// commitTimestampHeader is set on album writes to the commit timestamp, for
+// passing back to GET /albums as ?min_read_timestamp. It's always RFC3339 at
+// full precision, whatever the time format, since a millisecond value would
+// only say which millisecond the commit fell in.
+const commitTimestampHeader = "X-Commit-Timestamp"
+
+func setCommitTimestamp(w http.ResponseWriter, ts time.Time) {
+	w.Header().Set(commitTimestampHeader, ts.UTC().Format(time.RFC3339Nano))
+}
+
+// parseTimestamp parses a timestamp query parameter in the configured time
+// format, so clients can pass back what we gave them. RFC3339 is accepted in
+// either format, so a full-precision timestamp can always be passed back as
+// given.
+func parseTimestamp(v string) (time.Time, error) {
+	if jsonTimeFormat == TimeFormatUnixMillis {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms).UTC(), nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, nil
+		}
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected milliseconds since the epoch or RFC3339", v)
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC3339", v)
+	}
+	return t, nil
+}
+
+// parseTimestampRoundUp is parseTimestamp for a bound that must not fall
+// before the timestamp it was rendered from, such as a commit timestamp
+// passed back to read at or after. Commit timestamps have microseconds, so a
+// millisecond value only says which millisecond the commit fell in; it's
+// taken as the last instant of that millisecond rather than the first.
+func parseTimestampRoundUp(v string) (time.Time, error) {
+	t, err := parseTimestamp(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := strconv.ParseInt(v, 10, 64); err == nil && jsonTimeFormat == TimeFormatUnixMillis {
+		t = t.Add(time.Millisecond - time.Nanosecond)
+	}
+	return t, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTimeFormat sets the JSON time format for the rest of the test.
+func withTimeFormat(t *testing.T, f string) {
+	t.Helper()
+
+	prev := jsonTimeFormat
+	if err := setTimeFormat(f); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { jsonTimeFormat = prev })
+}
+
+func TestParseTimestamp(t *testing.T) {
+	// A commit timestamp, with microseconds.
+	commit := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+	ms := time.Date(2024, 5, 1, 12, 0, 0, 123000000, time.UTC)
+
+	tests := []struct {
+		name        string
+		format      string
+		in          string
+		want        time.Time
+		wantRoundUp time.Time
+		wantErr     bool
+	}{
+		{name: "rfc3339", format: TimeFormatRFC3339, in: "2024-05-01T12:00:00.123456Z", want: commit, wantRoundUp: commit},
+		{name: "rfc3339, millis", format: TimeFormatRFC3339, in: "1714564800123", wantErr: true},
+		{name: "millis", format: TimeFormatUnixMillis, in: "1714564800123", want: ms, wantRoundUp: ms.Add(time.Millisecond - time.Nanosecond)},
+		{name: "millis, full precision", format: TimeFormatUnixMillis, in: "2024-05-01T12:00:00.123456Z", want: commit, wantRoundUp: commit},
+		{name: "millis, invalid", format: TimeFormatUnixMillis, in: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTimeFormat(t, tt.format)
+
+			got, err := parseTimestamp(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimestamp(%q): %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+
+			got, err = parseTimestampRoundUp(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimestampRoundUp(%q): %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !got.Equal(tt.wantRoundUp) {
+				t.Errorf("parseTimestampRoundUp(%q) = %v, want %v", tt.in, got, tt.wantRoundUp)
+			}
+		})
+	}
+}
+
+// TestParseTimestampRoundUpCoversCommit checks a commit timestamp rendered in
+// either format parses back to a bound no earlier than the commit, and no
+// later than the end of the millisecond it fell in.
+func TestParseTimestampRoundUpCoversCommit(t *testing.T) {
+	commits := []time.Time{
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 1, 12, 0, 0, 1000, time.UTC),
+		time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC),
+		time.Date(2024, 5, 1, 12, 0, 0, 999999000, time.UTC),
+	}
+
+	for _, format := range []string{TimeFormatRFC3339, TimeFormatUnixMillis} {
+		withTimeFormat(t, format)
+
+		for _, commit := range commits {
+			b, err := newTimestamp(commit).MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rendered := strings.Trim(string(b), `"`)
+
+			got, err := parseTimestampRoundUp(rendered)
+			if err != nil {
+				t.Fatalf("%s: parseTimestampRoundUp(%q): %v", format, rendered, err)
+			}
+			if got.Before(commit) || got.After(commit.Truncate(time.Millisecond).Add(time.Millisecond)) {
+				t.Errorf("%s: %v rendered as %q parses back to %v", format, commit, rendered, got)
+			}
+		}
+	}
+}
+
+func TestTimestampMarshalJSON(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+
+	tests := []struct {
+		format string
+		in     Timestamp
+		want   string
+	}{
+		{format: TimeFormatRFC3339, in: newTimestamp(ts), want: `"2024-05-01T12:00:00.123456Z"`},
+		{format: TimeFormatRFC3339, in: Timestamp{}, want: `null`},
+		{format: TimeFormatUnixMillis, in: newTimestamp(ts), want: `1714564800123`},
+		{format: TimeFormatUnixMillis, in: Timestamp{}, want: `null`},
+	}
+
+	for _, tt := range tests {
+		withTimeFormat(t, tt.format)
+
+		got, err := tt.in.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: MarshalJSON = %s, want %s", tt.format, got, tt.want)
+		}
+	}
+}
+
+// TestSetCommitTimestamp checks the commit timestamp header keeps the commit's
+// full precision in either time format, so reading at or after it is sure to
+// see the write.
+func TestSetCommitTimestamp(t *testing.T) {
+	commit := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+
+	for _, format := range []string{TimeFormatRFC3339, TimeFormatUnixMillis} {
+		withTimeFormat(t, format)
+
+		w := httptest.NewRecorder()
+		setCommitTimestamp(w, commit)
+
+		got := w.Header().Get(commitTimestampHeader)
+		if got != "2024-05-01T12:00:00.123456Z" {
+			t.Errorf("%s: %s = %q, want the full commit timestamp", format, commitTimestampHeader, got)
+		}
+		if ts, err := parseTimestampRoundUp(got); err != nil || !ts.Equal(commit) {
+			t.Errorf("%s: parseTimestampRoundUp(%q) = %v, %v; want %v", format, got, ts, err, commit)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+const maxBatchTransfers = 100
+
+// Transfer moves Amount of marketing budget from one album to another.
+type Transfer struct {
+	FromSingerID int64 `json:"from_singer_id"`
+	FromAlbumID  int64 `json:"from_album_id"`
+	ToSingerID   int64 `json:"to_singer_id"`
+	ToAlbumID    int64 `json:"to_album_id"`
+	Amount       int64 `json:"amount"`
+}
+
+func (t Transfer) validate() error {
+	switch {
+	case t.FromSingerID <= 0 || t.FromAlbumID <= 0 || t.ToSingerID <= 0 || t.ToAlbumID <= 0:
+		return errors.New("album ids must be positive")
+	case t.FromSingerID == t.ToSingerID && t.FromAlbumID == t.ToAlbumID:
+		return errors.New("can't transfer to the same album")
+	case t.Amount <= 0:
+		return errors.New("amount must be positive")
+	}
+	return nil
+}
+
+func validateTransfers(transfers []Transfer) error {
+	if len(transfers) == 0 {
+		return errors.New("no transfers given")
+	}
+	if len(transfers) > maxBatchTransfers {
+		return fmt.Errorf("too many transfers, at most %d are allowed", maxBatchTransfers)
+	}
+	for i, t := range transfers {
+		if err := t.validate(); err != nil {
+			return &TransferError{Index: i, err: err}
+		}
+	}
+	return nil
+}
+
+// TransferError reports which transfer in a batch failed.
+type TransferError struct {
+	Index int
+	err   error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("transfer %d: %s", e.Index, e.err.Error())
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.err
+}
+
+// albumKey is bound as an ARRAY<STRUCT<SingerId INT64, AlbumId INT64>>.
+type albumKey struct {
+	SingerID int64 `spanner:"SingerId"`
+	AlbumID  int64 `spanner:"AlbumId"`
+}
+
+// batchTransferBudgets applies transfers in order in a single read-write
+// transaction. Every album involved is read up front with one query; if any
+// transfer would take an album's budget below zero the whole batch fails with
+// a *TransferError wrapping ErrInsufficientBudget, or ErrConflict if it would
+// push an album's budget past the largest INT64. A NULL budget counts as 0.
+// It returns the commit timestamp.
+func batchTransferBudgets(ctx context.Context, client *spanner.Client, audit *auditLog, transfers []Transfer) (ts time.Time, err error) {
+	defer func() { err = spannerError(err) }()
+
+	var recs []AuditRecord
+
+	ts, err = readWriteTransaction(ctx, client, "batchTransferBudgets", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		recs = nil
+
+		keys := make([]albumKey, 0, 2*len(transfers))
+		for _, t := range transfers {
+			keys = append(keys, albumKey{t.FromSingerID, t.FromAlbumID}, albumKey{t.ToSingerID, t.ToAlbumID})
+		}
+
+		before, err := readBudgets(ctx, txn, keys)
+		if err != nil {
+			return err
+		}
+
+		budgets, err := applyTransfers(transfers, before)
+		if err != nil {
+			return err
+		}
+
+		cols := []string{"SingerId", "AlbumId", "MarketingBudget", "LastUpdateTime"}
+		m := make([]*spanner.Mutation, 0, len(budgets))
+		for k, v := range budgets {
+			if v == before[k] {
+				continue
+			}
+			m = append(m, spanner.Update("Albums", cols, []interface{}{k.SingerID, k.AlbumID, v, spanner.CommitTimestamp}))
+			recs = append(recs, transferAudit(k, before[k], v))
+		}
+
+		return txn.BufferWrite(m)
+	})
+	if err != nil {
+		return
+	}
+
+	logCommit("batchTransferBudgets", ts)
+	noteAlbumWrite(ts)
+	audit.record(ctx, recs...)
+	return
+}
+
+// applyTransfers applies transfers in order to before, the budgets of the
+// albums involved that exist, and returns the budgets they end up with. It
+// fails the way batchTransferBudgets describes, without touching before.
+func applyTransfers(transfers []Transfer, before map[albumKey]int64) (map[albumKey]int64, error) {
+	budgets := make(map[albumKey]int64, len(before))
+	for k, v := range before {
+		budgets[k] = v
+	}
+
+	for i, t := range transfers {
+		from, to := albumKey{t.FromSingerID, t.FromAlbumID}, albumKey{t.ToSingerID, t.ToAlbumID}
+
+		for _, k := range []albumKey{from, to} {
+			if _, ok := budgets[k]; !ok {
+				return nil, &TransferError{Index: i, err: fmt.Errorf("%w: album %d/%d", ErrNotFound, k.SingerID, k.AlbumID)}
+			}
+		}
+		if budgets[from] < t.Amount {
+			return nil, &TransferError{Index: i, err: fmt.Errorf("%w: album %d/%d has %d, need %d",
+				ErrInsufficientBudget, from.SingerID, from.AlbumID, budgets[from], t.Amount)}
+		}
+		if budgets[to] > math.MaxInt64-t.Amount {
+			return nil, &TransferError{Index: i, err: fmt.Errorf("%w: album %d/%d has %d, adding %d would overflow",
+				ErrConflict, to.SingerID, to.AlbumID, budgets[to], t.Amount)}
+		}
+
+		budgets[from] -= t.Amount
+		budgets[to] += t.Amount
+	}
+
+	return budgets, nil
+}
+
+// transferAudit records a transfer changing an album's budget.
+func transferAudit(k albumKey, before, after int64) AuditRecord {
+	return AuditRecord{
+		Action: AuditUpdate,
+		Table:  "Albums",
+		Key:    spanner.Key{k.SingerID, k.AlbumID},
+		Before: map[string]interface{}{"MarketingBudget": before},
+		After:  map[string]interface{}{"MarketingBudget": after},
+	}
+}
+
+func readBudgets(ctx context.Context, txn *spanner.ReadWriteTransaction, keys []albumKey) (map[albumKey]int64, error) {
+	stmt := spanner.Statement{
+		SQL:    sqlSelectBudgets,
+		Params: map[string]interface{}{"keys": keys},
+	}
+
+	budgets := make(map[albumKey]int64)
+
+	err := queryRows(ctx, txn, "readBudgets", stmt, func(row *spanner.Row) error {
+		var (
+			k      albumKey
+			budget spanner.NullInt64
+		)
+		if err := row.Columns(&k.SingerID, &k.AlbumID, &budget); err != nil {
+			return err
+		}
+		budgets[k] = budget.Int64
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+func TestValidateTransfers(t *testing.T) {
+	ok := Transfer{FromSingerID: 1, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 2, Amount: 10}
+	same := Transfer{FromSingerID: 1, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 1, Amount: 10}
+	zero := Transfer{FromSingerID: 1, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 2}
+	badID := Transfer{FromSingerID: 0, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 2, Amount: 10}
+
+	tests := []struct {
+		name      string
+		transfers []Transfer
+		wantErr   bool
+		wantIndex int // -1 if the error isn't a *TransferError
+	}{
+		{name: "valid", transfers: []Transfer{ok, ok}},
+		{name: "empty", wantErr: true, wantIndex: -1},
+		{name: "too many", transfers: make([]Transfer, maxBatchTransfers+1), wantErr: true, wantIndex: -1},
+		{name: "same album", transfers: []Transfer{ok, same}, wantErr: true, wantIndex: 1},
+		{name: "zero amount", transfers: []Transfer{zero, ok}, wantErr: true, wantIndex: 0},
+		{name: "bad id", transfers: []Transfer{ok, ok, badID}, wantErr: true, wantIndex: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTransfers(tt.transfers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateTransfers: %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			var te *TransferError
+			switch {
+			case tt.wantIndex < 0 && errors.As(err, &te):
+				t.Errorf("got %v, want an error for the whole batch", err)
+			case tt.wantIndex >= 0 && !errors.As(err, &te):
+				t.Errorf("got %v, want a *TransferError", err)
+			case tt.wantIndex >= 0 && te.Index != tt.wantIndex:
+				t.Errorf("Index = %d, want %d", te.Index, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestBatchTransferBudgets(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, MarketingBudget: spanner.NullInt64{Int64: 100, Valid: true}},
+		&Album{SingerID: 1, AlbumID: 2, MarketingBudget: spanner.NullInt64{Int64: 50, Valid: true}},
+		&Album{SingerID: 2, AlbumID: 1},
+	)
+
+	if _, err := batchTransferBudgets(ctx, client, nil, []Transfer{
+		{FromSingerID: 1, FromAlbumID: 1, ToSingerID: 2, ToAlbumID: 1, Amount: 30},
+		// Only has the budget because of the transfer before it.
+		{FromSingerID: 2, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 2, Amount: 20},
+	}); err != nil {
+		t.Fatalf("batchTransferBudgets: %v", err)
+	}
+
+	wantBudgets(t, client, map[albumKey]int64{{1, 1}: 70, {1, 2}: 70, {2, 1}: 10})
+}
+
+// TestBatchTransferBudgetsLogsCommit checks a transfer's commit timestamp is
+// logged with TxnDebug on.
+func TestBatchTransferBudgetsLogsCommit(t *testing.T) {
+	client := newTestDB(t)
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, MarketingBudget: spanner.NullInt64{Int64: 100, Valid: true}},
+		&Album{SingerID: 1, AlbumID: 2},
+	)
+
+	withTxnDebug(t, true)
+	out := captureLog(t)
+
+	ts, err := batchTransferBudgets(context.Background(), client, nil, []Transfer{
+		{FromSingerID: 1, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 2, Amount: 10},
+	})
+	if err != nil {
+		t.Fatalf("batchTransferBudgets: %v", err)
+	}
+
+	want := "Txn batchTransferBudgets committed at " + ts.Format(time.RFC3339Nano) + "\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("log %q doesn't have %q", out, want)
+	}
+}
+
+// TestBatchTransferBudgetsFailsAtomically checks a batch that fails part way
+// through reports the transfer at fault and changes nothing, including the
+// transfers before it that would have succeeded.
+func TestBatchTransferBudgetsFailsAtomically(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	seedAlbums(t, client,
+		&Album{SingerID: 1, AlbumID: 1, MarketingBudget: spanner.NullInt64{Int64: 100, Valid: true}},
+		&Album{SingerID: 1, AlbumID: 2, MarketingBudget: spanner.NullInt64{Int64: math.MaxInt64 - 10, Valid: true}},
+		&Album{SingerID: 2, AlbumID: 1},
+	)
+	before := map[albumKey]int64{{1, 1}: 100, {1, 2}: math.MaxInt64 - 10, {2, 1}: 0}
+
+	ok := Transfer{FromSingerID: 1, FromAlbumID: 1, ToSingerID: 2, ToAlbumID: 1, Amount: 40}
+
+	tests := []struct {
+		name      string
+		transfers []Transfer
+		wantErr   error
+		wantIndex int
+	}{
+		{
+			name:      "insufficient budget",
+			transfers: []Transfer{ok, ok, ok},
+			wantErr:   ErrInsufficientBudget,
+			wantIndex: 2,
+		},
+		{
+			name:      "missing album",
+			transfers: []Transfer{ok, {FromSingerID: 2, FromAlbumID: 1, ToSingerID: 9, ToAlbumID: 9, Amount: 1}},
+			wantErr:   ErrNotFound,
+			wantIndex: 1,
+		},
+		{
+			name:      "overflow",
+			transfers: []Transfer{ok, {FromSingerID: 2, FromAlbumID: 1, ToSingerID: 1, ToAlbumID: 2, Amount: 11}},
+			wantErr:   ErrConflict,
+			wantIndex: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := batchTransferBudgets(ctx, client, nil, tt.transfers)
+
+			var te *TransferError
+			if !errors.As(err, &te) || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want a *TransferError wrapping %v", err, tt.wantErr)
+			}
+			if te.Index != tt.wantIndex {
+				t.Errorf("Index = %d, want %d", te.Index, tt.wantIndex)
+			}
+
+			wantBudgets(t, client, before)
+		})
+	}
+}
+
+// wantBudgets checks each album's marketing budget, with NULL read as 0.
+func wantBudgets(t *testing.T, client *spanner.Client, want map[albumKey]int64) {
+	t.Helper()
+
+	for k, budget := range want {
+		row, err := client.Single().ReadRow(context.Background(), "Albums", spanner.Key{k.SingerID, k.AlbumID}, []string{"MarketingBudget"})
+		if err != nil {
+			t.Fatalf("reading album %d/%d: %v", k.SingerID, k.AlbumID, err)
+		}
+		var got spanner.NullInt64
+		if err := row.Columns(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Int64 != budget {
+			t.Errorf("album %d/%d budget = %d, want %d", k.SingerID, k.AlbumID, got.Int64, budget)
+		}
+	}
+}
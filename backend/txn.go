@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	sppb "google.golang.org/genproto/googleapis/spanner/v1"
+)
+
+// txnStats counts, per transaction name, how often a read-write transaction
+// was retried after an abort and how often it ran out of attempts. A rising
+// exceeded count points at a contention hotspot.
+var txnStats = expvar.NewMap("txn_aborts")
+
+// txnMaxAttempts caps how many times a read-write transaction is run before
+// we give up on it. Zero leaves the client's own unbounded retries alone. It's
+// set once from config at startup.
+var txnMaxAttempts int
+
+// Write priorities, as named in config.
+const (
+	PriorityLow    = "low"
+	PriorityMedium = "medium"
+	PriorityHigh   = "high"
+)
+
+var writePriorities = map[string]sppb.RequestOptions_Priority{
+	"":             sppb.RequestOptions_PRIORITY_UNSPECIFIED,
+	PriorityLow:    sppb.RequestOptions_PRIORITY_LOW,
+	PriorityMedium: sppb.RequestOptions_PRIORITY_MEDIUM,
+	PriorityHigh:   sppb.RequestOptions_PRIORITY_HIGH,
+}
+
+// Options applied to every write, whether a read-write transaction or a
+// blind Apply. They're set once from config at startup. This version of the
+// Spanner client has no leader-aware routing, so there's no option for it;
+// writes from a non-leader region still pay the hop to the leader.
+var (
+	writePriority sppb.RequestOptions_Priority
+	// txnTagPrefix, if set, tags each write with the prefix and the write's
+	// name, so it can be picked out in Spanner's transaction statistics.
+	txnTagPrefix string
+)
+
+func setWriteOptions(priority, tagPrefix string) error {
+	p, ok := writePriorities[priority]
+	if !ok {
+		return fmt.Errorf("invalid write priority %q, expected %s, %s or %s", priority, PriorityLow, PriorityMedium, PriorityHigh)
+	}
+	writePriority = p
+	txnTagPrefix = tagPrefix
+	return nil
+}
+
+func txnTag(name string) string {
+	if txnTagPrefix == "" {
+		return ""
+	}
+	return txnTagPrefix + "." + name
+}
+
+// transactionOptions are the options for the read-write transaction name.
+func transactionOptions(name string) spanner.TransactionOptions {
+	return spanner.TransactionOptions{
+		TransactionTag: txnTag(name),
+		CommitPriority: writePriority,
+	}
+}
+
+// applyOptions are the same options as transactionOptions, for client.Apply.
+func applyOptions(name string) []spanner.ApplyOption {
+	var opts []spanner.ApplyOption
+	if tag := txnTag(name); tag != "" {
+		opts = append(opts, spanner.TransactionTag(tag))
+	}
+	if writePriority != sppb.RequestOptions_PRIORITY_UNSPECIFIED {
+		opts = append(opts, spanner.Priority(writePriority))
+	}
+	return opts
+}
+
+// TooManyAbortsError is returned when a transaction has been aborted more
+// times than txnMaxAttempts allows.
+type TooManyAbortsError struct {
+	Name     string
+	Attempts int
+}
+
+func (e *TooManyAbortsError) Error() string {
+	return fmt.Sprintf("transaction %s aborted too many times, gave up after %d attempts", e.Name, e.Attempts)
+}
+
+// readWriteTransaction runs fn in a read-write transaction like
+// client.ReadWriteTransaction, with the transactionOptions for name, but stops
+// retrying aborts after txnMaxAttempts attempts. The client reruns fn after
+// each abort, so counting the runs counts the attempts.
+func readWriteTransaction(ctx context.Context, client *spanner.Client, name string, fn func(context.Context, *spanner.ReadWriteTransaction) error) (time.Time, error) {
+	attempts := 0
+
+	resp, err := client.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		attempts++
+		if attempts > 1 {
+			txnStats.Add(name+".retries", 1)
+		}
+		if txnMaxAttempts > 0 && attempts > txnMaxAttempts {
+			txnStats.Add(name+".exceeded", 1)
+			return &TooManyAbortsError{Name: name, Attempts: attempts - 1}
+		}
+		return fn(ctx, txn)
+	}, transactionOptions(name))
+
+	return resp.CommitTs, err
+}
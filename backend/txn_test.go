@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/option"
+	sppb "google.golang.org/genproto/googleapis/spanner/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func withTxnMaxAttempts(t *testing.T, n int) {
+	t.Helper()
+
+	prev := txnMaxAttempts
+	txnMaxAttempts = n
+	t.Cleanup(func() { txnMaxAttempts = prev })
+}
+
+// txnStat is the txnStats counter key, or 0 if it hasn't been counted yet.
+func txnStat(key string) int64 {
+	if v, ok := txnStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// TestReadWriteTransactionAborts checks a transaction that keeps aborting is
+// given up on after txnMaxAttempts runs, and one that stops aborting in time
+// commits, with both counted in txnStats.
+func TestReadWriteTransactionAborts(t *testing.T) {
+	client := newTestDB(t)
+	ctx := context.Background()
+
+	withTxnMaxAttempts(t, 3)
+
+	tests := []struct {
+		name       string
+		aborts     int
+		wantErr    bool
+		wantRuns   int
+		wantRetry  int64
+		wantExceed int64
+	}{
+		{name: "testAbortsRecovers", aborts: 2, wantRuns: 3, wantRetry: 2},
+		{name: "testAbortsExceeded", aborts: 10, wantErr: true, wantRuns: 3, wantRetry: 3, wantExceed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			_, err := readWriteTransaction(ctx, client, tt.name, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+				runs++
+				if runs <= tt.aborts {
+					return spanner.ToSpannerError(status.Error(codes.Aborted, "forced abort"))
+				}
+				return nil
+			})
+
+			var tooMany *TooManyAbortsError
+			if tt.wantErr {
+				if !errors.As(err, &tooMany) {
+					t.Fatalf("got %v, want a *TooManyAbortsError", err)
+				}
+				if tooMany.Attempts != txnMaxAttempts {
+					t.Errorf("Attempts = %d, want %d", tooMany.Attempts, txnMaxAttempts)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if runs != tt.wantRuns {
+				t.Errorf("fn ran %d times, want %d", runs, tt.wantRuns)
+			}
+			if got := txnStat(tt.name + ".retries"); got != tt.wantRetry {
+				t.Errorf("retries = %d, want %d", got, tt.wantRetry)
+			}
+			if got := txnStat(tt.name + ".exceeded"); got != tt.wantExceed {
+				t.Errorf("exceeded = %d, want %d", got, tt.wantExceed)
+			}
+		})
+	}
+}
+
+// fakeSpanner is just enough of Spanner for writes that only buffer
+// mutations, recording every commit it's sent.
+type fakeSpanner struct {
+	sppb.UnimplementedSpannerServer
+
+	mu       sync.Mutex
+	sessions int
+	commits  []*sppb.CommitRequest
+}
+
+func (f *fakeSpanner) newSession(db string) *sppb.Session {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sessions++
+	return &sppb.Session{Name: fmt.Sprintf("%s/sessions/%d", db, f.sessions)}
+}
+
+func (f *fakeSpanner) CreateSession(ctx context.Context, req *sppb.CreateSessionRequest) (*sppb.Session, error) {
+	return f.newSession(req.Database), nil
+}
+
+func (f *fakeSpanner) BatchCreateSessions(ctx context.Context, req *sppb.BatchCreateSessionsRequest) (*sppb.BatchCreateSessionsResponse, error) {
+	res := &sppb.BatchCreateSessionsResponse{}
+	for i := int32(0); i < req.SessionCount; i++ {
+		res.Session = append(res.Session, f.newSession(req.Database))
+	}
+	return res, nil
+}
+
+func (f *fakeSpanner) DeleteSession(ctx context.Context, req *sppb.DeleteSessionRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeSpanner) BeginTransaction(ctx context.Context, req *sppb.BeginTransactionRequest) (*sppb.Transaction, error) {
+	return &sppb.Transaction{Id: []byte("txn")}, nil
+}
+
+func (f *fakeSpanner) Commit(ctx context.Context, req *sppb.CommitRequest) (*sppb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commits = append(f.commits, req)
+	return &sppb.CommitResponse{CommitTimestamp: timestamppb.Now()}, nil
+}
+
+func (f *fakeSpanner) Rollback(ctx context.Context, req *sppb.RollbackRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func newFakeSpannerClient(t *testing.T, f *fakeSpanner) *spanner.Client {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	sppb.RegisterSpannerServer(s, f)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := spanner.NewClientWithConfig(context.Background(), "projects/p/instances/i/databases/d",
+		spanner.ClientConfig{SessionPoolConfig: spanner.SessionPoolConfig{MinOpened: 1}}, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	return client
+}
+
+// TestWriteOptionsApplied checks the configured priority and tag reach
+// Spanner on the commit of both a read-write transaction and a blind Apply.
+func TestWriteOptionsApplied(t *testing.T) {
+	tests := []struct {
+		priority     string
+		tagPrefix    string
+		wantPriority sppb.RequestOptions_Priority
+		wantTag      string
+	}{
+		{wantPriority: sppb.RequestOptions_PRIORITY_UNSPECIFIED},
+		{priority: PriorityLow, tagPrefix: "albums-api", wantPriority: sppb.RequestOptions_PRIORITY_LOW, wantTag: "albums-api.saveThing"},
+		{priority: PriorityHigh, wantPriority: sppb.RequestOptions_PRIORITY_HIGH},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q/%q", tt.priority, tt.tagPrefix), func(t *testing.T) {
+			prevPriority, prevPrefix := writePriority, txnTagPrefix
+			t.Cleanup(func() { writePriority, txnTagPrefix = prevPriority, prevPrefix })
+			if err := setWriteOptions(tt.priority, tt.tagPrefix); err != nil {
+				t.Fatal(err)
+			}
+
+			f := &fakeSpanner{}
+			client := newFakeSpannerClient(t, f)
+			ctx := context.Background()
+			m := spanner.Insert("Singers", []string{"SingerId"}, []interface{}{1})
+
+			_, err := readWriteTransaction(ctx, client, "saveThing", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+				return txn.BufferWrite([]*spanner.Mutation{m})
+			})
+			if err != nil {
+				t.Fatalf("readWriteTransaction: %v", err)
+			}
+			if _, err := client.Apply(ctx, []*spanner.Mutation{m}, applyOptions("saveThing")...); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.commits) != 2 {
+				t.Fatalf("got %d commits, want 2", len(f.commits))
+			}
+			for i, c := range f.commits {
+				opts := c.GetRequestOptions()
+				if opts.GetPriority() != tt.wantPriority || opts.GetTransactionTag() != tt.wantTag {
+					t.Errorf("commit %d: priority %s, tag %q; want %s, %q", i, opts.GetPriority(), opts.GetTransactionTag(), tt.wantPriority, tt.wantTag)
+				}
+			}
+		})
+	}
+}
+
+func TestSetWriteOptionsInvalid(t *testing.T) {
+	prevPriority, prevPrefix := writePriority, txnTagPrefix
+	if err := setWriteOptions("urgent", "albums-api"); err == nil {
+		t.Error("setWriteOptions accepted priority urgent")
+	}
+	if writePriority != prevPriority || txnTagPrefix != prevPrefix {
+		t.Error("setWriteOptions failed but changed the write options")
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+// txnDebug turns on logging of transaction timestamps, to help work out which
+// transactions contend with each other. It's set once from config at startup.
+var txnDebug bool
+
+// logCommit logs the commit timestamp of a write.
+func logCommit(name string, ts time.Time) {
+	if txnDebug {
+		log.Printf("Txn %s committed at %s", name, ts.Format(time.RFC3339Nano))
+	}
+}
+
+// logReadTimestamp logs the timestamp a read-only transaction read at. It
+// must be called after the transaction's first read.
+func logReadTimestamp(name string, txn *spanner.ReadOnlyTransaction) {
+	if !txnDebug {
+		return
+	}
+	ts, err := txn.Timestamp()
+	if err != nil {
+		return
+	}
+	log.Printf("Txn %s read at %s", name, ts.Format(time.RFC3339Nano))
+}
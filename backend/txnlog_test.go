@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func withTxnDebug(t *testing.T, on bool) {
+	t.Helper()
+
+	prev := txnDebug
+	txnDebug = on
+	t.Cleanup(func() { txnDebug = prev })
+}
+
+func TestLogCommit(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+
+	for _, on := range []bool{false, true} {
+		withTxnDebug(t, on)
+		out := captureLog(t)
+
+		logCommit("saveAlbum", ts)
+
+		want := ""
+		if on {
+			want = "Txn saveAlbum committed at 2024-05-01T12:00:00.123456789Z\n"
+		}
+		if out.String() != want {
+			t.Errorf("txnDebug %v: logged %q, want %q", on, out, want)
+		}
+	}
+}
@@ -9,9 +9,11 @@ import (
 
 	pb "github.com/anrid/docker-dev-env-example/proto/health"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 var addr = flag.String("addr", "localhost:50051", "the address to connect to")
@@ -21,6 +23,17 @@ const (
 	streamingCount  = 10
 )
 
+// errorInfo returns the ErrorInfo detail attached to a gRPC error by the
+// server, or nil if there isn't one.
+func errorInfo(err error) *errdetails.ErrorInfo {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
 func unaryCallWithMetadata(c pb.HealthClient, message string) {
 	fmt.Printf("--- unary ---\n")
 	// Create metadata and context.
@@ -31,6 +44,9 @@ func unaryCallWithMetadata(c pb.HealthClient, message string) {
 	var header, trailer metadata.MD
 	r, err := c.Check(ctx, &pb.HealthCheckRequest{Service: "Let's Go!"}, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
+		if info := errorInfo(err); info != nil {
+			log.Fatalf("failed to call UnaryEcho: %v (reason %s, retriable %s)", err, info.Reason, info.Metadata["retriable"])
+		}
 		log.Fatalf("failed to call UnaryEcho: %v", err)
 	}
 
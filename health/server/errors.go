@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain identifies our services in ErrorInfo details.
+const errorDomain = "health.docker-dev-env-example"
+
+// Reasons are stable, UPPER_SNAKE_CASE strings clients can branch on, unlike
+// error messages, which may change.
+const (
+	ReasonMetadataMissing = "METADATA_MISSING"
+)
+
+// statusError returns a gRPC error with an ErrorInfo detail carrying reason and
+// whether the call is worth retrying as is. Every error our services return
+// should go through here so clients always find the detail.
+func statusError(code codes.Code, reason string, retriable bool, format string, args ...interface{}) error {
+	st := status.New(code, fmt.Sprintf(format, args...))
+
+	withInfo, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"retriable": strconv.FormatBool(retriable),
+		},
+	})
+	if err != nil {
+		// Only fails if the detail can't be marshaled; the plain status is
+		// still better than nothing.
+		return st.Err()
+	}
+	return withInfo.Err()
+}
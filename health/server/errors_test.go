@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
+)
+
+// errorInfo returns the ErrorInfo detail of err, failing the test if it has
+// none.
+func errorInfo(t *testing.T, err error) (*status.Status, *errdetails.ErrorInfo) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	if !ok {
+		t.Fatalf("%v isn't a gRPC status", err)
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return st, info
+		}
+	}
+	t.Fatalf("%v has no ErrorInfo detail, got %v", err, st.Details())
+	return nil, nil
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code      codes.Code
+		reason    string
+		retriable bool
+	}{
+		{code: codes.DataLoss, reason: ReasonMetadataMissing, retriable: false},
+		{code: codes.Unavailable, reason: "BACKEND_DOWN", retriable: true},
+	}
+
+	for _, tt := range tests {
+		st, info := errorInfo(t, statusError(tt.code, tt.reason, tt.retriable, "failed: %d", 42))
+
+		if st.Code() != tt.code || st.Message() != "failed: 42" {
+			t.Errorf("status = %v %q, want %v %q", st.Code(), st.Message(), tt.code, "failed: 42")
+		}
+		if info.Reason != tt.reason || info.Domain != errorDomain {
+			t.Errorf("ErrorInfo reason, domain = %q, %q; want %q, %q", info.Reason, info.Domain, tt.reason, errorDomain)
+		}
+		if want := map[bool]string{true: "true", false: "false"}[tt.retriable]; info.Metadata["retriable"] != want {
+			t.Errorf("ErrorInfo retriable = %q, want %q", info.Metadata["retriable"], want)
+		}
+	}
+}
+
+// TestCheckErrorDetails checks an error from the service itself carries the
+// detail.
+func TestCheckErrorDetails(t *testing.T) {
+	_, err := (&server{}).Check(context.Background(), &pb.HealthCheckRequest{})
+
+	st, info := errorInfo(t, err)
+	if st.Code() != codes.DataLoss || info.Reason != ReasonMetadataMissing {
+		t.Errorf("got %v with reason %q, want %v with %q", st.Code(), info.Reason, codes.DataLoss, ReasonMetadataMissing)
+	}
+}
@@ -2,22 +2,32 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
 
 	pb "github.com/anrid/docker-dev-env-example/proto/health"
 )
 
-var port = flag.Int("port", 50051, "the port to serve on")
+var (
+	port        = flag.Int("port", 50051, "the port to serve on")
+	metricsAddr = flag.String("metrics-addr", "", "address to serve metrics on (disabled if empty)")
+	maxRecvSize = flag.Int("max-recv-msg-size", 4<<20, "the largest message in bytes the server will receive")
+	maxSendSize = flag.Int("max-send-msg-size", 4<<20, "the largest message in bytes the server will send")
+	maintenance = flag.String("maintenance-file", "", "report NOT_SERVING while this file exists, checked on every call")
+)
+
+// maxMsgSizeLimit caps the message size flags at something sane.
+const maxMsgSizeLimit = 64 << 20
 
 const (
 	timestampFormat = time.StampNano
@@ -39,7 +49,7 @@ func (s *server) Check(ctx context.Context, in *pb.HealthCheckRequest) (*pb.Heal
 	// Read metadata from client.
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return nil, status.Errorf(codes.DataLoss, "UnaryEcho: failed to get metadata")
+		return nil, statusError(codes.DataLoss, ReasonMetadataMissing, false, "UnaryEcho: failed to get metadata")
 	}
 	if t, ok := md["timestamp"]; ok {
 		fmt.Printf("timestamp from metadata:\n")
@@ -54,19 +64,61 @@ func (s *server) Check(ctx context.Context, in *pb.HealthCheckRequest) (*pb.Heal
 
 	fmt.Printf("request received: %v, sending echo\n", in)
 
+	if inMaintenance() {
+		return &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_NOT_SERVING}, nil
+	}
 	return &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING}, nil
 }
 
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
+
+	if err := validateMsgSizes(*maxRecvSize, *maxSendSize); err != nil {
+		log.Fatal(err)
+	}
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	fmt.Printf("server listening at %v\n", lis.Addr())
 
-	s := grpc.NewServer()
-	pb.RegisterHealthServer(s, &server{})
+	if *metricsAddr != "" {
+		go func() {
+			fmt.Printf("metrics listening at %v\n", *metricsAddr)
+			log.Fatal(http.ListenAndServe(*metricsAddr, expvar.Handler()))
+		}()
+	}
+
+	s := newServer(*maxRecvSize, *maxSendSize, *metricsAddr != "")
 	s.Serve(lis)
 }
+
+func validateMsgSizes(maxRecv, maxSend int) error {
+	for _, f := range []struct {
+		name string
+		size int
+	}{{"max-recv-msg-size", maxRecv}, {"max-send-msg-size", maxSend}} {
+		if f.size <= 0 || f.size > maxMsgSizeLimit {
+			return fmt.Errorf("-%s must be between 1 and %d bytes, got %d", f.name, maxMsgSizeLimit, f.size)
+		}
+	}
+	return nil
+}
+
+// newServer returns a gRPC server with the health service registered,
+// rejecting messages over the size limits with ResourceExhausted. The payload
+// size interceptor is only installed withMetrics.
+func newServer(maxRecv, maxSend int, withMetrics bool) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxRecv),
+		grpc.MaxSendMsgSize(maxSend),
+	}
+	if withMetrics {
+		opts = append(opts, grpc.UnaryInterceptor(payloadSizeInterceptor))
+	}
+
+	s := grpc.NewServer(opts...)
+	pb.RegisterHealthServer(s, &server{})
+	return s
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
+)
+
+// dialServer serves s over an in-memory connection and returns a client for
+// it. Both are stopped when the test ends.
+func dialServer(t *testing.T, s *grpc.Server) pb.HealthClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewHealthClient(conn)
+}
+
+func TestMsgSizeLimits(t *testing.T) {
+	ctx := context.Background()
+	big := &pb.HealthCheckRequest{Service: strings.Repeat("x", 2048)}
+
+	tests := []struct {
+		name     string
+		maxRecv  int
+		maxSend  int
+		req      *pb.HealthCheckRequest
+		wantCode codes.Code
+	}{
+		{name: "within limits", maxRecv: 4096, maxSend: 4096, req: big, wantCode: codes.OK},
+		{name: "request over recv limit", maxRecv: 1024, maxSend: 4096, req: big, wantCode: codes.ResourceExhausted},
+		// A SERVING response is 2 bytes.
+		{name: "response over send limit", maxRecv: 4096, maxSend: 1, req: &pb.HealthCheckRequest{}, wantCode: codes.ResourceExhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialServer(t, newServer(tt.maxRecv, tt.maxSend, false))
+
+			_, err := client.Check(ctx, tt.req)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("Check: %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestValidateMsgSizes(t *testing.T) {
+	tests := []struct {
+		maxRecv, maxSend int
+		wantErr          bool
+	}{
+		{maxRecv: 4 << 20, maxSend: 4 << 20},
+		{maxRecv: 1, maxSend: maxMsgSizeLimit},
+		{maxRecv: 0, maxSend: 4 << 20, wantErr: true},
+		{maxRecv: 4 << 20, maxSend: -1, wantErr: true},
+		{maxRecv: maxMsgSizeLimit + 1, maxSend: 4 << 20, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateMsgSizes(tt.maxRecv, tt.maxSend); (err != nil) != tt.wantErr {
+			t.Errorf("validateMsgSizes(%d, %d): %v, want error %v", tt.maxRecv, tt.maxSend, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+)
+
+// inMaintenance reports whether the -maintenance-file exists. The backend
+// takes the same file as its MaintenanceFile and creates or removes it from
+// PUT /admin/maintenance, so it's checked on every call rather than cached.
+// The health protocol has no degraded state, so we report NOT_SERVING.
+func inMaintenance() bool {
+	if *maintenance == "" {
+		return false
+	}
+	_, err := os.Stat(*maintenance)
+	return err == nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
+)
+
+// setMaintenanceFile points -maintenance-file at path for the rest of the test.
+func setMaintenanceFile(t *testing.T, path string) {
+	prev := *maintenance
+	*maintenance = path
+	t.Cleanup(func() { *maintenance = prev })
+}
+
+func checkStatus(t *testing.T) pb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.MD{})
+	res, err := (&server{}).Check(ctx, &pb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	return res.Status
+}
+
+// TestMaintenanceFile checks Check follows the maintenance file as the
+// backend switches it, creating and removing it, with no reload in between.
+func TestMaintenanceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance")
+	setMaintenanceFile(t, path)
+
+	if got := checkStatus(t); got != pb.HealthCheckResponse_SERVING {
+		t.Errorf("without the file: status = %v, want SERVING", got)
+	}
+
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkStatus(t); got != pb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("with the file: status = %v, want NOT_SERVING", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkStatus(t); got != pb.HealthCheckResponse_SERVING {
+		t.Errorf("after removing the file: status = %v, want SERVING", got)
+	}
+}
+
+func TestMaintenanceFileUnset(t *testing.T) {
+	setMaintenanceFile(t, "")
+
+	if got := checkStatus(t); got != pb.HealthCheckResponse_SERVING {
+		t.Errorf("status = %v, want SERVING", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// callCounts counts calls for each method by the code they ended with, keyed
+// as "<method> <code>", e.g. "/health.Health/Check OK".
+var callCounts = expvar.NewMap("grpc_calls")
+
+// payloadSizes holds a histogram of marshaled message sizes in bytes for each
+// method, keyed as "<method> request" or "<method> response".
+var payloadSizes = expvar.NewMap("grpc_payload_bytes")
+
+var payloadSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// histogram is a cumulative bucketed histogram that renders itself as JSON for
+// expvar.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.buckets))
+	for i, b := range h.buckets {
+		buckets[jsonNumber(b)] = h.counts[i]
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"buckets": buckets,
+		"count":   h.count,
+		"sum":     h.sum,
+	})
+	return string(b)
+}
+
+func jsonNumber(f float64) string {
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+var payloadSizesMu sync.Mutex
+
+func observePayloadSize(key string, msg interface{}) {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return
+	}
+
+	payloadSizesMu.Lock()
+	h, ok := payloadSizes.Get(key).(*histogram)
+	if !ok {
+		h = newHistogram(payloadSizeBuckets)
+		payloadSizes.Set(key, h)
+	}
+	payloadSizesMu.Unlock()
+
+	h.Observe(float64(proto.Size(m)))
+}
+
+// payloadSizeInterceptor records the marshaled size of each unary request and
+// response, and counts calls by code. It's only installed when metrics are
+// enabled, so sizing messages costs nothing otherwise.
+func payloadSizeInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	observePayloadSize(info.FullMethod+" request", req)
+
+	resp, err := handler(ctx, req)
+	if err == nil {
+		observePayloadSize(info.FullMethod+" response", resp)
+	}
+	callCounts.Add(info.FullMethod+" "+status.Code(err).String(), 1)
+
+	return resp, err
+}
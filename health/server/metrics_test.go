@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "github.com/anrid/docker-dev-env-example/proto/health"
+)
+
+const checkMethod = "/health.Health/Check"
+
+func callCount(key string) int64 {
+	if v, ok := callCounts.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// payloadSize returns the number of observations and their sum for key.
+func payloadSize(key string) (int64, float64) {
+	h, ok := payloadSizes.Get(key).(*histogram)
+	if !ok {
+		return 0, 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+func TestPayloadSizeInterceptor(t *testing.T) {
+	ctx := context.Background()
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Test/Method"}
+	req := &pb.HealthCheckRequest{Service: "backend"}
+
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "ok", code: codes.OK},
+		{name: "not found", err: statusError(codes.NotFound, "TEST", false, "nope"), code: codes.NotFound},
+		{name: "plain error", err: context.Canceled, code: codes.Unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := info.FullMethod + " " + tt.code.String()
+			before := callCount(key)
+			reqsBefore, _ := payloadSize(info.FullMethod + " request")
+			respsBefore, _ := payloadSize(info.FullMethod + " response")
+
+			_, err := payloadSizeInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING}, nil
+			})
+			if err != tt.err {
+				t.Errorf("interceptor returned %v, want %v", err, tt.err)
+			}
+
+			if got := callCount(key) - before; got != 1 {
+				t.Errorf("%s counted %d times, want 1", key, got)
+			}
+			if reqs, _ := payloadSize(info.FullMethod + " request"); reqs-reqsBefore != 1 {
+				t.Errorf("observed %d requests, want 1", reqs-reqsBefore)
+			}
+			// Only a successful call has a response to size.
+			wantResps := int64(0)
+			if tt.err == nil {
+				wantResps = 1
+			}
+			if resps, _ := payloadSize(info.FullMethod + " response"); resps-respsBefore != wantResps {
+				t.Errorf("observed %d responses, want %d", resps-respsBefore, wantResps)
+			}
+		})
+	}
+}
+
+// TestMetricsWiring checks a Check call is measured when the server is built
+// with metrics, with non-zero sizes, and not otherwise.
+func TestMetricsWiring(t *testing.T) {
+	for _, withMetrics := range []bool{false, true} {
+		client := dialServer(t, newServer(4<<20, 4<<20, withMetrics))
+
+		calls := callCount(checkMethod + " OK")
+		reqs, reqBytes := payloadSize(checkMethod + " request")
+		resps, respBytes := payloadSize(checkMethod + " response")
+
+		if _, err := client.Check(context.Background(), &pb.HealthCheckRequest{Service: "backend"}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := int64(0)
+		if withMetrics {
+			want = 1
+		}
+		if got := callCount(checkMethod+" OK") - calls; got != want {
+			t.Errorf("withMetrics=%v: counted %d calls, want %d", withMetrics, got, want)
+		}
+
+		n, sum := payloadSize(checkMethod + " request")
+		if n-reqs != want || (withMetrics && sum-reqBytes <= 0) {
+			t.Errorf("withMetrics=%v: observed %d requests of %v bytes", withMetrics, n-reqs, sum-reqBytes)
+		}
+		n, sum = payloadSize(checkMethod + " response")
+		if n-resps != want || (withMetrics && sum-respBytes <= 0) {
+			t.Errorf("withMetrics=%v: observed %d responses of %v bytes", withMetrics, n-resps, sum-respBytes)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{10, 100})
+	for _, v := range []float64{5, 50, 500} {
+		h.Observe(v)
+	}
+
+	want := `{"buckets":{"10":1,"100":2},"count":3,"sum":555}`
+	if got := h.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}